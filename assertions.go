@@ -0,0 +1,367 @@
+package saml
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/xml"
+	"fmt"
+	"github.com/beevik/etree"
+	samllib "github.com/crewjam/saml"
+	"github.com/crewjam/saml/xmlenc"
+	"io"
+	"net/url"
+	"strings"
+)
+
+const (
+	multipleAssertionsReject = "reject"
+	multipleAssertionsSigned = "signed"
+	multipleAssertionsMerge  = "merge"
+)
+
+// samlResponseElement is the location of a child element of a SAML
+// Response in the raw response.
+type samlResponseElement struct {
+	Name  xml.Name
+	Start int64
+	End   int64
+}
+
+// getAssertionCount returns the number of plain and encrypted assertions
+// in the response.
+func (resp *samlResponse) getAssertionCount() int {
+	return len(resp.Assertions) + len(resp.EncryptedAssertions)
+}
+
+// parseAssertions validates the assertions of the SAML Response with the
+// service provider and returns the assertion the claims are mapped from.
+//
+// The service provider validates a single assertion only. Therefore, the
+// responses with multiple assertions are handled per MultipleAssertions:
+// "reject" rejects them, "signed" selects the first assertion passing the
+// validation, and "merge" requires all assertions to pass the validation
+// and merges their attribute statements, provided the assertions have
+// the same Issuer and NameID. In the latter two cases, each assertion is
+// validated separately, as if it was the only assertion of an unsigned
+// response. It means each assertion must have its own valid signature.
+//
+// With RequireSignedAssertion, a single assertion of a signed response is
+// validated the same way, because the service provider accepts an
+// assertion covered by the signature of the response only.
+func (az *AzureIdp) parseAssertions(sp *samllib.ServiceProvider, resp *samlResponse, raw []byte) (*samllib.Assertion, error) {
+	assertionCount := resp.getAssertionCount()
+	if assertionCount == 1 && resp.Signature != nil && *az.RequireSignedAssertion {
+		rawResponses, err := splitSAMLResponse(raw)
+		if err != nil {
+			return nil, err
+		}
+		return az.parseXMLResponse(sp, rawResponses[0])
+	}
+	if assertionCount <= 1 {
+		return az.parseXMLResponse(sp, raw)
+	}
+	if az.MultipleAssertions != multipleAssertionsSigned && az.MultipleAssertions != multipleAssertionsMerge {
+		return nil, fmt.Errorf("SAML Response has %d assertions, multiple assertions are rejected", assertionCount)
+	}
+
+	rawResponses, err := splitSAMLResponse(raw)
+	if err != nil {
+		return nil, err
+	}
+	var assertion *samllib.Assertion
+	assertionErrors := []string{}
+	for i, rawResponse := range rawResponses {
+		a, err := az.parseXMLResponse(sp, rawResponse)
+		if err != nil {
+			if az.MultipleAssertions == multipleAssertionsMerge {
+				return nil, fmt.Errorf("SAML Response assertion %d failed validation: %s", i+1, err)
+			}
+			assertionErrors = append(assertionErrors, fmt.Sprintf("assertion %d: %s", i+1, err))
+			continue
+		}
+		if az.MultipleAssertions == multipleAssertionsSigned {
+			return a, nil
+		}
+		if assertion == nil {
+			assertion = a
+			continue
+		}
+		if err := mergeAssertion(assertion, a); err != nil {
+			return nil, fmt.Errorf("SAML Response assertion %d cannot be merged: %s", i+1, err)
+		}
+	}
+	if assertion == nil {
+		return nil, fmt.Errorf("SAML Response has no valid signed assertion: %s", strings.Join(assertionErrors, ", "))
+	}
+	return assertion, nil
+}
+
+// mergeAssertion appends the attribute statements of the other assertion
+// to the assertion. The assertions must be issued by the same IdP about
+// the same subject, so that the attributes of different users are never
+// joined.
+func mergeAssertion(assertion, other *samllib.Assertion) error {
+	issuer := strings.TrimSpace(assertion.Issuer.Value)
+	if otherIssuer := strings.TrimSpace(other.Issuer.Value); otherIssuer != issuer {
+		return fmt.Errorf("Issuer %q does not match Issuer %q of the first assertion", otherIssuer, issuer)
+	}
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || other.Subject == nil || other.Subject.NameID == nil {
+		return fmt.Errorf("assertions without NameID cannot be matched")
+	}
+	nameID, otherNameID := *assertion.Subject.NameID, *other.Subject.NameID
+	nameID.Value, otherNameID.Value = strings.TrimSpace(nameID.Value), strings.TrimSpace(otherNameID.Value)
+	if otherNameID != nameID {
+		return fmt.Errorf("NameID %q does not match NameID %q of the first assertion", otherNameID.Value, nameID.Value)
+	}
+	assertion.AttributeStatements = append(assertion.AttributeStatements, other.AttributeStatements...)
+	return nil
+}
+
+// parseXMLResponse validates the raw SAML Response with the service
+// provider. When the validation fails and the response has an encrypted
+// assertion, the validation is retried with the additional decryption
+// keys, e.g. during the rotation of the encryption key pair.
+func (az *AzureIdp) parseXMLResponse(sp *samllib.ServiceProvider, raw []byte) (*samllib.Assertion, error) {
+	assertion, err := sp.ParseXMLResponse(raw, az.requestTracker.getIDs())
+	if err == nil || len(az.spDecryptionKeys) == 0 || !hasEncryptedAssertion(raw) {
+		return assertion, err
+	}
+	return tryDecryptionKeys(az.spDecryptionKeys, err, func(key *rsa.PrivateKey) (*samllib.Assertion, error) {
+		rotatedSP := *sp
+		rotatedSP.Key = key
+		return rotatedSP.ParseXMLResponse(raw, az.requestTracker.getIDs())
+	})
+}
+
+// tryDecryptionKeys returns the assertion of the first key the parse
+// succeeds with. When none of the keys succeeds, the error of the
+// encryption key is returned.
+func tryDecryptionKeys(keys []*rsa.PrivateKey, err error, parse func(*rsa.PrivateKey) (*samllib.Assertion, error)) (*samllib.Assertion, error) {
+	for _, key := range keys {
+		if assertion, keyErr := parse(key); keyErr == nil {
+			return assertion, nil
+		}
+	}
+	return nil, err
+}
+
+// hasEncryptedAssertion returns true when the raw SAML Response has an
+// encrypted assertion.
+func hasEncryptedAssertion(raw []byte) bool {
+	elements, err := getSAMLResponseElements(raw)
+	if err != nil {
+		return false
+	}
+	for _, element := range elements {
+		if element.Name == (xml.Name{Space: samlAssertionNamespace, Local: "EncryptedAssertion"}) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateEncryptedSignatureAlgorithms checks that the signatures of the
+// encrypted assertions of the raw SAML Response use sufficiently strong
+// algorithms. Unlike the signatures of the plain assertions, they are
+// known only once the assertions are decrypted.
+func (az *AzureIdp) validateEncryptedSignatureAlgorithms(sp *samllib.ServiceProvider, raw []byte) error {
+	if !hasEncryptedAssertion(raw) {
+		return nil
+	}
+	keys := append([]*rsa.PrivateKey{sp.Key}, az.spDecryptionKeys...)
+	signatures, err := getEncryptedAssertionSignatures(raw, keys)
+	if err != nil {
+		return err
+	}
+	for _, signature := range signatures {
+		if err := signature.validateAlgorithms(az.MinimumSignatureAlgorithm); err != nil {
+			return fmt.Errorf("SAML Response encrypted assertion: %s", err)
+		}
+	}
+	return nil
+}
+
+// getEncryptedAssertionSignatures returns the signatures of the encrypted
+// assertions of the raw SAML Response. Each assertion is decrypted with
+// the first of the keys that succeeds.
+func getEncryptedAssertionSignatures(raw []byte, keys []*rsa.PrivateKey) ([]*xmlSignature, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(raw); err != nil {
+		return nil, fmt.Errorf("malformed SAML Response: %s", err)
+	}
+	signatures := []*xmlSignature{}
+	for _, encryptedAssertion := range doc.FindElements("//EncryptedAssertion") {
+		plaintext, err := decryptAssertion(encryptedAssertion, keys)
+		if err != nil {
+			return nil, err
+		}
+		assertion := samlResponseAssertion{}
+		if err := xml.Unmarshal(plaintext, &assertion); err != nil {
+			return nil, fmt.Errorf("malformed SAML Response encrypted assertion: %s", err)
+		}
+		if assertion.Signature != nil {
+			signatures = append(signatures, assertion.Signature)
+		}
+	}
+	return signatures, nil
+}
+
+// decryptAssertion returns the plaintext of the encrypted assertion. The
+// key encrypting the assertion is either a sibling of the encrypted data,
+// or is embedded in its key info.
+func decryptAssertion(encryptedAssertion *etree.Element, keys []*rsa.PrivateKey) ([]byte, error) {
+	encryptedData := encryptedAssertion.FindElement("./EncryptedData")
+	if encryptedData == nil {
+		return nil, fmt.Errorf("SAML Response encrypted assertion has no EncryptedData")
+	}
+	err := fmt.Errorf("no decryption key")
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		var dataKey interface{} = key
+		if encryptedKey := encryptedAssertion.FindElement("./EncryptedKey"); encryptedKey != nil {
+			if dataKey, err = xmlenc.Decrypt(key, encryptedKey); err != nil {
+				continue
+			}
+		}
+		var plaintext []byte
+		if plaintext, err = xmlenc.Decrypt(dataKey, encryptedData); err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, fmt.Errorf("failed decrypting SAML Response encrypted assertion: %s", err)
+}
+
+// splitSAMLResponse returns a raw response per assertion of the raw SAML
+// Response. Each of the responses has a single assertion and no response
+// signature. The assertions are copied verbatim, so that their signatures
+// remain valid.
+func splitSAMLResponse(raw []byte) ([][]byte, error) {
+	elements, err := getSAMLResponseElements(raw)
+	if err != nil {
+		return nil, err
+	}
+	removed := []samlResponseElement{}
+	assertions := []samlResponseElement{}
+	for _, element := range elements {
+		switch element.Name {
+		case xml.Name{Space: xmlDsigNamespace, Local: "Signature"}:
+			removed = append(removed, element)
+		case xml.Name{Space: samlAssertionNamespace, Local: "Assertion"},
+			xml.Name{Space: samlAssertionNamespace, Local: "EncryptedAssertion"}:
+			removed = append(removed, element)
+			assertions = append(assertions, element)
+		}
+	}
+	rawResponses := [][]byte{}
+	for _, assertion := range assertions {
+		b := bytes.NewBuffer(nil)
+		var offset int64
+		for _, element := range removed {
+			b.Write(raw[offset:element.Start])
+			if element == assertion {
+				b.Write(raw[element.Start:element.End])
+			}
+			offset = element.End
+		}
+		b.Write(raw[offset:])
+		rawResponses = append(rawResponses, b.Bytes())
+	}
+	return rawResponses, nil
+}
+
+// getSAMLResponseElements returns the locations of the child elements of
+// the root element of the raw SAML Response. The names of the elements
+// carry the namespace URIs, rather than the prefixes, so that any prefix,
+// e.g. saml2, or a default namespace is recognized.
+func getSAMLResponseElements(raw []byte) ([]samlResponseElement, error) {
+	elements := []samlResponseElement{}
+	decoder := xml.NewDecoder(bytes.NewReader(raw))
+	depth := 0
+	var current samlResponseElement
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("malformed SAML Response: %s", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 2 {
+				current = samlResponseElement{Name: t.Name, Start: offset}
+			}
+		case xml.EndElement:
+			if depth == 2 {
+				current.End = decoder.InputOffset()
+				elements = append(elements, current)
+			}
+			depth--
+		}
+	}
+	return elements, nil
+}
+
+// validateAssertionIssuer checks that the Issuer of the decrypted assertion
+// is the expected IdP entity ID. The check is skipped when no issuer is
+// expected.
+func validateAssertionIssuer(assertion *samllib.Assertion, expectedIssuer string) error {
+	if expectedIssuer == "" {
+		return nil
+	}
+	if issuer := strings.TrimSpace(assertion.Issuer.Value); issuer != expectedIssuer {
+		return fmt.Errorf("assertion Issuer is not the expected issuer")
+	}
+	return nil
+}
+
+// validateAssertionIssuerConsistency checks that the Issuer of the
+// decrypted assertion matches the Issuer of the response, when present.
+func validateAssertionIssuerConsistency(assertion *samllib.Assertion, responseIssuer string) error {
+	responseIssuer = strings.TrimSpace(responseIssuer)
+	if responseIssuer == "" {
+		return nil
+	}
+	if issuer := strings.TrimSpace(assertion.Issuer.Value); issuer != responseIssuer {
+		return fmt.Errorf("assertion Issuer does not match the response Issuer")
+	}
+	return nil
+}
+
+// bearerSubjectConfirmationMethod is the method of the subject confirmation
+// of the Web Browser SSO profile.
+const bearerSubjectConfirmationMethod = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+// validateRecipient checks that the assertion has a bearer subject
+// confirmation whose Recipient is the ACS URL the SAML Response was
+// delivered to.
+func validateRecipient(assertion *samllib.Assertion, acsURL *url.URL) error {
+	if assertion.Subject == nil {
+		return fmt.Errorf("assertion has no Subject")
+	}
+	recipients := []string{}
+	for _, confirmation := range assertion.Subject.SubjectConfirmations {
+		if confirmation.Method != bearerSubjectConfirmationMethod || confirmation.SubjectConfirmationData == nil {
+			continue
+		}
+		recipient := confirmation.SubjectConfirmationData.Recipient
+		if recipient == "" {
+			continue
+		}
+		recipientURL, err := url.Parse(recipient)
+		if err == nil && isSameEndpoint(recipientURL, acsURL) {
+			return nil
+		}
+		recipients = append(recipients, recipient)
+	}
+	if len(recipients) == 0 {
+		return fmt.Errorf("assertion has no bearer SubjectConfirmation with Recipient")
+	}
+	return fmt.Errorf("assertion SubjectConfirmation Recipient %s does not match ACS URL %s",
+		strings.Join(recipients, ", "), acsURL,
+	)
+}
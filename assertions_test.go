@@ -0,0 +1,381 @@
+package saml
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/beevik/etree"
+	samllib "github.com/crewjam/saml"
+	"github.com/crewjam/saml/xmlenc"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const multiAssertionResponse = `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_r1" Version="2.0">` +
+	`<saml:Issuer>https://sts.windows.net/1b9e886b-8ff2-4378-b6c8-6771259a5f51/</saml:Issuer>` +
+	`<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:SignedInfo></ds:SignedInfo></ds:Signature>` +
+	`<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>` +
+	`<saml:Assertion ID="_a1" Version="2.0"><ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#"></ds:Signature>` +
+	`<saml:AttributeStatement><saml:Attribute Name="mail"><saml:AttributeValue>jsmith@contoso.com</saml:AttributeValue></saml:Attribute></saml:AttributeStatement>` +
+	`</saml:Assertion>` +
+	`<saml:Assertion ID="_a2" Version="2.0">` +
+	`<saml:AttributeStatement><saml:Attribute Name="department"><saml:AttributeValue>Engineering</saml:AttributeValue></saml:Attribute></saml:AttributeStatement>` +
+	`</saml:Assertion>` +
+	`</samlp:Response>`
+
+func TestMultipleAssertions(t *testing.T) {
+	resp, err := parseSAMLResponse([]byte(multiAssertionResponse))
+	if err != nil {
+		t.Fatalf("failed parsing response: %s", err)
+	}
+	if n := resp.getAssertionCount(); n != 2 {
+		t.Fatalf("expected 2 assertions, got %d", n)
+	}
+
+	az := &AzureIdp{MultipleAssertions: multipleAssertionsReject}
+	if _, err := az.parseAssertions(nil, resp, []byte(multiAssertionResponse)); err == nil {
+		t.Fatalf("response with multiple assertions was not rejected")
+	}
+
+	rawResponses, err := splitSAMLResponse([]byte(multiAssertionResponse))
+	if err != nil {
+		t.Fatalf("failed splitting response: %s", err)
+	}
+	if len(rawResponses) != 2 {
+		t.Fatalf("expected 2 responses, got %d", len(rawResponses))
+	}
+	for i, assertionID := range []string{"_a1", "_a2"} {
+		rawResponse := string(rawResponses[i])
+		splitResp, err := parseSAMLResponse(rawResponses[i])
+		if err != nil {
+			t.Fatalf("response %d: failed parsing: %s", i, err)
+		}
+		if len(splitResp.Assertions) != 1 || splitResp.Assertions[0].ID != assertionID {
+			t.Fatalf("response %d: expected assertion %s, got %v", i, assertionID, splitResp.Assertions)
+		}
+		if splitResp.Signature != nil {
+			t.Fatalf("response %d: response signature was not removed", i)
+		}
+		if splitResp.Status.getStatusCode() != samlStatusSuccess {
+			t.Fatalf("response %d: status was not preserved", i)
+		}
+		start := strings.Index(multiAssertionResponse, `<saml:Assertion ID="`+assertionID+`"`)
+		end := start + strings.Index(multiAssertionResponse[start:], `</saml:Assertion>`) + len(`</saml:Assertion>`)
+		if !strings.Contains(rawResponse, multiAssertionResponse[start:end]) {
+			t.Fatalf("response %d: assertion was not copied verbatim", i)
+		}
+	}
+	if splitResp, _ := parseSAMLResponse(rawResponses[0]); splitResp.Assertions[0].Signature == nil {
+		t.Fatalf("assertion signature was removed")
+	}
+}
+
+func TestValidateRecipient(t *testing.T) {
+	acsURL, _ := url.Parse("https://localhost:3443/saml")
+	for _, test := range []struct {
+		name       string
+		subject    *samllib.Subject
+		shouldFail bool
+	}{
+		{
+			name: "matching recipient",
+			subject: &samllib.Subject{
+				SubjectConfirmations: []samllib.SubjectConfirmation{
+					{
+						Method:                  bearerSubjectConfirmationMethod,
+						SubjectConfirmationData: &samllib.SubjectConfirmationData{Recipient: "https://localhost:3443/saml"},
+					},
+				},
+			},
+		},
+		{
+			name: "mismatched recipient",
+			subject: &samllib.Subject{
+				SubjectConfirmations: []samllib.SubjectConfirmation{
+					{
+						Method:                  bearerSubjectConfirmationMethod,
+						SubjectConfirmationData: &samllib.SubjectConfirmationData{Recipient: "https://evil.com/saml"},
+					},
+				},
+			},
+			shouldFail: true,
+		},
+		{
+			name: "matching recipient of non-bearer confirmation",
+			subject: &samllib.Subject{
+				SubjectConfirmations: []samllib.SubjectConfirmation{
+					{
+						Method:                  "urn:oasis:names:tc:SAML:2.0:cm:holder-of-key",
+						SubjectConfirmationData: &samllib.SubjectConfirmationData{Recipient: "https://localhost:3443/saml"},
+					},
+				},
+			},
+			shouldFail: true,
+		},
+		{
+			name: "absent recipient",
+			subject: &samllib.Subject{
+				SubjectConfirmations: []samllib.SubjectConfirmation{
+					{
+						Method:                  bearerSubjectConfirmationMethod,
+						SubjectConfirmationData: &samllib.SubjectConfirmationData{},
+					},
+				},
+			},
+			shouldFail: true,
+		},
+		{
+			name:       "absent subject",
+			shouldFail: true,
+		},
+	} {
+		err := validateRecipient(&samllib.Assertion{Subject: test.subject}, acsURL)
+		if test.shouldFail && err == nil {
+			t.Errorf("%s: expected failure, got success", test.name)
+		}
+		if !test.shouldFail && err != nil {
+			t.Errorf("%s: expected success, got %s", test.name, err)
+		}
+	}
+}
+
+func TestDecryptionKeyRotation(t *testing.T) {
+	encryptionKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed generating key: %s", err)
+	}
+	previousKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed generating key: %s", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed generating key: %s", err)
+	}
+
+	// The IdP encrypted the assertion key to the previous key, i.e. the
+	// rsa-oaep-mgf1p key transport of EncryptedKey.
+	assertionKey := []byte("0123456789abcdef")
+	encryptedKey, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, &previousKey.PublicKey, assertionKey, nil)
+	if err != nil {
+		t.Fatalf("failed encrypting assertion key: %s", err)
+	}
+	parse := func(key *rsa.PrivateKey) (*samllib.Assertion, error) {
+		b, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, key, encryptedKey, nil)
+		if err != nil {
+			return nil, err
+		}
+		if string(b) != string(assertionKey) {
+			return nil, errors.New("unexpected assertion key")
+		}
+		return &samllib.Assertion{ID: "_a1"}, nil
+	}
+	encryptionErr := errors.New("failed to decrypt EncryptedAssertion")
+	if _, err := parse(encryptionKey); err == nil {
+		t.Fatalf("assertion decrypted with the encryption key")
+	}
+
+	assertion, err := tryDecryptionKeys([]*rsa.PrivateKey{otherKey, previousKey}, encryptionErr, parse)
+	if err != nil {
+		t.Fatalf("assertion encrypted to the previous key failed decryption: %s", err)
+	}
+	if assertion.ID != "_a1" {
+		t.Fatalf("unexpected assertion: %s", assertion.ID)
+	}
+	if _, err := tryDecryptionKeys([]*rsa.PrivateKey{otherKey}, encryptionErr, parse); err != encryptionErr {
+		t.Fatalf("expected the error of the encryption key, got %v", err)
+	}
+
+	encryptedResponse := `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_r1">` +
+		`<saml:EncryptedAssertion><xenc:EncryptedData xmlns:xenc="http://www.w3.org/2001/04/xmlenc#"/></saml:EncryptedAssertion>` +
+		`</samlp:Response>`
+	if !hasEncryptedAssertion([]byte(encryptedResponse)) {
+		t.Fatalf("encrypted assertion not found")
+	}
+	if hasEncryptedAssertion([]byte(multiAssertionResponse)) {
+		t.Fatalf("plain assertions reported as encrypted")
+	}
+}
+
+func TestEncryptedSignatureAlgorithms(t *testing.T) {
+	_, keyPEM, cert := newTestKeyPair(t, "sp")
+	block, _ := pem.Decode(keyPEM)
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("failed parsing key: %s", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed generating key: %s", err)
+	}
+
+	for _, test := range []struct {
+		name               string
+		signatureAlgorithm string
+		digestAlgorithm    string
+		key                *rsa.PrivateKey
+		decryptionKeys     []*rsa.PrivateKey
+		shouldFail         bool
+	}{
+		{
+			name:               "rsa-sha256 signature",
+			signatureAlgorithm: "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+			digestAlgorithm:    "http://www.w3.org/2001/04/xmlenc#sha256",
+			key:                key,
+		},
+		{
+			name:               "rsa-sha1 signature",
+			signatureAlgorithm: "http://www.w3.org/2000/09/xmldsig#rsa-sha1",
+			digestAlgorithm:    "http://www.w3.org/2000/09/xmldsig#sha1",
+			key:                key,
+			shouldFail:         true,
+		},
+		{
+			name:               "rsa-sha256 signature with sha1 digest",
+			signatureAlgorithm: "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+			digestAlgorithm:    "http://www.w3.org/2000/09/xmldsig#sha1",
+			key:                key,
+			shouldFail:         true,
+		},
+		{
+			name:               "rsa-sha1 signature decrypted with previous key",
+			signatureAlgorithm: "http://www.w3.org/2000/09/xmldsig#rsa-sha1",
+			digestAlgorithm:    "http://www.w3.org/2000/09/xmldsig#sha1",
+			key:                otherKey,
+			decryptionKeys:     []*rsa.PrivateKey{key},
+			shouldFail:         true,
+		},
+		{
+			name:               "undecryptable assertion",
+			signatureAlgorithm: "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+			digestAlgorithm:    "http://www.w3.org/2001/04/xmlenc#sha256",
+			key:                otherKey,
+			shouldFail:         true,
+		},
+	} {
+		plaintext := `<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_a1" Version="2.0">` +
+			`<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:SignedInfo>` +
+			`<ds:SignatureMethod Algorithm="` + test.signatureAlgorithm + `"/>` +
+			`<ds:Reference URI="#_a1"><ds:DigestMethod Algorithm="` + test.digestAlgorithm + `"/></ds:Reference>` +
+			`</ds:SignedInfo></ds:Signature>` +
+			`</saml:Assertion>`
+		encrypter := xmlenc.OAEP()
+		encrypter.BlockCipher = xmlenc.AES128CBC
+		encryptedData, err := encrypter.Encrypt(cert, []byte(plaintext))
+		if err != nil {
+			t.Fatalf("%s: failed encrypting assertion: %s", test.name, err)
+		}
+		doc := etree.NewDocument()
+		doc.SetRoot(encryptedData)
+		encryptedAssertion, err := doc.WriteToString()
+		if err != nil {
+			t.Fatalf("%s: failed encoding encrypted assertion: %s", test.name, err)
+		}
+		raw := `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_r1">` +
+			`<saml:EncryptedAssertion>` + encryptedAssertion + `</saml:EncryptedAssertion>` +
+			`</samlp:Response>`
+
+		az := &AzureIdp{
+			MinimumSignatureAlgorithm: "sha256",
+			spDecryptionKeys:          test.decryptionKeys,
+		}
+		err = az.validateEncryptedSignatureAlgorithms(&samllib.ServiceProvider{Key: test.key}, []byte(raw))
+		if test.shouldFail && err == nil {
+			t.Errorf("%s: expected failure, got success", test.name)
+		}
+		if !test.shouldFail && err != nil {
+			t.Errorf("%s: expected success, got %s", test.name, err)
+		}
+	}
+
+	az := &AzureIdp{MinimumSignatureAlgorithm: "sha256"}
+	if err := az.validateEncryptedSignatureAlgorithms(&samllib.ServiceProvider{Key: key}, []byte(multiAssertionResponse)); err != nil {
+		t.Fatalf("response without encrypted assertions failed validation: %s", err)
+	}
+}
+
+func TestMergeAssertions(t *testing.T) {
+	newAssertion := func(issuer string, nameID *samllib.NameID, attrName, attrValue string) *samllib.Assertion {
+		assertion := &samllib.Assertion{
+			Issuer: samllib.Issuer{Value: issuer},
+			AttributeStatements: []samllib.AttributeStatement{
+				{
+					Attributes: []samllib.Attribute{
+						{Name: attrName, Values: []samllib.AttributeValue{{Value: attrValue}}},
+					},
+				},
+			},
+		}
+		if nameID != nil {
+			assertion.Subject = &samllib.Subject{NameID: nameID}
+		}
+		return assertion
+	}
+	issuer := "https://sts.windows.net/1b9e886b-8ff2-4378-b6c8-6771259a5f51/"
+	nameID := &samllib.NameID{
+		Format: string(samllib.PersistentNameIDFormat),
+		Value:  "3d1bc3d0-1d9c-4a9e-b2a6-5e0f0a8f2c11",
+	}
+	for _, test := range []struct {
+		name       string
+		issuer     string
+		nameID     *samllib.NameID
+		shouldFail bool
+	}{
+		{name: "same subject and issuer", issuer: issuer, nameID: nameID},
+		{
+			name:   "same subject with whitespace",
+			issuer: " " + issuer + "\n",
+			nameID: &samllib.NameID{Format: nameID.Format, Value: "\n" + nameID.Value + " "},
+		},
+		{
+			name:       "different subject",
+			issuer:     issuer,
+			nameID:     &samllib.NameID{Format: nameID.Format, Value: "9a0c5e6b-7f4d-4c1e-8b3a-2d6f1e0a9b77"},
+			shouldFail: true,
+		},
+		{
+			name:       "different NameID format",
+			issuer:     issuer,
+			nameID:     &samllib.NameID{Format: string(samllib.TransientNameIDFormat), Value: nameID.Value},
+			shouldFail: true,
+		},
+		{
+			name:       "different NameID qualifier",
+			issuer:     issuer,
+			nameID:     &samllib.NameID{Format: nameID.Format, SPNameQualifier: "urn:caddy:other", Value: nameID.Value},
+			shouldFail: true,
+		},
+		{
+			name:       "different issuer",
+			issuer:     "https://idp.university-b.edu/idp/shibboleth",
+			nameID:     nameID,
+			shouldFail: true,
+		},
+		{name: "missing subject", issuer: issuer, shouldFail: true},
+	} {
+		assertion := newAssertion(issuer, nameID, "mail", "jsmith@contoso.com")
+		other := newAssertion(test.issuer, test.nameID, "department", "Engineering")
+		err := mergeAssertion(assertion, other)
+		if test.shouldFail {
+			if err == nil {
+				t.Errorf("%s: expected failure, got success", test.name)
+			}
+			if len(assertion.AttributeStatements) != 1 {
+				t.Errorf("%s: attribute statements merged despite failure", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected success, got %s", test.name, err)
+			continue
+		}
+		if len(assertion.AttributeStatements) != 2 || assertion.AttributeStatements[1].Attributes[0].Name != "department" {
+			t.Errorf("%s: unexpected merged attribute statements: %v", test.name, assertion.AttributeStatements)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package saml
+
+import (
+	"fmt"
+	samllib "github.com/crewjam/saml"
+	"regexp"
+)
+
+// AttributeFilter restricts the values of the attributes matching the name
+// to the ones matching the allow patterns and not matching the deny
+// patterns. An attribute matches the name when the attribute name ends
+// with the name.
+type AttributeFilter struct {
+	// Attribute is the name of the filtered attributes, e.g.
+	// "identity/claims/groups".
+	Attribute string `json:"attribute,omitempty"`
+	// Allow are the regular expressions the values must match, any of
+	// them. All values are allowed when the list is empty.
+	Allow []string `json:"allow,omitempty"`
+	// Deny are the regular expressions the values must not match.
+	Deny []string `json:"deny,omitempty"`
+
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+// compilePatterns compiles the regular expressions of the filter setting.
+func compilePatterns(path string, patterns []string) ([]*regexp.Regexp, error) {
+	compiled := []*regexp.Regexp{}
+	for i, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, newConfigError(fmt.Sprintf("%s[%d]", path, i), "Azure AD attribute filter pattern %s is invalid: %s", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// validateAttributeFilters compiles the regular expressions of the
+// attribute filters.
+func (az *AzureIdp) validateAttributeFilters() error {
+	for i := range az.AttributeFilters {
+		filter := &az.AttributeFilters[i]
+		path := fmt.Sprintf("azure.attribute_filters[%d]", i)
+		if filter.Attribute == "" {
+			return newConfigError(path+".attribute", "Azure AD attribute filter has no attribute")
+		}
+		if len(filter.Allow) == 0 && len(filter.Deny) == 0 {
+			return newConfigError(path, "Azure AD attribute filter for %s has neither allow nor deny patterns", filter.Attribute)
+		}
+		var err error
+		if filter.allow, err = compilePatterns(path+".allow", filter.Allow); err != nil {
+			return err
+		}
+		if filter.deny, err = compilePatterns(path+".deny", filter.Deny); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match returns true when the value passes the filter.
+func (f *AttributeFilter) match(value string) bool {
+	for _, re := range f.deny {
+		if re.MatchString(value) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, re := range f.allow {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterValues drops the values not passing the filters of any of the
+// attribute names, e.g. the values decomposed from a complex attribute.
+func (az *AzureIdp) filterValues(names []string, values []string) []string {
+	for i := range az.AttributeFilters {
+		filter := &az.AttributeFilters[i]
+		matched := false
+		for _, name := range names {
+			if az.matchAttributeName(name, []string{filter.Attribute}) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		filtered := []string{}
+		for _, value := range values {
+			if filter.match(value) {
+				filtered = append(filtered, value)
+			}
+		}
+		values = filtered
+	}
+	return values
+}
+
+// filterAttributes drops the attribute values not passing the filters of
+// the attributes. The attributes left without values are dropped as well.
+func (az *AzureIdp) filterAttributes(attrs []samllib.Attribute) []samllib.Attribute {
+	if len(az.AttributeFilters) == 0 {
+		return attrs
+	}
+	filtered := []samllib.Attribute{}
+	for _, attr := range attrs {
+		for i := range az.AttributeFilters {
+			filter := &az.AttributeFilters[i]
+			if !az.matchAttributeName(attr.Name, []string{filter.Attribute}) {
+				continue
+			}
+			values := []samllib.AttributeValue{}
+			for _, attrValue := range attr.Values {
+				if filter.match(attrValue.Value) {
+					values = append(values, attrValue)
+				}
+			}
+			attr.Values = values
+		}
+		if len(attr.Values) > 0 {
+			filtered = append(filtered, attr)
+		}
+	}
+	return filtered
+}
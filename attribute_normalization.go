@@ -0,0 +1,90 @@
+package saml
+
+import (
+	"fmt"
+	samllib "github.com/crewjam/saml"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+)
+
+// AttributeNormalization cleans up the values of the attributes matching
+// the name before they become claims, e.g. strips the whitespace breaking
+// the comparisons of the roles. An attribute matches the name when the
+// attribute name ends with the name.
+type AttributeNormalization struct {
+	// Attribute is the name of the normalized attributes, e.g.
+	// "Attributes/Role". The normalization applies to all attributes when
+	// the name is empty.
+	Attribute string `json:"attribute,omitempty"`
+	// Trim strips the leading and trailing whitespace of the values.
+	Trim bool `json:"trim,omitempty"`
+	// StripControl removes the control characters, e.g. NUL or the line
+	// breaks, from the values.
+	StripControl bool `json:"strip_control,omitempty"`
+	// NFC converts the values to the Unicode Normalization Form C, so that
+	// the same characters encoded differently compare equal.
+	NFC bool `json:"nfc,omitempty"`
+}
+
+// validateAttributeNormalizations checks that each normalization does
+// something.
+func (az *AzureIdp) validateAttributeNormalizations() error {
+	for i, normalization := range az.AttributeNormalizations {
+		if !normalization.Trim && !normalization.StripControl && !normalization.NFC {
+			return newConfigError(fmt.Sprintf("azure.attribute_normalizations[%d]", i),
+				"Azure AD attribute normalization for %q enables none of trim, strip_control, or nfc", normalization.Attribute,
+			)
+		}
+	}
+	return nil
+}
+
+// normalize returns the normalized value.
+func (n *AttributeNormalization) normalize(value string) string {
+	if n.StripControl {
+		value = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, value)
+	}
+	if n.NFC {
+		value = norm.NFC.String(value)
+	}
+	if n.Trim {
+		value = strings.TrimSpace(value)
+	}
+	return value
+}
+
+// normalizeAttributes applies the normalizations of the attributes to
+// their values, in order. The values left empty are dropped, and so are
+// the attributes left without values.
+func (az *AzureIdp) normalizeAttributes(attrs []samllib.Attribute) []samllib.Attribute {
+	if len(az.AttributeNormalizations) == 0 {
+		return attrs
+	}
+	normalized := []samllib.Attribute{}
+	for _, attr := range attrs {
+		for i := range az.AttributeNormalizations {
+			normalization := &az.AttributeNormalizations[i]
+			if normalization.Attribute != "" && !az.matchAttributeName(attr.Name, []string{normalization.Attribute}) {
+				continue
+			}
+			values := []samllib.AttributeValue{}
+			for _, attrValue := range attr.Values {
+				attrValue.Value = normalization.normalize(attrValue.Value)
+				if attrValue.Value != "" {
+					values = append(values, attrValue)
+				}
+			}
+			attr.Values = values
+		}
+		if len(attr.Values) > 0 {
+			normalized = append(normalized, attr)
+		}
+	}
+	return normalized
+}
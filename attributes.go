@@ -0,0 +1,559 @@
+package saml
+
+import (
+	"fmt"
+	samllib "github.com/crewjam/saml"
+	"go.uber.org/zap"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// attributeProfile maps the claims to the names of the SAML attributes
+// carrying them. An attribute matches a name when the attribute name ends
+// with the name. When multiple names are listed for a single-valued claim,
+// the first name found in an assertion takes precedence.
+type attributeProfile struct {
+	SessionDuration []string
+	Name            []string
+	Email           []string
+	Origin          []string
+	Subject         []string
+	Roles           []string
+}
+
+const defaultAttributeProfile = "azure"
+
+// attributeProfiles are the preset attribute mappings selected via the
+// profile configuration setting.
+var attributeProfiles = map[string]*attributeProfile{
+	// Azure AD (Office 365) claims.
+	"azure": {
+		SessionDuration: []string{"Attributes/MaxSessionDuration"},
+		Name:            []string{"identity/claims/displayname"},
+		Email:           []string{"identity/claims/emailaddress"},
+		Origin:          []string{"identity/claims/identityprovider"},
+		Subject:         []string{"identity/claims/name"},
+		Roles:           []string{"Attributes/Role"},
+	},
+	// Higher education federations, e.g. InCommon and eduGAIN, use
+	// eduPerson and X.500 attributes identified by OIDs.
+	"edu": {
+		Name: []string{
+			"urn:oid:2.16.840.1.113730.3.1.241", // displayName
+			"urn:oid:2.5.4.3",                   // cn
+		},
+		Email: []string{
+			"urn:oid:0.9.2342.19200300.100.1.3", // mail
+			"urn:oid:1.3.6.1.4.1.5923.1.1.1.6",  // eduPersonPrincipalName
+		},
+		Subject: []string{
+			"urn:oid:1.3.6.1.4.1.5923.1.1.1.6", // eduPersonPrincipalName
+		},
+		Roles: []string{
+			"urn:oid:1.3.6.1.4.1.5923.1.1.1.1", // eduPersonAffiliation
+			"urn:oid:1.3.6.1.4.1.5923.1.1.1.9", // eduPersonScopedAffiliation
+		},
+	},
+}
+
+// getAttributeProfileNames returns the names of preset attribute profiles.
+func getAttributeProfileNames() []string {
+	names := []string{}
+	for name := range attributeProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getAttributeNames returns all attribute names of the profile.
+func (p *attributeProfile) getAttributeNames() []string {
+	names := []string{}
+	for _, entries := range [][]string{p.SessionDuration, p.Name, p.Email, p.Origin, p.Subject, p.Roles} {
+		names = append(names, entries...)
+	}
+	return names
+}
+
+// getClaimAttributeNames returns the names of the attributes populating
+// the claim, e.g. "roles", per the profile.
+func (p *attributeProfile) getClaimAttributeNames(claim string) []string {
+	switch claim {
+	case "name":
+		return p.Name
+	case "email":
+		return p.Email
+	case "roles":
+		return p.Roles
+	}
+	return nil
+}
+
+// hasAttributeNameSuffix returns true when the attribute name ends with
+// the name. With case-insensitive matching, the names are case-folded.
+func (az *AzureIdp) hasAttributeNameSuffix(attrName, name string) bool {
+	if az.CaseInsensitiveAttributes {
+		return strings.HasSuffix(strings.ToLower(attrName), strings.ToLower(name))
+	}
+	return strings.HasSuffix(attrName, name)
+}
+
+// matchAttributeName returns true when the attribute name matches one of
+// the names.
+func (az *AzureIdp) matchAttributeName(attrName string, names []string) bool {
+	for _, name := range names {
+		if az.hasAttributeNameSuffix(attrName, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// findAttributeValue returns the first value of the attribute matching the
+// names. The names are evaluated in order. When multiple attributes match
+// a name, e.g. by suffix, the last one wins.
+func (az *AzureIdp) findAttributeValue(attrs []samllib.Attribute, names []string) (string, bool) {
+	for _, name := range names {
+		var value string
+		var found bool
+		for _, attr := range attrs {
+			if az.hasAttributeNameSuffix(attr.Name, name) {
+				value = attr.Values[0].Value
+				found = true
+			}
+		}
+		if found {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// findAttributeValues returns the values of all attributes matching the
+// names.
+func (az *AzureIdp) findAttributeValues(attrs []samllib.Attribute, names []string) []string {
+	values := []string{}
+	for _, attr := range attrs {
+		if !az.matchAttributeName(attr.Name, names) {
+			continue
+		}
+		for _, attrValue := range attr.Values {
+			values = append(values, attrValue.Value)
+		}
+	}
+	return values
+}
+
+const (
+	// defaultMinSessionDuration is the default lower bound, in seconds,
+	// of the session duration conveyed by the IdP.
+	defaultMinSessionDuration = 60
+	// defaultMaxSessionDuration is the default upper bound, in seconds,
+	// of the session duration conveyed by the IdP.
+	defaultMaxSessionDuration = 43200
+)
+
+// getSessionDuration parses the session duration attribute. The durations
+// outside of the configured range are clamped to it. It returns false when
+// the value is not a positive number of seconds.
+func (az *AzureIdp) getSessionDuration(value string) (int, bool) {
+	duration, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		az.logger.Error(
+			"Failed parsing session duration attribute",
+			zap.String("error", err.Error()),
+		)
+		return 0, false
+	}
+	if duration <= 0 {
+		az.logger.Warn(
+			"Ignored non-positive session duration attribute",
+			zap.Int64("session_duration", duration),
+		)
+		return 0, false
+	}
+	if duration < int64(az.MinSessionDuration) {
+		az.logger.Warn(
+			"Clamped session duration attribute to min_session_duration",
+			zap.Int64("session_duration", duration),
+			zap.Int("min_session_duration", az.MinSessionDuration),
+		)
+		return az.MinSessionDuration, true
+	}
+	if duration > int64(az.MaxSessionDuration) {
+		az.logger.Warn(
+			"Clamped session duration attribute to max_session_duration",
+			zap.Int64("session_duration", duration),
+			zap.Int("max_session_duration", az.MaxSessionDuration),
+		)
+		return az.MaxSessionDuration, true
+	}
+	return int(duration), true
+}
+
+// newAttributeProfile returns the preset attribute profile with the name,
+// adjusted per SessionDurationAttribute, EmailSources, and OriginSources.
+func (az *AzureIdp) newAttributeProfile(name string) (*attributeProfile, bool) {
+	profile, exists := attributeProfiles[name]
+	if !exists {
+		return nil, false
+	}
+	customProfile := *profile
+	if az.SessionDurationAttribute != "" {
+		customProfile.SessionDuration = []string{az.SessionDurationAttribute}
+	}
+	if len(az.EmailSources) > 0 {
+		customProfile.Email = az.EmailSources
+	}
+	if len(az.OriginSources) > 0 {
+		customProfile.Origin = az.OriginSources
+	}
+	return &customProfile, true
+}
+
+// getAttributeProfile returns the attribute profile for the SAML
+// Responses issued by the issuer.
+func (az *AzureIdp) getAttributeProfile(issuer string) *attributeProfile {
+	if profile, exists := az.issuerProfiles[strings.TrimSpace(issuer)]; exists {
+		return profile
+	}
+	return az.attributeProfile
+}
+
+// mapAttributes populates user claims with the values of the attributes
+// in the attribute statements of an assertion.
+func (az *AzureIdp) mapAttributes(claims *UserClaims, attrStatements []samllib.AttributeStatement) {
+	az.mapIssuerAttributes(claims, "", attrStatements)
+}
+
+// mapIssuerAttributes populates user claims with the values of the
+// attributes per the attribute profile of the issuer of an assertion.
+func (az *AzureIdp) mapIssuerAttributes(claims *UserClaims, issuer string, attrStatements []samllib.AttributeStatement) {
+	profile := az.getAttributeProfile(issuer)
+	attrs := []samllib.Attribute{}
+	for _, attrStatement := range attrStatements {
+		for _, attrEntry := range attrStatement.Attributes {
+			if len(attrEntry.Values) == 0 {
+				continue
+			}
+			attrs = append(attrs, attrEntry)
+		}
+	}
+
+	if az.LogAttributes {
+		az.logAttributes(attrs)
+	}
+	attrs = az.normalizeAttributes(attrs)
+	attrs = az.filterAttributes(attrs)
+	// With collect, the single-valued claims are looked up in the attributes
+	// before merging, hence the last occurrence wins.
+	valueAttrs := attrs
+	attrs = az.mergeDuplicateAttributes(attrs)
+	switch az.DuplicateAttributes {
+	case duplicateAttributesFirst, duplicateAttributesLast:
+		valueAttrs = attrs
+	}
+
+	if value, found := az.findAttributeValue(valueAttrs, profile.SessionDuration); found {
+		if duration, ok := az.getSessionDuration(value); ok {
+			claims.ExpiresAt = time.Now().Add(time.Duration(duration) * time.Second).Unix()
+		}
+	}
+	if value, found := az.findAttributeValue(valueAttrs, profile.Name); found {
+		claims.Name = value
+	}
+	if value, found := az.findAttributeValue(valueAttrs, profile.Email); found {
+		if az.NormalizeEmail {
+			value = normalizeEmail(value)
+		}
+		claims.Email = value
+	}
+	if value, found := az.findAttributeValue(valueAttrs, profile.Origin); found {
+		claims.Origin = value
+	} else if claims.Origin == "" {
+		// The IdPs other than Azure AD convey no origin attribute.
+		claims.Origin = strings.TrimSpace(issuer)
+	}
+	if value, found := az.findAttributeValue(valueAttrs, profile.Subject); found {
+		claims.Subject = value
+	}
+	claims.Roles = append(claims.Roles, az.findAttributeValues(attrs, profile.Roles)...)
+	az.mapComplexAttributes(claims, profile, attrs)
+
+	knownAttrNames := append(profile.getAttributeNames(), az.getComplexAttributeNames()...)
+	for _, attr := range attrs {
+		if !az.matchAttributeName(attr.Name, knownAttrNames) {
+			az.handleUnknownAttribute(claims, attr)
+		}
+	}
+}
+
+// mergeDuplicateAttributes merges the attributes with the same name per
+// DuplicateAttributes. The merged attribute takes the place of the first
+// occurrence. With case-insensitive matching, the names are case-folded.
+func (az *AzureIdp) mergeDuplicateAttributes(attrs []samllib.Attribute) []samllib.Attribute {
+	merged := []samllib.Attribute{}
+	positions := make(map[string]int)
+	for _, attr := range attrs {
+		name := attr.Name
+		if az.CaseInsensitiveAttributes {
+			name = strings.ToLower(name)
+		}
+		i, exists := positions[name]
+		if !exists {
+			positions[name] = len(merged)
+			merged = append(merged, attr)
+			continue
+		}
+		switch az.DuplicateAttributes {
+		case duplicateAttributesFirst:
+		case duplicateAttributesLast:
+			merged[i].Values = attr.Values
+		default:
+			values := append([]samllib.AttributeValue{}, merged[i].Values...)
+			merged[i].Values = append(values, attr.Values...)
+		}
+	}
+	return merged
+}
+
+// redactedAttributeValue replaces the values of sensitive attributes in logs.
+const redactedAttributeValue = "REDACTED"
+
+// logAttributes logs the names and the values of the attributes. The values
+// of the sensitive attributes are redacted.
+func (az *AzureIdp) logAttributes(attrs []samllib.Attribute) {
+	for _, attr := range attrs {
+		values := []string{}
+		for _, attrValue := range attr.Values {
+			if az.matchAttributeName(attr.Name, az.SensitiveAttributes) {
+				values = append(values, redactedAttributeValue)
+				continue
+			}
+			values = append(values, attrValue.Value)
+		}
+		az.logger.Debug(
+			"found SAML attribute",
+			zap.String("name", attr.Name),
+			zap.Strings("values", values),
+		)
+	}
+}
+
+// handleUnknownAttribute processes an attribute not matched by any of
+// the claim mappings.
+func (az *AzureIdp) handleUnknownAttribute(claims *UserClaims, attr samllib.Attribute) {
+	values := []string{}
+	for _, attrValue := range attr.Values {
+		values = append(values, attrValue.Value)
+	}
+	switch az.OnUnknownAttribute {
+	case unknownAttributeLog:
+		az.logger.Debug(
+			"found unknown SAML attribute",
+			zap.String("name", attr.Name),
+			zap.Strings("values", values),
+		)
+	case unknownAttributePassthrough:
+		if claims.Custom == nil {
+			claims.Custom = make(map[string]interface{})
+		}
+		if len(values) == 1 {
+			claims.Custom[attr.Name] = values[0]
+		} else {
+			claims.Custom[attr.Name] = values
+		}
+	}
+}
+
+const (
+	subjectSourceAttribute = "attribute"
+	subjectSourceNameID    = "nameid"
+	subjectSourceEmail     = "email"
+)
+
+// defaultSubjectSource is the default order of the sources of the subject.
+var defaultSubjectSource = []string{subjectSourceAttribute, subjectSourceNameID}
+
+// setSubject sets the subject of the claims from the first source, in the
+// order of SubjectSource, having a non-empty value. The "attribute" source
+// is the subject attribute of the profile, "nameid" is the NameID of the
+// assertion's subject, and "email" is the email claim.
+func (az *AzureIdp) setSubject(claims *UserClaims, assertion *samllib.Assertion) {
+	subject := claims.Subject
+	claims.Subject = ""
+	for _, source := range az.SubjectSource {
+		switch source {
+		case subjectSourceAttribute:
+			claims.Subject = subject
+		case subjectSourceNameID:
+			if assertion.Subject != nil && assertion.Subject.NameID != nil {
+				claims.Subject = assertion.Subject.NameID.Value
+			}
+		case subjectSourceEmail:
+			claims.Subject = claims.Email
+		}
+		if claims.Subject != "" {
+			return
+		}
+	}
+}
+
+// validateSubjectSource validates the sources of the subject.
+func (az *AzureIdp) validateSubjectSource() error {
+	if len(az.SubjectSource) == 0 {
+		az.SubjectSource = defaultSubjectSource
+	}
+	for _, source := range az.SubjectSource {
+		switch source {
+		case subjectSourceAttribute, subjectSourceNameID, subjectSourceEmail:
+		default:
+			return newConfigError("azure.subject_source", "Azure AD subject_source %s is not supported", source)
+		}
+	}
+	return nil
+}
+
+const (
+	userIDAttributeEmail  = "email"
+	userIDAttributeNameID = "nameid"
+)
+
+// hasAttributes returns true when the assertion carries at least one
+// attribute with a value.
+func hasAttributes(assertion *samllib.Assertion) bool {
+	for _, attrStatement := range assertion.AttributeStatements {
+		for _, attrEntry := range attrStatement.Attributes {
+			if len(attrEntry.Values) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setUserID sets the email claim, i.e. the user ID, from the NameID of the
+// assertion per UserIDAttribute. With "nameid", the NameID is the user
+// ID. With "email", the email attribute of the profile is the user ID,
+// unless the assertion has no attributes and the NameID is an email
+// address. The name claim of the assertions without attributes is the
+// user ID.
+func (az *AzureIdp) setUserID(claims *UserClaims, assertion *samllib.Assertion) {
+	var nameID *samllib.NameID
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		nameID = assertion.Subject.NameID
+	}
+	attributeless := !hasAttributes(assertion)
+	if nameID != nil && nameID.Value != "" {
+		value := nameID.Value
+		if az.NormalizeEmail {
+			value = normalizeEmail(value)
+		}
+		switch az.UserIDAttribute {
+		case userIDAttributeNameID:
+			claims.Email = value
+		default:
+			if claims.Email == "" && attributeless && nameID.Format == string(samllib.EmailAddressNameIDFormat) {
+				claims.Email = value
+			}
+		}
+	}
+	if attributeless && claims.Name == "" {
+		claims.Name = claims.Email
+	}
+}
+
+// deriveName populates the absent name claim with the local part of the
+// email address, when enabled.
+func (az *AzureIdp) deriveName(claims *UserClaims) {
+	if !az.DeriveNameFromEmail || claims.Name != "" || claims.Email == "" {
+		return
+	}
+	localPart := claims.Email
+	if i := strings.LastIndex(localPart, "@"); i > 0 {
+		localPart = localPart[:i]
+	}
+	claims.Name = localPart
+}
+
+// validateUserIDAttribute validates the source of the user ID.
+func (az *AzureIdp) validateUserIDAttribute() error {
+	switch az.UserIDAttribute {
+	case "":
+		az.UserIDAttribute = userIDAttributeEmail
+	case userIDAttributeEmail, userIDAttributeNameID:
+	default:
+		return newConfigError("azure.user_id_attribute", "Azure AD user_id_attribute %s is not supported", az.UserIDAttribute)
+	}
+	return nil
+}
+
+// setAuthnContext sets the time and the method of the authentication at
+// the IdP from the first authentication statement of the assertion.
+func setAuthnContext(claims *UserClaims, assertion *samllib.Assertion) {
+	if len(assertion.AuthnStatements) == 0 {
+		return
+	}
+	authnStatement := assertion.AuthnStatements[0]
+	if !authnStatement.AuthnInstant.IsZero() {
+		claims.AuthInstant = authnStatement.AuthnInstant.Unix()
+	}
+	if authnStatement.AuthnContext.AuthnContextClassRef != nil {
+		claims.AuthMethod = strings.TrimSpace(authnStatement.AuthnContext.AuthnContextClassRef.Value)
+	}
+}
+
+// setSessionIndex sets the session of the user at the IdP from the first
+// authentication statement of the assertion, when enabled.
+func (az *AzureIdp) setSessionIndex(claims *UserClaims, assertion *samllib.Assertion) {
+	if !az.IncludeSessionIndex || len(assertion.AuthnStatements) == 0 {
+		return
+	}
+	claims.SessionIndex = strings.TrimSpace(assertion.AuthnStatements[0].SessionIndex)
+}
+
+// normalizeEmail returns the lowercased email address without surrounding
+// whitespace.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// dedupeRoles returns the roles without duplicates, preserving the order
+// of the first occurrences.
+func dedupeRoles(roles []string) []string {
+	if len(roles) < 2 {
+		return roles
+	}
+	seen := make(map[string]bool)
+	deduped := []string{}
+	for _, role := range roles {
+		if seen[role] {
+			continue
+		}
+		seen[role] = true
+		deduped = append(deduped, role)
+	}
+	return deduped
+}
+
+// limitRoles enforces the maximum number of the roles of a user. Per the
+// policy, the roles exceeding the maximum are either dropped, with a
+// warning logged, or the login is rejected.
+func (az *AzureIdp) limitRoles(claims *UserClaims) error {
+	if az.MaxRoles == 0 || len(claims.Roles) <= az.MaxRoles {
+		return nil
+	}
+	if az.MaxRolesPolicy == maxRolesFail {
+		return fmt.Errorf("user %s has %d roles, exceeding the maximum of %d", claims.Email, len(claims.Roles), az.MaxRoles)
+	}
+	az.logger.Warn(
+		"truncating roles exceeding the maximum",
+		zap.String("email", claims.Email),
+		zap.Int("roles", len(claims.Roles)),
+		zap.Int("max_roles", az.MaxRoles),
+	)
+	claims.Roles = claims.Roles[:az.MaxRoles]
+	return nil
+}
@@ -0,0 +1,132 @@
+package saml
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// auditLoggerName is the name of the logger recording the audit trail.
+const auditLoggerName = "audit"
+
+const (
+	// auditFormatJSON logs the fields of the audit events as structured
+	// fields, i.e. the keys of the JSON log entries.
+	auditFormatJSON = "json"
+	// auditFormatLogfmt logs the fields of the audit events as the
+	// key=value pairs of the message.
+	auditFormatLogfmt = "logfmt"
+)
+
+// auditLogger records the audit trail, i.e. security-relevant events,
+// e.g. the denials of access.
+type auditLogger struct {
+	logger         *zap.Logger
+	trustedProxies []*net.IPNet
+	format         string
+}
+
+func newAuditLogger(logger *zap.Logger, trustedProxies []*net.IPNet, format string) *auditLogger {
+	return &auditLogger{
+		logger:         logger.Named(auditLoggerName),
+		trustedProxies: trustedProxies,
+		format:         format,
+	}
+}
+
+// validateAuditFormat validates the format of the audit trail.
+func validateAuditFormat(format string) error {
+	switch format {
+	case auditFormatJSON, auditFormatLogfmt:
+		return nil
+	}
+	return fmt.Errorf("audit_format %s is not supported, supported: %s, %s", format, auditFormatJSON, auditFormatLogfmt)
+}
+
+// auditField is a field of an audit event. The fields are ordered, so that
+// both formats list them the same way.
+type auditField struct {
+	Key   string
+	Value interface{}
+}
+
+// record logs the event along with the request details. The fields are
+// either structured or the key=value pairs of the message, per format.
+func (a *auditLogger) record(r *http.Request, event string, fields ...auditField) {
+	fields = append([]auditField{
+		{"event", event},
+		{"client_ip", getClientIP(r, a.trustedProxies)},
+		{"remote_addr", r.RemoteAddr},
+		{"method", r.Method},
+		{"path", r.URL.Path},
+	}, fields...)
+	if a.format == auditFormatLogfmt {
+		a.logger.Info(formatLogfmt(fields))
+		return
+	}
+	zapFields := []zap.Field{}
+	for _, field := range fields {
+		zapFields = append(zapFields, zap.Any(field.Key, field.Value))
+	}
+	a.logger.Info(event, zapFields...)
+}
+
+// formatLogfmt returns the fields as logfmt, i.e. space-separated
+// key=value pairs. The values with spaces, quotes, or equal signs, and the
+// empty values, are quoted.
+func formatLogfmt(fields []auditField) string {
+	pairs := []string{}
+	for _, field := range fields {
+		value := fmt.Sprint(field.Value)
+		if value == "" || strings.ContainsAny(value, " =\"\t\r\n\\") {
+			value = strconv.Quote(value)
+		}
+		pairs = append(pairs, field.Key+"="+value)
+	}
+	return strings.Join(pairs, " ")
+}
+
+// recordAuthorizationDenied logs the denial of access to the authenticated
+// user.
+func (a *auditLogger) recordAuthorizationDenied(r *http.Request, user *caddyauth.User, err error) {
+	reason := ""
+	if authzErr, ok := err.(*authorizationError); ok {
+		reason = authzErr.reason
+	}
+	a.record(r, "authorization denied",
+		auditField{"user", user.ID},
+		auditField{"roles", user.Metadata["roles"]},
+		auditField{"auth_method", user.Metadata["auth_method"]},
+		auditField{"reason", reason},
+		auditField{"error", err.Error()},
+	)
+}
+
+// recordSessionRevoked logs the revocation of the session by the user.
+func (a *auditLogger) recordSessionRevoked(r *http.Request, userID, sessionID string) {
+	a.record(r, "session revoked",
+		auditField{"user", userID},
+		auditField{"session_id", sessionID},
+	)
+}
+
+// recordUserSessionsRevoked logs the revocation of all sessions of the user
+// via the admin endpoint.
+func (a *auditLogger) recordUserSessionsRevoked(r *http.Request, userID string, count int) {
+	a.record(r, "user sessions revoked",
+		auditField{"user", userID},
+		auditField{"revoked_sessions", count},
+	)
+}
+
+// recordLoginLockedOut logs the login rejected due to repeated login
+// failures of the client IP or the user.
+func (a *auditLogger) recordLoginLockedOut(r *http.Request, userID string) {
+	a.record(r, "login locked out",
+		auditField{"user", userID},
+	)
+}
@@ -0,0 +1,84 @@
+package saml
+
+import (
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuditFormat(t *testing.T) {
+	user := &caddyauth.User{
+		ID: "jsmith@contoso.com",
+		Metadata: map[string]string{
+			"roles": "AzureAD_Viewer AzureAD_Editor",
+		},
+	}
+	err := &authorizationError{reason: "required_roles", msg: "user has none of the required roles"}
+
+	// The structured fields.
+	core, logs := observer.New(zap.InfoLevel)
+	audit := newAuditLogger(zap.New(core), nil, auditFormatJSON)
+	r := httptest.NewRequest("GET", "/app", nil)
+	r.RemoteAddr = "192.0.2.10:52314"
+	audit.recordAuthorizationDenied(r, user, err)
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 audit entry, got %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	for k, v := range map[string]interface{}{
+		"event":       "authorization denied",
+		"client_ip":   "192.0.2.10",
+		"remote_addr": "192.0.2.10:52314",
+		"method":      "GET",
+		"path":        "/app",
+		"user":        "jsmith@contoso.com",
+		"roles":       "AzureAD_Viewer AzureAD_Editor",
+		"auth_method": "",
+		"reason":      "required_roles",
+	} {
+		if fields[k] != v {
+			t.Errorf("json: unexpected %s: %v, expected: %v", k, fields[k], v)
+		}
+	}
+
+	// The key=value pairs of the message.
+	core, logs = observer.New(zap.InfoLevel)
+	audit = newAuditLogger(zap.New(core), nil, auditFormatLogfmt)
+	audit.recordAuthorizationDenied(r, user, err)
+	entries = logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 audit entry, got %d", len(entries))
+	}
+	expected := `event="authorization denied" client_ip=192.0.2.10 remote_addr=192.0.2.10:52314 method=GET path=/app ` +
+		`user=jsmith@contoso.com roles="AzureAD_Viewer AzureAD_Editor" auth_method="" reason=required_roles ` +
+		`error="user has none of the required roles"`
+	if entries[0].Message != expected {
+		t.Errorf("logfmt: unexpected message:\n%s\nexpected:\n%s", entries[0].Message, expected)
+	}
+	if len(entries[0].Context) != 0 {
+		t.Errorf("logfmt: unexpected structured fields: %v", entries[0].ContextMap())
+	}
+
+	if err := validateAuditFormat("xml"); err == nil {
+		t.Errorf("unsupported audit format passed validation")
+	}
+}
+
+func TestFormatLogfmt(t *testing.T) {
+	for _, test := range []struct {
+		fields   []auditField
+		expected string
+	}{
+		{fields: []auditField{{"user", "jsmith@contoso.com"}, {"revoked_sessions", 3}}, expected: `user=jsmith@contoso.com revoked_sessions=3`},
+		{fields: []auditField{{"roles", "a b"}, {"reason", ""}}, expected: `roles="a b" reason=""`},
+		{fields: []auditField{{"error", `invalid "token"`}}, expected: `error="invalid \"token\""`},
+		{fields: []auditField{{"path", "/app?a=b"}}, expected: `path="/app?a=b"`},
+	} {
+		if s := formatLogfmt(test.fields); s != test.expected {
+			t.Errorf("unexpected logfmt: %s, expected: %s", s, test.expected)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	samllib "github.com/crewjam/saml"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultAuthnRequestLifetime is the time the plugin waits for an IdP to
+// respond to an authentication request.
+const defaultAuthnRequestLifetime = 10 * time.Minute
+
+// defaultMaxAuthnRequests is the maximum number of pending authentication
+// requests. The SP-initiated logins are unauthenticated, so the number is
+// bounded to keep the memory usage in check.
+const defaultMaxAuthnRequests = 10000
+
+// authnRequestTracker keeps track of the authentication requests issued
+// during SP-initiated logins until the IdP responds to them.
+type authnRequestTracker struct {
+	mu          sync.Mutex
+	requests    map[string]time.Time
+	lifetime    time.Duration
+	maxRequests int
+}
+
+func newAuthnRequestTracker(lifetime time.Duration) *authnRequestTracker {
+	return &authnRequestTracker{
+		requests:    make(map[string]time.Time),
+		lifetime:    lifetime,
+		maxRequests: defaultMaxAuthnRequests,
+	}
+}
+
+// add starts tracking the authentication request with the ID. When the
+// maximum number of pending requests is reached, the expired requests are
+// discarded, and then, if still needed, the oldest one.
+func (t *authnRequestTracker) add(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if _, exists := t.requests[id]; !exists && len(t.requests) >= t.maxRequests {
+		var oldestID string
+		var oldestExpiresAt time.Time
+		for requestID, expiresAt := range t.requests {
+			if now.After(expiresAt) {
+				delete(t.requests, requestID)
+				continue
+			}
+			if oldestID == "" || expiresAt.Before(oldestExpiresAt) {
+				oldestID, oldestExpiresAt = requestID, expiresAt
+			}
+		}
+		if len(t.requests) >= t.maxRequests {
+			delete(t.requests, oldestID)
+		}
+	}
+	t.requests[id] = now.Add(t.lifetime)
+}
+
+// remove stops tracking the authentication request with the ID.
+func (t *authnRequestTracker) remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.requests, id)
+}
+
+// has returns true when the authentication request with the ID is pending,
+// i.e. it was issued and it has not expired yet.
+func (t *authnRequestTracker) has(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	expiresAt, exists := t.requests[id]
+	return exists && time.Now().Before(expiresAt)
+}
+
+// getIDs returns the IDs of pending authentication requests. The expired
+// requests are being discarded.
+func (t *authnRequestTracker) getIDs() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ids := []string{}
+	now := time.Now()
+	for id, expiresAt := range t.requests {
+		if now.After(expiresAt) {
+			delete(t.requests, id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// getServiceProvider returns the service provider with the ACS URL the
+// request arrived at. When there is no such provider, it returns the
+// first one.
+func (az *AzureIdp) getServiceProvider(r *http.Request) *samllib.ServiceProvider {
+	reqURL := getExternalURL(r, az.trustedProxies)
+	for _, sp := range az.ServiceProviders {
+		if isSameEndpoint(&sp.AcsURL, reqURL) {
+			return sp
+		}
+	}
+	return az.ServiceProviders[0]
+}
+
+// newAuthnRequest returns the authentication request to the IdP. When the
+// default ACS index is configured, the request refers to the ACS URL by
+// its index rather than by its location and binding.
+func (az *AzureIdp) newAuthnRequest(sp *samllib.ServiceProvider, idpURL string) (*samllib.AuthnRequest, error) {
+	req, err := sp.MakeAuthenticationRequest(idpURL)
+	if err != nil {
+		return nil, err
+	}
+	if az.DefaultAcsIndex != nil {
+		req.AssertionConsumerServiceIndex = strconv.Itoa(*az.DefaultAcsIndex)
+		req.AssertionConsumerServiceURL = ""
+		req.ProtocolBinding = ""
+	}
+	return req, nil
+}
+
+// getLoginRedirectURL issues an authentication request and returns the URL
+// redirecting the request to the IdP via HTTP-Redirect binding. The relay
+// state, e.g. the originally requested URL, is returned by the IdP along
+// with the SAML Response.
+func (az *AzureIdp) getLoginRedirectURL(r *http.Request, relayState string) (string, error) {
+	sp := az.getServiceProvider(r)
+	idpURL := sp.GetSSOBindingLocation(samllib.HTTPRedirectBinding)
+	if idpURL == "" {
+		return "", fmt.Errorf("IdP metadata has no HTTP-Redirect SSO endpoint")
+	}
+	req, err := az.newAuthnRequest(sp, idpURL)
+	if err != nil {
+		return "", err
+	}
+	reqXML, err := xml.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	compressor, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := compressor.Write(reqXML); err != nil {
+		return "", err
+	}
+	if err := compressor.Close(); err != nil {
+		return "", err
+	}
+	redirectURL, err := url.Parse(idpURL)
+	if err != nil {
+		return "", err
+	}
+	query := redirectURL.Query()
+	query.Set("SAMLRequest", base64.StdEncoding.EncodeToString(buf.Bytes()))
+	if relayState != "" {
+		query.Set("RelayState", relayState)
+	}
+	redirectURL.RawQuery = query.Encode()
+	az.requestTracker.add(req.ID)
+	return redirectURL.String(), nil
+}
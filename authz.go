@@ -0,0 +1,88 @@
+package saml
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"net/http"
+	"strings"
+)
+
+// authorizationError is the error returned when an authenticated user is
+// not allowed access, e.g. the user lacks the required roles.
+type authorizationError struct {
+	msg string
+	// reason is the name of the unmet requirement, e.g. required_roles.
+	reason string
+}
+
+func (e *authorizationError) Error() string {
+	return e.msg
+}
+
+// authorize checks whether the authenticated user authenticated with one
+// of the required authentication methods, e.g. MFA, and has at least one
+// of the required roles. Any user is allowed when nothing is required.
+func (m AuthProvider) authorize(user *caddyauth.User) error {
+	if err := m.authorizeAuthnContext(user); err != nil {
+		return err
+	}
+	if len(m.RequiredRoles) == 0 {
+		return nil
+	}
+	for _, role := range strings.Fields(user.Metadata["roles"]) {
+		for _, requiredRole := range m.RequiredRoles {
+			if role == requiredRole {
+				return nil
+			}
+		}
+	}
+	return &authorizationError{
+		msg:    fmt.Sprintf("The user %s has none of the required roles", user.ID),
+		reason: "required_roles",
+	}
+}
+
+// authorizeAuthnContext checks whether the authentication method of the
+// user is one of the required authentication contexts.
+func (m AuthProvider) authorizeAuthnContext(user *caddyauth.User) error {
+	if len(m.RequiredAuthnContext) == 0 {
+		return nil
+	}
+	for _, authnContext := range m.RequiredAuthnContext {
+		if user.Metadata["auth_method"] == authnContext {
+			return nil
+		}
+	}
+	authMethod := user.Metadata["auth_method"]
+	if authMethod == "" {
+		authMethod = "none"
+	}
+	return &authorizationError{
+		msg: fmt.Sprintf("The authentication context %s is not one of the required authentication contexts: %s",
+			authMethod, strings.Join(m.RequiredAuthnContext, ", "),
+		),
+		reason: "required_authn_context",
+	}
+}
+
+// getFailureStatusCode returns the HTTP status code for the failure.
+func (m AuthProvider) getFailureStatusCode(err error) int {
+	if _, ok := err.(*authorizationError); ok {
+		return m.AuthorizationFailureStatusCode
+	}
+	if _, ok := err.(*lockoutError); ok {
+		return http.StatusTooManyRequests
+	}
+	return m.AuthenticationFailureStatusCode
+}
+
+// validateStatusCode checks that the status code is a client error.
+func validateStatusCode(name string, statusCode int) error {
+	if statusCode < 400 || statusCode > 499 {
+		return fmt.Errorf("%s %d is not a client error status code", name, statusCode)
+	}
+	if http.StatusText(statusCode) == "" {
+		return fmt.Errorf("%s %d is unknown", name, statusCode)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package saml
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFailureStatusCodes(t *testing.T) {
+	m := AuthProvider{
+		CommonParameters: CommonParameters{
+			RequiredRoles:                   []string{"AzureAD_Editor", "AzureAD_Administrator"},
+			AuthenticationFailureStatusCode: 401,
+			AuthorizationFailureStatusCode:  403,
+		},
+	}
+
+	user := &caddyauth.User{
+		ID:       "jsmith@contoso.com",
+		Metadata: map[string]string{"roles": "AzureAD_Viewer AzureAD_Editor"},
+	}
+	if err := m.authorize(user); err != nil {
+		t.Fatalf("user with required role was denied access: %s", err)
+	}
+
+	user.Metadata["roles"] = "AzureAD_Viewer"
+	err := m.authorize(user)
+	if err == nil {
+		t.Fatalf("user without required role was allowed access")
+	}
+	if statusCode := m.getFailureStatusCode(err); statusCode != 403 {
+		t.Fatalf("unexpected authorization failure status code: %d", statusCode)
+	}
+
+	err = fmt.Errorf("The Azure AD authorization POST request has no SAMLResponse")
+	if statusCode := m.getFailureStatusCode(err); statusCode != 401 {
+		t.Fatalf("unexpected authentication failure status code: %d", statusCode)
+	}
+
+	if err := validateStatusCode("authorization_failure_status_code", 302); err == nil {
+		t.Fatalf("non-client error status code passed validation")
+	}
+}
+
+func TestRequiredAuthnContext(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	m := AuthProvider{
+		CommonParameters: CommonParameters{
+			RequiredAuthnContext: []string{
+				"http://schemas.microsoft.com/claims/multipleauthn",
+				"https://refeds.org/profile/mfa",
+			},
+			AuthenticationFailureStatusCode: 401,
+			AuthorizationFailureStatusCode:  403,
+		},
+		audit: newAuditLogger(zap.New(core), nil, auditFormatJSON),
+	}
+
+	user := &caddyauth.User{
+		ID: "jsmith@contoso.com",
+		Metadata: map[string]string{
+			"auth_method": "https://refeds.org/profile/mfa",
+		},
+	}
+	if err := m.authorize(user); err != nil {
+		t.Fatalf("user authenticated with MFA was denied access: %s", err)
+	}
+
+	user.Metadata["auth_method"] = "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+	err := m.authorize(user)
+	if err == nil {
+		t.Fatalf("user authenticated without MFA was allowed access")
+	}
+	for _, s := range []string{
+		"urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport",
+		"http://schemas.microsoft.com/claims/multipleauthn",
+		"https://refeds.org/profile/mfa",
+	} {
+		if !strings.Contains(err.Error(), s) {
+			t.Fatalf("error message %q does not name %s", err, s)
+		}
+	}
+	if strings.Contains(err.Error(), "MFA") {
+		t.Fatalf("error message %q assumes MFA", err)
+	}
+	if statusCode := m.getFailureStatusCode(err); statusCode != 403 {
+		t.Fatalf("unexpected authorization failure status code: %d", statusCode)
+	}
+
+	r := httptest.NewRequest("POST", "/saml", nil)
+	m.audit.recordAuthorizationDenied(r, user, err)
+	entries := logs.FilterMessage("authorization denied").All()
+	if len(entries) != 1 {
+		t.Fatalf("expected denial in audit trail, got %d entries", len(entries))
+	}
+	if entries[0].LoggerName != auditLoggerName {
+		t.Fatalf("unexpected logger name: %s", entries[0].LoggerName)
+	}
+	if reason := entries[0].ContextMap()["reason"]; reason != "required_authn_context" {
+		t.Fatalf("unexpected denial reason: %v", reason)
+	}
+}
@@ -2,7 +2,8 @@ package saml
 
 import (
 	"context"
-	"encoding/base64"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/xml"
 	"fmt"
 	//"github.com/caddyserver/caddy/v2"
@@ -10,12 +11,10 @@ import (
 	samllib "github.com/crewjam/saml"
 	samlutils "github.com/crewjam/saml"
 	"github.com/crewjam/saml/samlsp"
-	jwt "github.com/dgrijalva/jwt-go"
 	"go.uber.org/zap"
-	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -23,7 +22,10 @@ import (
 // AzureIdp authenticates request from Azure AD.
 type AzureIdp struct {
 	CommonParameters
-	Enabled             bool                       `json:"enabled,omitempty"`
+	// Enabled toggles the provider. A disabled provider keeps its
+	// configuration, but it is neither validated nor used. Defaults to
+	// true.
+	Enabled             *bool                      `json:"enabled,omitempty"`
 	ServiceProviders    []*samllib.ServiceProvider `json:"-"`
 	IdpMetadataLocation string                     `json:"idp_metadata_location,omitempty"`
 	IdpMetadataURL      *url.URL                   `json:"-"`
@@ -32,6 +34,38 @@ type AzureIdp struct {
 	ApplicationID       string                     `json:"application_id,omitempty"`
 	ApplicationName     string                     `json:"application_name,omitempty"`
 
+	// IdpSignCertPEM is the PEM-encoded IdP signing certificate. It takes
+	// precedence over IdpSignCertLocation.
+	IdpSignCertPEM string `json:"idp_sign_cert_pem,omitempty"`
+	// SignCertMismatch is the handling of the configured IdP signing
+	// certificate not found among the signing certificates of IdP
+	// metadata: "warn" (default) logs a warning, and "error" fails the
+	// validation of the configuration.
+	SignCertMismatch string `json:"sign_cert_mismatch,omitempty"`
+
+	// IdpEntityID is the entity ID of the IdP to select from IdP metadata
+	// describing multiple entities, e.g. federation metadata.
+	IdpEntityID string `json:"idp_entity_id,omitempty"`
+	// MetadataMinTLSVersion is the minimum TLS version, i.e. "1.0",
+	// "1.1", "1.2" (default), or "1.3", accepted when fetching IdP
+	// metadata over HTTPS.
+	MetadataMinTLSVersion string `json:"metadata_min_tls_version,omitempty"`
+	// MetadataCipherSuites are the names of the TLS cipher suites, e.g.
+	// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", allowed when fetching IdP
+	// metadata over HTTPS. Defaults to the Go defaults. The TLS 1.3
+	// cipher suites are not configurable.
+	MetadataCipherSuites []string `json:"metadata_cipher_suites,omitempty"`
+	// ExpectedIssuer is the entity ID of the IdP the SAML Responses and
+	// their assertions must be issued by. It prevents the responses of
+	// another IdP from being accepted, e.g. when multiple IdPs are
+	// configured. The issuer is not checked when empty.
+	ExpectedIssuer string `json:"expected_issuer,omitempty"`
+	// AllowIssuerMismatch disables the rejection of the SAML Responses
+	// whose Issuer differs from the Issuer of their assertions. Some IdPs
+	// legitimately issue the responses and the assertions under different
+	// entity IDs. The mismatches are rejected by default.
+	AllowIssuerMismatch bool `json:"allow_issuer_mismatch,omitempty"`
+
 	// LoginURL is the link to Azure AD authentication portal.
 	// The link is auto-generated based on Azure AD tenant and
 	// application IDs.
@@ -40,86 +74,409 @@ type AzureIdp struct {
 	// specifies in "Set up Single Sign-On with SAML" in Azure AD
 	// Enterprise Applications.
 	EntityID string `json:"entity_id,omitempty"`
-	// AcsURL is the list of URLs server instance is listening on. These URLS
-	// are known as SP Assertion Consumer Service endpoints. For example,
-	// users may access a website via http://app.domain.local. At the
-	// same time the users may access it by IP, e.g. http://10.10.10.10. or
-	// by name, i.e. app. Each of the URLs is a separate endpoint.
-	AssertionConsumerServiceURLs []string `json:"acs_urls,omitempty"`
-	logger                       *zap.Logger
+	// OnUnknownAttribute controls the handling of the attributes not
+	// matched by any claim mapping. The "ignore" mode (default) drops
+	// them, "log" logs them at debug level, and "passthrough" copies them
+	// to the custom claims.
+	OnUnknownAttribute string `json:"on_unknown_attribute,omitempty"`
+	// DuplicateAttributes is the handling of the attributes with the same
+	// name appearing multiple times, e.g. in multiple attribute
+	// statements: "collect" (default) merges the values of all
+	// occurrences, "first" keeps the first occurrence, and "last" keeps
+	// the last one. The single-valued claims take the first value of the
+	// merged attribute.
+	DuplicateAttributes string `json:"duplicate_attributes,omitempty"`
+	// Profile is the name of the preset mapping of SAML attributes to
+	// claims, e.g. "azure" (default) or "edu".
+	Profile string `json:"profile,omitempty"`
+	// IssuerProfiles maps the entity IDs of the IdPs to the names of the
+	// attribute profiles, e.g. "edu", used for the assertions issued by
+	// them. The assertions of other issuers use Profile.
+	IssuerProfiles map[string]string `json:"issuer_profiles,omitempty"`
+	// MinimumSignatureAlgorithm is the weakest hash function, e.g. sha256,
+	// the signatures of SAML Responses may use. Defaults to sha256, i.e.
+	// the responses signed with rsa-sha1 are rejected.
+	MinimumSignatureAlgorithm string `json:"minimum_signature_algorithm,omitempty"`
+	// LogSignatureAlgorithms enables logging of the signature and digest
+	// algorithms of each accepted SAML Response at info level, e.g. for
+	// proving to auditors that the responses are signed with SHA-256.
+	LogSignatureAlgorithms bool `json:"log_signature_algorithms,omitempty"`
+	// IncludeSessionIndex adds the SessionIndex of the assertion's
+	// authentication statement to the session_index claim, so that the
+	// Single Logout can reference the session at the IdP.
+	IncludeSessionIndex bool `json:"include_session_index,omitempty"`
+	// AllowIdpInitiated controls whether the plugin accepts unsolicited
+	// SAML Responses, i.e. IdP-initiated logins. Defaults to true. When
+	// disabled, the responses must be in response to the authentication
+	// requests issued by the plugin, i.e. SP-initiated logins.
+	AllowIdpInitiated *bool `json:"allow_idp_initiated,omitempty"`
+	// RequireSignedAssertion controls whether each assertion must carry
+	// its own valid signature. Defaults to true. When disabled, the valid
+	// signature of the response covers its assertion. The unsigned
+	// assertions of unsigned responses are always rejected.
+	RequireSignedAssertion *bool `json:"require_signed_assertion,omitempty"`
+	// LogAttributes enables debug logging of the names and the values of
+	// all attributes found in the assertions. It is disabled by default.
+	LogAttributes bool `json:"log_attributes,omitempty"`
+	// SensitiveAttributes are the names of the attributes whose values
+	// are redacted when logging the attributes.
+	SensitiveAttributes []string `json:"sensitive_attributes,omitempty"`
+	// AttributeFilters restrict the values of the attributes, e.g. of the
+	// groups, to the ones matching regular expressions. The values not
+	// passing the filters do not populate the claims.
+	AttributeFilters []AttributeFilter `json:"attribute_filters,omitempty"`
+	// AttributeNormalizations clean up the values of the attributes, e.g.
+	// strip the whitespace, before the filters apply and the values
+	// populate the claims.
+	AttributeNormalizations []AttributeNormalization `json:"attribute_normalizations,omitempty"`
+	// ComplexAttributes decompose the JSON or the delimited values of the
+	// attributes into multiple claims.
+	ComplexAttributes []ComplexAttribute `json:"complex_attributes,omitempty"`
+	// CaseInsensitiveAttributes enables the case-insensitive matching of
+	// the attribute names, e.g. in the profiles, the attribute filters,
+	// and the sensitive attributes. The matching is case-sensitive by
+	// default.
+	CaseInsensitiveAttributes bool `json:"case_insensitive_attributes,omitempty"`
+	// AllowMultipartForm enables the acceptance of the SAML Responses
+	// posted as multipart/form-data. Only application/x-www-form-urlencoded
+	// is accepted by default.
+	AllowMultipartForm bool `json:"allow_multipart_form,omitempty"`
+	// AllowSpNameQualifierMismatch disables the rejection of persistent
+	// NameIDs whose SPNameQualifier is not the EntityID. The mismatches
+	// are logged instead. Some legacy IdPs set the qualifier incorrectly.
+	AllowSpNameQualifierMismatch bool `json:"allow_sp_name_qualifier_mismatch,omitempty"`
+	// AcceptedNameIDFormats is the list of NameID formats the subjects of
+	// the assertions may use. Defaults to unspecified, emailAddress,
+	// persistent, and transient formats.
+	AcceptedNameIDFormats []string `json:"accepted_nameid_formats,omitempty"`
+	// LoginButton is the appearance of the Azure AD login button in
+	// the user interface.
+	LoginButton *LoginButton `json:"login_button,omitempty"`
+	// Priority is the precedence of the provider when a SAML Response
+	// matches multiple providers. The higher takes precedence.
+	Priority int `json:"priority,omitempty"`
+	// Branding is the title and the logo of the pages rendered during the
+	// Azure AD authentication flow.
+	Branding *ProviderBranding `json:"branding,omitempty"`
+	// SubjectSource is the order of the sources of the subject claim:
+	// "attribute" (the subject attribute of the profile), "nameid" (the
+	// NameID of the assertion), and "email". The first non-empty value
+	// is used. Defaults to attribute, followed by nameid.
+	SubjectSource []string `json:"subject_source,omitempty"`
+	// UserIDAttribute is the source of the user ID, i.e. the email claim:
+	// "email" (default) is the email attribute of the profile, and
+	// "nameid" is the NameID of the assertion. With "email", the
+	// assertions without attributes fall back to the NameID in the
+	// emailAddress format.
+	UserIDAttribute string `json:"user_id_attribute,omitempty"`
+	// MaxRoles is the maximum number of the roles of a user, protecting
+	// the backends limiting the size of the tokens and the headers from
+	// the IdPs releasing enormous numbers of groups. The number of the
+	// roles is not limited when zero.
+	MaxRoles int `json:"max_roles,omitempty"`
+	// MaxRolesPolicy is the handling of the users exceeding MaxRoles:
+	// "truncate" (default) keeps the first MaxRoles roles and logs a
+	// warning, and "fail" rejects the login.
+	MaxRolesPolicy string `json:"max_roles_policy,omitempty"`
+	// MultipleAssertions is the handling of the SAML Responses with
+	// multiple assertions: "reject" (default) rejects them, "signed"
+	// uses the first assertion with a valid signature, and "merge"
+	// requires all assertions to have valid signatures and merges their
+	// attribute statements.
+	MultipleAssertions string `json:"multiple_assertions,omitempty"`
+	// ClaimEnrichers are the names of the registered claim enrichers
+	// adding custom claims, see RegisterClaimEnricher. The enrichers run
+	// in the order listed, after the built-in attribute mapping.
+	ClaimEnrichers []string `json:"claim_enrichers,omitempty"`
+	// ResponseParseTimeout is the number of seconds the parsing and the
+	// validation of a SAML Response may take. Defaults to 10 seconds.
+	ResponseParseTimeout int `json:"response_parse_timeout,omitempty"`
+	// MaxReplayWindow is the number of seconds the consumed one-time-use
+	// assertions are remembered for at most. The one-time-use assertions
+	// valid for longer, i.e. with NotOnOrAfter further in the future, are
+	// rejected. When zero, the assertions are remembered until their
+	// NotOnOrAfter, or for an hour when they have none.
+	MaxReplayWindow int `json:"max_replay_window,omitempty"`
+	// MinSessionDuration and MaxSessionDuration are the number of seconds
+	// the session duration conveyed by the IdP, i.e. MaxSessionDuration
+	// attribute, is clamped to. Default to 60 seconds and 12 hours.
+	MinSessionDuration int `json:"min_session_duration,omitempty"`
+	MaxSessionDuration int `json:"max_session_duration,omitempty"`
+	// SessionDurationAttribute is the name, matched by suffix, of the
+	// attribute conveying the session duration, in seconds. It overrides
+	// the one of the profile, i.e. Attributes/MaxSessionDuration of Azure
+	// AD.
+	SessionDurationAttribute string `json:"session_duration_attribute,omitempty"`
+	// EmailSources are the names, matched by suffix, of the attributes
+	// conveying the email address, in the order of precedence, e.g. mail
+	// before userPrincipalName. The first attribute present populates the
+	// email claim. They override the ones of the profile.
+	EmailSources []string `json:"email_sources,omitempty"`
+	// OriginSources are the names, matched by suffix, of the attributes
+	// conveying the origin, i.e. the identity provider of the user, in the
+	// order of precedence. They override the ones of the profile. When
+	// none is present, the origin is the issuer of the SAML Response.
+	OriginSources []string `json:"origin_sources,omitempty"`
+	// DeriveNameFromEmail populates the name claim with the local part of
+	// the email address, e.g. jsmith of jsmith@contoso.com, when the
+	// display name attribute is absent. Otherwise, such a login fails.
+	DeriveNameFromEmail bool `json:"derive_name_from_email,omitempty"`
+	// SpCertLocation and SpKeyLocation are the paths to the PEM-encoded
+	// signing certificate and private key of the service provider.
+	SpCertLocation string `json:"sp_cert_location,omitempty"`
+	SpKeyLocation  string `json:"sp_key_location,omitempty"`
+	// SpCertPEM and SpKeyPEM are the PEM-encoded signing certificate and
+	// private key of the service provider. They take precedence over
+	// SpCertLocation and SpKeyLocation.
+	SpCertPEM string `json:"sp_cert_pem,omitempty"`
+	SpKeyPEM  string `json:"sp_key_pem,omitempty"`
+	// SpEncryptionCertLocation and SpEncryptionKeyLocation are the paths
+	// to the PEM-encoded certificate and private key the IdP encrypts the
+	// assertions to. Defaults to the signing key pair.
+	SpEncryptionCertLocation string `json:"sp_encryption_cert_location,omitempty"`
+	SpEncryptionKeyLocation  string `json:"sp_encryption_key_location,omitempty"`
+	// SpDecryptionKeyLocations are the paths to the PEM-encoded private
+	// keys, e.g. the previous encryption keys, tried in order when the
+	// encryption key fails to decrypt an assertion. They allow the IdP
+	// to encrypt the assertions to either the old or the new key during
+	// the rotation of the encryption key pair.
+	SpDecryptionKeyLocations []string `json:"sp_decryption_key_locations,omitempty"`
+	// NormalizeEmail enables the lowercasing and the trimming of the email
+	// address of a user. The email address is the ID of the user. It is
+	// disabled by default.
+	NormalizeEmail bool `json:"normalize_email,omitempty"`
+	// DefaultAcsIndex is the index of the ACS URL, i.e. its position in
+	// the ACS URLs starting with 0, the authentication requests ask the
+	// IdP to deliver the SAML Responses to. When not set, the requests
+	// carry the ACS URL the login was initiated at.
+	DefaultAcsIndex  *int `json:"default_acs_index,omitempty"`
+	requestTracker   *authnRequestTracker
+	assertionCache   *assertionCache
+	poolKeys         []string
+	attributeProfile *attributeProfile
+	issuerProfiles   map[string]*attributeProfile
+	logger           *zap.Logger
+	spSigningCert    *x509.Certificate
+	spSigningKey     *rsa.PrivateKey
+	spEncryptionCert *x509.Certificate
+	spEncryptionKey  *rsa.PrivateKey
+	spDecryptionKeys []*rsa.PrivateKey
+	metadataClient   *http.Client
+}
+
+const (
+	duplicateAttributesCollect = "collect"
+	duplicateAttributesFirst   = "first"
+	duplicateAttributesLast    = "last"
+)
+
+const (
+	signCertMismatchWarn  = "warn"
+	signCertMismatchError = "error"
+)
+
+const (
+	maxRolesTruncate = "truncate"
+	maxRolesFail     = "fail"
+)
+
+const (
+	unknownAttributeIgnore      = "ignore"
+	unknownAttributeLog         = "log"
+	unknownAttributePassthrough = "passthrough"
+)
+
+// validateContentType checks that the media type of the POST request is
+// application/x-www-form-urlencoded, regardless of its parameters, e.g.
+// charset, or multipart/form-data when allowed.
+func (az *AzureIdp) validateContentType(r *http.Request) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("The Azure AD authorization POST request has malformed Content-Type: %s", err)
+	}
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		return nil
+	case "multipart/form-data":
+		if az.AllowMultipartForm {
+			return nil
+		}
+	}
+	return fmt.Errorf("The Azure AD authorization POST request is not application/x-www-form-urlencoded")
 }
 
 // Authenticate parses and validates SAML Response originating at Azure Active Directory.
 func (az *AzureIdp) Authenticate(r *http.Request) (*caddyauth.User, string, error) {
-	if r.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
-		return nil, "", fmt.Errorf("The Azure AD authorization POST request is not application/x-www-form-urlencoded")
+	if err := az.validateContentType(r); err != nil {
+		return nil, "", err
 	}
 	if r.FormValue("SAMLResponse") == "" {
 		return nil, "", fmt.Errorf("The Azure AD authorization POST request has no SAMLResponse")
 	}
-	samlpRespRaw, err := base64.StdEncoding.DecodeString(r.FormValue("SAMLResponse"))
+	samlpRespRaw, err := decodeSAMLResponse(r.FormValue("SAMLResponse"))
 	if err != nil {
 		return nil, "", fmt.Errorf("The Azure AD authorization POST request with SAMLResponse failed base64 decoding: %s", err)
 	}
 
-	spErrors := []string{}
+	// The SAML Response must be delivered to one of the ACS URLs.
+	acsURL := getExternalURL(r, az.trustedProxies)
+	serviceProviders := []*samllib.ServiceProvider{}
 	for _, sp := range az.ServiceProviders {
-		samlAssertions, err := sp.ParseXMLResponse(samlpRespRaw, []string{""})
+		if isSameEndpoint(&sp.AcsURL, acsURL) {
+			serviceProviders = append(serviceProviders, sp)
+		}
+	}
+	if len(serviceProviders) == 0 {
+		return nil, "", fmt.Errorf("The Azure AD authorization POST request was delivered to %s, which is not one of the ACS URLs", acsURL)
+	}
+
+	samlResp, err := parseSAMLResponse(samlpRespRaw)
+	if err != nil {
+		return nil, "", fmt.Errorf("The Azure AD authorization POST request with SAMLResponse failed parsing: %s", err)
+	}
+	if err := samlResp.Status.validate(); err != nil {
+		az.logger.Warn(
+			"Azure AD returned SAML Response with failure status",
+			zap.String("status_code", samlResp.Status.getStatusCode()),
+			zap.String("sub_status_code", samlResp.Status.getSubStatusCode()),
+			zap.String("status_message", samlResp.Status.StatusMessage),
+		)
+		return nil, "", err
+	}
+	if err := samlResp.validateDestination(acsURL); err != nil {
+		az.logger.Warn(
+			"SAML Response Destination does not match the ACS URL",
+			zap.String("destination", samlResp.Destination),
+			zap.String("acs_url", acsURL.String()),
+		)
+		return nil, "", fmt.Errorf("The Azure AD authorization failed: %s", err)
+	}
+	serviceProviders = selectServiceProviders(serviceProviders, samlResp.Destination)
+	for _, signature := range samlResp.getSignatures() {
+		az.logger.Debug(
+			"found SAML Response signature",
+			zap.Strings("algorithms", signature.getAlgorithms()),
+		)
+	}
+	if err := samlResp.validateSignatureAlgorithms(az.MinimumSignatureAlgorithm); err != nil {
+		return nil, "", fmt.Errorf("The Azure AD authorization failed: %s", err)
+	}
+	if err := samlResp.validateSignaturePresence(*az.RequireSignedAssertion); err != nil {
+		return nil, "", fmt.Errorf("The Azure AD authorization failed: %s", err)
+	}
+	if err := samlResp.validateIssuer(az.ExpectedIssuer); err != nil {
+		az.logger.Warn(
+			err.Error(),
+			zap.String("issuer", samlResp.Issuer),
+			zap.Strings("assertion_issuers", samlResp.getAssertionIssuers()),
+			zap.String("expected_issuer", az.ExpectedIssuer),
+		)
+		return nil, "", fmt.Errorf("The Azure AD authorization failed: %s", err)
+	}
+	if err := samlResp.validateIssuerConsistency(); err != nil {
+		fields := []zap.Field{
+			zap.String("error", err.Error()),
+			zap.String("issuer", samlResp.Issuer),
+			zap.Strings("assertion_issuers", samlResp.getAssertionIssuers()),
+		}
+		if !az.AllowIssuerMismatch {
+			az.logger.Warn("rejecting SAML Response issuer mismatch", fields...)
+			return nil, "", fmt.Errorf("The Azure AD authorization failed: %s", err)
+		}
+		az.logger.Debug("allowing SAML Response issuer mismatch", fields...)
+	}
+
+	if err := az.validateInResponseTo(samlResp); err != nil {
+		return nil, "", fmt.Errorf("The Azure AD authorization failed: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(az.ResponseParseTimeout)*time.Second)
+	defer cancel()
+
+	spErrors := []string{}
+	for _, sp := range serviceProviders {
+		sp := sp
+		samlAssertions, err := parseAssertionWithContext(ctx, func() (*samllib.Assertion, error) {
+			return az.parseAssertions(sp, samlResp, samlpRespRaw)
+		})
+		if _, timedOut := err.(*responseParseTimeoutError); timedOut {
+			return nil, "", fmt.Errorf("The Azure AD authorization failed, timed out after %d seconds: %s", az.ResponseParseTimeout, err)
+		}
 		if err != nil {
 			spErrors = append(spErrors, err.Error())
 			continue
 		}
+		if err := az.validateEncryptedSignatureAlgorithms(sp, samlpRespRaw); err != nil {
+			return nil, "", fmt.Errorf("The Azure AD authorization failed: %s", err)
+		}
+		if err := validateRecipient(samlAssertions, &sp.AcsURL); err != nil {
+			return nil, "", fmt.Errorf("The Azure AD authorization failed: %s", err)
+		}
+		if err := validateAssertionIssuer(samlAssertions, az.ExpectedIssuer); err != nil {
+			az.logger.Warn(
+				err.Error(),
+				zap.String("assertion_id", samlAssertions.ID),
+				zap.String("assertion_issuer", samlAssertions.Issuer.Value),
+				zap.String("expected_issuer", az.ExpectedIssuer),
+			)
+			return nil, "", fmt.Errorf("The Azure AD authorization failed: %s", err)
+		}
+		if err := validateAssertionIssuerConsistency(samlAssertions, samlResp.Issuer); err != nil {
+			fields := []zap.Field{
+				zap.String("error", err.Error()),
+				zap.String("issuer", samlResp.Issuer),
+				zap.String("assertion_id", samlAssertions.ID),
+				zap.String("assertion_issuer", samlAssertions.Issuer.Value),
+			}
+			if !az.AllowIssuerMismatch {
+				az.logger.Warn("rejecting SAML Response issuer mismatch", fields...)
+				return nil, "", fmt.Errorf("The Azure AD authorization failed: %s", err)
+			}
+			az.logger.Debug("allowing SAML Response issuer mismatch", fields...)
+		}
+		if err := az.validateNameID(samlAssertions); err != nil {
+			return nil, "", fmt.Errorf("The Azure AD authorization failed: %s", err)
+		}
+		if err := az.validateOneTimeUse(samlAssertions, time.Now()); err != nil {
+			return nil, "", fmt.Errorf("The Azure AD authorization failed: %s", err)
+		}
+		if samlResp.InResponseTo != "" {
+			az.requestTracker.remove(samlResp.InResponseTo)
+		}
+		az.logSignatureAlgorithms(samlResp, samlAssertions)
 
+		now := time.Now()
 		claims := UserClaims{}
-		claims.ExpiresAt = time.Now().Add(time.Duration(900) * time.Second).Unix()
-
-		for _, attrStatement := range samlAssertions.AttributeStatements {
-			for _, attrEntry := range attrStatement.Attributes {
-				if len(attrEntry.Values) == 0 {
-					continue
-				}
-				if strings.HasSuffix(attrEntry.Name, "Attributes/MaxSessionDuration") {
-					multiplier, err := strconv.Atoi(attrEntry.Values[0].Value)
-					if err != nil {
-						az.logger.Error(
-							"Failed parsing Attributes/MaxSessionDuration",
-							zap.String("error", err.Error()),
-						)
-						continue
-					}
-					claims.ExpiresAt = time.Now().Add(time.Duration(multiplier) * time.Second).Unix()
-					continue
-				}
-
-				if strings.HasSuffix(attrEntry.Name, "identity/claims/displayname") {
-					claims.Name = attrEntry.Values[0].Value
-					continue
-				}
-
-				if strings.HasSuffix(attrEntry.Name, "identity/claims/emailaddress") {
-					claims.Email = attrEntry.Values[0].Value
-					continue
-				}
-
-				if strings.HasSuffix(attrEntry.Name, "identity/claims/identityprovider") {
-					claims.Origin = attrEntry.Values[0].Value
-					continue
-				}
-
-				if strings.HasSuffix(attrEntry.Name, "identity/claims/name") {
-					claims.Subject = attrEntry.Values[0].Value
-					continue
-				}
-
-				if strings.HasSuffix(attrEntry.Name, "Attributes/Role") {
-					for _, attrEntryElement := range attrEntry.Values {
-						claims.Roles = append(claims.Roles, attrEntryElement.Value)
-					}
-					continue
-				}
+		claims.ExpiresAt = now.Add(time.Duration(900) * time.Second).Unix()
+		claims.IssuedAt = now.Unix()
+		claims.AuthTime = now.Unix()
+
+		// The profile is selected by the issuer of the assertion, which is
+		// covered by the signature, unlike the Issuer of the response.
+		az.mapIssuerAttributes(&claims, samlAssertions.Issuer.Value, samlAssertions.AttributeStatements)
+		az.setUserID(&claims, samlAssertions)
+		az.setSubject(&claims, samlAssertions)
+		setAuthnContext(&claims, samlAssertions)
+		az.setSessionIndex(&claims, samlAssertions)
+
+		if len(az.ClaimEnrichers) > 0 {
+			assertionCtx := &AssertionContext{
+				Assertion:       samlAssertions,
+				RawResponse:     samlpRespRaw,
+				ServiceProvider: sp,
+			}
+			if err := az.enrichClaims(assertionCtx, &claims); err != nil {
+				return nil, "", fmt.Errorf("The Azure AD authorization failed: %s", err)
 			}
 		}
 
+		claims.Roles = dedupeRoles(claims.Roles)
+		if err := az.limitRoles(&claims); err != nil {
+			return nil, "", fmt.Errorf("The Azure AD authorization failed: %s", err)
+		}
+		az.Jwt.applyRemember(&claims, az.Jwt.isRememberRequested(r))
+
+		az.deriveName(&claims)
 		if claims.Email == "" || claims.Name == "" {
 			return nil, "", fmt.Errorf("The Azure AD authorization failed, mandatory attributes not found: %v", claims)
 		}
@@ -128,17 +485,13 @@ func (az *AzureIdp) Authenticate(r *http.Request) (*caddyauth.User, string, erro
 			claims.Issuer = az.Jwt.TokenIssuer
 		}
 
-		user := &caddyauth.User{
-			ID: claims.Email,
-			Metadata: map[string]string{
-				"name":  claims.Name,
-				"email": claims.Email,
-				"roles": strings.Join(claims.Roles, " "),
-			},
+		if err := az.Jwt.startSession(&claims); err != nil {
+			return nil, "", fmt.Errorf("Failed to start session for %s: %s", claims.Email, err)
 		}
 
-		token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
-		validToken, err := token.SignedString([]byte(az.Jwt.TokenSecret))
+		user := claims.newUser()
+
+		validToken, err := az.Jwt.signToken(claims)
 		if err != nil {
 			return nil, "", fmt.Errorf("Failed to issue JWT token with %v claims: %s", claims, err)
 		}
@@ -147,13 +500,390 @@ func (az *AzureIdp) Authenticate(r *http.Request) (*caddyauth.User, string, erro
 	return nil, "", fmt.Errorf("The Azure AD validation failures: %s", strings.Join(spErrors, ", "))
 }
 
+// defaultAzureLoginButton is the default appearance of the Azure AD login
+// button.
+var defaultAzureLoginButton = LoginButton{
+	Title: "Office 365",
+	Icon:  "fab fa-windows",
+	Style: "btn-primary",
+}
+
+// isEnabled returns true unless the provider is disabled.
+func (az *AzureIdp) isEnabled() bool {
+	return az.Enabled == nil || *az.Enabled
+}
+
+// getProviderName returns the name of the Azure AD provider.
+func (az *AzureIdp) getProviderName() string {
+	return "azure"
+}
+
+// getPriority returns the precedence of the Azure AD provider.
+func (az *AzureIdp) getPriority() int {
+	return az.Priority
+}
+
+// matchesSAMLResponse returns true when the request comes from the Azure
+// AD login pages, or is a programmatic client posting a SAML Response.
+func (az *AzureIdp) matchesSAMLResponse(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Origin"), "login.microsoftonline.com") ||
+		strings.Contains(r.Header.Get("Referer"), "windowsazure.com") ||
+		(acceptsJSON(r) && r.FormValue("SAMLResponse") != "")
+}
+
+// getUserInterfaceLink returns the link to Azure AD authentication portal.
+func (az *AzureIdp) getUserInterfaceLink() userInterfaceLink {
+	return newUserInterfaceLink(az.LoginURL, az.LoginButton, defaultAzureLoginButton)
+}
+
+// selectServiceProviders returns the service providers validating a SAML
+// Response with the Destination. The service providers are the ones
+// matching the URL the response was delivered to. When the Destination
+// is present, the service providers whose ACS URL is the Destination
+// verbatim take precedence over the ones with an equivalent ACS URL,
+// e.g. with an explicit default port. When the Destination is absent,
+// the service providers are returned as is.
+func selectServiceProviders(serviceProviders []*samllib.ServiceProvider, destination string) []*samllib.ServiceProvider {
+	if destination == "" {
+		return serviceProviders
+	}
+	for _, sp := range serviceProviders {
+		if sp.AcsURL.String() == destination {
+			return []*samllib.ServiceProvider{sp}
+		}
+	}
+	destinationURL, err := url.Parse(destination)
+	if err != nil {
+		return serviceProviders
+	}
+	selected := []*samllib.ServiceProvider{}
+	for _, sp := range serviceProviders {
+		if isSameEndpoint(&sp.AcsURL, destinationURL) {
+			selected = append(selected, sp)
+		}
+	}
+	return selected
+}
+
+// validateInResponseTo checks whether the SAML Response is allowed with
+// respect to IdP-initiated logins. The unsolicited responses, i.e. the
+// ones with empty InResponseTo, are allowed only when IdP-initiated logins
+// are. The solicited responses must be in response to one of the pending
+// authentication requests. A response in response to an unknown request
+// is rejected, even when IdP-initiated logins are allowed, because it is
+// either replayed or forged.
+func (az *AzureIdp) validateInResponseTo(resp *samlResponse) error {
+	if resp.InResponseTo == "" {
+		if !*az.AllowIdpInitiated {
+			return fmt.Errorf("IdP-initiated login is disabled, the SAML Response is not in response to an authentication request")
+		}
+		return nil
+	}
+	if !az.requestTracker.has(resp.InResponseTo) {
+		// The error is shown to the user, hence the unsigned InResponseTo
+		// is logged only.
+		az.logger.Warn(
+			"SAML Response is in response to unknown or expired authentication request",
+			zap.String("in_response_to", resp.InResponseTo),
+		)
+		return fmt.Errorf("the SAML Response is in response to an unknown or expired authentication request")
+	}
+	return nil
+}
+
+// logSignatureAlgorithms logs the signature and digest algorithms of the
+// accepted SAML Response, along with the enforced minimum hash function.
+func (az *AzureIdp) logSignatureAlgorithms(resp *samlResponse, assertion *samllib.Assertion) {
+	if !az.LogSignatureAlgorithms {
+		return
+	}
+	signatureAlgorithms, digestAlgorithms := resp.getSignatureAlgorithms()
+	az.logger.Info(
+		"accepted SAML Response signature algorithms",
+		zap.String("response_id", resp.ID),
+		zap.String("assertion_id", assertion.ID),
+		zap.Strings("signature_algorithms", signatureAlgorithms),
+		zap.Strings("digest_algorithms", digestAlgorithms),
+		zap.Strings("hash_algorithms", getHashAlgorithms(signatureAlgorithms, digestAlgorithms)),
+		zap.String("minimum_signature_algorithm", az.MinimumSignatureAlgorithm),
+	)
+}
+
+// defaultNameIDFormats are the NameID formats accepted by default.
+var defaultNameIDFormats = []string{
+	string(samllib.UnspecifiedNameIDFormat),
+	string(samllib.EmailAddressNameIDFormat),
+	string(samllib.PersistentNameIDFormat),
+	string(samllib.TransientNameIDFormat),
+}
+
+// validateNameID checks that the NameID of the assertion's subject is in
+// one of the accepted formats and that the persistent NameID, when scoped
+// by SPNameQualifier, is scoped to the EntityID.
+func (az *AzureIdp) validateNameID(assertion *samllib.Assertion) error {
+	if assertion.Subject == nil || assertion.Subject.NameID == nil {
+		return nil
+	}
+	nameID := assertion.Subject.NameID
+	nameIDFormat := nameID.Format
+	if nameIDFormat == "" {
+		// The omitted format is the same as unspecified.
+		nameIDFormat = string(samllib.UnspecifiedNameIDFormat)
+	}
+	accepted := false
+	for _, format := range az.AcceptedNameIDFormats {
+		if format == nameIDFormat {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		return fmt.Errorf("NameID format %s is not accepted", nameIDFormat)
+	}
+
+	if nameIDFormat != string(samllib.PersistentNameIDFormat) {
+		return nil
+	}
+	if nameID.SPNameQualifier == "" || az.EntityID == "" {
+		return nil
+	}
+	if nameID.SPNameQualifier == az.EntityID {
+		return nil
+	}
+	if az.AllowSpNameQualifierMismatch {
+		az.logger.Warn(
+			"persistent NameID SPNameQualifier does not match Entity ID",
+			zap.String("sp_name_qualifier", nameID.SPNameQualifier),
+			zap.String("entity_id", az.EntityID),
+		)
+		return nil
+	}
+	return fmt.Errorf("persistent NameID SPNameQualifier %s does not match Entity ID %s", nameID.SPNameQualifier, az.EntityID)
+}
+
+// getInstanceKey returns the key identifying the provider, i.e. the
+// tenant, the Entity ID, and the ACS URLs, in the state pool.
+func (az *AzureIdp) getInstanceKey() string {
+	return fmt.Sprintf("azure/%s/%s/%s", az.TenantID, az.EntityID, strings.Join(az.AssertionConsumerServiceURLs.split(), ","))
+}
+
 // Validate performs configuration validation
 func (az *AzureIdp) Validate() error {
+	az.AssertionConsumerServiceURLs = az.AssertionConsumerServiceURLs.split()
 	if len(az.AssertionConsumerServiceURLs) == 0 {
-		return fmt.Errorf("ACS URLs are missing")
+		return newConfigError("azure.acs_urls", "ACS URLs are missing")
+	}
+	for i, acsURL := range az.AssertionConsumerServiceURLs {
+		u, err := url.Parse(acsURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return newConfigError(fmt.Sprintf("azure.acs_urls[%d]", i), "ACS URL %s is not an absolute HTTP(S) URL", acsURL)
+		}
+	}
+	if az.DefaultAcsIndex != nil {
+		if *az.DefaultAcsIndex < 0 || *az.DefaultAcsIndex >= len(az.AssertionConsumerServiceURLs) {
+			return newConfigError("azure.default_acs_index", "Azure AD default_acs_index %d does not correspond to any of %d ACS URLs",
+				*az.DefaultAcsIndex, len(az.AssertionConsumerServiceURLs),
+			)
+		}
+		az.logger.Info(
+			"validating Azure AD default ACS index",
+			zap.Int("default_acs_index", *az.DefaultAcsIndex),
+			zap.String("acs_url", az.AssertionConsumerServiceURLs[*az.DefaultAcsIndex]),
+		)
 	}
 	if az.TenantID == "" {
-		return fmt.Errorf("Azure AD Tenant ID not found")
+		return newConfigError("azure.tenant_id", "Azure AD Tenant ID not found")
+	}
+
+	if az.AllowIdpInitiated == nil {
+		allowIdpInitiated := true
+		az.AllowIdpInitiated = &allowIdpInitiated
+	}
+	if !*az.AllowIdpInitiated {
+		az.logger.Info("IdP-initiated login is disabled")
+	}
+	if az.RequireSignedAssertion == nil {
+		requireSignedAssertion := true
+		az.RequireSignedAssertion = &requireSignedAssertion
+	}
+	if !*az.RequireSignedAssertion {
+		az.logger.Warn("signed assertions are not required, the response signature suffices")
+	}
+	// The pending requests survive config reloads.
+	requestTrackerKey := "authn_requests/" + az.getInstanceKey()
+	requestTracker, err := loadPooledState(requestTrackerKey, func() (interface{}, error) {
+		return newAuthnRequestTracker(defaultAuthnRequestLifetime), nil
+	})
+	if err != nil {
+		return err
+	}
+	az.requestTracker = requestTracker.(*authnRequestTracker)
+	az.poolKeys = append(az.poolKeys, requestTrackerKey)
+	// The consumed one-time-use assertions survive config reloads.
+	assertionCacheKey := "consumed_assertions/" + az.getInstanceKey()
+	consumedAssertions, err := loadPooledState(assertionCacheKey, func() (interface{}, error) {
+		return newAssertionCache(), nil
+	})
+	if err != nil {
+		return err
+	}
+	az.assertionCache = consumedAssertions.(*assertionCache)
+	az.poolKeys = append(az.poolKeys, assertionCacheKey)
+
+	if az.Profile == "" {
+		az.Profile = defaultAttributeProfile
+	}
+	profile, exists := az.newAttributeProfile(az.Profile)
+	if !exists {
+		return newConfigError("azure.profile", "Azure AD profile %s is not supported, supported: %s",
+			az.Profile, strings.Join(getAttributeProfileNames(), ", "),
+		)
+	}
+	for i, source := range az.EmailSources {
+		if strings.TrimSpace(source) == "" {
+			return newConfigError(fmt.Sprintf("azure.email_sources[%d]", i), "Azure AD email_sources must not contain empty names")
+		}
+	}
+	for i, source := range az.OriginSources {
+		if strings.TrimSpace(source) == "" {
+			return newConfigError(fmt.Sprintf("azure.origin_sources[%d]", i), "Azure AD origin_sources must not contain empty names")
+		}
+	}
+	az.attributeProfile = profile
+	az.issuerProfiles = make(map[string]*attributeProfile)
+	for issuer, name := range az.IssuerProfiles {
+		if strings.TrimSpace(issuer) == "" {
+			return newConfigError("azure.issuer_profiles", "Azure AD issuer_profiles has an empty issuer")
+		}
+		profile, exists := az.newAttributeProfile(name)
+		if !exists {
+			return newConfigError("azure.issuer_profiles."+issuer, "Azure AD issuer_profiles profile %s is not supported, supported: %s",
+				name, strings.Join(getAttributeProfileNames(), ", "),
+			)
+		}
+		az.issuerProfiles[strings.TrimSpace(issuer)] = profile
+	}
+
+	if az.MinimumSignatureAlgorithm == "" {
+		az.MinimumSignatureAlgorithm = "sha256"
+	}
+	if _, exists := hashAlgorithmStrength[az.MinimumSignatureAlgorithm]; !exists {
+		return newConfigError("azure.minimum_signature_algorithm", "Azure AD minimum_signature_algorithm %s is not supported, supported: %s",
+			az.MinimumSignatureAlgorithm, strings.Join(getSupportedHashAlgorithms(), ", "),
+		)
+	}
+
+	if err := az.validateSubjectSource(); err != nil {
+		return err
+	}
+	if err := az.validateUserIDAttribute(); err != nil {
+		return err
+	}
+
+	switch az.MultipleAssertions {
+	case "":
+		az.MultipleAssertions = multipleAssertionsReject
+	case multipleAssertionsReject, multipleAssertionsSigned, multipleAssertionsMerge:
+	default:
+		return newConfigError("azure.multiple_assertions", "Azure AD multiple_assertions %s is not supported", az.MultipleAssertions)
+	}
+
+	switch az.DuplicateAttributes {
+	case "":
+		az.DuplicateAttributes = duplicateAttributesCollect
+	case duplicateAttributesCollect, duplicateAttributesFirst, duplicateAttributesLast:
+	default:
+		return newConfigError("azure.duplicate_attributes", "Azure AD duplicate_attributes %s is not supported", az.DuplicateAttributes)
+	}
+
+	if az.MaxRoles < 0 {
+		return newConfigError("azure.max_roles", "Azure AD max_roles must not be negative, got %d", az.MaxRoles)
+	}
+	switch az.MaxRolesPolicy {
+	case "":
+		az.MaxRolesPolicy = maxRolesTruncate
+	case maxRolesTruncate, maxRolesFail:
+	default:
+		return newConfigError("azure.max_roles_policy", "Azure AD max_roles_policy %s is not supported", az.MaxRolesPolicy)
+	}
+
+	switch az.SignCertMismatch {
+	case "":
+		az.SignCertMismatch = signCertMismatchWarn
+	case signCertMismatchWarn, signCertMismatchError:
+	default:
+		return newConfigError("azure.sign_cert_mismatch", "Azure AD sign_cert_mismatch %s is not supported", az.SignCertMismatch)
+	}
+
+	switch az.OnUnknownAttribute {
+	case "":
+		az.OnUnknownAttribute = unknownAttributeIgnore
+	case unknownAttributeIgnore, unknownAttributeLog, unknownAttributePassthrough:
+	default:
+		return newConfigError("azure.on_unknown_attribute", "Azure AD on_unknown_attribute %s is not supported", az.OnUnknownAttribute)
+	}
+
+	if err := az.validateAttributeNormalizations(); err != nil {
+		return err
+	}
+	if err := az.validateAttributeFilters(); err != nil {
+		return err
+	}
+	if err := az.validateComplexAttributes(); err != nil {
+		return err
+	}
+
+	if len(az.AcceptedNameIDFormats) == 0 {
+		az.AcceptedNameIDFormats = defaultNameIDFormats
+	}
+	for _, format := range az.AcceptedNameIDFormats {
+		if format == "" {
+			return newConfigError("azure.accepted_nameid_formats", "Azure AD accepted_nameid_formats has an empty entry")
+		}
+	}
+	az.logger.Info(
+		"validating Azure AD accepted NameID formats",
+		zap.Strings("accepted_nameid_formats", az.AcceptedNameIDFormats),
+	)
+
+	if az.ResponseParseTimeout == 0 {
+		az.ResponseParseTimeout = defaultResponseParseTimeout
+	}
+	if az.MaxReplayWindow < 0 {
+		return newConfigError("azure.max_replay_window", "Azure AD max_replay_window must not be negative, got %d", az.MaxReplayWindow)
+	}
+	if az.ResponseParseTimeout < 0 {
+		return newConfigError("azure.response_parse_timeout", "Azure AD response_parse_timeout must be positive, got %d", az.ResponseParseTimeout)
+	}
+
+	if az.MinSessionDuration == 0 {
+		az.MinSessionDuration = defaultMinSessionDuration
+	}
+	if az.MaxSessionDuration == 0 {
+		az.MaxSessionDuration = defaultMaxSessionDuration
+	}
+	if az.MinSessionDuration < 0 {
+		return newConfigError("azure.min_session_duration", "Azure AD min_session_duration must be positive, got %d", az.MinSessionDuration)
+	}
+	if az.MaxSessionDuration < az.MinSessionDuration {
+		return newConfigError("azure.max_session_duration", "Azure AD max_session_duration %d is less than min_session_duration %d",
+			az.MaxSessionDuration, az.MinSessionDuration,
+		)
+	}
+
+	if err := az.validateClaimEnrichers(); err != nil {
+		return err
+	}
+
+	if az.AllowSpNameQualifierMismatch {
+		az.logger.Warn("validation of persistent NameID SPNameQualifier is relaxed")
+	}
+
+	if az.LogAttributes {
+		az.logger.Warn(
+			"logging of SAML attributes is enabled",
+			zap.Strings("sensitive_attributes", az.SensitiveAttributes),
+		)
 	}
 
 	az.logger.Info(
@@ -162,7 +892,7 @@ func (az *AzureIdp) Validate() error {
 	)
 
 	if az.ApplicationID == "" {
-		return fmt.Errorf("Azure AD Application ID not found")
+		return newConfigError("azure.application_id", "Azure AD Application ID not found")
 	}
 
 	az.logger.Info(
@@ -171,7 +901,7 @@ func (az *AzureIdp) Validate() error {
 	)
 
 	if az.ApplicationName == "" {
-		return fmt.Errorf("Azure AD Application Name not found")
+		return newConfigError("azure.application_name", "Azure AD Application Name not found")
 	}
 
 	az.logger.Info(
@@ -190,19 +920,20 @@ func (az *AzureIdp) Validate() error {
 		"validating Azure AD IdP Metadata Location",
 		zap.String("idp_metadata_location", az.IdpMetadataLocation),
 	)
-
-	if az.IdpSignCertLocation == "" {
-		return fmt.Errorf("Azure AD IdP Signing Certificate not found")
+	if az.IdpEntityID != "" {
+		az.logger.Info(
+			"validating Azure AD IdP Entity ID",
+			zap.String("idp_entity_id", az.IdpEntityID),
+		)
 	}
-
-	az.logger.Info(
-		"validating Azure AD IdP Signing Certificate",
-		zap.String("idp_signing_cert", az.IdpSignCertLocation),
-	)
-
-	idpSignCert, err := readCertFile(az.IdpSignCertLocation)
-	if err != nil {
-		return err
+	if az.ExpectedIssuer != "" {
+		az.logger.Info(
+			"validating Azure AD expected issuer",
+			zap.String("expected_issuer", az.ExpectedIssuer),
+		)
+	}
+	if az.AllowIssuerMismatch {
+		az.logger.Warn("SAML Response and assertion issuer mismatches are allowed")
 	}
 
 	az.LoginURL = fmt.Sprintf(
@@ -215,41 +946,106 @@ func (az *AzureIdp) Validate() error {
 		zap.String("login_url", az.LoginURL),
 	)
 
+	if az.MetadataMinTLSVersion == "" {
+		az.MetadataMinTLSVersion = defaultMetadataMinTLSVersion
+	}
+	minTLSVersion, err := getTLSVersion(az.MetadataMinTLSVersion)
+	if err != nil {
+		return newConfigError("azure.metadata_min_tls_version", "Azure AD metadata_min_tls_version %s", err)
+	}
+	cipherSuites, err := getCipherSuites(az.MetadataCipherSuites)
+	if err != nil {
+		return newConfigError("azure.metadata_cipher_suites", "Azure AD metadata_cipher_suites %s", err)
+	}
+	az.metadataClient = newMetadataClient(minTLSVersion, cipherSuites)
+
 	azureOptions := samlsp.Options{}
+	idpMetadata, err := az.loadIdpMetadata()
+	metrics.recordMetadataRefresh(az.IdpMetadataLocation, err)
+	if err != nil {
+		return wrapConfigError("azure.idp_metadata_location", err)
+	}
+	if az.IdpMetadataURL != nil {
+		azureOptions.URL = *az.IdpMetadataURL
+	}
+	azureOptions.IDPMetadata = idpMetadata
 
-	if strings.HasPrefix(az.IdpMetadataLocation, "http") {
-		idpMetadataURL, err := url.Parse(az.IdpMetadataLocation)
-		if err != nil {
-			return err
-		}
-		az.IdpMetadataURL = idpMetadataURL
-		azureOptions.URL = *idpMetadataURL
-		idpMetadata, err := samlsp.FetchMetadata(
-			context.Background(),
-			http.DefaultClient,
-			*idpMetadataURL,
-		)
-		if err != nil {
-			return err
+	// The signing certificate is optional when IdP metadata has one.
+	if az.IdpSignCertPEM != "" || az.IdpSignCertLocation != "" {
+		var idpSignCert string
+		idpSignCertPath := "azure.idp_sign_cert_location"
+		if az.IdpSignCertPEM != "" {
+			idpSignCertPath = "azure.idp_sign_cert_pem"
+			az.logger.Info("validating inline Azure AD IdP Signing Certificate")
+			idpSignCert, err = readCertPEM(az.IdpSignCertPEM)
+			if err != nil {
+				return newConfigError("azure.idp_sign_cert_pem", "Azure AD idp_sign_cert_pem is invalid: %s", err)
+			}
+		} else {
+			az.logger.Info(
+				"validating Azure AD IdP Signing Certificate",
+				zap.String("idp_signing_cert", az.IdpSignCertLocation),
+			)
+			idpSignCert, err = readCertFile(az.IdpSignCertLocation)
+			if err != nil {
+				return wrapConfigError("azure.idp_sign_cert_location", err)
+			}
 		}
-		azureOptions.IDPMetadata = idpMetadata
-
-	} else {
-		metadataFileContent, err := ioutil.ReadFile(az.IdpMetadataLocation)
-		if err != nil {
-			return err
+		if len(idpMetadata.IDPSSODescriptors) == 0 {
+			return newConfigError("azure.idp_metadata_location", "Azure AD IdP Metadata has no IdP SSO descriptors")
 		}
-		idpMetadata, err := samlsp.ParseMetadata(metadataFileContent)
-		if err != nil {
-			return err
+		if err := validateSignCertInMetadata(idpSignCert, getIdpSigningCerts(idpMetadata)); err != nil {
+			if az.SignCertMismatch == signCertMismatchError {
+				return newConfigError(idpSignCertPath, "Azure AD %s", err)
+			}
+			az.logger.Warn(
+				"Azure AD IdP Signing Certificate mismatch",
+				zap.String("error", err.Error()),
+			)
+		}
+		idpSSODescriptor := &idpMetadata.IDPSSODescriptors[0]
+		keyDescriptor := &samlutils.KeyDescriptor{
+			Use: "signing",
+			KeyInfo: samlutils.KeyInfo{
+				XMLName: xml.Name{
+					Space: "http://www.w3.org/2000/09/xmldsig#",
+					Local: "KeyInfo",
+				},
+				Certificate: idpSignCert,
+			},
 		}
-		azureOptions.IDPMetadata = idpMetadata
+		idpSSODescriptor.KeyDescriptors = append(idpSSODescriptor.KeyDescriptors, *keyDescriptor)
+	} else {
+		if len(getIdpSigningCerts(idpMetadata)) == 0 {
+			return newConfigError("azure.idp_sign_cert_location", "Azure AD IdP Signing Certificate not found in either idp_sign_cert_location or IdP metadata")
+		}
+		az.logger.Info("using Azure AD IdP Signing Certificates from IdP metadata")
+	}
+	if err := metrics.recordCertExpiry(az, az.IdpMetadataLocation, getIdpSigningCerts(idpMetadata)); err != nil {
+		az.logger.Warn(
+			"failed recording Azure AD IdP Signing Certificate expiry",
+			zap.String("error", err.Error()),
+		)
+	}
+
+	if err := az.loadServiceProviderKeys(); err != nil {
+		return err
+	}
+	if az.spSigningCert != nil {
+		az.logger.Info(
+			"validating Azure AD SP key pairs",
+			zap.String("sp_cert_location", az.SpCertLocation),
+			zap.String("sp_encryption_cert_location", az.SpEncryptionCertLocation),
+		)
 	}
 
 	for _, acsURL := range az.AssertionConsumerServiceURLs {
 
 		sp := samlsp.DefaultServiceProvider(azureOptions)
-		sp.AllowIDPInitiated = true
+		sp.AllowIDPInitiated = *az.AllowIdpInitiated
+		// The key of the service provider decrypts the assertions.
+		sp.Key = az.spEncryptionKey
+		sp.Certificate = az.spEncryptionCert
 		//sp.EntityID = sp.IDPMetadata.EntityID
 
 		cfgAcsURL, _ := url.Parse(acsURL)
@@ -262,22 +1058,6 @@ func (az *AzureIdp) Validate() error {
 			sp.MetadataURL = *az.IdpMetadataURL
 		}
 
-		for i := range sp.IDPMetadata.IDPSSODescriptors {
-			idpSSODescriptor := &sp.IDPMetadata.IDPSSODescriptors[i]
-			keyDescriptor := &samlutils.KeyDescriptor{
-				Use: "signing",
-				KeyInfo: samlutils.KeyInfo{
-					XMLName: xml.Name{
-						Space: "http://www.w3.org/2000/09/xmldsig#",
-						Local: "KeyInfo",
-					},
-					Certificate: idpSignCert,
-				},
-			}
-			idpSSODescriptor.KeyDescriptors = append(idpSSODescriptor.KeyDescriptors, *keyDescriptor)
-			break
-		}
-
 		az.ServiceProviders = append(az.ServiceProviders, &sp)
 	}
 	return nil
@@ -0,0 +1,1774 @@
+package saml
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	samllib "github.com/crewjam/saml"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleUnknownAttribute(t *testing.T) {
+	attr := samllib.Attribute{
+		Name: "http://schemas.example.com/claims/department",
+		Values: []samllib.AttributeValue{
+			{Value: "Engineering"},
+		},
+	}
+
+	for _, mode := range []string{unknownAttributeIgnore, unknownAttributeLog, unknownAttributePassthrough} {
+		core, logs := observer.New(zap.DebugLevel)
+		az := &AzureIdp{
+			OnUnknownAttribute: mode,
+			logger:             zap.New(core),
+		}
+		claims := UserClaims{}
+		az.handleUnknownAttribute(&claims, attr)
+
+		switch mode {
+		case unknownAttributeIgnore:
+			if logs.Len() != 0 || claims.Custom != nil {
+				t.Fatalf("%s: expected attribute to be dropped", mode)
+			}
+		case unknownAttributeLog:
+			if logs.FilterMessage("found unknown SAML attribute").Len() != 1 {
+				t.Fatalf("%s: expected attribute to be logged", mode)
+			}
+			if claims.Custom != nil {
+				t.Fatalf("%s: expected no custom claims, got %v", mode, claims.Custom)
+			}
+		case unknownAttributePassthrough:
+			if v, exists := claims.Custom[attr.Name]; !exists || v != "Engineering" {
+				t.Fatalf("%s: expected attribute in custom claims, got %v", mode, claims.Custom)
+			}
+		}
+	}
+}
+
+func TestEduAttributeProfile(t *testing.T) {
+	az := &AzureIdp{
+		attributeProfile:   attributeProfiles["edu"],
+		OnUnknownAttribute: unknownAttributeIgnore,
+		logger:             zap.NewNop(),
+	}
+	attrStatements := []samllib.AttributeStatement{
+		{
+			Attributes: []samllib.Attribute{
+				{
+					FriendlyName: "eduPersonPrincipalName",
+					Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.6",
+					NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
+					Values:       []samllib.AttributeValue{{Value: "jsmith@university.edu"}},
+				},
+				{
+					FriendlyName: "displayName",
+					Name:         "urn:oid:2.16.840.1.113730.3.1.241",
+					NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
+					Values:       []samllib.AttributeValue{{Value: "John Smith"}},
+				},
+				{
+					FriendlyName: "eduPersonAffiliation",
+					Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.1",
+					NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
+					Values: []samllib.AttributeValue{
+						{Value: "member"},
+						{Value: "faculty"},
+					},
+				},
+			},
+		},
+	}
+	claims := UserClaims{}
+	az.mapAttributes(&claims, attrStatements)
+
+	if claims.Subject != "jsmith@university.edu" {
+		t.Errorf("unexpected subject: %s", claims.Subject)
+	}
+	if claims.Email != "jsmith@university.edu" {
+		t.Errorf("unexpected email: %s", claims.Email)
+	}
+	if claims.Name != "John Smith" {
+		t.Errorf("unexpected name: %s", claims.Name)
+	}
+	if len(claims.Roles) != 2 || claims.Roles[0] != "member" || claims.Roles[1] != "faculty" {
+		t.Errorf("unexpected roles: %v", claims.Roles)
+	}
+}
+
+func TestDedupeRoles(t *testing.T) {
+	az := &AzureIdp{
+		attributeProfile:   attributeProfiles["azure"],
+		OnUnknownAttribute: unknownAttributeIgnore,
+		logger:             zap.NewNop(),
+	}
+	attrStatements := []samllib.AttributeStatement{
+		{
+			Attributes: []samllib.Attribute{
+				{
+					Name: "http://schemas.microsoft.com/ws/2008/06/identity/claims/Attributes/Role",
+					Values: []samllib.AttributeValue{
+						{Value: "AzureAD_Editor"},
+						{Value: "AzureAD_Viewer"},
+						{Value: "AzureAD_Editor"},
+					},
+				},
+			},
+		},
+	}
+	claims := UserClaims{Roles: []string{"AzureAD_Viewer"}}
+	az.mapAttributes(&claims, attrStatements)
+	claims.Roles = dedupeRoles(claims.Roles)
+
+	expected := []string{"AzureAD_Viewer", "AzureAD_Editor"}
+	if len(claims.Roles) != len(expected) {
+		t.Fatalf("unexpected roles: %v", claims.Roles)
+	}
+	for i, role := range expected {
+		if claims.Roles[i] != role {
+			t.Fatalf("unexpected roles: %v, expected: %v", claims.Roles, expected)
+		}
+	}
+}
+
+func TestMaxRoles(t *testing.T) {
+	roles := []string{"AzureAD_Admin", "AzureAD_Editor", "AzureAD_Viewer", "AzureAD_Guest"}
+	for _, test := range []struct {
+		policy    string
+		maxRoles  int
+		shouldErr bool
+		expected  []string
+	}{
+		{policy: maxRolesTruncate, maxRoles: 0, expected: roles},
+		{policy: maxRolesTruncate, maxRoles: 4, expected: roles},
+		{policy: maxRolesTruncate, maxRoles: 2, expected: []string{"AzureAD_Admin", "AzureAD_Editor"}},
+		{policy: maxRolesFail, maxRoles: 4, expected: roles},
+		{policy: maxRolesFail, maxRoles: 2, shouldErr: true},
+	} {
+		az := &AzureIdp{
+			MaxRoles:       test.maxRoles,
+			MaxRolesPolicy: test.policy,
+			logger:         zap.NewNop(),
+		}
+		claims := UserClaims{Email: "jsmith@contoso.com", Roles: append([]string{}, roles...)}
+		err := az.limitRoles(&claims)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("%s/%d: expected failure, got roles %v", test.policy, test.maxRoles, claims.Roles)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s/%d: unexpected failure: %s", test.policy, test.maxRoles, err)
+			continue
+		}
+		if strings.Join(claims.Roles, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s/%d: unexpected roles: %v, expected: %v", test.policy, test.maxRoles, claims.Roles, test.expected)
+		}
+	}
+}
+
+func TestDuplicateAttributes(t *testing.T) {
+	newStatement := func(name, role, department string) samllib.AttributeStatement {
+		return samllib.AttributeStatement{
+			Attributes: []samllib.Attribute{
+				{
+					Name:   "http://schemas.microsoft.com/identity/claims/displayname",
+					Values: []samllib.AttributeValue{{Value: name}},
+				},
+				{
+					Name:   "http://schemas.microsoft.com/ws/2008/06/identity/claims/Attributes/Role",
+					Values: []samllib.AttributeValue{{Value: role}},
+				},
+				{
+					Name:   "department",
+					Values: []samllib.AttributeValue{{Value: department}},
+				},
+			},
+		}
+	}
+	attrStatements := []samllib.AttributeStatement{
+		newStatement("John Smith", "AzureAD_Editor", "Sales"),
+		newStatement("Smith, John", "AzureAD_Viewer", "Marketing"),
+	}
+	for _, test := range []struct {
+		policy     string
+		name       string
+		roles      []string
+		department interface{}
+	}{
+		{
+			policy:     "",
+			name:       "Smith, John",
+			roles:      []string{"AzureAD_Editor", "AzureAD_Viewer"},
+			department: []string{"Sales", "Marketing"},
+		},
+		{
+			policy:     duplicateAttributesCollect,
+			name:       "Smith, John",
+			roles:      []string{"AzureAD_Editor", "AzureAD_Viewer"},
+			department: []string{"Sales", "Marketing"},
+		},
+		{
+			policy:     duplicateAttributesFirst,
+			name:       "John Smith",
+			roles:      []string{"AzureAD_Editor"},
+			department: "Sales",
+		},
+		{
+			policy:     duplicateAttributesLast,
+			name:       "Smith, John",
+			roles:      []string{"AzureAD_Viewer"},
+			department: "Marketing",
+		},
+	} {
+		az := &AzureIdp{
+			attributeProfile:    attributeProfiles["azure"],
+			OnUnknownAttribute:  unknownAttributePassthrough,
+			DuplicateAttributes: test.policy,
+			logger:              zap.NewNop(),
+		}
+		claims := UserClaims{}
+		az.mapAttributes(&claims, attrStatements)
+		if claims.Name != test.name {
+			t.Errorf("%s: unexpected name: %q, expected: %q", test.policy, claims.Name, test.name)
+		}
+		if strings.Join(claims.Roles, ",") != strings.Join(test.roles, ",") {
+			t.Errorf("%s: unexpected roles: %v, expected: %v", test.policy, claims.Roles, test.roles)
+		}
+		if fmt.Sprint(claims.Custom["department"]) != fmt.Sprint(test.department) {
+			t.Errorf("%s: unexpected department: %v, expected: %v", test.policy, claims.Custom["department"], test.department)
+		}
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	attrStatements := []samllib.AttributeStatement{
+		{
+			Attributes: []samllib.Attribute{
+				{
+					Name:   "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+					Values: []samllib.AttributeValue{{Value: " JSmith@Contoso.com "}},
+				},
+			},
+		},
+	}
+	for _, test := range []struct {
+		normalizeEmail bool
+		expected       string
+	}{
+		{normalizeEmail: false, expected: " JSmith@Contoso.com "},
+		{normalizeEmail: true, expected: "jsmith@contoso.com"},
+	} {
+		az := &AzureIdp{
+			attributeProfile:   attributeProfiles["azure"],
+			OnUnknownAttribute: unknownAttributeIgnore,
+			NormalizeEmail:     test.normalizeEmail,
+			logger:             zap.NewNop(),
+		}
+		claims := UserClaims{}
+		az.mapAttributes(&claims, attrStatements)
+		if claims.Email != test.expected {
+			t.Fatalf("normalize_email=%t: unexpected email: %q", test.normalizeEmail, claims.Email)
+		}
+		if user := claims.newUser(); user.ID != test.expected {
+			t.Fatalf("normalize_email=%t: unexpected user ID: %q", test.normalizeEmail, user.ID)
+		}
+	}
+}
+
+func TestSessionDuration(t *testing.T) {
+	az := &AzureIdp{
+		attributeProfile:   attributeProfiles["azure"],
+		OnUnknownAttribute: unknownAttributeIgnore,
+		MinSessionDuration: defaultMinSessionDuration,
+		MaxSessionDuration: defaultMaxSessionDuration,
+		logger:             zap.NewNop(),
+	}
+	for _, test := range []struct {
+		name     string
+		value    string
+		expected int64
+	}{
+		{name: "duration within range", value: "3600", expected: 3600},
+		{name: "absurdly large duration", value: "999999999999", expected: defaultMaxSessionDuration},
+		{name: "overflowing duration", value: "99999999999999999999999"},
+		{name: "short duration", value: "5", expected: defaultMinSessionDuration},
+		{name: "negative duration", value: "-3600"},
+		{name: "zero duration", value: "0"},
+		{name: "malformed duration", value: "1h"},
+	} {
+		attrStatements := []samllib.AttributeStatement{
+			{
+				Attributes: []samllib.Attribute{
+					{
+						Name:   "http://claims.contoso.com/SAML/Attributes/MaxSessionDuration",
+						Values: []samllib.AttributeValue{{Value: test.value}},
+					},
+				},
+			},
+		}
+		claims := UserClaims{}
+		now := time.Now().Unix()
+		az.mapAttributes(&claims, attrStatements)
+		if test.expected == 0 {
+			if claims.ExpiresAt != 0 {
+				t.Errorf("%s: session duration %s was not ignored: %d", test.name, test.value, claims.ExpiresAt-now)
+			}
+			continue
+		}
+		if duration := claims.ExpiresAt - now; duration < test.expected || duration > test.expected+1 {
+			t.Errorf("%s: unexpected session duration %d, expected %d", test.name, duration, test.expected)
+		}
+	}
+}
+
+func TestSessionDurationAttribute(t *testing.T) {
+	az := &AzureIdp{
+		IdpMetadataLocation:      "assets/idp/azure_ad_app_metadata.xml",
+		TenantID:                 "1b9e886b-8ff2-4378-b6c8-6771259a5f51",
+		ApplicationID:            "623cae7c-e6b2-43c5-853c-2059c9b2cb58",
+		ApplicationName:          "My Gatekeeper",
+		EntityID:                 "urn:caddy:mygatekeeper",
+		SessionDurationAttribute: "urn:example:session-lifetime",
+		logger:                   zap.NewNop(),
+	}
+	az.AssertionConsumerServiceURLs = []string{"https://localhost:3443/saml"}
+	if err := az.Validate(); err != nil {
+		t.Fatalf("failed validating Azure AD settings: %s", err)
+	}
+	if names := attributeProfiles["azure"].SessionDuration; len(names) != 1 || names[0] != "Attributes/MaxSessionDuration" {
+		t.Fatalf("preset profile was modified: %v", names)
+	}
+
+	for _, test := range []struct {
+		attribute string
+		expected  int64
+	}{
+		{attribute: "urn:example:session-lifetime", expected: 7200},
+		{attribute: "http://claims.contoso.com/SAML/Attributes/MaxSessionDuration"},
+	} {
+		attrStatements := []samllib.AttributeStatement{
+			{
+				Attributes: []samllib.Attribute{
+					{
+						Name:   test.attribute,
+						Values: []samllib.AttributeValue{{Value: "7200"}},
+					},
+				},
+			},
+		}
+		claims := UserClaims{}
+		now := time.Now().Unix()
+		az.mapAttributes(&claims, attrStatements)
+		if test.expected == 0 {
+			if claims.ExpiresAt != 0 {
+				t.Errorf("%s: session duration was not ignored: %d", test.attribute, claims.ExpiresAt-now)
+			}
+			continue
+		}
+		if duration := claims.ExpiresAt - now; duration < test.expected || duration > test.expected+1 {
+			t.Errorf("%s: unexpected session duration %d, expected %d", test.attribute, duration, test.expected)
+		}
+	}
+}
+
+func TestIssuerProfiles(t *testing.T) {
+	eduIssuer := "https://idp.university-b.edu/idp/shibboleth"
+	az := &AzureIdp{
+		IdpMetadataLocation: "assets/idp/azure_ad_app_metadata.xml",
+		TenantID:            "1b9e886b-8ff2-4378-b6c8-6771259a5f51",
+		ApplicationID:       "623cae7c-e6b2-43c5-853c-2059c9b2cb58",
+		ApplicationName:     "My Gatekeeper",
+		EntityID:            "urn:caddy:mygatekeeper",
+		IssuerProfiles:      map[string]string{eduIssuer: "edu"},
+		logger:              zap.NewNop(),
+	}
+	az.AssertionConsumerServiceURLs = []string{"https://localhost:3443/saml"}
+	if err := az.Validate(); err != nil {
+		t.Fatalf("failed validating Azure AD settings: %s", err)
+	}
+
+	attrStatements := []samllib.AttributeStatement{
+		{
+			Attributes: []samllib.Attribute{
+				{
+					Name:   "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+					Values: []samllib.AttributeValue{{Value: "jsmith@contoso.com"}},
+				},
+				{
+					Name:   "urn:oid:0.9.2342.19200300.100.1.3",
+					Values: []samllib.AttributeValue{{Value: "jsmith@university-b.edu"}},
+				},
+			},
+		},
+	}
+	for _, test := range []struct {
+		issuer   string
+		expected string
+	}{
+		{issuer: "https://sts.windows.net/1b9e886b-8ff2-4378-b6c8-6771259a5f51/", expected: "jsmith@contoso.com"},
+		{issuer: eduIssuer, expected: "jsmith@university-b.edu"},
+	} {
+		claims := UserClaims{}
+		az.mapIssuerAttributes(&claims, test.issuer, attrStatements)
+		if claims.Email != test.expected {
+			t.Errorf("%s: unexpected email %q, expected %q", test.issuer, claims.Email, test.expected)
+		}
+	}
+
+	az.IssuerProfiles = map[string]string{eduIssuer: "unknown"}
+	if err := az.Validate(); err == nil {
+		t.Fatalf("unsupported issuer profile passed validation")
+	}
+}
+
+func TestEmailSources(t *testing.T) {
+	az := &AzureIdp{
+		IdpMetadataLocation: "assets/idp/azure_ad_app_metadata.xml",
+		TenantID:            "1b9e886b-8ff2-4378-b6c8-6771259a5f51",
+		ApplicationID:       "623cae7c-e6b2-43c5-853c-2059c9b2cb58",
+		ApplicationName:     "My Gatekeeper",
+		EntityID:            "urn:caddy:mygatekeeper",
+		EmailSources:        []string{"urn:oid:0.9.2342.19200300.100.1.3", "userPrincipalName"},
+		logger:              zap.NewNop(),
+	}
+	az.AssertionConsumerServiceURLs = []string{"https://localhost:3443/saml"}
+	if err := az.Validate(); err != nil {
+		t.Fatalf("failed validating Azure AD settings: %s", err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		attrs    map[string]string
+		expected string
+	}{
+		{
+			name: "primary source",
+			attrs: map[string]string{
+				"userPrincipalName":                 "jsmith@contoso.onmicrosoft.com",
+				"urn:oid:0.9.2342.19200300.100.1.3": "jsmith@contoso.com",
+			},
+			expected: "jsmith@contoso.com",
+		},
+		{
+			name: "fallback source",
+			attrs: map[string]string{
+				"userPrincipalName": "jsmith@contoso.onmicrosoft.com",
+				"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress": "john.smith@contoso.com",
+			},
+			expected: "jsmith@contoso.onmicrosoft.com",
+		},
+	} {
+		attrStatement := samllib.AttributeStatement{}
+		for name, value := range test.attrs {
+			attrStatement.Attributes = append(attrStatement.Attributes, samllib.Attribute{
+				Name:   name,
+				Values: []samllib.AttributeValue{{Value: value}},
+			})
+		}
+		claims := UserClaims{}
+		az.mapAttributes(&claims, []samllib.AttributeStatement{attrStatement})
+		if claims.Email != test.expected {
+			t.Errorf("%s: unexpected email %q, expected %q", test.name, claims.Email, test.expected)
+		}
+	}
+
+	az.EmailSources = []string{"mail", " "}
+	if err := az.Validate(); err == nil {
+		t.Fatalf("empty email source passed validation")
+	}
+}
+
+func TestOriginSources(t *testing.T) {
+	issuer := "https://idp.university-b.edu/idp/shibboleth"
+	for _, test := range []struct {
+		name          string
+		profile       string
+		originSources []string
+		attrs         map[string]string
+		expected      string
+	}{
+		{
+			name:    "azure origin attribute",
+			profile: "azure",
+			attrs: map[string]string{
+				"http://schemas.microsoft.com/identity/claims/identityprovider": "live.com",
+			},
+			expected: "live.com",
+		},
+		{
+			name:     "issuer fallback",
+			profile:  "edu",
+			attrs:    map[string]string{"urn:oid:0.9.2342.19200300.100.1.3": "jsmith@university-b.edu"},
+			expected: issuer,
+		},
+		{
+			name:          "configured origin source",
+			profile:       "edu",
+			originSources: []string{"urn:oid:1.3.6.1.4.1.25178.1.2.9"}, // schacHomeOrganization
+			attrs: map[string]string{
+				"urn:oid:1.3.6.1.4.1.25178.1.2.9": "university-b.edu",
+			},
+			expected: "university-b.edu",
+		},
+	} {
+		az := &AzureIdp{
+			OriginSources: test.originSources,
+			logger:        zap.NewNop(),
+		}
+		profile, _ := az.newAttributeProfile(test.profile)
+		az.attributeProfile = profile
+		attrStatement := samllib.AttributeStatement{}
+		for name, value := range test.attrs {
+			attrStatement.Attributes = append(attrStatement.Attributes, samllib.Attribute{
+				Name:   name,
+				Values: []samllib.AttributeValue{{Value: value}},
+			})
+		}
+		claims := UserClaims{}
+		az.mapIssuerAttributes(&claims, issuer, []samllib.AttributeStatement{attrStatement})
+		if claims.Origin != test.expected {
+			t.Errorf("%s: unexpected origin %q, expected %q", test.name, claims.Origin, test.expected)
+		}
+	}
+}
+
+func TestDeriveNameFromEmail(t *testing.T) {
+	attrStatements := []samllib.AttributeStatement{
+		{
+			Attributes: []samllib.Attribute{
+				{
+					Name:   "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+					Values: []samllib.AttributeValue{{Value: "jsmith@contoso.com"}},
+				},
+			},
+		},
+	}
+	for _, test := range []struct {
+		name                string
+		deriveNameFromEmail bool
+		existingName        string
+		expected            string
+	}{
+		{name: "disabled"},
+		{name: "only email present", deriveNameFromEmail: true, expected: "jsmith"},
+		{name: "name present", deriveNameFromEmail: true, existingName: "Smith, John", expected: "Smith, John"},
+	} {
+		az := &AzureIdp{
+			DeriveNameFromEmail: test.deriveNameFromEmail,
+			attributeProfile:    attributeProfiles["azure"],
+			logger:              zap.NewNop(),
+		}
+		claims := UserClaims{Name: test.existingName}
+		az.mapAttributes(&claims, attrStatements)
+		az.deriveName(&claims)
+		if claims.Email != "jsmith@contoso.com" {
+			t.Fatalf("%s: unexpected email %q", test.name, claims.Email)
+		}
+		if claims.Name != test.expected {
+			t.Errorf("%s: unexpected name %q, expected %q", test.name, claims.Name, test.expected)
+		}
+	}
+}
+
+func TestValidateDefaults(t *testing.T) {
+	az := &AzureIdp{
+		IdpMetadataLocation: "assets/idp/azure_ad_app_metadata.xml",
+		TenantID:            "1b9e886b-8ff2-4378-b6c8-6771259a5f51",
+		ApplicationID:       "623cae7c-e6b2-43c5-853c-2059c9b2cb58",
+		ApplicationName:     "My Gatekeeper",
+		EntityID:            "urn:caddy:mygatekeeper",
+		logger:              zap.NewNop(),
+	}
+	az.AssertionConsumerServiceURLs = []string{"https://localhost:3443/saml"}
+	if err := az.Validate(); err != nil {
+		t.Fatalf("failed validating Azure AD settings: %s", err)
+	}
+	if len(az.AcceptedNameIDFormats) != len(defaultNameIDFormats) {
+		t.Errorf("unexpected default accepted_nameid_formats: %v", az.AcceptedNameIDFormats)
+	}
+	if az.ResponseParseTimeout != defaultResponseParseTimeout {
+		t.Errorf("unexpected default response_parse_timeout: %d", az.ResponseParseTimeout)
+	}
+	if az.MinSessionDuration != defaultMinSessionDuration || az.MaxSessionDuration != defaultMaxSessionDuration {
+		t.Errorf("unexpected default session duration range: %d-%d", az.MinSessionDuration, az.MaxSessionDuration)
+	}
+}
+
+func TestValidateConfigErrorPaths(t *testing.T) {
+	for _, test := range []struct {
+		path      string
+		configure func(az *AzureIdp)
+	}{
+		{path: "azure.acs_urls", configure: func(az *AzureIdp) { az.AssertionConsumerServiceURLs = nil }},
+		{path: "azure.tenant_id", configure: func(az *AzureIdp) { az.TenantID = "" }},
+		{path: "azure.application_id", configure: func(az *AzureIdp) { az.ApplicationID = "" }},
+		{path: "azure.profile", configure: func(az *AzureIdp) { az.Profile = "unknown" }},
+		{path: "azure.subject_source", configure: func(az *AzureIdp) { az.SubjectSource = []string{"unknown"} }},
+		{path: "azure.duplicate_attributes", configure: func(az *AzureIdp) { az.DuplicateAttributes = "unknown" }},
+		{path: "azure.max_roles", configure: func(az *AzureIdp) { az.MaxRoles = -1 }},
+		{path: "azure.max_roles_policy", configure: func(az *AzureIdp) { az.MaxRolesPolicy = "unknown" }},
+		{path: "azure.response_parse_timeout", configure: func(az *AzureIdp) { az.ResponseParseTimeout = -1 }},
+		{path: "azure.max_session_duration", configure: func(az *AzureIdp) { az.MinSessionDuration, az.MaxSessionDuration = 3600, 60 }},
+		{path: "azure.claim_enrichers", configure: func(az *AzureIdp) { az.ClaimEnrichers = []string{"unknown"} }},
+		{path: "azure.idp_metadata_location", configure: func(az *AzureIdp) { az.IdpMetadataLocation = "assets/idp/missing.xml" }},
+		{path: "azure.sp_cert_pem", configure: func(az *AzureIdp) { az.SpCertPEM = "MIIC" }},
+	} {
+		az := &AzureIdp{
+			IdpMetadataLocation: "assets/idp/azure_ad_app_metadata.xml",
+			TenantID:            "1b9e886b-8ff2-4378-b6c8-6771259a5f51",
+			ApplicationID:       "623cae7c-e6b2-43c5-853c-2059c9b2cb58",
+			ApplicationName:     "My Gatekeeper",
+			logger:              zap.NewNop(),
+		}
+		az.AssertionConsumerServiceURLs = []string{"https://localhost:3443/saml"}
+		test.configure(az)
+		err := az.Validate()
+		if err == nil {
+			t.Errorf("%s: expected failure, got success", test.path)
+			continue
+		}
+		var configErr *ConfigError
+		if !errors.As(err, &configErr) {
+			t.Errorf("%s: unexpected error type %T: %s", test.path, err, err)
+			continue
+		}
+		if configErr.Path != test.path {
+			t.Errorf("%s: unexpected error path %s: %s", test.path, configErr.Path, err)
+		}
+		if !strings.HasPrefix(err.Error(), test.path+": ") {
+			t.Errorf("%s: error has no path: %s", test.path, err)
+		}
+	}
+}
+
+func TestAllowIdpInitiated(t *testing.T) {
+	for _, allowIdpInitiated := range []bool{true, false} {
+		allow := allowIdpInitiated
+		az := &AzureIdp{
+			AllowIdpInitiated: &allow,
+			requestTracker:    newAuthnRequestTracker(defaultAuthnRequestLifetime),
+		}
+		az.requestTracker.add("id-4f3b5d2a")
+
+		err := az.validateInResponseTo(&samlResponse{})
+		if allowIdpInitiated && err != nil {
+			t.Errorf("allow_idp_initiated=%t: unsolicited response rejected: %s", allowIdpInitiated, err)
+		}
+		if !allowIdpInitiated && err == nil {
+			t.Errorf("allow_idp_initiated=%t: unsolicited response accepted", allowIdpInitiated)
+		}
+
+		if err := az.validateInResponseTo(&samlResponse{InResponseTo: "id-4f3b5d2a"}); err != nil {
+			t.Errorf("allow_idp_initiated=%t: solicited response rejected: %s", allowIdpInitiated, err)
+		}
+	}
+}
+
+func TestDefaultAcsIndex(t *testing.T) {
+	acsURLs := []string{"https://mygatekeeper/saml", "https://localhost:3443/saml"}
+	acsURL, _ := url.Parse(acsURLs[0])
+	sp := &samllib.ServiceProvider{AcsURL: *acsURL}
+
+	az := &AzureIdp{}
+	az.AssertionConsumerServiceURLs = acsURLs
+	req, err := az.newAuthnRequest(sp, "https://login.microsoftonline.com/saml2")
+	if err != nil {
+		t.Fatalf("failed creating authentication request: %s", err)
+	}
+	if req.AssertionConsumerServiceIndex != "" || req.AssertionConsumerServiceURL != acsURLs[0] {
+		t.Fatalf("unexpected ACS of authentication request without default index: %q, %q",
+			req.AssertionConsumerServiceIndex, req.AssertionConsumerServiceURL,
+		)
+	}
+
+	index := 1
+	az.DefaultAcsIndex = &index
+	req, err = az.newAuthnRequest(sp, "https://login.microsoftonline.com/saml2")
+	if err != nil {
+		t.Fatalf("failed creating authentication request: %s", err)
+	}
+	if req.AssertionConsumerServiceIndex != "1" {
+		t.Fatalf("unexpected ACS index of authentication request: %q", req.AssertionConsumerServiceIndex)
+	}
+	if req.AssertionConsumerServiceURL != "" || req.ProtocolBinding != "" {
+		t.Fatalf("authentication request with ACS index has ACS URL or binding: %q, %q",
+			req.AssertionConsumerServiceURL, req.ProtocolBinding,
+		)
+	}
+
+	for _, index := range []int{-1, 2} {
+		index := index
+		az := &AzureIdp{DefaultAcsIndex: &index, logger: zap.NewNop()}
+		az.AssertionConsumerServiceURLs = acsURLs
+		err := az.Validate()
+		if err == nil || !strings.Contains(err.Error(), "default_acs_index") {
+			t.Fatalf("default_acs_index %d passed validation: %v", index, err)
+		}
+	}
+}
+
+func TestValidateInResponseTo(t *testing.T) {
+	allow := true
+	az := &AzureIdp{
+		AllowIdpInitiated: &allow,
+		requestTracker:    newAuthnRequestTracker(defaultAuthnRequestLifetime),
+		logger:            zap.NewNop(),
+	}
+	az.requestTracker.add("id-4f3b5d2a")
+	for _, test := range []struct {
+		name         string
+		inResponseTo string
+		shouldFail   bool
+	}{
+		{name: "empty InResponseTo"},
+		{name: "matching InResponseTo", inResponseTo: "id-4f3b5d2a"},
+		{name: "bogus InResponseTo", inResponseTo: "id-8c1e0f7b", shouldFail: true},
+		{name: "markup in InResponseTo", inResponseTo: "<script>alert(1)</script>", shouldFail: true},
+	} {
+		err := az.validateInResponseTo(&samlResponse{InResponseTo: test.inResponseTo})
+		if test.shouldFail && err == nil {
+			t.Errorf("%s: expected failure, got success", test.name)
+		}
+		// The unsigned InResponseTo is not echoed to the user.
+		if err != nil && strings.Contains(err.Error(), test.inResponseTo) {
+			t.Errorf("%s: error echoes the InResponseTo: %s", test.name, err)
+		}
+		if !test.shouldFail && err != nil {
+			t.Errorf("%s: expected success, got %s", test.name, err)
+		}
+	}
+
+	az.requestTracker = newAuthnRequestTracker(-1 * time.Second)
+	az.requestTracker.add("id-4f3b5d2a")
+	if err := az.validateInResponseTo(&samlResponse{InResponseTo: "id-4f3b5d2a"}); err == nil {
+		t.Errorf("response to expired authentication request accepted")
+	}
+}
+
+func TestAuthnRequestTracker(t *testing.T) {
+	tracker := newAuthnRequestTracker(defaultAuthnRequestLifetime)
+	tracker.add("id-4f3b5d2a")
+	if ids := tracker.getIDs(); len(ids) != 1 || ids[0] != "id-4f3b5d2a" {
+		t.Fatalf("unexpected pending requests: %v", ids)
+	}
+	tracker.remove("id-4f3b5d2a")
+	if ids := tracker.getIDs(); len(ids) != 0 {
+		t.Fatalf("unexpected pending requests: %v", ids)
+	}
+
+	tracker = newAuthnRequestTracker(-1 * time.Second)
+	tracker.add("id-4f3b5d2a")
+	if ids := tracker.getIDs(); len(ids) != 0 {
+		t.Fatalf("expired request is pending: %v", ids)
+	}
+
+	// The expired requests are discarded once the tracker is full.
+	tracker.maxRequests = 3
+	for i := 0; i < 3; i++ {
+		tracker.add(fmt.Sprintf("id-expired-%d", i))
+	}
+	tracker.lifetime = defaultAuthnRequestLifetime
+	tracker.add("id-4f3b5d2a")
+	if n := len(tracker.requests); n != 1 {
+		t.Fatalf("expected expired requests to be discarded, found %d requests", n)
+	}
+
+	// The oldest pending request is discarded when none has expired.
+	for i := 0; i < 3; i++ {
+		tracker.add(fmt.Sprintf("id-pending-%d", i))
+	}
+	if n := len(tracker.requests); n != 3 {
+		t.Fatalf("expected %d pending requests, found %d", 3, n)
+	}
+	if tracker.has("id-4f3b5d2a") {
+		t.Fatalf("oldest pending request was not discarded")
+	}
+	if !tracker.has("id-pending-2") {
+		t.Fatalf("newest pending request was discarded")
+	}
+}
+
+func TestLogAttributes(t *testing.T) {
+	attrStatements := []samllib.AttributeStatement{
+		{
+			Attributes: []samllib.Attribute{
+				{
+					Name:   "http://schemas.microsoft.com/identity/claims/displayname",
+					Values: []samllib.AttributeValue{{Value: "Smith, John"}},
+				},
+				{
+					Name:   "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+					Values: []samllib.AttributeValue{{Value: "jsmith@contoso.com"}},
+				},
+			},
+		},
+	}
+
+	for _, logAttributes := range []bool{false, true} {
+		core, logs := observer.New(zap.DebugLevel)
+		az := &AzureIdp{
+			OnUnknownAttribute:  unknownAttributeIgnore,
+			LogAttributes:       logAttributes,
+			SensitiveAttributes: []string{"identity/claims/emailaddress"},
+			attributeProfile:    attributeProfiles["azure"],
+			logger:              zap.New(core),
+		}
+		claims := UserClaims{}
+		az.mapAttributes(&claims, attrStatements)
+
+		entries := logs.FilterMessage("found SAML attribute").All()
+		if !logAttributes {
+			if len(entries) != 0 {
+				t.Fatalf("expected no attributes logged, got %d", len(entries))
+			}
+			continue
+		}
+		if len(entries) != 2 {
+			t.Fatalf("expected 2 attributes logged, got %d", len(entries))
+		}
+		for _, entry := range entries {
+			ctx := entry.ContextMap()
+			values := fmt.Sprintf("%v", ctx["values"])
+			switch ctx["name"] {
+			case "http://schemas.microsoft.com/identity/claims/displayname":
+				if values != "[Smith, John]" {
+					t.Fatalf("unexpected logged values: %s", values)
+				}
+			case "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress":
+				if values != "["+redactedAttributeValue+"]" {
+					t.Fatalf("sensitive attribute not redacted: %s", values)
+				}
+			default:
+				t.Fatalf("unexpected logged attribute: %v", ctx["name"])
+			}
+		}
+		if claims.Email != "jsmith@contoso.com" {
+			t.Fatalf("redaction altered claims: %s", claims.Email)
+		}
+	}
+}
+
+func TestValidateNameID(t *testing.T) {
+	entityID := "urn:caddy:mygatekeeper"
+	testcases := []struct {
+		name          string
+		nameID        *samllib.NameID
+		allowMismatch bool
+		shouldErr     bool
+	}{
+		{
+			name:   "no name id",
+			nameID: nil,
+		},
+		{
+			name: "persistent with matching qualifier",
+			nameID: &samllib.NameID{
+				Format:          string(samllib.PersistentNameIDFormat),
+				SPNameQualifier: entityID,
+				Value:           "AAdzZWNyZXQx",
+			},
+		},
+		{
+			name: "persistent with mismatched qualifier",
+			nameID: &samllib.NameID{
+				Format:          string(samllib.PersistentNameIDFormat),
+				SPNameQualifier: "urn:caddy:othergatekeeper",
+				Value:           "AAdzZWNyZXQx",
+			},
+			shouldErr: true,
+		},
+		{
+			name: "persistent with mismatched qualifier and relaxed validation",
+			nameID: &samllib.NameID{
+				Format:          string(samllib.PersistentNameIDFormat),
+				SPNameQualifier: "urn:caddy:othergatekeeper",
+				Value:           "AAdzZWNyZXQx",
+			},
+			allowMismatch: true,
+		},
+		{
+			name: "persistent without qualifier",
+			nameID: &samllib.NameID{
+				Format: string(samllib.PersistentNameIDFormat),
+				Value:  "AAdzZWNyZXQx",
+			},
+		},
+		{
+			name: "email with mismatched qualifier",
+			nameID: &samllib.NameID{
+				Format:          string(samllib.EmailAddressNameIDFormat),
+				SPNameQualifier: "urn:caddy:othergatekeeper",
+				Value:           "jsmith@contoso.com",
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		core, logs := observer.New(zap.DebugLevel)
+		az := &AzureIdp{
+			EntityID:                     entityID,
+			AllowSpNameQualifierMismatch: tc.allowMismatch,
+			AcceptedNameIDFormats:        defaultNameIDFormats,
+			logger:                       zap.New(core),
+		}
+		assertion := &samllib.Assertion{
+			Subject: &samllib.Subject{NameID: tc.nameID},
+		}
+		err := az.validateNameID(assertion)
+		if tc.shouldErr && err == nil {
+			t.Fatalf("%s: expected error, got none", tc.name)
+		}
+		if !tc.shouldErr && err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.name, err)
+		}
+		if tc.allowMismatch && logs.Len() != 1 {
+			t.Fatalf("%s: expected mismatch to be logged", tc.name)
+		}
+	}
+}
+
+func TestAcceptedNameIDFormats(t *testing.T) {
+	testcases := []struct {
+		name            string
+		format          string
+		acceptedFormats []string
+		shouldErr       bool
+	}{
+		{
+			name:            "email address with default formats",
+			format:          string(samllib.EmailAddressNameIDFormat),
+			acceptedFormats: defaultNameIDFormats,
+		},
+		{
+			name:            "omitted format with default formats",
+			format:          "",
+			acceptedFormats: defaultNameIDFormats,
+		},
+		{
+			name:            "kerberos with default formats",
+			format:          "urn:oasis:names:tc:SAML:2.0:nameid-format:kerberos",
+			acceptedFormats: defaultNameIDFormats,
+			shouldErr:       true,
+		},
+		{
+			name:            "persistent with persistent format only",
+			format:          string(samllib.PersistentNameIDFormat),
+			acceptedFormats: []string{string(samllib.PersistentNameIDFormat)},
+		},
+		{
+			name:            "transient with persistent format only",
+			format:          string(samllib.TransientNameIDFormat),
+			acceptedFormats: []string{string(samllib.PersistentNameIDFormat)},
+			shouldErr:       true,
+		},
+		{
+			name:            "omitted format with persistent format only",
+			format:          "",
+			acceptedFormats: []string{string(samllib.PersistentNameIDFormat)},
+			shouldErr:       true,
+		},
+	}
+
+	for _, tc := range testcases {
+		az := &AzureIdp{
+			AcceptedNameIDFormats: tc.acceptedFormats,
+			logger:                zap.NewNop(),
+		}
+		assertion := &samllib.Assertion{
+			Subject: &samllib.Subject{
+				NameID: &samllib.NameID{
+					Format: tc.format,
+					Value:  "jsmith@contoso.com",
+				},
+			},
+		}
+		err := az.validateNameID(assertion)
+		if tc.shouldErr && err == nil {
+			t.Fatalf("%s: expected error, got none", tc.name)
+		}
+		if !tc.shouldErr && err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.name, err)
+		}
+	}
+}
+
+func TestProviderAcsURLs(t *testing.T) {
+	common := CommonParameters{
+		AssertionConsumerServiceURLs: []string{
+			"https://localhost:3443/saml",
+		},
+	}
+	providers := []*AzureIdp{
+		{
+			CommonParameters: CommonParameters{
+				AssertionConsumerServiceURLs: []string{
+					"https://localhost:3443/saml/azure",
+					"https://mygatekeeper/saml/azure",
+				},
+			},
+		},
+		{},
+	}
+	expectedAcsURLs := [][]string{
+		{"https://localhost:3443/saml/azure", "https://mygatekeeper/saml/azure"},
+		{"https://localhost:3443/saml"},
+	}
+
+	for i, az := range providers {
+		az.inheritAcsURLs(common)
+		az.IdpMetadataLocation = "assets/idp/azure_ad_app_metadata.xml"
+		az.TenantID = "1b9e886b-8ff2-4378-b6c8-6771259a5f51"
+		az.ApplicationID = "623cae7c-e6b2-43c5-853c-2059c9b2cb58"
+		az.ApplicationName = "My Gatekeeper"
+		az.EntityID = "urn:caddy:mygatekeeper"
+		az.logger = zap.NewNop()
+		if err := az.Validate(); err != nil {
+			t.Fatalf("provider %d: validation failed: %s", i, err)
+		}
+		acsURLs := []string{}
+		for _, sp := range az.ServiceProviders {
+			acsURLs = append(acsURLs, sp.AcsURL.String())
+		}
+		if fmt.Sprintf("%v", acsURLs) != fmt.Sprintf("%v", expectedAcsURLs[i]) {
+			t.Fatalf("provider %d: expected ACS URLs %v, got %v", i, expectedAcsURLs[i], acsURLs)
+		}
+	}
+}
+
+func TestSelectServiceProviders(t *testing.T) {
+	serviceProviders := []*samllib.ServiceProvider{}
+	for _, acsURL := range []string{
+		"https://localhost:443/saml",
+		"https://localhost/saml",
+		"https://LOCALHOST/saml",
+	} {
+		u, _ := url.Parse(acsURL)
+		serviceProviders = append(serviceProviders, &samllib.ServiceProvider{AcsURL: *u})
+	}
+
+	for _, test := range []struct {
+		name        string
+		destination string
+		expected    []string
+	}{
+		{
+			name:        "verbatim match",
+			destination: "https://localhost/saml",
+			expected:    []string{"https://localhost/saml"},
+		},
+		{
+			name:        "verbatim match with default port",
+			destination: "https://localhost:443/saml",
+			expected:    []string{"https://localhost:443/saml"},
+		},
+		{
+			name:        "equivalent match",
+			destination: "https://Localhost/saml",
+			expected:    []string{"https://localhost:443/saml", "https://localhost/saml", "https://LOCALHOST/saml"},
+		},
+		{
+			name:     "absent destination",
+			expected: []string{"https://localhost:443/saml", "https://localhost/saml", "https://LOCALHOST/saml"},
+		},
+	} {
+		acsURLs := []string{}
+		for _, sp := range selectServiceProviders(serviceProviders, test.destination) {
+			acsURLs = append(acsURLs, sp.AcsURL.String())
+		}
+		if fmt.Sprintf("%v", acsURLs) != fmt.Sprintf("%v", test.expected) {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.expected, acsURLs)
+		}
+	}
+}
+
+func TestSubjectSource(t *testing.T) {
+	attrStatements := []samllib.AttributeStatement{
+		{
+			Attributes: []samllib.Attribute{
+				{
+					Name:   "http://schemas.microsoft.com/identity/claims/displayname",
+					Values: []samllib.AttributeValue{{Value: "Smith, John"}},
+				},
+				{
+					Name:   "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+					Values: []samllib.AttributeValue{{Value: "jsmith@contoso.com"}},
+				},
+			},
+		},
+	}
+	nameID := &samllib.NameID{
+		Format: string(samllib.PersistentNameIDFormat),
+		Value:  "AAdzZWNyZXQx",
+	}
+
+	for _, test := range []struct {
+		name            string
+		subjectSource   []string
+		nameID          *samllib.NameID
+		expectedSubject string
+	}{
+		{
+			name:            "default falls back to nameid",
+			nameID:          nameID,
+			expectedSubject: "AAdzZWNyZXQx",
+		},
+		{
+			name:            "default without nameid",
+			expectedSubject: "",
+		},
+		{
+			name:            "email",
+			subjectSource:   []string{"email"},
+			nameID:          nameID,
+			expectedSubject: "jsmith@contoso.com",
+		},
+		{
+			name:            "nameid falls back to email",
+			subjectSource:   []string{"attribute", "nameid", "email"},
+			expectedSubject: "jsmith@contoso.com",
+		},
+	} {
+		az := &AzureIdp{
+			SubjectSource:      test.subjectSource,
+			OnUnknownAttribute: unknownAttributeIgnore,
+			attributeProfile:   attributeProfiles["azure"],
+			logger:             zap.NewNop(),
+		}
+		if err := az.validateSubjectSource(); err != nil {
+			t.Fatalf("%s: unexpected validation error: %s", test.name, err)
+		}
+		assertion := &samllib.Assertion{
+			Subject:             &samllib.Subject{NameID: test.nameID},
+			AttributeStatements: attrStatements,
+		}
+		claims := UserClaims{}
+		az.mapAttributes(&claims, assertion.AttributeStatements)
+		az.setSubject(&claims, assertion)
+		if claims.Subject != test.expectedSubject {
+			t.Fatalf("%s: expected subject %q, got %q", test.name, test.expectedSubject, claims.Subject)
+		}
+	}
+
+	az := &AzureIdp{SubjectSource: []string{"upn"}}
+	if err := az.validateSubjectSource(); err == nil {
+		t.Fatalf("expected validation error for unsupported source, got none")
+	}
+}
+
+func TestAttributelessAssertion(t *testing.T) {
+	emailNameID := &samllib.NameID{
+		Format: string(samllib.EmailAddressNameIDFormat),
+		Value:  "JSmith@contoso.com",
+	}
+	persistentNameID := &samllib.NameID{
+		Format: string(samllib.PersistentNameIDFormat),
+		Value:  "AAdzZWNyZXQx",
+	}
+
+	for _, test := range []struct {
+		name            string
+		userIDAttribute string
+		normalizeEmail  bool
+		nameID          *samllib.NameID
+		expectedEmail   string
+		expectedSubject string
+	}{
+		{
+			name:            "email name id",
+			nameID:          emailNameID,
+			expectedEmail:   "JSmith@contoso.com",
+			expectedSubject: "JSmith@contoso.com",
+		},
+		{
+			name:            "normalized email name id",
+			normalizeEmail:  true,
+			nameID:          emailNameID,
+			expectedEmail:   "jsmith@contoso.com",
+			expectedSubject: "JSmith@contoso.com",
+		},
+		{
+			name:            "persistent name id is not an email",
+			nameID:          persistentNameID,
+			expectedSubject: "AAdzZWNyZXQx",
+		},
+		{
+			name:            "persistent name id as user id",
+			userIDAttribute: "nameid",
+			nameID:          persistentNameID,
+			expectedEmail:   "AAdzZWNyZXQx",
+			expectedSubject: "AAdzZWNyZXQx",
+		},
+		{
+			name: "no name id",
+		},
+	} {
+		az := &AzureIdp{
+			UserIDAttribute:  test.userIDAttribute,
+			NormalizeEmail:   test.normalizeEmail,
+			attributeProfile: attributeProfiles["azure"],
+			logger:           zap.NewNop(),
+		}
+		if err := az.validateSubjectSource(); err != nil {
+			t.Fatalf("%s: unexpected validation error: %s", test.name, err)
+		}
+		if err := az.validateUserIDAttribute(); err != nil {
+			t.Fatalf("%s: unexpected validation error: %s", test.name, err)
+		}
+		assertion := &samllib.Assertion{
+			Subject: &samllib.Subject{NameID: test.nameID},
+		}
+		claims := UserClaims{}
+		az.mapAttributes(&claims, assertion.AttributeStatements)
+		az.setUserID(&claims, assertion)
+		az.setSubject(&claims, assertion)
+		if claims.Email != test.expectedEmail {
+			t.Fatalf("%s: expected email %q, got %q", test.name, test.expectedEmail, claims.Email)
+		}
+		if claims.Name != test.expectedEmail {
+			t.Fatalf("%s: expected name %q, got %q", test.name, test.expectedEmail, claims.Name)
+		}
+		if claims.Subject != test.expectedSubject {
+			t.Fatalf("%s: expected subject %q, got %q", test.name, test.expectedSubject, claims.Subject)
+		}
+	}
+
+	az := &AzureIdp{UserIDAttribute: "upn"}
+	if err := az.validateUserIDAttribute(); err == nil {
+		t.Fatalf("expected validation error for unsupported user_id_attribute, got none")
+	}
+}
+
+func TestComplexAttributes(t *testing.T) {
+	az := &AzureIdp{
+		ComplexAttributes: []ComplexAttribute{
+			{
+				Attribute: "claims/profile",
+				Format:    "json",
+				Fields: map[string]string{
+					"displayName":    "name",
+					"mail":           "email",
+					"org.department": "department",
+					"groups":         "roles",
+				},
+			},
+			{
+				Attribute: "claims/location",
+				Format:    "delimited",
+				Delimiter: ";",
+				Fields: map[string]string{
+					"0": "office",
+					"2": "country",
+				},
+			},
+		},
+		OnUnknownAttribute: unknownAttributePassthrough,
+		attributeProfile:   attributeProfiles["azure"],
+		logger:             zap.NewNop(),
+	}
+	if err := az.validateComplexAttributes(); err != nil {
+		t.Fatalf("unexpected validation error: %s", err)
+	}
+	attrStatements := []samllib.AttributeStatement{
+		{
+			Attributes: []samllib.Attribute{
+				{
+					Name: "http://schemas.contoso.com/claims/profile",
+					Values: []samllib.AttributeValue{{
+						Value: `{"displayName":"Smith, John","mail":"jsmith@contoso.com","org":{"department":"Sales"},"groups":["Sales","Managers"]}`,
+					}},
+				},
+				{
+					Name:   "http://schemas.contoso.com/claims/location",
+					Values: []samllib.AttributeValue{{Value: "Building 7; Seattle; US"}},
+				},
+				{
+					Name:   "Attributes/Role",
+					Values: []samllib.AttributeValue{{Value: "Viewer"}},
+				},
+			},
+		},
+	}
+	claims := UserClaims{}
+	az.mapAttributes(&claims, attrStatements)
+
+	if claims.Name != "Smith, John" {
+		t.Errorf("unexpected name: %s", claims.Name)
+	}
+	if claims.Email != "jsmith@contoso.com" {
+		t.Errorf("unexpected email: %s", claims.Email)
+	}
+	if strings.Join(claims.Roles, ",") != "Viewer,Sales,Managers" {
+		t.Errorf("unexpected roles: %v", claims.Roles)
+	}
+	expectedCustom := map[string]interface{}{
+		"department": "Sales",
+		"office":     "Building 7",
+		"country":    "US",
+	}
+	if len(claims.Custom) != len(expectedCustom) {
+		t.Fatalf("unexpected custom claims: %v", claims.Custom)
+	}
+	for k, v := range expectedCustom {
+		if claims.Custom[k] != v {
+			t.Errorf("unexpected custom claim %s: %v", k, claims.Custom[k])
+		}
+	}
+
+	// The decomposed values pass the attribute filters of the claim
+	// attributes and of the fields.
+	az.AttributeFilters = []AttributeFilter{
+		{Attribute: "Attributes/Role", Deny: []string{"^Managers$"}},
+		{Attribute: "profile/org.department", Allow: []string{"^Engineering$"}},
+	}
+	if err := az.validateAttributeFilters(); err != nil {
+		t.Fatalf("unexpected validation error: %s", err)
+	}
+	claims = UserClaims{}
+	az.mapAttributes(&claims, attrStatements)
+	if strings.Join(claims.Roles, ",") != "Viewer,Sales" {
+		t.Errorf("unexpected filtered roles: %v", claims.Roles)
+	}
+	if _, exists := claims.Custom["department"]; exists {
+		t.Errorf("filtered department claim found: %v", claims.Custom["department"])
+	}
+	if claims.Custom["office"] != "Building 7" {
+		t.Errorf("unexpected custom claim office: %v", claims.Custom["office"])
+	}
+
+	for i, attr := range []ComplexAttribute{
+		{Format: "json", Fields: map[string]string{"mail": "email"}},
+		{Attribute: "claims/profile", Format: "xml", Fields: map[string]string{"mail": "email"}},
+		{Attribute: "claims/profile", Format: "json"},
+		{Attribute: "claims/location", Format: "delimited", Fields: map[string]string{"office": "office"}},
+		{Attribute: "claims/profile", Format: "json", Fields: map[string]string{"mail": ""}},
+	} {
+		az := &AzureIdp{ComplexAttributes: []ComplexAttribute{attr}}
+		if err := az.validateComplexAttributes(); err == nil {
+			t.Errorf("test %d: expected validation error, got none", i)
+		}
+	}
+}
+
+func TestAuthnContextClaims(t *testing.T) {
+	authnInstant := time.Date(2020, time.April, 10, 14, 30, 0, 0, time.UTC)
+	assertion := &samllib.Assertion{
+		AuthnStatements: []samllib.AuthnStatement{
+			{
+				AuthnInstant: authnInstant,
+				AuthnContext: samllib.AuthnContext{
+					AuthnContextClassRef: &samllib.AuthnContextClassRef{
+						Value: "https://refeds.org/profile/mfa",
+					},
+				},
+			},
+		},
+	}
+	claims := UserClaims{
+		ExpiresAt: time.Now().Add(time.Duration(900) * time.Second).Unix(),
+		Name:      "Smith, John",
+		Email:     "jsmith@contoso.com",
+	}
+	setAuthnContext(&claims, assertion)
+	if claims.AuthInstant != authnInstant.Unix() {
+		t.Fatalf("unexpected auth_instant: %d", claims.AuthInstant)
+	}
+	if claims.AuthMethod != "https://refeds.org/profile/mfa" {
+		t.Fatalf("unexpected auth_method: %s", claims.AuthMethod)
+	}
+
+	p := TokenParameters{TokenSecret: "75f03764-147c-4d87-b2f0-4fda89e331c8"}
+	signedToken, err := p.signToken(claims)
+	if err != nil {
+		t.Fatalf("failed signing token: %s", err)
+	}
+	validatedClaims, _, err := p.validateToken(signedToken)
+	if err != nil {
+		t.Fatalf("token failed validation: %s", err)
+	}
+	if validatedClaims.AuthInstant != claims.AuthInstant || validatedClaims.AuthMethod != claims.AuthMethod {
+		t.Fatalf("authentication context claims lost in token: %v", validatedClaims)
+	}
+
+	claims = UserClaims{}
+	setAuthnContext(&claims, &samllib.Assertion{})
+	if claims.AuthInstant != 0 || claims.AuthMethod != "" {
+		t.Fatalf("unexpected claims without authentication statement: %v", claims)
+	}
+}
+
+func TestSessionIndex(t *testing.T) {
+	assertion := &samllib.Assertion{
+		AuthnStatements: []samllib.AuthnStatement{
+			{
+				AuthnInstant: time.Now(),
+				SessionIndex: "_be9967abd904ddcae3c0eb4189adbe3f71e327cf93",
+			},
+		},
+	}
+	for _, includeSessionIndex := range []bool{false, true} {
+		az := &AzureIdp{IncludeSessionIndex: includeSessionIndex}
+		claims := UserClaims{
+			ExpiresAt: time.Now().Add(time.Duration(900) * time.Second).Unix(),
+			Name:      "Smith, John",
+			Email:     "jsmith@contoso.com",
+		}
+		az.setSessionIndex(&claims, assertion)
+		if !includeSessionIndex {
+			if claims.SessionIndex != "" {
+				t.Fatalf("session_index set while disabled: %s", claims.SessionIndex)
+			}
+			continue
+		}
+		if claims.SessionIndex != "_be9967abd904ddcae3c0eb4189adbe3f71e327cf93" {
+			t.Fatalf("unexpected session_index: %s", claims.SessionIndex)
+		}
+
+		// The session index survives the round trip through the token
+		// claims, e.g. of the renewed sessions.
+		b, err := json.Marshal(claims.AsMap())
+		if err != nil {
+			t.Fatalf("failed encoding claims: %s", err)
+		}
+		tokenClaims := map[string]interface{}{}
+		if err := json.Unmarshal(b, &tokenClaims); err != nil {
+			t.Fatalf("failed decoding claims: %s", err)
+		}
+		decodedClaims, err := newUserClaimsFromMap(tokenClaims)
+		if err != nil {
+			t.Fatalf("failed converting claims: %s", err)
+		}
+		if decodedClaims.SessionIndex != claims.SessionIndex {
+			t.Fatalf("session_index lost in claims: %v", decodedClaims)
+		}
+
+		p := TokenParameters{TokenSecret: "75f03764-147c-4d87-b2f0-4fda89e331c8"}
+		signedToken, err := p.signToken(claims)
+		if err != nil {
+			t.Fatalf("failed signing token: %s", err)
+		}
+		validatedClaims, _, err := p.validateToken(signedToken)
+		if err != nil {
+			t.Fatalf("token failed validation: %s", err)
+		}
+		if validatedClaims.SessionIndex != claims.SessionIndex {
+			t.Fatalf("session_index lost in token: %v", validatedClaims)
+		}
+	}
+}
+func TestAttributeFilters(t *testing.T) {
+	attrStatements := []samllib.AttributeStatement{
+		{
+			Attributes: []samllib.Attribute{
+				{
+					Name: "https://aws.amazon.com/SAML/Attributes/Role",
+					Values: []samllib.AttributeValue{
+						{Value: "CN=app-admins,OU=Groups,DC=contoso,DC=com"},
+						{Value: "CN=app-users,OU=Groups,DC=contoso,DC=com"},
+						{Value: "CN=app-users-test,OU=Groups,DC=contoso,DC=com"},
+						{Value: "CN=Domain Users,OU=Groups,DC=contoso,DC=com"},
+						{Value: "CN=VPN Users,OU=Groups,DC=contoso,DC=com"},
+					},
+				},
+				{
+					Name:   "http://schemas.microsoft.com/identity/claims/displayname",
+					Values: []samllib.AttributeValue{{Value: "Smith, John"}},
+				},
+			},
+		},
+	}
+	az := &AzureIdp{
+		attributeProfile:   attributeProfiles["azure"],
+		OnUnknownAttribute: unknownAttributeIgnore,
+		AttributeFilters: []AttributeFilter{
+			{
+				Attribute: "Attributes/Role",
+				Allow:     []string{`^CN=app-[a-z-]+,`},
+				Deny:      []string{`-test,`},
+			},
+		},
+		logger: zap.NewNop(),
+	}
+	if err := az.validateAttributeFilters(); err != nil {
+		t.Fatalf("failed validating attribute filters: %s", err)
+	}
+	claims := UserClaims{}
+	az.mapAttributes(&claims, attrStatements)
+	expected := []string{
+		"CN=app-admins,OU=Groups,DC=contoso,DC=com",
+		"CN=app-users,OU=Groups,DC=contoso,DC=com",
+	}
+	if strings.Join(claims.Roles, ";") != strings.Join(expected, ";") {
+		t.Fatalf("unexpected filtered roles: %v", claims.Roles)
+	}
+	if claims.Name != "Smith, John" {
+		t.Fatalf("unfiltered attribute was changed: %q", claims.Name)
+	}
+
+	for _, filter := range []AttributeFilter{
+		{Allow: []string{"^app-"}},
+		{Attribute: "Attributes/Role"},
+		{Attribute: "Attributes/Role", Allow: []string{"(app"}},
+	} {
+		az := &AzureIdp{AttributeFilters: []AttributeFilter{filter}}
+		if err := az.validateAttributeFilters(); err == nil {
+			t.Errorf("invalid attribute filter passed validation: %+v", filter)
+		}
+	}
+}
+
+func TestAttributeNormalizations(t *testing.T) {
+	attrStatements := []samllib.AttributeStatement{
+		{
+			Attributes: []samllib.Attribute{
+				{
+					Name: "https://aws.amazon.com/SAML/Attributes/Role",
+					Values: []samllib.AttributeValue{
+						{Value: "  AzureAD_Viewer\t"},
+						{Value: "AzureAD_Editor\x00\n"},
+						{Value: " \r\n"},
+					},
+				},
+				{
+					Name:   "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+					Values: []samllib.AttributeValue{{Value: " jsmith@contoso.com "}},
+				},
+				{
+					Name: "http://schemas.microsoft.com/identity/claims/displayname",
+					// The decomposed e with combining acute accent.
+					Values: []samllib.AttributeValue{{Value: " Ren\u0065\u0301 Dupont "}},
+				},
+			},
+		},
+	}
+	az := &AzureIdp{
+		attributeProfile:   attributeProfiles["azure"],
+		OnUnknownAttribute: unknownAttributeIgnore,
+		AttributeNormalizations: []AttributeNormalization{
+			{Trim: true},
+			{Attribute: "Attributes/Role", StripControl: true},
+			{Attribute: "identity/claims/displayname", NFC: true},
+		},
+		logger: zap.NewNop(),
+	}
+	if err := az.validateAttributeNormalizations(); err != nil {
+		t.Fatalf("failed validating attribute normalizations: %s", err)
+	}
+	claims := UserClaims{}
+	az.mapAttributes(&claims, attrStatements)
+	if strings.Join(claims.Roles, ";") != "AzureAD_Viewer;AzureAD_Editor" {
+		t.Errorf("unexpected normalized roles: %q", claims.Roles)
+	}
+	if claims.Email != "jsmith@contoso.com" {
+		t.Errorf("unexpected normalized email: %q", claims.Email)
+	}
+	if claims.Name != "Ren\u00e9 Dupont" {
+		t.Errorf("unexpected normalized name: %q", claims.Name)
+	}
+
+	// The values are left intact without normalizations.
+	az.AttributeNormalizations = nil
+	claims = UserClaims{}
+	az.mapAttributes(&claims, attrStatements)
+	if claims.Email != " jsmith@contoso.com " {
+		t.Errorf("email was normalized: %q", claims.Email)
+	}
+
+	az.AttributeNormalizations = []AttributeNormalization{{Attribute: "Attributes/Role"}}
+	if err := az.validateAttributeNormalizations(); err == nil {
+		t.Errorf("attribute normalization without any normalization passed validation")
+	}
+}
+func TestAcsURLListForms(t *testing.T) {
+	var acsURLs []string
+	for _, config := range []string{
+		`{"acs_urls": ["https://localhost:3443/saml", "https://mygatekeeper/saml"]}`,
+		`{"acs_urls": "https://localhost:3443/saml, https://mygatekeeper/saml,"}`,
+	} {
+		az := &AzureIdp{}
+		if err := json.Unmarshal([]byte(config), az); err != nil {
+			t.Fatalf("failed parsing %s: %s", config, err)
+		}
+		az.IdpMetadataLocation = "assets/idp/azure_ad_app_metadata.xml"
+		az.TenantID = "1b9e886b-8ff2-4378-b6c8-6771259a5f51"
+		az.ApplicationID = "623cae7c-e6b2-43c5-853c-2059c9b2cb58"
+		az.ApplicationName = "My Gatekeeper"
+		az.EntityID = "urn:caddy:mygatekeeper"
+		az.logger = zap.NewNop()
+		if err := az.Validate(); err != nil {
+			t.Fatalf("failed validating %s: %s", config, err)
+		}
+		spAcsURLs := []string{}
+		for _, sp := range az.ServiceProviders {
+			spAcsURLs = append(spAcsURLs, sp.AcsURL.String())
+		}
+		if acsURLs == nil {
+			acsURLs = spAcsURLs
+		}
+		if strings.Join(spAcsURLs, ";") != "https://localhost:3443/saml;https://mygatekeeper/saml" ||
+			strings.Join(spAcsURLs, ";") != strings.Join(acsURLs, ";") {
+			t.Fatalf("unexpected ACS URLs of %s: %v", config, spAcsURLs)
+		}
+	}
+
+	for _, config := range []string{
+		`{"acs_urls": 3443}`,
+		`{"acs_urls": [3443]}`,
+	} {
+		az := &AzureIdp{}
+		if err := json.Unmarshal([]byte(config), az); err == nil {
+			t.Errorf("invalid acs_urls parsed: %s", config)
+		}
+	}
+	for _, acsURLs := range []string{" , ", "/saml", "localhost:3443/saml", "ftp://localhost/saml"} {
+		az := &AzureIdp{TenantID: "1b9e886b-8ff2-4378-b6c8-6771259a5f51", logger: zap.NewNop()}
+		az.AssertionConsumerServiceURLs = []string{acsURLs}
+		if err := az.Validate(); err == nil || !strings.Contains(err.Error(), "azure.acs_urls") {
+			t.Errorf("invalid acs_urls %q passed validation: %v", acsURLs, err)
+		}
+	}
+}
+
+func TestValidateContentType(t *testing.T) {
+	for _, test := range []struct {
+		contentType        string
+		allowMultipartForm bool
+		shouldFail         bool
+	}{
+		{contentType: "application/x-www-form-urlencoded"},
+		{contentType: "application/x-www-form-urlencoded; charset=UTF-8"},
+		{contentType: "Application/X-WWW-Form-Urlencoded;charset=utf-8"},
+		{contentType: "multipart/form-data; boundary=xyz", shouldFail: true},
+		{contentType: "multipart/form-data; boundary=xyz", allowMultipartForm: true},
+		{contentType: "application/json", shouldFail: true},
+		{contentType: "", shouldFail: true},
+		{contentType: "application/x-www-form-urlencoded; charset", shouldFail: true},
+	} {
+		az := &AzureIdp{AllowMultipartForm: test.allowMultipartForm}
+		r := httptest.NewRequest("POST", "https://localhost:3443/saml", strings.NewReader("SAMLResponse="))
+		r.Header.Set("Content-Type", test.contentType)
+		err := az.validateContentType(r)
+		if test.shouldFail && err == nil {
+			t.Errorf("content type %q: expected failure, got success", test.contentType)
+		}
+		if !test.shouldFail && err != nil {
+			t.Errorf("content type %q: expected success, got %s", test.contentType, err)
+		}
+	}
+
+	// The charset-suffixed POST passes the content type check.
+	az := &AzureIdp{}
+	r := httptest.NewRequest("POST", "https://localhost:3443/saml", strings.NewReader("SAMLResponse="))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=UTF-8")
+	_, _, err := az.Authenticate(r)
+	if err == nil || !strings.Contains(err.Error(), "has no SAMLResponse") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCaseInsensitiveAttributes(t *testing.T) {
+	attrStatements := []samllib.AttributeStatement{
+		{
+			Attributes: []samllib.Attribute{
+				{
+					Name:   "http://schemas.microsoft.com/Identity/Claims/DisplayName",
+					Values: []samllib.AttributeValue{{Value: "Smith, John"}},
+				},
+				{
+					Name:   "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/EmailAddress",
+					Values: []samllib.AttributeValue{{Value: "jsmith@contoso.com"}},
+				},
+				{
+					Name:   "https://aws.amazon.com/SAML/attributes/role",
+					Values: []samllib.AttributeValue{{Value: "AzureAD_Administrator"}, {Value: "AzureAD_Test"}},
+				},
+			},
+		},
+	}
+	for _, caseInsensitive := range []bool{false, true} {
+		az := &AzureIdp{
+			attributeProfile:          attributeProfiles["azure"],
+			OnUnknownAttribute:        unknownAttributeIgnore,
+			CaseInsensitiveAttributes: caseInsensitive,
+			AttributeFilters: []AttributeFilter{
+				{Attribute: "ATTRIBUTES/ROLE", Deny: []string{"_Test$"}},
+			},
+			logger: zap.NewNop(),
+		}
+		if err := az.validateAttributeFilters(); err != nil {
+			t.Fatalf("failed validating attribute filters: %s", err)
+		}
+		claims := UserClaims{}
+		az.mapAttributes(&claims, attrStatements)
+		if !caseInsensitive {
+			if claims.Name != "" || claims.Email != "" || len(claims.Roles) != 0 {
+				t.Fatalf("mixed-case attributes matched case-sensitively: %+v", claims)
+			}
+			continue
+		}
+		if claims.Name != "Smith, John" || claims.Email != "jsmith@contoso.com" {
+			t.Fatalf("mixed-case attributes not matched: %+v", claims)
+		}
+		if strings.Join(claims.Roles, ",") != "AzureAD_Administrator" {
+			t.Fatalf("unexpected roles: %v", claims.Roles)
+		}
+	}
+}
+
+func TestLogSignatureAlgorithms(t *testing.T) {
+	raw := `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_r1">` +
+		`<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="_a1">` +
+		`<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:SignedInfo>` +
+		`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/>` +
+		`<ds:Reference URI="#_a1"><ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/></ds:Reference>` +
+		`</ds:SignedInfo></ds:Signature>` +
+		`</Assertion></samlp:Response>`
+	resp, err := parseSAMLResponse([]byte(raw))
+	if err != nil {
+		t.Fatalf("failed parsing response: %s", err)
+	}
+	signatureAlgorithms, digestAlgorithms := resp.getSignatureAlgorithms()
+	if strings.Join(signatureAlgorithms, ",") != "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256" {
+		t.Fatalf("unexpected signature algorithms: %v", signatureAlgorithms)
+	}
+	if strings.Join(digestAlgorithms, ",") != "http://www.w3.org/2001/04/xmlenc#sha256" {
+		t.Fatalf("unexpected digest algorithms: %v", digestAlgorithms)
+	}
+
+	for _, logSignatureAlgorithms := range []bool{false, true} {
+		core, logs := observer.New(zap.InfoLevel)
+		az := &AzureIdp{
+			MinimumSignatureAlgorithm: "sha256",
+			LogSignatureAlgorithms:    logSignatureAlgorithms,
+			logger:                    zap.New(core),
+		}
+		az.logSignatureAlgorithms(resp, &samllib.Assertion{ID: "_a1"})
+
+		entries := logs.FilterMessage("accepted SAML Response signature algorithms").All()
+		if !logSignatureAlgorithms {
+			if len(entries) != 0 {
+				t.Fatalf("signature algorithms logged while disabled")
+			}
+			continue
+		}
+		if len(entries) != 1 {
+			t.Fatalf("expected 1 log entry, got %d", len(entries))
+		}
+		fields := entries[0].ContextMap()
+		if fields["assertion_id"] != "_a1" || fields["minimum_signature_algorithm"] != "sha256" {
+			t.Errorf("unexpected log fields: %v", fields)
+		}
+		if hashes := fmt.Sprint(fields["hash_algorithms"]); hashes != "[sha256]" {
+			t.Errorf("unexpected hash algorithms %s", hashes)
+		}
+		if algorithms := fmt.Sprint(fields["signature_algorithms"]); !strings.Contains(algorithms, "rsa-sha256") {
+			t.Errorf("unexpected signature algorithms %s", algorithms)
+		}
+	}
+}
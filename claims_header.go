@@ -0,0 +1,113 @@
+package saml
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// ClaimsHeaderParameters are the settings of the response header carrying
+// the claims of the authenticated user as base64url-encoded JSON, e.g. for
+// the backends unable to decode the JWT tokens.
+type ClaimsHeaderParameters struct {
+	// Name is the name of the header. Defaults to X-SAML-Claims.
+	Name string `json:"name,omitempty"`
+	// Claims are the names of the token claims, i.e. after claim_name_map,
+	// the header carries. Defaults to all claims of the token.
+	Claims []string `json:"claims,omitempty"`
+	// RedactedClaims are the names of the claims whose values are
+	// replaced with REDACTED.
+	RedactedClaims []string `json:"redacted_claims,omitempty"`
+	// MaxSize is the maximum size of the encoded header value in bytes.
+	// The header is omitted when the claims exceed the size. Defaults to
+	// 4096.
+	MaxSize int `json:"max_size,omitempty"`
+}
+
+const (
+	defaultClaimsHeaderName    = "X-SAML-Claims"
+	defaultClaimsHeaderMaxSize = 4096
+)
+
+// validate checks the settings and sets the defaults.
+func (h *ClaimsHeaderParameters) validate() error {
+	if h.Name == "" {
+		h.Name = defaultClaimsHeaderName
+	}
+	if strings.ContainsAny(h.Name, " :\t\r\n") {
+		return fmt.Errorf("claims_header.name %q is not a valid header name", h.Name)
+	}
+	h.Name = textproto.CanonicalMIMEHeaderKey(h.Name)
+	switch h.Name {
+	case "Authorization", "Cookie", "Set-Cookie":
+		return fmt.Errorf("claims_header.name %s is reserved", h.Name)
+	}
+	if h.MaxSize < 0 {
+		return fmt.Errorf("claims_header.max_size must not be negative, got %d", h.MaxSize)
+	}
+	if h.MaxSize == 0 {
+		h.MaxSize = defaultClaimsHeaderMaxSize
+	}
+	return nil
+}
+
+// encode returns the base64url-encoded JSON of the selected claims of the
+// token, with the values of the redacted claims replaced.
+func (h *ClaimsHeaderParameters) encode(tokenClaims map[string]interface{}) (string, error) {
+	included := make(map[string]bool)
+	for _, k := range h.Claims {
+		included[k] = true
+	}
+	redacted := make(map[string]bool)
+	for _, k := range h.RedactedClaims {
+		redacted[k] = true
+	}
+	selected := make(map[string]interface{})
+	for k, v := range tokenClaims {
+		if len(included) > 0 && !included[k] {
+			continue
+		}
+		if redacted[k] {
+			v = redactedAttributeValue
+		}
+		selected[k] = v
+	}
+	b, err := json.Marshal(selected)
+	if err != nil {
+		return "", err
+	}
+	value := base64.RawURLEncoding.EncodeToString(b)
+	if len(value) > h.MaxSize {
+		return "", fmt.Errorf("claims header size %d exceeds claims_header.max_size %d", len(value), h.MaxSize)
+	}
+	return value, nil
+}
+
+// setClaimsHeader adds the claims header to the response to the request of
+// the authenticated user.
+func (m AuthProvider) setClaimsHeader(w http.ResponseWriter, claims *UserClaims) error {
+	if m.ClaimsHeader == nil {
+		return nil
+	}
+	value, err := m.ClaimsHeader.encode(m.Jwt.getTokenClaims(*claims))
+	if err != nil {
+		return err
+	}
+	w.Header().Set(m.ClaimsHeader.Name, value)
+	return nil
+}
+
+// logClaimsHeaderError logs the failure to add the claims header. The
+// request proceeds without the header.
+func (m AuthProvider) logClaimsHeaderError(err error) {
+	if err != nil {
+		m.logger.Warn(
+			"failed adding claims header",
+			zap.String("error", err.Error()),
+		)
+	}
+}
@@ -0,0 +1,98 @@
+package saml
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClaimsHeader(t *testing.T) {
+	claims := &UserClaims{
+		Subject: "jsmith@contoso.com",
+		Name:    "John Smith",
+		Email:   "jsmith@contoso.com",
+		Roles:   []string{"Admin", "Reader"},
+		Origin:  "https://sts.windows.net/1b9e886b-8ff2-4378-b6c8-6771259a5f51/",
+	}
+	for _, test := range []struct {
+		name         string
+		header       *ClaimsHeaderParameters
+		excludeNames []string
+		headerName   string
+		expected     map[string]interface{}
+	}{
+		{
+			name:       "selected claims",
+			header:     &ClaimsHeaderParameters{Claims: []string{"sub", "email", "roles"}},
+			headerName: "X-Saml-Claims",
+			expected: map[string]interface{}{
+				"sub":   "jsmith@contoso.com",
+				"email": "jsmith@contoso.com",
+				"roles": []interface{}{"Admin", "Reader"},
+			},
+		},
+		{
+			name:         "redacted and excluded claims",
+			header:       &ClaimsHeaderParameters{Name: "x-user-claims", RedactedClaims: []string{"email"}},
+			excludeNames: []string{"origin"},
+			headerName:   "X-User-Claims",
+			expected: map[string]interface{}{
+				"sub":   "jsmith@contoso.com",
+				"name":  "John Smith",
+				"email": redactedAttributeValue,
+				"roles": []interface{}{"Admin", "Reader"},
+			},
+		},
+		{
+			name:       "size limit",
+			header:     &ClaimsHeaderParameters{MaxSize: 16},
+			headerName: "X-Saml-Claims",
+		},
+	} {
+		if err := test.header.validate(); err != nil {
+			t.Fatalf("%s: failed validating claims header: %s", test.name, err)
+		}
+		m := AuthProvider{
+			CommonParameters: CommonParameters{
+				Jwt:          TokenParameters{ExcludeClaims: test.excludeNames},
+				ClaimsHeader: test.header,
+			},
+		}
+		w := httptest.NewRecorder()
+		err := m.setClaimsHeader(w, claims)
+		value := w.Header().Get(test.headerName)
+		if test.expected == nil {
+			if err == nil || value != "" {
+				t.Errorf("%s: expected the header to be omitted, got %q", test.name, value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed setting claims header: %s", test.name, err)
+			continue
+		}
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			t.Errorf("%s: failed decoding header %q: %s", test.name, value, err)
+			continue
+		}
+		decoded := map[string]interface{}{}
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			t.Errorf("%s: failed decoding claims %s: %s", test.name, b, err)
+			continue
+		}
+		expected, _ := json.Marshal(test.expected)
+		actual, _ := json.Marshal(decoded)
+		if string(actual) != string(expected) {
+			t.Errorf("%s: unexpected claims %s, expected %s", test.name, actual, expected)
+		}
+	}
+
+	for _, name := range []string{"Authorization", "set-cookie", "X Claims"} {
+		h := &ClaimsHeaderParameters{Name: name}
+		if err := h.validate(); err == nil {
+			t.Errorf("claims header name %q passed validation", name)
+		}
+	}
+}
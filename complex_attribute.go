@@ -0,0 +1,200 @@
+package saml
+
+import (
+	"encoding/json"
+	"fmt"
+	samllib "github.com/crewjam/saml"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+)
+
+const (
+	complexAttributeJSON      = "json"
+	complexAttributeDelimited = "delimited"
+)
+
+// defaultComplexAttributeDelimiter is the default delimiter of the
+// delimited attribute values.
+const defaultComplexAttributeDelimiter = ","
+
+// ComplexAttribute decomposes the structured value of the attribute
+// matching the name into multiple claims. An attribute matches the name
+// when the attribute name ends with the name.
+type ComplexAttribute struct {
+	// Attribute is the name of the attribute, e.g. "claims/profile".
+	Attribute string `json:"attribute,omitempty"`
+	// Format is the format of the value: "json" or "delimited".
+	Format string `json:"format,omitempty"`
+	// Delimiter separates the fields of the delimited values. Defaults
+	// to a comma.
+	Delimiter string `json:"delimiter,omitempty"`
+	// Fields map the fields of the value to the claims. The fields of the
+	// JSON values are the keys, with the dots separating the keys of the
+	// nested objects, e.g. "org.department". The fields of the delimited
+	// values are the zero-based positions, e.g. "0". The "name", "email",
+	// and "roles" claims populate the respective claims, and the others
+	// populate the custom claims.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// validateComplexAttributes validates the complex attribute settings.
+func (az *AzureIdp) validateComplexAttributes() error {
+	for i := range az.ComplexAttributes {
+		attr := &az.ComplexAttributes[i]
+		path := fmt.Sprintf("azure.complex_attributes[%d]", i)
+		if attr.Attribute == "" {
+			return newConfigError(path+".attribute", "Azure AD complex attribute has no attribute")
+		}
+		switch attr.Format {
+		case complexAttributeJSON:
+		case complexAttributeDelimited:
+			if attr.Delimiter == "" {
+				attr.Delimiter = defaultComplexAttributeDelimiter
+			}
+			for field := range attr.Fields {
+				if _, err := strconv.Atoi(field); err != nil {
+					return newConfigError(path+".fields", "Azure AD complex attribute %s field %s is not a position", attr.Attribute, field)
+				}
+			}
+		default:
+			return newConfigError(path+".format", "Azure AD complex attribute format %s is not supported", attr.Format)
+		}
+		if len(attr.Fields) == 0 {
+			return newConfigError(path+".fields", "Azure AD complex attribute %s has no fields", attr.Attribute)
+		}
+		for field, claim := range attr.Fields {
+			if claim == "" {
+				return newConfigError(path+".fields", "Azure AD complex attribute %s field %s has no claim", attr.Attribute, field)
+			}
+		}
+	}
+	return nil
+}
+
+// getComplexAttributeNames returns the names of the complex attributes.
+func (az *AzureIdp) getComplexAttributeNames() []string {
+	names := []string{}
+	for _, attr := range az.ComplexAttributes {
+		names = append(names, attr.Attribute)
+	}
+	return names
+}
+
+// decompose returns the values of the fields of the attribute value.
+func (c *ComplexAttribute) decompose(value string) (map[string][]string, error) {
+	fields := make(map[string][]string)
+	switch c.Format {
+	case complexAttributeJSON:
+		var doc interface{}
+		if err := json.Unmarshal([]byte(value), &doc); err != nil {
+			return nil, err
+		}
+		for field := range c.Fields {
+			if values := getJSONFieldValues(doc, strings.Split(field, ".")); len(values) > 0 {
+				fields[field] = values
+			}
+		}
+	case complexAttributeDelimited:
+		parts := strings.Split(value, c.Delimiter)
+		for field := range c.Fields {
+			i, _ := strconv.Atoi(field)
+			if i < 0 || i >= len(parts) {
+				continue
+			}
+			if part := strings.TrimSpace(parts[i]); part != "" {
+				fields[field] = []string{part}
+			}
+		}
+	}
+	return fields, nil
+}
+
+// getJSONFieldValues returns the values at the path of the JSON document.
+// The values are strings, numbers, or booleans, or the arrays of them.
+func getJSONFieldValues(doc interface{}, path []string) []string {
+	for _, key := range path {
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if doc, ok = obj[key]; !ok {
+			return nil
+		}
+	}
+	items := []interface{}{doc}
+	if arr, ok := doc.([]interface{}); ok {
+		items = arr
+	}
+	values := []string{}
+	for _, item := range items {
+		switch v := item.(type) {
+		case string:
+			if v != "" {
+				values = append(values, v)
+			}
+		case float64:
+			values = append(values, strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			values = append(values, strconv.FormatBool(v))
+		}
+	}
+	return values
+}
+
+// mapComplexAttributes populates the claims with the fields of the
+// complex attributes. The name and the email claims found in the
+// attributes of the profile take precedence. The values of the fields
+// pass the attribute filters the same way as the attribute values do.
+func (az *AzureIdp) mapComplexAttributes(claims *UserClaims, profile *attributeProfile, attrs []samllib.Attribute) {
+	for i := range az.ComplexAttributes {
+		complexAttr := &az.ComplexAttributes[i]
+		for _, value := range az.findAttributeValues(attrs, []string{complexAttr.Attribute}) {
+			fields, err := complexAttr.decompose(value)
+			if err != nil {
+				az.logger.Warn(
+					"failed decomposing SAML attribute",
+					zap.String("name", complexAttr.Attribute),
+					zap.String("format", complexAttr.Format),
+					zap.String("error", err.Error()),
+				)
+				continue
+			}
+			for field, values := range fields {
+				claim := complexAttr.Fields[field]
+				names := append([]string{complexAttr.Attribute + "/" + field}, profile.getClaimAttributeNames(claim)...)
+				if values = az.filterValues(names, values); len(values) > 0 {
+					setComplexAttributeClaim(claims, claim, values, az.NormalizeEmail)
+				}
+			}
+		}
+	}
+}
+
+// setComplexAttributeClaim sets the claim to the values of a field.
+func setComplexAttributeClaim(claims *UserClaims, claim string, values []string, normalize bool) {
+	switch claim {
+	case "name":
+		if claims.Name == "" {
+			claims.Name = values[0]
+		}
+	case "email":
+		if claims.Email == "" {
+			claims.Email = values[0]
+			if normalize {
+				claims.Email = normalizeEmail(claims.Email)
+			}
+		}
+	case "roles":
+		claims.Roles = append(claims.Roles, values...)
+	default:
+		if claims.Custom == nil {
+			claims.Custom = make(map[string]interface{})
+		}
+		if len(values) == 1 {
+			claims.Custom[claim] = values[0]
+		} else {
+			claims.Custom[claim] = values
+		}
+	}
+}
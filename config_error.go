@@ -0,0 +1,40 @@
+package saml
+
+import (
+	"fmt"
+)
+
+// ConfigError is a configuration validation error of the setting at the
+// JSON path, e.g. azure.tenant_id, relative to the plugin configuration.
+type ConfigError struct {
+	// Path is the dot-separated JSON path of the setting.
+	Path string
+	// Err is the validation failure.
+	Err error
+}
+
+// newConfigError returns the validation error of the setting at the path.
+func newConfigError(path, format string, args ...interface{}) *ConfigError {
+	return &ConfigError{
+		Path: path,
+		Err:  fmt.Errorf(format, args...),
+	}
+}
+
+// wrapConfigError returns the validation error of the setting at the path
+// caused by the error.
+func wrapConfigError(path string, err error) *ConfigError {
+	return &ConfigError{
+		Path: path,
+		Err:  err,
+	}
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Err)
+}
+
+// Unwrap returns the validation failure.
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
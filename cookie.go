@@ -0,0 +1,34 @@
+package saml
+
+import (
+	"net/http"
+	"time"
+)
+
+// newSessionCookie returns the cookie carrying the JWT token issued
+// upon successful authentication.
+func (p TokenParameters) newSessionCookie(r *http.Request, token string) *http.Cookie {
+	return &http.Cookie{
+		Name:     p.TokenName,
+		Value:    token,
+		Path:     "/",
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// newExpiredSessionCookie returns the cookie instructing a browser to
+// delete the cookie carrying the JWT token.
+func (p TokenParameters) newExpiredSessionCookie(r *http.Request) *http.Cookie {
+	return &http.Cookie{
+		Name:     p.TokenName,
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
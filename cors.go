@@ -0,0 +1,133 @@
+package saml
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORSParameters are the settings of the cross-origin requests to the
+// endpoints of the plugin, e.g. login, whoami, and session endpoints.
+type CORSParameters struct {
+	// AllowedOrigins are the origins, e.g. https://app.contoso.com, allowed
+	// to make the cross-origin requests. The "*" allows any origin.
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+	// AllowedMethods are the methods of the allowed cross-origin requests.
+	// Defaults to GET and POST.
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+	// AllowedHeaders are the request headers of the allowed cross-origin
+	// requests. Defaults to Authorization and Content-Type.
+	AllowedHeaders []string `json:"allowed_headers,omitempty"`
+	// AllowCredentials allows the cross-origin requests with credentials,
+	// e.g. the cookie with the token.
+	AllowCredentials bool `json:"allow_credentials,omitempty"`
+	// MaxAge is the number of seconds the browsers may cache the responses
+	// to the preflight requests. Defaults to 600.
+	MaxAge int `json:"max_age,omitempty"`
+}
+
+const defaultCORSMaxAge = 600
+
+var (
+	defaultCORSAllowedMethods = []string{"GET", "POST"}
+	defaultCORSAllowedHeaders = []string{"Authorization", "Content-Type"}
+)
+
+// validate checks the settings and sets the defaults.
+func (c *CORSParameters) validate() error {
+	if len(c.AllowedOrigins) == 0 {
+		return fmt.Errorf("cors.allowed_origins must not be empty")
+	}
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			if c.AllowCredentials {
+				return fmt.Errorf("cors.allowed_origins must not allow any origin when cors.allow_credentials is enabled")
+			}
+			continue
+		}
+		if !strings.HasPrefix(origin, "https://") && !strings.HasPrefix(origin, "http://") {
+			return fmt.Errorf("cors.allowed_origins entry %s is not an origin, e.g. https://app.contoso.com", origin)
+		}
+	}
+	if len(c.AllowedMethods) == 0 {
+		c.AllowedMethods = defaultCORSAllowedMethods
+	}
+	if len(c.AllowedHeaders) == 0 {
+		c.AllowedHeaders = defaultCORSAllowedHeaders
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultCORSMaxAge
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("cors.max_age must be positive, got %d", c.MaxAge)
+	}
+	return nil
+}
+
+// isAllowedOrigin returns true when the origin may make the cross-origin
+// requests.
+func (c *CORSParameters) isAllowedOrigin(origin string) bool {
+	for _, allowedOrigin := range c.AllowedOrigins {
+		if allowedOrigin == "*" || strings.EqualFold(strings.TrimSuffix(allowedOrigin, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPreflightRequest returns true when the request is a CORS preflight
+// request.
+func isPreflightRequest(r *http.Request) bool {
+	return r.Method == "OPTIONS" && r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// handleCORS sets the CORS headers of the response to the request from an
+// allowed origin, exposing the token header. It responds to the preflight
+// requests and returns true when the response is complete.
+func (c *CORSParameters) handleCORS(w http.ResponseWriter, r *http.Request, tokenHeaderName string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	w.Header().Add("Vary", "Origin")
+	if !c.isAllowedOrigin(origin) {
+		if isPreflightRequest(r) {
+			w.WriteHeader(http.StatusForbidden)
+			return true
+		}
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if c.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !isPreflightRequest(r) {
+		w.Header().Set("Access-Control-Expose-Headers", tokenHeaderName)
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+	w.Header().Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// isEndpointRequest returns true when the request is to one of the
+// endpoints of the plugin, as opposed to the protected resources.
+func (m AuthProvider) isEndpointRequest(r *http.Request) bool {
+	paths := []string{m.AuthURLPath, m.LogoutURLPath, m.WhoamiURLPath}
+	if m.isAzureEnabled() {
+		paths = append(paths, m.MetadataURLPath)
+	}
+	if m.SessionStore != nil {
+		paths = append(paths, m.SessionStore.RevokeURLPath, m.SessionStore.AdminURLPath)
+	}
+	for _, path := range paths {
+		if path != "" && r.URL.Path == path {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package saml
+
+import (
+	"go.uber.org/zap"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	m := AuthProvider{
+		CommonParameters: CommonParameters{
+			AuthURLPath:   "/saml",
+			LogoutURLPath: "/saml/logout",
+			WhoamiURLPath: "/saml/whoami",
+			Jwt:           TokenParameters{TokenName: "JWT_TOKEN"},
+			CORS: &CORSParameters{
+				AllowedOrigins:   []string{"https://app.contoso.com"},
+				AllowCredentials: true,
+			},
+		},
+		UI:     &UserInterface{},
+		logger: zap.NewNop(),
+	}
+	if err := m.CORS.validate(); err != nil {
+		t.Fatalf("failed validating CORS settings: %s", err)
+	}
+	if err := m.UI.validate(); err != nil {
+		t.Fatalf("failed validating UI: %s", err)
+	}
+
+	// Preflight request
+	r := httptest.NewRequest("OPTIONS", "https://localhost:3443/saml/whoami", nil)
+	r.Header.Set("Origin", "https://app.contoso.com")
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	r.Header.Set("Access-Control-Request-Headers", "Authorization")
+	w := httptest.NewRecorder()
+	if _, authenticated, _ := m.Authenticate(w, r); authenticated {
+		t.Fatalf("preflight request was authenticated")
+	}
+	if w.Code != 204 {
+		t.Fatalf("expected preflight status code 204, got %d", w.Code)
+	}
+	for header, expected := range map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.contoso.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "GET, POST",
+		"Access-Control-Allow-Headers":     "Authorization, Content-Type",
+		"Access-Control-Max-Age":           "600",
+		"Vary":                             "Origin",
+	} {
+		if value := w.Header().Get(header); value != expected {
+			t.Errorf("preflight: expected %s header %q, got %q", header, expected, value)
+		}
+	}
+
+	// Simple cross-origin request
+	r = httptest.NewRequest("GET", "https://localhost:3443/saml/whoami", nil)
+	r.Header.Set("Origin", "https://app.contoso.com")
+	w = httptest.NewRecorder()
+	m.Authenticate(w, r)
+	if w.Code != 401 {
+		t.Fatalf("expected status code 401, got %d", w.Code)
+	}
+	if value := w.Header().Get("Access-Control-Allow-Origin"); value != "https://app.contoso.com" {
+		t.Fatalf("unexpected Access-Control-Allow-Origin: %q", value)
+	}
+	if value := w.Header().Get("Access-Control-Expose-Headers"); value != "Authorization" {
+		t.Fatalf("unexpected Access-Control-Expose-Headers: %q", value)
+	}
+
+	// Disallowed origin
+	r = httptest.NewRequest("OPTIONS", "https://localhost:3443/saml/whoami", nil)
+	r.Header.Set("Origin", "https://evil.com")
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	w = httptest.NewRecorder()
+	m.Authenticate(w, r)
+	if w.Code != 403 {
+		t.Fatalf("expected status code 403 for disallowed origin, got %d", w.Code)
+	}
+	if value := w.Header().Get("Access-Control-Allow-Origin"); value != "" {
+		t.Fatalf("disallowed origin got Access-Control-Allow-Origin: %q", value)
+	}
+
+	// Protected resources are not affected
+	r = httptest.NewRequest("GET", "https://localhost:3443/app", nil)
+	r.Header.Set("Origin", "https://app.contoso.com")
+	w = httptest.NewRecorder()
+	m.Authenticate(w, r)
+	if value := w.Header().Get("Access-Control-Allow-Origin"); value != "" {
+		t.Fatalf("protected resource got Access-Control-Allow-Origin: %q", value)
+	}
+}
+
+func TestCORSValidation(t *testing.T) {
+	for _, c := range []*CORSParameters{
+		{},
+		{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+		{AllowedOrigins: []string{"app.contoso.com"}},
+		{AllowedOrigins: []string{"https://app.contoso.com"}, MaxAge: -1},
+	} {
+		if err := c.validate(); err == nil {
+			t.Errorf("invalid CORS settings passed validation: %+v", c)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package saml
+
+import (
+	"fmt"
+	samllib "github.com/crewjam/saml"
+	"sort"
+	"sync"
+)
+
+// AssertionContext is the data a ClaimEnricher receives along with the
+// claims mapped from the attributes of an assertion.
+type AssertionContext struct {
+	// Assertion is the decoded assertion validated by a service provider.
+	// Its Subject, Conditions, AuthnStatements, and AttributeStatements are
+	// the parsed elements of the assertion.
+	Assertion *samllib.Assertion
+	// RawResponse is the decoded, i.e. XML, SAML Response the assertion
+	// was found in. It allows extracting the elements the Assertion does
+	// not parse, e.g. signed Advice.
+	RawResponse []byte
+	// ServiceProvider is the service provider validating the assertion.
+	ServiceProvider *samllib.ServiceProvider
+}
+
+// String returns the description of the context. The raw response is
+// omitted, so that formatting the context for logging does not leak it.
+func (c *AssertionContext) String() string {
+	return fmt.Sprintf("AssertionContext{Assertion: %s, RawResponse: %d bytes}", c.Assertion.ID, len(c.RawResponse))
+}
+
+// ClaimEnricher adds custom claims beyond the built-in attribute mapping.
+// An error returned by an enricher fails the authentication.
+type ClaimEnricher interface {
+	EnrichClaims(ctx *AssertionContext, claims *UserClaims) error
+}
+
+// ClaimEnricherFunc is an adapter allowing the use of a function as
+// a ClaimEnricher.
+type ClaimEnricherFunc func(ctx *AssertionContext, claims *UserClaims) error
+
+// EnrichClaims calls f(ctx, claims).
+func (f ClaimEnricherFunc) EnrichClaims(ctx *AssertionContext, claims *UserClaims) error {
+	return f(ctx, claims)
+}
+
+var (
+	claimEnrichersMu sync.RWMutex
+	claimEnrichers   = map[string]ClaimEnricher{}
+)
+
+// RegisterClaimEnricher makes a claim enricher available by the name in
+// the claim_enrichers configuration of the providers. It is intended to be
+// called from the init function of the packages implementing enrichers.
+// It panics when the name is already registered.
+func RegisterClaimEnricher(name string, enricher ClaimEnricher) {
+	claimEnrichersMu.Lock()
+	defer claimEnrichersMu.Unlock()
+	if name == "" {
+		panic("claim enricher name is empty")
+	}
+	if enricher == nil {
+		panic("claim enricher " + name + " is nil")
+	}
+	if _, exists := claimEnrichers[name]; exists {
+		panic("claim enricher " + name + " is already registered")
+	}
+	claimEnrichers[name] = enricher
+}
+
+// getClaimEnricher returns the registered claim enricher.
+func getClaimEnricher(name string) (ClaimEnricher, bool) {
+	claimEnrichersMu.RLock()
+	defer claimEnrichersMu.RUnlock()
+	enricher, exists := claimEnrichers[name]
+	return enricher, exists
+}
+
+// getClaimEnricherNames returns the names of the registered enrichers.
+func getClaimEnricherNames() []string {
+	claimEnrichersMu.RLock()
+	defer claimEnrichersMu.RUnlock()
+	names := []string{}
+	for name := range claimEnrichers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateClaimEnrichers checks that the claim enrichers are registered.
+func (az *AzureIdp) validateClaimEnrichers() error {
+	for _, name := range az.ClaimEnrichers {
+		if _, exists := getClaimEnricher(name); !exists {
+			return newConfigError("azure.claim_enrichers", "Azure AD claim enricher %s is not registered, registered: %v", name, getClaimEnricherNames())
+		}
+	}
+	return nil
+}
+
+// enrichClaims runs the claim enrichers in the configured order.
+func (az *AzureIdp) enrichClaims(ctx *AssertionContext, claims *UserClaims) error {
+	for _, name := range az.ClaimEnrichers {
+		enricher, exists := getClaimEnricher(name)
+		if !exists {
+			return fmt.Errorf("claim enricher %s is not registered", name)
+		}
+		if err := enricher.EnrichClaims(ctx, claims); err != nil {
+			return fmt.Errorf("claim enricher %s failed: %s", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package saml
+
+import (
+	"fmt"
+	samllib "github.com/crewjam/saml"
+	"strings"
+	"testing"
+)
+
+func TestClaimEnrichers(t *testing.T) {
+	RegisterClaimEnricher("test_department", ClaimEnricherFunc(func(ctx *AssertionContext, claims *UserClaims) error {
+		if !strings.Contains(string(ctx.RawResponse), "<saml:Advice>") {
+			return fmt.Errorf("advice not found")
+		}
+		if claims.Custom == nil {
+			claims.Custom = make(map[string]interface{})
+		}
+		claims.Custom["department"] = "Engineering"
+		claims.Custom["assertion_id"] = ctx.Assertion.ID
+		return nil
+	}))
+
+	az := &AzureIdp{ClaimEnrichers: []string{"test_department"}}
+	if err := az.validateClaimEnrichers(); err != nil {
+		t.Fatalf("unexpected validation error: %s", err)
+	}
+	ctx := &AssertionContext{
+		Assertion:   &samllib.Assertion{ID: "_a1"},
+		RawResponse: []byte(`<samlp:Response><saml:Assertion ID="_a1"><saml:Advice></saml:Advice></saml:Assertion></samlp:Response>`),
+	}
+	claims := UserClaims{}
+	if err := az.enrichClaims(ctx, &claims); err != nil {
+		t.Fatalf("unexpected enrichment error: %s", err)
+	}
+	if claims.Custom["department"] != "Engineering" || claims.Custom["assertion_id"] != "_a1" {
+		t.Fatalf("unexpected custom claims: %v", claims.Custom)
+	}
+
+	ctx.RawResponse = []byte(`<samlp:Response></samlp:Response>`)
+	if err := az.enrichClaims(ctx, &UserClaims{}); err == nil {
+		t.Fatalf("expected enrichment error, got none")
+	}
+
+	if s := fmt.Sprintf("%v", ctx); strings.Contains(s, "samlp:Response") {
+		t.Fatalf("formatted context contains raw response: %s", s)
+	}
+
+	az = &AzureIdp{ClaimEnrichers: []string{"test_unknown"}}
+	if err := az.validateClaimEnrichers(); err == nil {
+		t.Fatalf("expected validation error for unregistered enricher, got none")
+	}
+}
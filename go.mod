@@ -3,8 +3,10 @@ module github.com/trajche/caddy-auth-saml
 go 1.14
 
 require (
+	github.com/beevik/etree v1.1.0
 	github.com/caddyserver/caddy/v2 v2.0.0-test.4
 	github.com/crewjam/saml v0.4.0
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	go.uber.org/zap v1.14.1
+	golang.org/x/text v0.3.2
 )
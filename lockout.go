@@ -0,0 +1,174 @@
+package saml
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultLockoutMaxFailures is the default number of the login
+	// failures within the window locking out the client IP or the user.
+	defaultLockoutMaxFailures = 5
+	// defaultLockoutWindow is the default number of seconds the login
+	// failures are counted within.
+	defaultLockoutWindow = 900
+)
+
+// failureCounter counts the login failures. The session stores implement
+// it, so that the counts are shared the same way as the sessions are.
+type failureCounter interface {
+	incrementFailures(key string, window time.Duration) (int, error)
+	getFailures(key string) (int, error)
+	resetFailures(key string) error
+}
+
+// LockoutParameters represent the settings of the temporary lockout of
+// the client IPs and the users after repeated login failures.
+type LockoutParameters struct {
+	// MaxFailures is the number of the login failures within the window
+	// past which the client IP or the user is locked out. Defaults to 5.
+	MaxFailures int `json:"max_failures,omitempty"`
+	// Window is the number of seconds since the first failure the
+	// failures are counted within. The lockout lasts until the window
+	// ends. Defaults to 900, i.e. 15 minutes.
+	Window  int `json:"window,omitempty"`
+	counter failureCounter
+}
+
+// lockoutError is returned when the client IP or the user is locked out.
+type lockoutError struct{}
+
+func (e *lockoutError) Error() string {
+	return "Too many failed login attempts, try again later"
+}
+
+// validate checks the settings and sets the defaults.
+func (p *LockoutParameters) validate() error {
+	if p.MaxFailures < 0 {
+		return fmt.Errorf("lockout.max_failures must not be negative")
+	}
+	if p.MaxFailures == 0 {
+		p.MaxFailures = defaultLockoutMaxFailures
+	}
+	if p.Window < 0 {
+		return fmt.Errorf("lockout.window must not be negative")
+	}
+	if p.Window == 0 {
+		p.Window = defaultLockoutWindow
+	}
+	return nil
+}
+
+// getLockoutKeys returns the keys the failures of the request and of the
+// user, if known, are counted under.
+func getLockoutKeys(clientIP, userID string) []string {
+	keys := []string{"ip:" + clientIP}
+	if userID != "" {
+		keys = append(keys, getUserLockoutKey(userID))
+	}
+	return keys
+}
+
+// getUserLockoutKey returns the key the failures of the user are counted
+// under. The user IDs are compared case-insensitively.
+func getUserLockoutKey(userID string) string {
+	return "user:" + strings.ToLower(userID)
+}
+
+// loadFailureCounter sets the counter to the memory one of the plugin
+// instance from the state pool, so that the failures survive config
+// reloads. It returns the key of the counter in the pool.
+func (p *LockoutParameters) loadFailureCounter(instanceKey string) (string, error) {
+	key := "lockout/" + instanceKey
+	value, err := loadPooledState(key, func() (interface{}, error) {
+		return newMemorySessionStore(), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	p.counter = value.(failureCounter)
+	return key, nil
+}
+
+// isLockedOut returns true when any of the keys reached the maximum
+// number of failures.
+func (p *LockoutParameters) isLockedOut(keys []string) (bool, error) {
+	for _, key := range keys {
+		count, err := p.counter.getFailures(key)
+		if err != nil {
+			return false, err
+		}
+		if count >= p.MaxFailures {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// recordFailure counts a login failure of each of the keys.
+func (p *LockoutParameters) recordFailure(keys []string) error {
+	for _, key := range keys {
+		if _, err := p.counter.incrementFailures(key, time.Duration(p.Window)*time.Second); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reset clears the failures of the keys upon a successful login.
+func (p *LockoutParameters) reset(keys []string) error {
+	for _, key := range keys {
+		if err := p.counter.resetFailures(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLockout returns lockoutError when the client IP or the user is
+// locked out. The errors of the store are logged, and do not lock out.
+func (m AuthProvider) checkLockout(r *http.Request, userID string) error {
+	if m.Lockout == nil {
+		return nil
+	}
+	lockedOut, err := m.Lockout.isLockedOut(getLockoutKeys(getClientIP(r, m.clientIPProxies), userID))
+	if err != nil {
+		m.logger.Error(
+			"failed checking login lockout",
+			zap.String("error", err.Error()),
+		)
+		return nil
+	}
+	if lockedOut {
+		return &lockoutError{}
+	}
+	return nil
+}
+
+// recordLoginResult counts the failed login of the client IP and of the
+// user, if known, or clears the failures of the user upon a successful
+// login. The failures of the client IP are kept, so that the successful
+// logins from the IP do not clear the failures of the other users.
+func (m AuthProvider) recordLoginResult(r *http.Request, userID string, loginErr error) {
+	if m.Lockout == nil {
+		return
+	}
+	if _, lockedOut := loginErr.(*lockoutError); lockedOut {
+		return
+	}
+	var err error
+	if loginErr != nil {
+		err = m.Lockout.recordFailure(getLockoutKeys(getClientIP(r, m.clientIPProxies), userID))
+	} else if userID != "" {
+		err = m.Lockout.reset([]string{getUserLockoutKey(userID)})
+	}
+	if err != nil {
+		m.logger.Error(
+			"failed recording login result",
+			zap.String("error", err.Error()),
+		)
+	}
+}
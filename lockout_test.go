@@ -0,0 +1,156 @@
+package saml
+
+import (
+	"go.uber.org/zap"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	m := AuthProvider{
+		CommonParameters: CommonParameters{
+			Lockout: &LockoutParameters{MaxFailures: 3},
+		},
+		logger: zap.NewNop(),
+	}
+	if err := m.Lockout.validate(); err != nil {
+		t.Fatalf("unexpected validation error: %s", err)
+	}
+	if m.Lockout.Window != defaultLockoutWindow {
+		t.Fatalf("unexpected default window: %d", m.Lockout.Window)
+	}
+	m.Lockout.counter = newMemorySessionStore()
+
+	r := httptest.NewRequest("POST", "/saml", nil)
+	r.RemoteAddr = "192.0.2.10:51000"
+	otherIP := httptest.NewRequest("POST", "/saml", nil)
+	otherIP.RemoteAddr = "192.0.2.20:51000"
+	loginErr := &authorizationError{}
+
+	// The failures of the client IP trigger the lockout of the IP.
+	for i := 0; i < 3; i++ {
+		if err := m.checkLockout(r, ""); err != nil {
+			t.Fatalf("failure %d: unexpected lockout", i+1)
+		}
+		m.recordLoginResult(r, "", loginErr)
+	}
+	if _, ok := m.checkLockout(r, "").(*lockoutError); !ok {
+		t.Fatalf("expected lockout of client IP after 3 failures")
+	}
+	if err := m.checkLockout(otherIP, ""); err != nil {
+		t.Fatalf("unexpected lockout of another client IP: %s", err)
+	}
+	if code := m.getFailureStatusCode(&lockoutError{}); code != 429 {
+		t.Fatalf("expected status code 429 for lockout, got %d", code)
+	}
+
+	// The failures of the user trigger the lockout of the user from any
+	// client IP.
+	for i := 0; i < 3; i++ {
+		m.recordLoginResult(otherIP, "JSmith@contoso.com", loginErr)
+	}
+	if _, ok := m.checkLockout(otherIP, "jsmith@contoso.com").(*lockoutError); !ok {
+		t.Fatalf("expected lockout of user after 3 failures")
+	}
+
+	// The successful login clears the lockout of the user, but not of the
+	// client IP.
+	m.recordLoginResult(r, "jsmith@contoso.com", nil)
+	thirdIP := httptest.NewRequest("POST", "/saml", nil)
+	thirdIP.RemoteAddr = "192.0.2.30:51000"
+	if err := m.checkLockout(thirdIP, "jsmith@contoso.com"); err != nil {
+		t.Fatalf("unexpected lockout of user after successful login: %s", err)
+	}
+	if _, ok := m.checkLockout(r, "").(*lockoutError); !ok {
+		t.Fatalf("expected lockout of client IP to survive successful login")
+	}
+
+	// The failures expire along with the window.
+	store := newMemorySessionStore()
+	if _, err := store.incrementFailures("ip:192.0.2.10", 10*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if count, _ := store.getFailures("ip:192.0.2.10"); count != 0 {
+		t.Fatalf("expected expired failures, got %d", count)
+	}
+
+	for i, params := range []*LockoutParameters{
+		{MaxFailures: -1},
+		{Window: -1},
+	} {
+		if err := params.validate(); err == nil {
+			t.Errorf("test %d: expected validation error, got none", i)
+		}
+	}
+}
+
+func TestLockoutFailureCounter(t *testing.T) {
+	params := &LockoutParameters{}
+	poolKey, err := params.loadFailureCounter("/saml|https://app.contoso.com/saml")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer releasePooledState([]string{poolKey})
+	if _, err := params.counter.incrementFailures("ip:192.0.2.10", time.Minute); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The reloaded instance keeps counting the failures.
+	reloaded := &LockoutParameters{}
+	reloadedPoolKey, err := reloaded.loadFailureCounter("/saml|https://app.contoso.com/saml")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer releasePooledState([]string{reloadedPoolKey})
+	if count, _ := reloaded.counter.getFailures("ip:192.0.2.10"); count != 1 {
+		t.Fatalf("expected 1 failure after reload, got %d", count)
+	}
+
+	// The instance of another site, and the session store of the same
+	// instance, count their own failures.
+	other := &LockoutParameters{}
+	otherPoolKey, err := other.loadFailureCounter("/saml|https://portal.contoso.com/saml")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer releasePooledState([]string{otherPoolKey})
+	if count, _ := other.counter.getFailures("ip:192.0.2.10"); count != 0 {
+		t.Fatalf("expected no failures of another site, got %d", count)
+	}
+	store, storePoolKey, err := (&SessionStoreParameters{}).loadSessionStore("/saml|https://app.contoso.com/saml")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer releasePooledState([]string{storePoolKey})
+	if count, _ := store.(failureCounter).getFailures("ip:192.0.2.10"); count != 0 {
+		t.Fatalf("expected no failures in the session store, got %d", count)
+	}
+}
+
+func TestRedisLockout(t *testing.T) {
+	server := newFakeRedisServer(t)
+	defer server.listener.Close()
+
+	store := newRedisSessionStore(server.listener.Addr().String(), "secret", 0, defaultRedisKeyPrefix)
+	defer store.Close()
+	for i := 1; i <= 2; i++ {
+		count, err := store.incrementFailures("user:jsmith@contoso.com", time.Minute)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if count != i {
+			t.Fatalf("expected %d failures, got %d", i, count)
+		}
+	}
+	if count, err := store.getFailures("user:jsmith@contoso.com"); err != nil || count != 2 {
+		t.Fatalf("expected 2 failures, got %d: %v", count, err)
+	}
+	if err := store.resetFailures("user:jsmith@contoso.com"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if count, err := store.getFailures("user:jsmith@contoso.com"); err != nil || count != 0 {
+		t.Fatalf("expected no failures after reset, got %d: %v", count, err)
+	}
+}
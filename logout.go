@@ -0,0 +1,40 @@
+package saml
+
+import (
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// handleLogout terminates the local session by deleting the cookie with
+// the JWT token and redirects the browser to the post-logout redirect URL.
+// Without the post-logout redirect URL, the logout confirmation page with
+// a link to the login page is rendered instead. When the session store is
+// enabled, the session of the token is revoked.
+func (m AuthProvider) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if m.Jwt.sessions != nil {
+		if claims, _, err := m.Jwt.validateRequestToken(r); err == nil {
+			if err := m.Jwt.sessions.Revoke(claims.SessionID); err != nil {
+				m.logger.Error(
+					"failed revoking session",
+					zap.String("session_id", claims.SessionID),
+					zap.String("error", err.Error()),
+				)
+			}
+		}
+	}
+	http.SetCookie(w, m.Jwt.newExpiredSessionCookie(r))
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if m.PostLogoutRedirectURL == "" {
+		args := m.UI.newUserInterfaceArgs()
+		args.Title = "Signed Out"
+		args.Message = "You have been signed out."
+		if err := m.UI.renderLogout(w, args); err != nil {
+			m.logger.Error(
+				"failed rendering logout page",
+				zap.String("error", err.Error()),
+			)
+		}
+		return
+	}
+	http.Redirect(w, r, m.PostLogoutRedirectURL, http.StatusSeeOther)
+}
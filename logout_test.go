@@ -0,0 +1,121 @@
+package saml
+
+import (
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogoutRedirect(t *testing.T) {
+	m := AuthProvider{
+		CommonParameters: CommonParameters{
+			Jwt:                   TokenParameters{TokenName: "JWT_TOKEN"},
+			PostLogoutRedirectURL: "https://localhost:3443/app",
+		},
+	}
+	r := httptest.NewRequest("GET", "https://localhost:3443/saml/logout", nil)
+	w := httptest.NewRecorder()
+	m.handleLogout(w, r)
+
+	if w.Code != 303 {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+	if location := w.Header().Get("Location"); location != "https://localhost:3443/app" {
+		t.Fatalf("unexpected redirect target: %s", location)
+	}
+	if cookie := w.Header().Get("Set-Cookie"); !strings.HasPrefix(cookie, "JWT_TOKEN=;") {
+		t.Fatalf("session cookie was not deleted: %s", cookie)
+	}
+}
+
+func TestLogoutConfirmation(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "caddy-auth-saml")
+	if err != nil {
+		t.Fatalf("failed creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	logoutTemplateLocation := filepath.Join(tmpDir, "logout.template")
+	logoutTemplate := `<html><h1>{{ .Title }}</h1><img src="{{ .LogoURL }}"><a href="{{ .AuthEndpoint }}">Sign in again</a></html>`
+	if err := ioutil.WriteFile(logoutTemplateLocation, []byte(logoutTemplate), 0600); err != nil {
+		t.Fatalf("failed writing logout template: %s", err)
+	}
+
+	for _, test := range []struct {
+		name                   string
+		logoutTemplateLocation string
+		expected               []string
+	}{
+		{
+			name:     "default logout page",
+			expected: []string{"<title>Signed Out</title>", "You have been signed out.", `<img src="/logo.png" alt="Contoso">`, `<a href="/saml">Sign In</a>`},
+		},
+		{
+			name:                   "custom logout page",
+			logoutTemplateLocation: logoutTemplateLocation,
+			expected:               []string{"<h1>Signed Out</h1>", `<img src="/logo.png">`, `<a href="/saml">Sign in again</a>`},
+		},
+	} {
+		m := AuthProvider{
+			CommonParameters: CommonParameters{
+				Jwt: TokenParameters{TokenName: "JWT_TOKEN"},
+			},
+			UI: &UserInterface{
+				LogoURL:                "/logo.png",
+				LogoDescription:        "Contoso",
+				AuthEndpoint:           "/saml",
+				LogoutTemplateLocation: test.logoutTemplateLocation,
+			},
+			logger: zap.NewNop(),
+		}
+		if err := m.UI.validate(); err != nil {
+			t.Fatalf("%s: failed validating UI: %s", test.name, err)
+		}
+		r := httptest.NewRequest("GET", "https://localhost:3443/saml/logout", nil)
+		w := httptest.NewRecorder()
+		m.handleLogout(w, r)
+
+		if w.Code != 200 {
+			t.Fatalf("%s: unexpected status code: %d", test.name, w.Code)
+		}
+		if cookie := w.Header().Get("Set-Cookie"); !strings.HasPrefix(cookie, "JWT_TOKEN=;") {
+			t.Fatalf("%s: session cookie was not deleted: %s", test.name, cookie)
+		}
+		body := w.Body.String()
+		for _, s := range test.expected {
+			if !strings.Contains(body, s) {
+				t.Errorf("%s: %q not found in logout page: %s", test.name, s, body)
+			}
+		}
+	}
+
+	ui := &UserInterface{LogoutTemplateLocation: filepath.Join(tmpDir, "missing.template")}
+	if err := ui.validate(); err == nil {
+		t.Fatalf("missing logout template passed validation")
+	}
+}
+
+func TestIsSafeRedirectURL(t *testing.T) {
+	allowedHosts := []string{"localhost:3443", "mygatekeeper"}
+	for _, test := range []struct {
+		target string
+		safe   bool
+	}{
+		{target: "/saml", safe: true},
+		{target: "https://localhost:3443/app", safe: true},
+		{target: "https://MYGATEKEEPER/", safe: true},
+		{target: "", safe: false},
+		{target: "saml", safe: false},
+		{target: "//evil.com/", safe: false},
+		{target: "/\\evil.com/", safe: false},
+		{target: "https://evil.com/", safe: false},
+		{target: "javascript:alert(1)", safe: false},
+	} {
+		if safe := isSafeRedirectURL(test.target, allowedHosts); safe != test.safe {
+			t.Errorf("redirect target %q: expected safe=%t, got %t", test.target, test.safe, safe)
+		}
+	}
+}
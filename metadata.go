@@ -0,0 +1,208 @@
+package saml
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	samllib "github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMetadataMinTLSVersion = "1.2"
+	// metadataFetchTimeout bounds the fetch of IdP metadata, including
+	// reading the body, so that an unresponsive server does not stall the
+	// config load.
+	metadataFetchTimeout = 30 * time.Second
+	// maxMetadataSize is the maximum size, in bytes, of IdP metadata. It
+	// accommodates federation metadata aggregates.
+	maxMetadataSize = 64 << 20
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// getTLSVersion returns the TLS version with the name, e.g. "1.2".
+func getTLSVersion(name string) (uint16, error) {
+	version, exists := tlsVersions[name]
+	if !exists {
+		return 0, fmt.Errorf("TLS version %s is not supported", name)
+	}
+	return version, nil
+}
+
+// getCipherSuites returns the IDs of the TLS cipher suites with the
+// names. The insecure cipher suites are not supported.
+func getCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	supported := make(map[string]uint16)
+	for _, cipherSuite := range tls.CipherSuites() {
+		supported[cipherSuite.Name] = cipherSuite.ID
+	}
+	ids := []uint16{}
+	for _, name := range names {
+		id, exists := supported[name]
+		if !exists {
+			return nil, fmt.Errorf("TLS cipher suite %s is not supported", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// newMetadataClient returns the HTTP client fetching IdP metadata with
+// the minimum TLS version and the cipher suites.
+func newMetadataClient(minVersion uint16, cipherSuites []uint16) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+	}
+	return &http.Client{Transport: transport, Timeout: metadataFetchTimeout}
+}
+
+// getMetadataClient returns the HTTP client fetching IdP metadata. Before
+// Validate, it enforces the default minimum TLS version.
+func (az *AzureIdp) getMetadataClient() *http.Client {
+	if az.metadataClient == nil {
+		minVersion, _ := getTLSVersion(defaultMetadataMinTLSVersion)
+		az.metadataClient = newMetadataClient(minVersion, nil)
+	}
+	return az.metadataClient
+}
+
+// loadIdpMetadata fetches IdP metadata from a URL or reads it from a file.
+// When IdpEntityID is set, the metadata may describe multiple entities,
+// and the IdP with the entity ID is selected.
+func (az *AzureIdp) loadIdpMetadata() (*samllib.EntityDescriptor, error) {
+	if strings.HasPrefix(az.IdpMetadataLocation, "http") {
+		idpMetadataURL, err := url.Parse(az.IdpMetadataLocation)
+		if err != nil {
+			return nil, err
+		}
+		az.IdpMetadataURL = idpMetadataURL
+		metadataContent, err := fetchMetadataDocument(az.getMetadataClient(), idpMetadataURL)
+		if err != nil {
+			return nil, err
+		}
+		if az.IdpEntityID == "" {
+			return samlsp.ParseMetadata(metadataContent)
+		}
+		return parseIdpMetadata(metadataContent, az.IdpEntityID)
+	}
+	metadataFileContent, err := ioutil.ReadFile(az.IdpMetadataLocation)
+	if err != nil {
+		return nil, err
+	}
+	if az.IdpEntityID == "" {
+		return samlsp.ParseMetadata(metadataFileContent)
+	}
+	return parseIdpMetadata(metadataFileContent, az.IdpEntityID)
+}
+
+// fetchMetadataDocument downloads the metadata document of at most
+// maxMetadataSize bytes.
+func fetchMetadataDocument(client *http.Client, metadataURL *url.URL) ([]byte, error) {
+	resp, err := client.Get(metadataURL.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed fetching metadata from %s: %s", metadataURL, resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMetadataSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxMetadataSize {
+		return nil, fmt.Errorf("failed fetching metadata from %s: metadata exceeds %d bytes", metadataURL, maxMetadataSize)
+	}
+	return b, nil
+}
+
+// parseIdpMetadata returns the descriptor of the IdP with the entity ID.
+// The metadata is either a single entity descriptor or an aggregate of
+// entity descriptors, e.g. federation metadata.
+func parseIdpMetadata(b []byte, entityID string) (*samllib.EntityDescriptor, error) {
+	entity := &samllib.EntityDescriptor{}
+	if err := xml.Unmarshal(b, entity); err == nil {
+		if entity.EntityID != entityID || len(entity.IDPSSODescriptors) == 0 {
+			return nil, fmt.Errorf("IdP entity %s not found in metadata", entityID)
+		}
+		return entity, nil
+	}
+	entities := &samllib.EntitiesDescriptor{}
+	if err := xml.Unmarshal(b, entities); err != nil {
+		return nil, fmt.Errorf("malformed metadata: %s", err)
+	}
+	if entity := findIdpEntity(entities, entityID); entity != nil {
+		return entity, nil
+	}
+	return nil, fmt.Errorf("IdP entity %s not found in metadata", entityID)
+}
+
+// findIdpEntity searches the aggregate, including nested aggregates, for
+// the IdP with the entity ID.
+func findIdpEntity(entities *samllib.EntitiesDescriptor, entityID string) *samllib.EntityDescriptor {
+	for i := range entities.EntityDescriptors {
+		entity := &entities.EntityDescriptors[i]
+		if entity.EntityID == entityID && len(entity.IDPSSODescriptors) > 0 {
+			return entity
+		}
+	}
+	for i := range entities.EntitiesDescriptors {
+		if entity := findIdpEntity(&entities.EntitiesDescriptors[i], entityID); entity != nil {
+			return entity
+		}
+	}
+	return nil
+}
+
+// getIdpSigningCerts returns the signing certificates found in the IdP
+// SSO descriptors of IdP metadata. A key descriptor without use applies
+// to both signing and encryption.
+func getIdpSigningCerts(idpMetadata *samllib.EntityDescriptor) []string {
+	certs := []string{}
+	for _, idpSSODescriptor := range idpMetadata.IDPSSODescriptors {
+		for _, keyDescriptor := range idpSSODescriptor.KeyDescriptors {
+			if keyDescriptor.Use != "" && keyDescriptor.Use != "signing" {
+				continue
+			}
+			cert := strings.Join(strings.Fields(keyDescriptor.KeyInfo.Certificate), "")
+			if cert == "" {
+				continue
+			}
+			certs = append(certs, cert)
+		}
+	}
+	return certs
+}
+
+// validateSignCertInMetadata checks that the configured IdP signing
+// certificate is one of the signing certificates of IdP metadata. The
+// check is skipped when IdP metadata has no signing certificates.
+func validateSignCertInMetadata(cert string, metadataCerts []string) error {
+	if len(metadataCerts) == 0 {
+		return nil
+	}
+	cert = strings.Join(strings.Fields(cert), "")
+	for _, metadataCert := range metadataCerts {
+		if metadataCert == cert {
+			return nil
+		}
+	}
+	return fmt.Errorf("IdP Signing Certificate not found among %d signing certificates in IdP metadata", len(metadataCerts))
+}
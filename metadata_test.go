@@ -0,0 +1,243 @@
+package saml
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"github.com/crewjam/saml/samlsp"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestGetIdpSigningCerts(t *testing.T) {
+	metadataFile := "assets/idp/azure_ad_app_metadata.xml"
+	metadataFileContent, err := ioutil.ReadFile(metadataFile)
+	if err != nil {
+		t.Fatalf("failed reading %s: %s", metadataFile, err)
+	}
+	idpMetadata, err := samlsp.ParseMetadata(metadataFileContent)
+	if err != nil {
+		t.Fatalf("failed parsing %s: %s", metadataFile, err)
+	}
+	if certs := getIdpSigningCerts(idpMetadata); len(certs) == 0 {
+		t.Fatalf("signing certificates not found in %s", metadataFile)
+	}
+
+	idpMetadata, err = samlsp.ParseMetadata([]byte(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.contoso.com/">` +
+		`<IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">` +
+		`<SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.contoso.com/sso"/>` +
+		`</IDPSSODescriptor></EntityDescriptor>`))
+	if err != nil {
+		t.Fatalf("failed parsing metadata: %s", err)
+	}
+	if certs := getIdpSigningCerts(idpMetadata); len(certs) != 0 {
+		t.Fatalf("unexpected signing certificates: %v", certs)
+	}
+}
+
+func TestParseIdpMetadataWithEntityID(t *testing.T) {
+	metadataFile := "assets/idp/federation_metadata.xml"
+	metadataFileContent, err := ioutil.ReadFile(metadataFile)
+	if err != nil {
+		t.Fatalf("failed reading %s: %s", metadataFile, err)
+	}
+	for _, test := range []struct {
+		entityID    string
+		ssoLocation string
+		shouldFail  bool
+	}{
+		{
+			entityID:    "https://idp.university-b.edu/idp/shibboleth",
+			ssoLocation: "https://idp.university-b.edu/idp/profile/SAML2/Redirect/SSO",
+		},
+		{
+			entityID:    "https://idp.university-c.edu/idp/shibboleth",
+			ssoLocation: "https://idp.university-c.edu/idp/profile/SAML2/Redirect/SSO",
+		},
+		{
+			entityID:   "https://sp.example.edu/shibboleth",
+			shouldFail: true,
+		},
+		{
+			entityID:   "https://idp.university-d.edu/idp/shibboleth",
+			shouldFail: true,
+		},
+	} {
+		idpMetadata, err := parseIdpMetadata(metadataFileContent, test.entityID)
+		if test.shouldFail {
+			if err == nil {
+				t.Errorf("%s: expected failure, got success", test.entityID)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: expected success, got %s", test.entityID, err)
+		}
+		if idpMetadata.EntityID != test.entityID {
+			t.Fatalf("%s: selected wrong entity %s", test.entityID, idpMetadata.EntityID)
+		}
+		if location := idpMetadata.IDPSSODescriptors[0].SingleSignOnServices[0].Location; location != test.ssoLocation {
+			t.Fatalf("%s: unexpected SSO location %s", test.entityID, location)
+		}
+	}
+
+	metadataFile = "assets/idp/azure_ad_app_metadata.xml"
+	metadataFileContent, err = ioutil.ReadFile(metadataFile)
+	if err != nil {
+		t.Fatalf("failed reading %s: %s", metadataFile, err)
+	}
+	if _, err := parseIdpMetadata(metadataFileContent, "https://sts.windows.net/1b9e886b-8ff2-4378-b6c8-6771259a5f51/"); err != nil {
+		t.Fatalf("failed selecting entity in single entity metadata: %s", err)
+	}
+	if _, err := parseIdpMetadata(metadataFileContent, "https://idp.university-b.edu/idp/shibboleth"); err == nil {
+		t.Fatalf("selected entity not present in single entity metadata")
+	}
+}
+
+func TestValidateSignCertInMetadata(t *testing.T) {
+	idpCertPEM, _, idpCert := newTestKeyPair(t, "idp")
+	idpMetadata, err := samlsp.ParseMetadata([]byte(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.contoso.com/">` +
+		`<IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">` +
+		`<KeyDescriptor use="signing"><KeyInfo xmlns="http://www.w3.org/2000/09/xmldsig#"><X509Data><X509Certificate>` +
+		base64.StdEncoding.EncodeToString(idpCert.Raw) +
+		`</X509Certificate></X509Data></KeyInfo></KeyDescriptor>` +
+		`<SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.contoso.com/sso"/>` +
+		`</IDPSSODescriptor></EntityDescriptor>`))
+	if err != nil {
+		t.Fatalf("failed parsing metadata: %s", err)
+	}
+	metadataCerts := getIdpSigningCerts(idpMetadata)
+
+	matchingCert, err := readCertPEM(string(idpCertPEM))
+	if err != nil {
+		t.Fatalf("failed reading signing certificate: %s", err)
+	}
+	if err := validateSignCertInMetadata(matchingCert, metadataCerts); err != nil {
+		t.Fatalf("matching signing certificate failed validation: %s", err)
+	}
+
+	certPEM, _, _ := newTestKeyPair(t, "idp")
+	otherCert, err := readCertPEM(string(certPEM))
+	if err != nil {
+		t.Fatalf("failed reading signing certificate: %s", err)
+	}
+	if err := validateSignCertInMetadata(otherCert, metadataCerts); err == nil {
+		t.Fatalf("non-matching signing certificate passed validation")
+	}
+
+	// Without signing certificates in IdP metadata, there is nothing to
+	// compare against.
+	if err := validateSignCertInMetadata(otherCert, []string{}); err != nil {
+		t.Fatalf("unexpected failure without metadata certificates: %s", err)
+	}
+}
+
+func TestMetadataMinTLSVersion(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		maxVersion    uint16
+		minVersion    string
+		cipherSuites  []string
+		shouldFail    bool
+		shouldErrConf bool
+	}{
+		{name: "tls 1.2 server", maxVersion: tls.VersionTLS12},
+		{name: "tls 1.0 server", maxVersion: tls.VersionTLS10, shouldFail: true},
+		{name: "tls 1.0 server allowed", maxVersion: tls.VersionTLS10, minVersion: "1.0"},
+		{name: "tls 1.2 server with tls 1.3 minimum", maxVersion: tls.VersionTLS12, minVersion: "1.3", shouldFail: true},
+		{name: "cipher suites", maxVersion: tls.VersionTLS12, cipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+		{name: "unsupported tls version", minVersion: "2.0", shouldErrConf: true},
+		{name: "unsupported cipher suite", cipherSuites: []string{"TLS_FOO"}, shouldErrConf: true},
+	} {
+		if test.minVersion == "" {
+			test.minVersion = defaultMetadataMinTLSVersion
+		}
+		minVersion, err := getTLSVersion(test.minVersion)
+		if err == nil {
+			_, err = getCipherSuites(test.cipherSuites)
+		}
+		if test.shouldErrConf {
+			if err == nil {
+				t.Errorf("%s: expected configuration failure, got success", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected configuration failure: %s", test.name, err)
+			continue
+		}
+		cipherSuites, _ := getCipherSuites(test.cipherSuites)
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("<EntityDescriptor/>"))
+		}))
+		server.TLS = &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: test.maxVersion}
+		server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+		server.StartTLS()
+
+		client := newMetadataClient(minVersion, cipherSuites)
+		rootCAs := x509.NewCertPool()
+		rootCAs.AddCert(server.Certificate())
+		client.Transport.(*http.Transport).TLSClientConfig.RootCAs = rootCAs
+
+		metadataURL, _ := url.Parse(server.URL)
+		_, err = fetchMetadataDocument(client, metadataURL)
+		server.Close()
+		if test.shouldFail && err == nil {
+			t.Errorf("%s: expected failure, got success", test.name)
+		}
+		if !test.shouldFail && err != nil {
+			t.Errorf("%s: expected success, got %s", test.name, err)
+		}
+	}
+}
+
+func TestFetchMetadataDocumentLimits(t *testing.T) {
+	client := newMetadataClient(tls.VersionTLS12, nil)
+	if client.Timeout != metadataFetchTimeout {
+		t.Fatalf("unexpected metadata client timeout: %s", client.Timeout)
+	}
+	for _, test := range []struct {
+		name       string
+		size       int64
+		shouldFail bool
+	}{
+		{name: "metadata within limit", size: maxMetadataSize},
+		{name: "metadata exceeding limit", size: maxMetadataSize + 1, shouldFail: true},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.CopyN(w, zeroReader{}, test.size)
+		}))
+		metadataURL, _ := url.Parse(server.URL)
+		b, err := fetchMetadataDocument(client, metadataURL)
+		server.Close()
+		if test.shouldFail {
+			if err == nil {
+				t.Errorf("%s: expected failure, got success", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected success, got %s", test.name, err)
+			continue
+		}
+		if int64(len(b)) != test.size {
+			t.Errorf("%s: expected %d bytes, got %d", test.name, test.size, len(b))
+		}
+	}
+}
+
+// zeroReader is an endless source of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
@@ -0,0 +1,108 @@
+package saml
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// metricsName is the name of the expvar variable with the metrics of the
+// plugin. Caddy serves the expvar variables at /debug/vars of its admin
+// endpoint.
+const metricsName = "caddy_auth_saml"
+
+// pluginMetrics are the metrics of the plugin, shared by the plugin
+// instances.
+type pluginMetrics struct {
+	// metadataRefreshSuccesses and metadataRefreshFailures count the
+	// loads of the IdP metadata, keyed by the metadata location.
+	metadataRefreshSuccesses *expvar.Map
+	metadataRefreshFailures  *expvar.Map
+	mu                       sync.Mutex
+	// certExpiry holds the expiration time of the IdP signing
+	// certificates of the provisioned IdPs, keyed by the IdP, and then by
+	// the metadata location and the serial number of the certificate. The
+	// time until the expiry is computed on scrape.
+	certExpiry map[interface{}]map[string]time.Time
+}
+
+var (
+	metrics = &pluginMetrics{
+		metadataRefreshSuccesses: new(expvar.Map).Init(),
+		metadataRefreshFailures:  new(expvar.Map).Init(),
+		certExpiry:               make(map[interface{}]map[string]time.Time),
+	}
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics publishes the metrics. The metrics are published once,
+// because expvar does not allow to publish a variable twice, e.g. upon
+// config reload.
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		m := new(expvar.Map).Init()
+		m.Set("metadata_refresh_successes", metrics.metadataRefreshSuccesses)
+		m.Set("metadata_refresh_failures", metrics.metadataRefreshFailures)
+		m.Set("idp_cert_expiry_seconds", expvar.Func(metrics.getCertExpirySeconds))
+		expvar.Publish(metricsName, m)
+	})
+}
+
+// recordMetadataRefresh counts the successful or the failed load of the
+// IdP metadata.
+func (p *pluginMetrics) recordMetadataRefresh(location string, err error) {
+	if err != nil {
+		p.metadataRefreshFailures.Add(location, 1)
+		return
+	}
+	p.metadataRefreshSuccesses.Add(location, 1)
+}
+
+// recordCertExpiry records the expiration time of the IdP signing
+// certificates, i.e. base64-encoded DER certificates, of the metadata of
+// the IdP. The previously recorded certificates of the IdP are replaced.
+func (p *pluginMetrics) recordCertExpiry(idp interface{}, location string, certs []string) error {
+	expiry := make(map[string]time.Time)
+	for _, s := range certs {
+		der, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return err
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		expiry[fmt.Sprintf("%s#%s", location, cert.SerialNumber)] = cert.NotAfter
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.certExpiry[idp] = expiry
+	return nil
+}
+
+// releaseCertExpiry drops the IdP signing certificates of the IdP, e.g.
+// when the plugin instance is cleaned up upon config reload.
+func (p *pluginMetrics) releaseCertExpiry(idp interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.certExpiry, idp)
+}
+
+// getCertExpirySeconds returns the number of seconds until the IdP
+// signing certificates of the provisioned IdPs expire. It is negative for
+// the expired ones.
+func (p *pluginMetrics) getCertExpirySeconds() interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	seconds := make(map[string]int64)
+	for _, expiry := range p.certExpiry {
+		for k, v := range expiry {
+			seconds[k] = int64(v.Sub(now) / time.Second)
+		}
+	}
+	return seconds
+}
@@ -0,0 +1,86 @@
+package saml
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	registerMetrics()
+	// The repeated registration, e.g. upon config reload, must not panic.
+	registerMetrics()
+
+	v := expvar.Get(metricsName)
+	if v == nil {
+		t.Fatalf("metrics %s not registered", metricsName)
+	}
+
+	location := "https://login.microsoftonline.com/test/federationmetadata.xml"
+	metrics.recordMetadataRefresh(location, nil)
+	metrics.recordMetadataRefresh(location, nil)
+	metrics.recordMetadataRefresh(location, fmt.Errorf("connection refused"))
+
+	_, _, cert := newTestKeyPair(t, "idp")
+	certs := []string{base64.StdEncoding.EncodeToString(cert.Raw)}
+	az := &AzureIdp{}
+	if err := metrics.recordCertExpiry(az, location, certs); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := metrics.recordCertExpiry(az, location, []string{"invalid"}); err == nil {
+		t.Fatalf("expected error for invalid certificate, got none")
+	}
+
+	type scrapedMetrics struct {
+		Successes map[string]int64 `json:"metadata_refresh_successes"`
+		Failures  map[string]int64 `json:"metadata_refresh_failures"`
+		Expiry    map[string]int64 `json:"idp_cert_expiry_seconds"`
+	}
+	var got scrapedMetrics
+	if err := json.Unmarshal([]byte(v.String()), &got); err != nil {
+		t.Fatalf("failed parsing metrics %s: %s", v.String(), err)
+	}
+	if got.Successes[location] != 2 {
+		t.Errorf("expected 2 metadata refresh successes, got %d", got.Successes[location])
+	}
+	if got.Failures[location] != 1 {
+		t.Errorf("expected 1 metadata refresh failure, got %d", got.Failures[location])
+	}
+	key := fmt.Sprintf("%s#%s", location, cert.SerialNumber)
+	expiresIn, exists := got.Expiry[key]
+	if !exists {
+		t.Fatalf("certificate expiry %s not found in %v", key, got.Expiry)
+	}
+	// The test certificate expires in an hour.
+	if expiresIn <= 0 || expiresIn > int64(time.Hour/time.Second) {
+		t.Errorf("unexpected certificate expiry in %d seconds", expiresIn)
+	}
+
+	// The time until the expiry is computed on scrape.
+	metrics.mu.Lock()
+	metrics.certExpiry[az][key] = time.Now().Add(-time.Minute)
+	metrics.mu.Unlock()
+	got = scrapedMetrics{}
+	if err := json.Unmarshal([]byte(v.String()), &got); err != nil {
+		t.Fatalf("failed parsing metrics %s: %s", v.String(), err)
+	}
+	if got.Expiry[key] >= 0 {
+		t.Errorf("expected expired certificate, got expiry in %d seconds", got.Expiry[key])
+	}
+
+	// The certificates of the IdPs cleaned up are dropped.
+	m := &AuthProvider{Azure: az}
+	if err := m.Cleanup(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	got = scrapedMetrics{}
+	if err := json.Unmarshal([]byte(v.String()), &got); err != nil {
+		t.Fatalf("failed parsing metrics %s: %s", v.String(), err)
+	}
+	if _, exists := got.Expiry[key]; exists {
+		t.Errorf("certificate expiry %s not dropped after cleanup", key)
+	}
+}
@@ -0,0 +1,50 @@
+package saml
+
+import (
+	"github.com/caddyserver/caddy/v2"
+)
+
+// replacePlaceholders resolves the global Caddy placeholders, e.g.
+// {env.JWT_TOKEN_SECRET}, in the token and the provider settings. The
+// unknown placeholders are left intact.
+func (m *AuthProvider) replacePlaceholders(repl *caddy.Replacer) {
+	replace := func(s *string) {
+		*s = repl.ReplaceKnown(*s, "")
+	}
+	replace(&m.Jwt.TokenSecret)
+	replace(&m.Jwt.TokenIssuer)
+	for i := range m.Jwt.PreviousTokenSecrets {
+		replace(&m.Jwt.PreviousTokenSecrets[i])
+	}
+	if m.SessionStore != nil {
+		replace(&m.SessionStore.RedisPassword)
+		replace(&m.SessionStore.AdminToken)
+	}
+	if m.SignedRedirect != nil {
+		replace(&m.SignedRedirect.Secret)
+	}
+	if m.Azure != nil {
+		az := m.Azure
+		for _, s := range []*string{
+			&az.IdpMetadataLocation,
+			&az.IdpSignCertLocation,
+			&az.IdpSignCertPEM,
+			&az.SpCertPEM,
+			&az.SpKeyPEM,
+			&az.IdpEntityID,
+			&az.ExpectedIssuer,
+			&az.TenantID,
+			&az.ApplicationID,
+			&az.ApplicationName,
+			&az.EntityID,
+		} {
+			replace(s)
+		}
+		for i := range az.AssertionConsumerServiceURLs {
+			replace(&az.AssertionConsumerServiceURLs[i])
+		}
+	}
+	for i := range m.AssertionConsumerServiceURLs {
+		replace(&m.AssertionConsumerServiceURLs[i])
+	}
+}
@@ -0,0 +1,37 @@
+package saml
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"os"
+	"testing"
+)
+
+func TestReplacePlaceholders(t *testing.T) {
+	os.Setenv("SAML_TEST_TOKEN_SECRET", "383aca9a-1c39-4d7a-b4d8-67ba4718dd3f")
+	os.Setenv("SAML_TEST_TENANT_ID", "1b9e886b-8ff2-4378-b6c8-6771259a5f51")
+	defer os.Unsetenv("SAML_TEST_TOKEN_SECRET")
+	defer os.Unsetenv("SAML_TEST_TENANT_ID")
+
+	m := &AuthProvider{
+		CommonParameters: CommonParameters{
+			Jwt: TokenParameters{
+				TokenSecret: "{env.SAML_TEST_TOKEN_SECRET}",
+				TokenIssuer: "{unknown.placeholder}",
+			},
+		},
+		Azure: &AzureIdp{
+			TenantID: "{env.SAML_TEST_TENANT_ID}",
+		},
+	}
+	m.replacePlaceholders(caddy.NewReplacer())
+
+	if m.Jwt.TokenSecret != "383aca9a-1c39-4d7a-b4d8-67ba4718dd3f" {
+		t.Fatalf("token_secret placeholder not resolved: %s", m.Jwt.TokenSecret)
+	}
+	if m.Azure.TenantID != "1b9e886b-8ff2-4378-b6c8-6771259a5f51" {
+		t.Fatalf("tenant_id placeholder not resolved: %s", m.Azure.TenantID)
+	}
+	if m.Jwt.TokenIssuer != "{unknown.placeholder}" {
+		t.Fatalf("unknown placeholder was altered: %s", m.Jwt.TokenIssuer)
+	}
+}
@@ -1,10 +1,12 @@
 package saml
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
 	"go.uber.org/zap"
+	"net"
 	"net/http"
 	"os"
 	"strings"
@@ -22,7 +24,9 @@ type AuthProvider struct {
 	Azure            *AzureIdp      `json:"azure,omitempty"`
 	UI               *UserInterface `json:"ui,omitempty"`
 	logger           *zap.Logger    `json:"-"`
+	audit            *auditLogger   `json:"-"`
 	idpProviderCount uint64         `json:"-"`
+	poolKeys         []string       `json:"-"`
 }
 
 // CommonParameters represent a common set of configuration settings, e.g.
@@ -31,6 +35,151 @@ type CommonParameters struct {
 	AuthURLPath    string          `json:"auth_url_path,omitempty"`
 	SuccessURLPath string          `json:"success_url_path,omitempty"`
 	Jwt            TokenParameters `json:"jwt,omitempty"`
+	// LogoutURLPath is the path of the endpoint terminating user sessions.
+	// Defaults to the authentication endpoint followed by /logout.
+	LogoutURLPath string `json:"logout_url_path,omitempty"`
+	// PostLogoutRedirectURL is the URL the browser lands on after logout.
+	// It must be either a relative path or an absolute URL pointing to one
+	// of the hosts in ACS URLs. Without it, the logout confirmation page
+	// is rendered.
+	PostLogoutRedirectURL string `json:"post_logout_redirect_url,omitempty"`
+	// DefaultLandingURL is the URL the user lands on after the login when
+	// neither the originally requested URL, e.g. RelayState of IdP-initiated
+	// logins, nor SuccessURLPath is available. Without it, the plugin
+	// renders a success page with a link to the root path.
+	DefaultLandingURL string `json:"default_landing_url,omitempty"`
+	// MetadataURLPath is the path of the endpoint publishing the SP
+	// metadata. Defaults to the authentication endpoint followed by
+	// /metadata.
+	MetadataURLPath string `json:"metadata_url_path,omitempty"`
+	// MetadataRequireAuth restricts the SP metadata to the requests with a
+	// valid token of the plugin. The metadata is public by default.
+	MetadataRequireAuth bool `json:"metadata_require_auth,omitempty"`
+	// MetadataAllowCIDRs is the list of IP addresses and CIDR blocks of
+	// the clients allowed to fetch the SP metadata. Any client is allowed
+	// when the list is empty.
+	MetadataAllowCIDRs    []string     `json:"metadata_allow_cidrs,omitempty"`
+	metadataAllowNetworks []*net.IPNet `json:"-"`
+	// SessionStore enables the server-side tracking of the sessions of
+	// the issued tokens, so that the sessions can be revoked. The tokens
+	// are stateless by default.
+	SessionStore *SessionStoreParameters `json:"session_store,omitempty"`
+	// Lockout enables the temporary lockout of the client IPs and the
+	// users after repeated login failures.
+	Lockout *LockoutParameters `json:"lockout,omitempty"`
+	// AuditFormat is the format of the audit trail: "json" (default) logs
+	// the fields of the events as structured fields, and "logfmt" logs
+	// them as the key=value pairs of the message.
+	AuditFormat string `json:"audit_format,omitempty"`
+	// WhoamiURLPath is the path of the endpoint returning the claims of
+	// the token passed with a request. The endpoint is disabled when the
+	// path is empty.
+	WhoamiURLPath string `json:"whoami_url_path,omitempty"`
+	// RequiredRoles is the list of the roles allowed access. A user must
+	// have at least one of them. Any authenticated user is allowed access
+	// when the list is empty.
+	RequiredRoles []string `json:"required_roles,omitempty"`
+	// RequiredAuthnContext is the list of the authentication methods,
+	// i.e. AuthnContextClassRef, allowed access, e.g. MFA. A user must
+	// have authenticated with one of them. Any authentication method is
+	// allowed when the list is empty.
+	RequiredAuthnContext []string `json:"required_authn_context,omitempty"`
+	// AuthenticationFailureStatusCode is the HTTP status code of the
+	// response to a failed authentication. Defaults to 401.
+	AuthenticationFailureStatusCode int `json:"authentication_failure_status_code,omitempty"`
+	// AuthorizationFailureStatusCode is the HTTP status code of the
+	// response to an authenticated user lacking the required roles.
+	// Defaults to 403.
+	AuthorizationFailureStatusCode int `json:"authorization_failure_status_code,omitempty"`
+	// AcsURL is the list of URLs server instance is listening on. These URLS
+	// are known as SP Assertion Consumer Service endpoints. For example,
+	// users may access a website via http://app.domain.local. At the
+	// same time the users may access it by IP, e.g. http://10.10.10.10. or
+	// by name, i.e. app. Each of the URLs is a separate endpoint. The list
+	// of a provider overrides the plugin-wide list.
+	AssertionConsumerServiceURLs AcsURLList `json:"acs_urls,omitempty"`
+	// CORS enables the cross-origin requests to the endpoints of the
+	// plugin, e.g. from single-page applications. The endpoints are
+	// same-origin only by default.
+	CORS *CORSParameters `json:"cors,omitempty"`
+	// ClaimsHeader adds the response header carrying the claims of the
+	// authenticated user, in addition to the token.
+	ClaimsHeader *ClaimsHeaderParameters `json:"claims_header,omitempty"`
+	// SignedRedirect redirects the user to a backend URL with the claims
+	// signed with HMAC after the login, instead of the landing URL.
+	SignedRedirect *SignedRedirectParameters `json:"signed_redirect,omitempty"`
+	// Webhook enables the delivery of the login events, i.e. the successes
+	// and the failures, to a webhook.
+	Webhook *WebhookParameters `json:"webhook,omitempty"`
+	// TrustedProxies is the list of IP addresses and CIDR blocks of the
+	// proxies allowed to convey the external scheme and host of a request
+	// via X-Forwarded-Proto and X-Forwarded-Host headers.
+	TrustedProxies []string     `json:"trusted_proxies,omitempty"`
+	trustedProxies []*net.IPNet `json:"-"`
+	// ProxyProtocol indicates that Caddy accepts the connections from
+	// PROXY protocol load balancers, e.g. via a listener wrapper, i.e. the
+	// peer address of a request is the client address conveyed by the
+	// load balancer. The client address of the audit events and the login
+	// lockout is then the peer address, and X-Forwarded-For and X-Real-IP
+	// headers are ignored.
+	ProxyProtocol   bool         `json:"proxy_protocol,omitempty"`
+	clientIPProxies []*net.IPNet `json:"-"`
+	// RedirectAllowlist is the list of the hosts, optionally followed by
+	// path prefixes, e.g. portal.contoso.com/app, the absolute redirect
+	// URLs may point to, besides the hosts of the ACS URLs. It applies to
+	// RelayState, post-login, and post-logout redirects. The relative
+	// paths are always allowed.
+	RedirectAllowlist []string `json:"redirect_allowlist,omitempty"`
+	// RedirectStatusCode is the HTTP status code of the post-login
+	// redirects: 302, 303 (default), or 307. With 303, the browser follows
+	// the redirect with a GET request. With 307, the browser repeats the
+	// POST request, i.e. posts the SAML Response to the landing URL.
+	RedirectStatusCode int `json:"redirect_status_code,omitempty"`
+	// redirectAllowlist is the allowlist along with the hosts of the ACS
+	// URLs.
+	redirectAllowlist []string
+}
+
+// AcsURLList is the list of ACS URLs. In JSON, the list is either an array
+// of strings or a single comma-separated string. The comma-separated
+// entries are split in Validate.
+type AcsURLList []string
+
+// UnmarshalJSON accepts either an array of strings or a string.
+func (l *AcsURLList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = AcsURLList{s}
+		return nil
+	}
+	var urls []string
+	if err := json.Unmarshal(b, &urls); err != nil {
+		return fmt.Errorf("acs_urls must be either an array of strings or a comma-separated string")
+	}
+	*l = urls
+	return nil
+}
+
+// split returns the list with the comma-separated entries split into
+// separate entries. The entries are trimmed and the empty ones dropped.
+func (l AcsURLList) split() AcsURLList {
+	urls := AcsURLList{}
+	for _, entry := range l {
+		for _, s := range strings.Split(entry, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				urls = append(urls, s)
+			}
+		}
+	}
+	return urls
+}
+
+// inheritAcsURLs sets the ACS URLs of a provider to the plugin-wide ACS
+// URLs, unless the provider has its own.
+func (p *CommonParameters) inheritAcsURLs(common CommonParameters) {
+	if len(p.AssertionConsumerServiceURLs) == 0 {
+		p.AssertionConsumerServiceURLs = common.AssertionConsumerServiceURLs
+	}
 }
 
 // TokenParameters represent JWT parameters of CommonParameters.
@@ -38,6 +187,47 @@ type TokenParameters struct {
 	TokenName   string `json:"token_name,omitempty"`
 	TokenSecret string `json:"token_secret,omitempty"`
 	TokenIssuer string `json:"token_issuer,omitempty"`
+	// PreviousTokenSecrets are the secrets the tokens were signed with
+	// prior to secret rotation. The tokens signed with them remain valid,
+	// while new tokens are signed with TokenSecret.
+	PreviousTokenSecrets []string `json:"previous_token_secrets,omitempty"`
+	// TokenExpiryLeeway is the number of seconds a token remains valid
+	// past its expiration time, and prior to its not before and issued at
+	// times, to tolerate clock skew.
+	TokenExpiryLeeway int `json:"token_expiry_leeway,omitempty"`
+	// RefreshWindow is the number of seconds prior to the expiration of
+	// a session token when the token is renewed with a fresh expiration
+	// time, i.e. sliding expiration. The renewal is disabled when zero.
+	RefreshWindow int `json:"refresh_window,omitempty"`
+	// MaxSessionLifetime is the number of seconds since authentication
+	// past which a session token is no longer renewed. Defaults to
+	// 12 hours.
+	MaxSessionLifetime int `json:"max_session_lifetime,omitempty"`
+	// TokenLifetimeRemember is the number of seconds the token is valid
+	// for when the user checks "Remember me" on the login page. The
+	// checkbox is shown when set. It must not exceed 30 days.
+	TokenLifetimeRemember int `json:"token_lifetime_remember,omitempty"`
+	// ClaimNameMap renames the claims in the issued tokens, e.g.
+	// "name" to "preferred_username" or "roles" to "groups".
+	ClaimNameMap map[string]string `json:"claim_name_map,omitempty"`
+	// ExcludeClaims are the claims, e.g. "roles" or "custom", omitted from
+	// the issued tokens to keep them small and to avoid disclosing, e.g.,
+	// group membership. The claims still populate the user of the login
+	// request.
+	ExcludeClaims []string `json:"exclude_claims,omitempty"`
+	// HeaderFields are the static fields, e.g. "tenant", added to the
+	// header of the issued tokens for the verifiers keying on them. The
+	// registered fields, e.g. "alg" or "kid", cannot be set.
+	HeaderFields map[string]string `json:"header_fields,omitempty"`
+	// TokenHeaderName is the name of the response header carrying the
+	// token as "Bearer <token>". Defaults to Authorization.
+	TokenHeaderName string `json:"token_header_name,omitempty"`
+	// ExistingTokenHeader is the handling of the token header already
+	// present in the response, e.g. set by another handler: "overwrite"
+	// (default) replaces it, and "preserve" keeps it, i.e. the token is
+	// not added.
+	ExistingTokenHeader string `json:"existing_token_header,omitempty"`
+	sessions            SessionStore
 }
 
 // CaddyModule returns the Caddy module information.
@@ -53,10 +243,28 @@ func (m *AuthProvider) Provision(ctx caddy.Context) error {
 	m.logger = ctx.Logger(m)
 	m.logger.Info("provisioning plugin instance")
 	m.Name = "saml"
+	registerMetrics()
 	m.logger.Error(fmt.Sprintf("azure is %v", m.Azure))
 	return nil
 }
 
+// Cleanup implements caddy.CleanerUpper. It releases the state of the
+// instance, e.g. the session store, unless the instance of the reloaded
+// config took it over.
+func (m *AuthProvider) Cleanup() error {
+	keys := m.poolKeys
+	if m.Azure != nil {
+		keys = append(keys, m.Azure.poolKeys...)
+		metrics.releaseCertExpiry(m.Azure)
+	}
+	if m.UI != nil {
+		keys = append(keys, m.UI.poolKeys...)
+		m.UI.poolKeys = nil
+	}
+	m.poolKeys = nil
+	return releasePooledState(keys)
+}
+
 // Validate implements caddy.Validator.
 func (m *AuthProvider) Validate() error {
 	m.logger.Info("validating plugin UI Settings")
@@ -66,6 +274,8 @@ func (m *AuthProvider) Validate() error {
 		return fmt.Errorf("%s: authentication endpoint cannot be empty, try setting auth_url_path to /saml", m.Name)
 	}
 
+	m.replacePlaceholders(caddy.NewReplacer())
+
 	if m.Jwt.TokenName == "" {
 		m.Jwt.TokenName = "JWT_TOKEN"
 	}
@@ -82,6 +292,70 @@ func (m *AuthProvider) Validate() error {
 				m.Name,
 			)
 		}
+		m.Jwt.TokenSecret = os.Getenv("JWT_TOKEN_SECRET")
+	}
+
+	for _, secret := range m.Jwt.PreviousTokenSecrets {
+		if secret == "" {
+			return fmt.Errorf("%s: jwt.previous_token_secrets must not contain empty secrets", m.Name)
+		}
+	}
+	if len(m.Jwt.PreviousTokenSecrets) > 0 {
+		m.logger.Info(
+			"found previous JWT token secrets",
+			zap.Int("count", len(m.Jwt.PreviousTokenSecrets)),
+		)
+	}
+
+	if err := m.Jwt.validateClaimNameMap(); err != nil {
+		return fmt.Errorf("%s: %s", m.Name, err)
+	}
+
+	if err := m.Jwt.validateExcludeClaims(); err != nil {
+		return fmt.Errorf("%s: %s", m.Name, err)
+	}
+	if err := m.Jwt.validateHeaderFields(); err != nil {
+		return fmt.Errorf("%s: %s", m.Name, err)
+	}
+	if m.Jwt.isClaimExcluded("roles") && len(m.RequiredRoles) > 0 {
+		return fmt.Errorf("%s: jwt.exclude_claims: roles cannot be excluded along with required_roles", m.Name)
+	}
+	if m.Jwt.isClaimExcluded("auth_method") && len(m.RequiredAuthnContext) > 0 {
+		return fmt.Errorf("%s: jwt.exclude_claims: auth_method cannot be excluded along with required_authn_context", m.Name)
+	}
+
+	if err := m.Jwt.validateTokenHeader(); err != nil {
+		return fmt.Errorf("%s: %s", m.Name, err)
+	}
+
+	if m.Jwt.TokenExpiryLeeway < 0 {
+		return fmt.Errorf("%s: jwt.token_expiry_leeway must not be negative", m.Name)
+	}
+
+	if m.Jwt.RefreshWindow < 0 {
+		return fmt.Errorf("%s: jwt.refresh_window must not be negative", m.Name)
+	}
+	if m.Jwt.MaxSessionLifetime < 0 {
+		return fmt.Errorf("%s: jwt.max_session_lifetime must not be negative", m.Name)
+	}
+	if m.Jwt.MaxSessionLifetime == 0 {
+		m.Jwt.MaxSessionLifetime = defaultMaxSessionLifetime
+	}
+	if err := m.Jwt.validateRemember(); err != nil {
+		return fmt.Errorf("%s: %s", m.Name, err)
+	}
+	if m.Jwt.isRememberEnabled() {
+		m.logger.Info(
+			"found JWT token remember settings",
+			zap.Int("jwt.token_lifetime_remember", m.Jwt.TokenLifetimeRemember),
+		)
+	}
+	if m.Jwt.RefreshWindow > 0 {
+		m.logger.Info(
+			"found JWT token renewal settings",
+			zap.Int("jwt.refresh_window", m.Jwt.RefreshWindow),
+			zap.Int("jwt.max_session_lifetime", m.Jwt.MaxSessionLifetime),
+		)
 	}
 
 	if m.Jwt.TokenIssuer == "" {
@@ -92,12 +366,143 @@ func (m *AuthProvider) Validate() error {
 		m.Jwt.TokenIssuer = "localhost"
 	}
 
+	if m.AuthenticationFailureStatusCode == 0 {
+		m.AuthenticationFailureStatusCode = http.StatusUnauthorized
+	}
+	if err := validateStatusCode("authentication_failure_status_code", m.AuthenticationFailureStatusCode); err != nil {
+		return fmt.Errorf("%s: %s", m.Name, err)
+	}
+	if m.AuthorizationFailureStatusCode == 0 {
+		m.AuthorizationFailureStatusCode = http.StatusForbidden
+	}
+	if err := validateStatusCode("authorization_failure_status_code", m.AuthorizationFailureStatusCode); err != nil {
+		return fmt.Errorf("%s: %s", m.Name, err)
+	}
+
+	for _, authnContext := range m.RequiredAuthnContext {
+		if authnContext == "" {
+			return fmt.Errorf("%s: required_authn_context must not contain empty entries", m.Name)
+		}
+	}
+	if len(m.RequiredAuthnContext) > 0 {
+		m.logger.Info(
+			"found required authentication contexts",
+			zap.Strings("required_authn_context", m.RequiredAuthnContext),
+		)
+	}
+
+	if m.SessionStore != nil {
+		sessions, poolKey, err := m.SessionStore.loadSessionStore(m.getInstanceKey())
+		if err != nil {
+			return fmt.Errorf("%s: %s", m.Name, err)
+		}
+		m.poolKeys = append(m.poolKeys, poolKey)
+		m.Jwt.sessions = sessions
+		m.logger.Info(
+			"found session store settings",
+			zap.String("session_store.type", m.SessionStore.Type),
+			zap.String("session_store.revoke_url_path", m.SessionStore.RevokeURLPath),
+			zap.String("session_store.admin_url_path", m.SessionStore.AdminURLPath),
+		)
+	}
+
+	if m.Lockout != nil {
+		if err := m.Lockout.validate(); err != nil {
+			return fmt.Errorf("%s: %s", m.Name, err)
+		}
+		// The failures are counted in the session store, or in the
+		// memory counter of the instance when the session store is
+		// disabled.
+		if counter, ok := m.Jwt.sessions.(failureCounter); ok {
+			m.Lockout.counter = counter
+		} else {
+			poolKey, err := m.Lockout.loadFailureCounter(m.getInstanceKey())
+			if err != nil {
+				return fmt.Errorf("%s: %s", m.Name, err)
+			}
+			m.poolKeys = append(m.poolKeys, poolKey)
+		}
+		m.logger.Info(
+			"found login lockout settings",
+			zap.Int("lockout.max_failures", m.Lockout.MaxFailures),
+			zap.Int("lockout.window", m.Lockout.Window),
+		)
+	}
+
+	if m.Webhook != nil {
+		poolKey, err := m.Webhook.loadWebhookSender(m.logger)
+		if err != nil {
+			return fmt.Errorf("%s: %s", m.Name, err)
+		}
+		m.poolKeys = append(m.poolKeys, poolKey)
+		m.logger.Info(
+			"found webhook settings",
+			zap.String("webhook.url", m.Webhook.URL),
+			zap.Int("webhook.queue_size", m.Webhook.QueueSize),
+		)
+	}
+
+	if m.CORS != nil {
+		if err := m.CORS.validate(); err != nil {
+			return fmt.Errorf("%s: %s", m.Name, err)
+		}
+		m.logger.Info(
+			"found CORS settings",
+			zap.Strings("cors.allowed_origins", m.CORS.AllowedOrigins),
+			zap.Bool("cors.allow_credentials", m.CORS.AllowCredentials),
+		)
+	}
+
+	if m.ClaimsHeader != nil {
+		if err := m.ClaimsHeader.validate(); err != nil {
+			return fmt.Errorf("%s: %s", m.Name, err)
+		}
+		m.logger.Info(
+			"found claims header settings",
+			zap.String("claims_header.name", m.ClaimsHeader.Name),
+			zap.Strings("claims_header.claims", m.ClaimsHeader.Claims),
+		)
+	}
+
+	trustedProxies, err := parseTrustedProxies(m.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("%s: %s", m.Name, err)
+	}
+	m.trustedProxies = trustedProxies
+	m.clientIPProxies = getClientIPProxies(trustedProxies, m.ProxyProtocol)
+	metadataAllowNetworks, err := parseNetworks(m.MetadataAllowCIDRs)
+	if err != nil {
+		return fmt.Errorf("%s: metadata_allow_cidrs: %s", m.Name, err)
+	}
+	m.metadataAllowNetworks = metadataAllowNetworks
+	if m.AuditFormat == "" {
+		m.AuditFormat = auditFormatJSON
+	}
+	if err := validateAuditFormat(m.AuditFormat); err != nil {
+		return fmt.Errorf("%s: %s", m.Name, err)
+	}
+	m.audit = newAuditLogger(m.logger, m.clientIPProxies, m.AuditFormat)
+	if len(m.TrustedProxies) > 0 {
+		m.logger.Info(
+			"found trusted proxies",
+			zap.Strings("trusted_proxies", m.TrustedProxies),
+		)
+	}
+	if m.ProxyProtocol {
+		m.logger.Info("using PROXY protocol peer addresses as client addresses")
+	}
+
 	// Validate Azure AD settings
-	if m.Azure != nil {
+	if m.Azure != nil && !m.Azure.isEnabled() {
+		m.logger.Info("Azure AD provider is disabled")
+	}
+	if m.isAzureEnabled() {
+		m.Azure.inheritAcsURLs(m.CommonParameters)
 		m.Azure.logger = m.logger
 		m.Azure.Jwt = m.Jwt
+		m.Azure.trustedProxies = m.trustedProxies
 		if err := m.Azure.Validate(); err != nil {
-			return fmt.Errorf("%s: %s", m.Name, err)
+			return fmt.Errorf("%s: %w", m.Name, err)
 		}
 		m.idpProviderCount++
 	}
@@ -106,6 +511,33 @@ func (m *AuthProvider) Validate() error {
 		return fmt.Errorf("%s: no valid IdP configuration found", m.Name)
 	}
 
+	// Validate logout settings
+	if m.LogoutURLPath == "" {
+		m.LogoutURLPath = strings.TrimSuffix(m.AuthURLPath, "/") + "/logout"
+	}
+	if m.MetadataURLPath == "" {
+		m.MetadataURLPath = strings.TrimSuffix(m.AuthURLPath, "/") + "/metadata"
+	}
+	if err := m.validateRedirects(); err != nil {
+		return fmt.Errorf("%s: %s", m.Name, err)
+	}
+	if m.SignedRedirect != nil {
+		if err := m.SignedRedirect.validate(m.redirectAllowlist); err != nil {
+			return fmt.Errorf("%s: %s", m.Name, err)
+		}
+		m.logger.Info(
+			"found signed redirect settings",
+			zap.String("signed_redirect.url", m.SignedRedirect.URL),
+			zap.String("signed_redirect.method", m.SignedRedirect.Method),
+		)
+	}
+	m.logger.Info(
+		"found logout settings",
+		zap.String("logout_url_path", m.LogoutURLPath),
+		zap.String("post_logout_redirect_url", m.PostLogoutRedirectURL),
+		zap.Strings("redirect_allowlist", m.RedirectAllowlist),
+	)
+
 	// Validate UI settings
 	if m.UI == nil {
 		m.UI = &UserInterface{}
@@ -114,20 +546,42 @@ func (m *AuthProvider) Validate() error {
 	if err := m.UI.validate(); err != nil {
 		return fmt.Errorf("%s: UI settings validation error: %s", m.Name, err)
 	}
+	if m.UI.TemplateDevReload {
+		m.logger.Warn(
+			"UI template is re-parsed on each render, disable template_dev_reload in production",
+			zap.String("template_location", m.UI.TemplateLocation),
+		)
+	}
 
 	m.UI.AuthEndpoint = m.AuthURLPath
-	if m.Azure != nil {
-		link := userInterfaceLink{
-			Link:  m.Azure.LoginURL,
-			Title: "Office 365",
-			Style: "fa-windows",
-		}
-		m.UI.Links = append(m.UI.Links, link)
+	linkProviders := []userInterfaceLinkProvider{}
+	if m.isAzureEnabled() {
+		linkProviders = append(linkProviders, m.Azure)
+	}
+	for _, linkProvider := range linkProviders {
+		m.UI.addProviderLink(linkProvider)
 	}
 
 	return nil
 }
 
+// getInstanceKey returns the key identifying the plugin instance, i.e. the
+// authentication endpoint, the ACS URLs, and the IdP, in the state pool.
+// The key does not change across config reloads of the same site.
+func (m AuthProvider) getInstanceKey() string {
+	key := m.AuthURLPath + "|" + strings.Join(m.AssertionConsumerServiceURLs.split(), ",")
+	if m.Azure != nil {
+		key += "|" + m.Azure.getInstanceKey()
+	}
+	return key
+}
+
+// isAzureEnabled returns true when the Azure AD provider is configured
+// and enabled.
+func (m AuthProvider) isAzureEnabled() bool {
+	return m.Azure != nil && m.Azure.isEnabled()
+}
+
 // Authenticate validates the user credentials in and returns a user identity, if valid.
 func (m AuthProvider) Authenticate(w http.ResponseWriter, r *http.Request) (caddyauth.User, bool, error) {
 	var userIdentity *caddyauth.User
@@ -135,32 +589,209 @@ func (m AuthProvider) Authenticate(w http.ResponseWriter, r *http.Request) (cadd
 	var err error
 	var userAuthenticated bool
 	m.logger.Error(fmt.Sprintf("authenticating ... %v", r))
+
+	// CORS
+	if m.CORS != nil && m.isEndpointRequest(r) {
+		if m.CORS.handleCORS(w, r, m.Jwt.getTokenHeaderName()) {
+			return caddyauth.User{}, false, nil
+		}
+	}
+
+	// Static Assets
+	if m.UI.isStaticAssetRequest(r) {
+		if err := m.UI.serveStaticAsset(w, r); err != nil {
+			m.logger.Warn(err.Error())
+		}
+		return caddyauth.User{}, false, nil
+	}
+
+	// Logout
+	if r.URL.Path == m.LogoutURLPath {
+		m.handleLogout(w, r)
+		return caddyauth.User{}, false, nil
+	}
+
+	// SP Metadata
+	if m.isAzureEnabled() && r.URL.Path == m.MetadataURLPath {
+		if err := m.authorizeMetadataRequest(w, r); err != nil {
+			m.logger.Warn(
+				"denied SP metadata request",
+				zap.String("error", err.Error()),
+			)
+			return caddyauth.User{}, false, nil
+		}
+		if err := m.handleMetadata(w, r); err != nil {
+			m.logger.Error(
+				"failed publishing SP metadata",
+				zap.String("error", err.Error()),
+			)
+		}
+		return caddyauth.User{}, false, nil
+	}
+
+	// Session Revocation
+	if m.SessionStore != nil && m.SessionStore.RevokeURLPath != "" && r.URL.Path == m.SessionStore.RevokeURLPath {
+		if err := m.handleSessionRevocation(w, r); err != nil {
+			m.logger.Debug(
+				"session revocation failed",
+				zap.String("error", err.Error()),
+			)
+		}
+		return caddyauth.User{}, false, nil
+	}
+
+	// Session Administration
+	if m.SessionStore != nil && m.SessionStore.AdminURLPath != "" && r.URL.Path == m.SessionStore.AdminURLPath {
+		if err := m.handleSessionAdmin(w, r); err != nil {
+			m.logger.Warn(
+				"session admin request failed",
+				zap.String("error", err.Error()),
+			)
+		}
+		return caddyauth.User{}, false, nil
+	}
+
+	// Token Introspection
+	if m.WhoamiURLPath != "" && r.URL.Path == m.WhoamiURLPath {
+		if err := m.handleWhoami(w, r); err != nil {
+			m.logger.Debug(
+				"token introspection failed",
+				zap.String("error", err.Error()),
+			)
+		}
+		return caddyauth.User{}, false, nil
+	}
+
+	// Sessions
+	if r.URL.Path != m.AuthURLPath {
+		if claims, _, err := m.Jwt.validateRequestToken(r); err == nil {
+			return m.authenticateSession(w, r, claims)
+		}
+	}
+
 	uiArgs := m.UI.newUserInterfaceArgs()
+	uiArgs.RememberEnabled = m.isAzureEnabled() && m.Jwt.isRememberEnabled()
+	statusCode := m.UI.LoginPageStatus
+
+	// Original URL
+	if r.Method == "GET" && r.URL.Path != m.AuthURLPath {
+		if requestURI := r.URL.RequestURI(); isSafeRedirectURL(requestURI, nil) {
+			uiArgs.OriginalURL = requestURI
+			http.SetCookie(w, newRedirectURLCookie(r, uiArgs.OriginalURL))
+		}
+	} else {
+		uiArgs.OriginalURL = m.getOriginalURL(r)
+	}
+
+	// SP-initiated Login
+	if r.Method == "GET" && r.URL.Path == m.AuthURLPath && r.URL.Query().Get("provider") == "azure" && m.isAzureEnabled() {
+		remember := m.Jwt.isRememberEnabled() && r.URL.Query().Get(rememberParameter) != ""
+		redirectURL, err := m.Azure.getLoginRedirectURL(r, newRelayState(uiArgs.OriginalURL, remember))
+		if err == nil {
+			http.Redirect(w, r, redirectURL, http.StatusFound)
+			return caddyauth.User{}, false, nil
+		}
+		m.logger.Error(
+			"failed issuing authentication request",
+			zap.String("error", err.Error()),
+		)
+		m.Azure.Branding.apply(&uiArgs)
+		uiArgs.Message = "Failed to initiate the login with the identity provider"
+	}
 
 	// Authentication Requests
 	if r.Method == "POST" {
-		if strings.Contains(r.Header.Get("Origin"), "login.microsoftonline.com") ||
-			strings.Contains(r.Header.Get("Referer"), "windowsazure.com") {
-			userIdentity, userToken, err = m.Azure.Authenticate(r)
+		if provider := m.getSAMLResponseProvider(r); provider != nil && provider == samlResponseProvider(m.Azure) {
+			m.Azure.Branding.apply(&uiArgs)
+			err = m.checkLockout(r, "")
+			if err == nil {
+				userIdentity, userToken, err = m.Azure.Authenticate(r)
+			}
+			userID := ""
+			if userIdentity != nil {
+				userID = userIdentity.ID
+			}
+			if err == nil {
+				err = m.checkLockout(r, userID)
+			}
+			if err == nil {
+				err = m.authorize(userIdentity)
+				if err != nil {
+					m.audit.recordAuthorizationDenied(r, userIdentity, err)
+				}
+			}
+			if _, lockedOut := err.(*lockoutError); lockedOut {
+				m.audit.recordLoginLockedOut(r, userID)
+			}
+			m.recordLoginResult(r, userID, err)
+			m.sendLoginWebhookEvent(r, userIdentity, err)
 			if err != nil {
 				uiArgs.Message = err.Error()
+				statusCode = m.getFailureStatusCode(err)
 			} else {
 				userAuthenticated = true
 				uiArgs.Authenticated = true
+				statusCode = http.StatusOK
 			}
 		}
 
 	}
 
-	// Render UI
-	uiErr := m.UI.render(w, uiArgs)
-	if uiErr != nil {
-		m.logger.Error(uiErr.Error())
+	// Headers must be set prior to rendering the UI
+	if userAuthenticated {
+		cookie := m.Jwt.newSessionCookie(r, userToken)
+		if m.Jwt.isRememberRequested(r) {
+			// The remembered session survives browser restarts.
+			cookie.MaxAge = m.Jwt.TokenLifetimeRemember
+		}
+		http.SetCookie(w, cookie)
+		m.Jwt.setTokenHeader(w, userToken)
+		if m.ClaimsHeader != nil {
+			if claims, _, err := m.Jwt.validateToken(userToken); err == nil {
+				m.logClaimsHeaderError(m.setClaimsHeader(w, claims))
+			}
+		}
+		if r.Method == "POST" && acceptsJSON(r) {
+			if err := m.writeTokenResponse(w, r, userToken); err != nil {
+				m.logger.Error(
+					"failed writing token response",
+					zap.String("error", err.Error()),
+				)
+			}
+			return caddyauth.User{}, false, nil
+		}
+		if m.SignedRedirect != nil {
+			claims, _, err := m.Jwt.validateToken(userToken)
+			if err == nil {
+				err = m.redirectWithSignedPayload(w, r, claims, m.getLandingURL(uiArgs.OriginalURL))
+			}
+			if err == nil {
+				return caddyauth.User{}, false, nil
+			}
+			m.logger.Error(
+				"failed redirecting with signed payload",
+				zap.String("error", err.Error()),
+			)
+		}
+		if redirectToOriginalURL(w, r, m.getLandingURL(uiArgs.OriginalURL), m.RedirectStatusCode) {
+			return caddyauth.User{}, false, nil
+		}
+		uiArgs.LandingURL = defaultLandingURL
+	}
+	if statusCode == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	if r.Method == "POST" && acceptsJSON(r) && r.FormValue("SAMLResponse") != "" {
+		m.writeTokenErrorResponse(w, statusCode, uiArgs.Message)
+		return caddyauth.User{}, false, nil
 	}
 
+	// Render UI
+	m.renderUI(w, statusCode, uiArgs)
+
 	// Wrap up
 	if !userAuthenticated {
-		return m.failAzureAuthentication(w, nil)
+		return caddyauth.User{}, false, nil
 	}
 
 	/*
@@ -171,18 +802,27 @@ func (m AuthProvider) Authenticate(w http.ResponseWriter, r *http.Request) (cadd
 		m.logger.Info(fmt.Sprintf("%v", userIdentity))
 	*/
 
-	w.Header().Set("Authorization", "Bearer "+userToken)
 	return *userIdentity, true, nil
 }
 
-func (m AuthProvider) failAzureAuthentication(w http.ResponseWriter, err error) (caddyauth.User, bool, error) {
-	w.Header().Set("WWW-Authenticate", "Bearer")
-	return caddyauth.User{}, false, err
+// renderUI renders the user interface and logs the rendering failures.
+func (m AuthProvider) renderUI(w http.ResponseWriter, statusCode int, uiArgs userInterfaceArgs) {
+	uiErr := m.UI.render(w, statusCode, uiArgs)
+	if renderErr, ok := uiErr.(*renderError); ok {
+		m.logger.Error(
+			"failed rendering UI template",
+			zap.String("correlation_id", renderErr.CorrelationID),
+			zap.String("error", renderErr.Err.Error()),
+		)
+	} else if uiErr != nil {
+		m.logger.Error(uiErr.Error())
+	}
 }
 
 // Interface guards
 var (
 	_ caddy.Provisioner       = (*AuthProvider)(nil)
 	_ caddy.Validator         = (*AuthProvider)(nil)
+	_ caddy.CleanerUpper      = (*AuthProvider)(nil)
 	_ caddyauth.Authenticator = (*AuthProvider)(nil)
 )
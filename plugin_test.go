@@ -4,6 +4,11 @@ package saml
 
 import (
 	"github.com/caddyserver/caddy/v2/caddytest"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 )
@@ -26,3 +31,53 @@ func TestPlugin(t *testing.T) {
 	// Uncomment the below line to perform manual testing
 	// time.Sleep(6000 * time.Second)
 }
+
+func TestDisabledProvider(t *testing.T) {
+	disabled := false
+	m := AuthProvider{
+		Name: "saml",
+		CommonParameters: CommonParameters{
+			AuthURLPath: "/saml",
+			Jwt:         TokenParameters{TokenSecret: "0e2fdcf8-6868-41a7-884b-7308795fc286"},
+		},
+		Azure:  &AzureIdp{Enabled: &disabled},
+		logger: zap.NewNop(),
+	}
+	if err := m.Validate(); err == nil || !strings.Contains(err.Error(), "no valid IdP configuration found") {
+		t.Fatalf("expected no valid IdP error for disabled provider, got %v", err)
+	}
+	if m.isAzureEnabled() {
+		t.Fatalf("expected disabled Azure AD provider")
+	}
+
+	m.UI = &UserInterface{}
+	if err := m.UI.validate(); err != nil {
+		t.Fatalf("unexpected UI validation error: %s", err)
+	}
+	if len(m.UI.Links) != 0 {
+		t.Fatalf("expected no UI links for disabled provider, got %v", m.UI.Links)
+	}
+
+	// The SP-initiated login is not dispatched to the disabled provider.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/saml?provider=azure", nil)
+	if _, authenticated, _ := m.Authenticate(w, r); authenticated {
+		t.Fatalf("unexpected authentication by disabled provider")
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected login page, got status %d, location %q", w.Code, w.Header().Get("Location"))
+	}
+
+	// The SAML Responses are not dispatched to the disabled provider.
+	form := url.Values{"SAMLResponse": {"PHNhbWxwOlJlc3BvbnNlLz4="}}
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/saml", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Origin", "https://login.microsoftonline.com")
+	if _, authenticated, _ := m.Authenticate(w, r); authenticated {
+		t.Fatalf("unexpected authentication by disabled provider")
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected login page, got status %d", w.Code)
+	}
+}
@@ -0,0 +1,179 @@
+package saml
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parseTrustedProxies parses the list of IP addresses and CIDR blocks of
+// the proxies allowed to set X-Forwarded-* headers.
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	networks, err := parseNetworks(entries)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy %s", err)
+	}
+	return networks, nil
+}
+
+// parseNetworks parses the list of IP addresses and CIDR blocks. A single
+// address is a network of its own.
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("address: %s", entry)
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("network: %s", err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// isTrustedProxy returns true when the immediate peer of the request is
+// one of the trusted proxies.
+func isTrustedProxy(r *http.Request, trustedProxies []*net.IPNet) bool {
+	if len(trustedProxies) == 0 {
+		return false
+	}
+	ip := net.ParseIP(getPeerIP(r))
+	if ip == nil {
+		return false
+	}
+	return isTrustedIP(ip, trustedProxies)
+}
+
+// getPeerIP returns the IP address of the immediate peer of the request.
+// A peer address not being an IP address, e.g. of a unix socket, is used
+// as is.
+func getPeerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// isTrustedIP returns true when the IP address belongs to one of the
+// trusted proxies.
+func isTrustedIP(ip net.IP, trustedProxies []*net.IPNet) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// getClientIP returns the IP address of the client making the request.
+// The X-Forwarded-For and X-Real-IP headers are honored only when the
+// request arrives from a trusted proxy. The X-Forwarded-For addresses are
+// evaluated from right to left, and the first address not belonging to
+// a trusted proxy is the client, so that the addresses prepended by the
+// client itself are ignored.
+func getClientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	peerIP := getPeerIP(r)
+	if !isTrustedProxy(r, trustedProxies) {
+		return peerIP
+	}
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		addrs := strings.Split(forwardedFor, ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(addrs[i]))
+			if ip == nil {
+				// The chain is broken, the addresses to the left
+				// cannot be trusted.
+				break
+			}
+			if i == 0 || !isTrustedIP(ip, trustedProxies) {
+				return ip.String()
+			}
+		}
+		return peerIP
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return peerIP
+}
+
+// getClientIPProxies returns the trusted proxies whose forwarded headers
+// convey the client addresses. Behind PROXY protocol load balancers, the
+// peer address is the client address, and none do.
+func getClientIPProxies(trustedProxies []*net.IPNet, proxyProtocol bool) []*net.IPNet {
+	if proxyProtocol {
+		return nil
+	}
+	return trustedProxies
+}
+
+// getFirstHeaderValue returns the first value of a comma-separated header.
+func getFirstHeaderValue(r *http.Request, name string) string {
+	value := r.Header.Get(name)
+	if i := strings.Index(value, ","); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value)
+}
+
+// getExternalURL returns the URL of the request as seen by the client.
+// The X-Forwarded-Proto and X-Forwarded-Host headers are honored only when
+// the request arrives from a trusted proxy.
+func getExternalURL(r *http.Request, trustedProxies []*net.IPNet) *url.URL {
+	u := &url.URL{
+		Scheme: "http",
+		Host:   r.Host,
+		Path:   r.URL.Path,
+	}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	if isTrustedProxy(r, trustedProxies) {
+		if proto := strings.ToLower(getFirstHeaderValue(r, "X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			u.Scheme = proto
+		}
+		if host := getFirstHeaderValue(r, "X-Forwarded-Host"); host != "" {
+			u.Host = host
+		}
+	}
+	return u
+}
+
+// isSameEndpoint returns true when both URLs have the same scheme, host,
+// port, and path. The default ports of the schemes are implied.
+func isSameEndpoint(a, b *url.URL) bool {
+	if !strings.EqualFold(a.Scheme, b.Scheme) {
+		return false
+	}
+	if !strings.EqualFold(getHostWithPort(a), getHostWithPort(b)) {
+		return false
+	}
+	return a.Path == b.Path
+}
+
+func getHostWithPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	case "http":
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+	return u.Host
+}
@@ -0,0 +1,197 @@
+package saml
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetExternalURL(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("failed parsing trusted proxies: %s", err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{
+			name:       "direct request",
+			remoteAddr: "172.16.1.1:51000",
+			expected:   "http://app.internal:8080/saml",
+		},
+		{
+			name:       "forwarded by trusted proxy",
+			remoteAddr: "10.1.1.1:51000",
+			headers: map[string]string{
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "mygatekeeper.local, app.internal:8080",
+			},
+			expected: "https://mygatekeeper.local/saml",
+		},
+		{
+			name:       "forwarded by trusted proxy address",
+			remoteAddr: "192.168.1.1:51000",
+			headers: map[string]string{
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "mygatekeeper.local",
+			},
+			expected: "https://mygatekeeper.local/saml",
+		},
+		{
+			name:       "spoofed by untrusted peer",
+			remoteAddr: "172.16.1.1:51000",
+			headers: map[string]string{
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "mygatekeeper.local",
+			},
+			expected: "http://app.internal:8080/saml",
+		},
+	} {
+		r := httptest.NewRequest("POST", "http://app.internal:8080/saml", nil)
+		r.RemoteAddr = test.remoteAddr
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		if u := getExternalURL(r, trustedProxies); u.String() != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, u.String())
+		}
+	}
+}
+
+func TestGetClientIP(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("failed parsing trusted proxies: %s", err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{
+			name:       "direct request",
+			remoteAddr: "203.0.113.10:51000",
+			expected:   "203.0.113.10",
+		},
+		{
+			name:       "spoofed forwarded for from untrusted peer",
+			remoteAddr: "203.0.113.10:51000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			expected:   "203.0.113.10",
+		},
+		{
+			name:       "spoofed real ip from untrusted peer",
+			remoteAddr: "203.0.113.10:51000",
+			headers:    map[string]string{"X-Real-IP": "198.51.100.1"},
+			expected:   "203.0.113.10",
+		},
+		{
+			name:       "forwarded for from trusted proxy",
+			remoteAddr: "10.1.1.1:51000",
+			headers:    map[string]string{"X-Forwarded-For": "203.0.113.10"},
+			expected:   "203.0.113.10",
+		},
+		{
+			name:       "forwarded for through chain of trusted proxies",
+			remoteAddr: "10.1.1.1:51000",
+			headers:    map[string]string{"X-Forwarded-For": "203.0.113.10, 192.168.1.1, 10.2.2.2"},
+			expected:   "203.0.113.10",
+		},
+		{
+			name:       "forwarded for with address prepended by client",
+			remoteAddr: "10.1.1.1:51000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.10"},
+			expected:   "203.0.113.10",
+		},
+		{
+			name:       "real ip from trusted proxy",
+			remoteAddr: "192.168.1.1:51000",
+			headers:    map[string]string{"X-Real-IP": "203.0.113.10"},
+			expected:   "203.0.113.10",
+		},
+		{
+			name:       "malformed forwarded for from trusted proxy",
+			remoteAddr: "10.1.1.1:51000",
+			headers:    map[string]string{"X-Forwarded-For": "unknown"},
+			expected:   "10.1.1.1",
+		},
+	} {
+		r := httptest.NewRequest("GET", "http://app.internal:8080/saml", nil)
+		r.RemoteAddr = test.remoteAddr
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		if clientIP := getClientIP(r, trustedProxies); clientIP != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, clientIP)
+		}
+	}
+}
+
+func TestGetClientIPProxyProtocol(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("failed parsing trusted proxies: %s", err)
+	}
+
+	for _, test := range []struct {
+		name          string
+		proxyProtocol bool
+		remoteAddr    string
+		headers       map[string]string
+		expected      string
+	}{
+		{
+			name:       "forwarded for without proxy protocol",
+			remoteAddr: "10.1.1.1:51000",
+			headers:    map[string]string{"X-Forwarded-For": "203.0.113.10"},
+			expected:   "203.0.113.10",
+		},
+		{
+			name:          "client address conveyed by proxy protocol",
+			proxyProtocol: true,
+			remoteAddr:    "203.0.113.10:51000",
+			expected:      "203.0.113.10",
+		},
+		{
+			name:          "spoofed forwarded for from client in trusted network",
+			proxyProtocol: true,
+			remoteAddr:    "10.1.1.1:51000",
+			headers:       map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			expected:      "10.1.1.1",
+		},
+		{
+			name:          "spoofed real ip from client in trusted network",
+			proxyProtocol: true,
+			remoteAddr:    "10.1.1.1:51000",
+			headers:       map[string]string{"X-Real-IP": "198.51.100.1"},
+			expected:      "10.1.1.1",
+		},
+		{
+			name:          "ipv6 client address",
+			proxyProtocol: true,
+			remoteAddr:    "[2001:db8::10]:51000",
+			expected:      "2001:db8::10",
+		},
+		{
+			name:          "unix socket peer",
+			proxyProtocol: true,
+			remoteAddr:    "@",
+			expected:      "@",
+		},
+	} {
+		r := httptest.NewRequest("GET", "http://app.internal:8080/saml", nil)
+		r.RemoteAddr = test.remoteAddr
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		proxies := getClientIPProxies(trustedProxies, test.proxyProtocol)
+		if clientIP := getClientIP(r, proxies); clientIP != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, clientIP)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package saml
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// redirectURLParameter is the query parameter of the authentication
+// endpoint carrying the URL the user lands on after the login.
+const redirectURLParameter = "redirect_url"
+
+// redirectURLCookieName is the name of the cookie carrying the URL an
+// unauthenticated user originally requested.
+const redirectURLCookieName = "saml_redirect_url"
+
+// redirectURLCookieMaxAge is the lifetime, in seconds, of the cookie
+// carrying the originally requested URL.
+const redirectURLCookieMaxAge = 600
+
+// isSafeRedirectURL returns true when the redirect target is either a
+// relative path on the same origin or an absolute URL matching one of the
+// allowlist entries. An entry is either a host, e.g. app.contoso.com, or
+// a host followed by a path prefix, e.g. portal.contoso.com/app. The
+// hosts include the ports, if any.
+func isSafeRedirectURL(target string, allowlist []string) bool {
+	if target == "" {
+		return false
+	}
+	if strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return false
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	if u.Scheme == "" && u.Host == "" {
+		return strings.HasPrefix(u.Path, "/")
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return false
+	}
+	for _, entry := range allowlist {
+		if matchRedirectAllowlistEntry(u, entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRedirectAllowlistEntry returns true when the URL matches the host
+// and the path prefix, if any, of the allowlist entry. The path prefix
+// matches whole path segments only, after resolving the dot segments the
+// browser resolves, e.g. /app/../admin is matched as /admin.
+func matchRedirectAllowlistEntry(u *url.URL, entry string) bool {
+	host, pathPrefix := entry, ""
+	if i := strings.Index(entry, "/"); i >= 0 {
+		host, pathPrefix = entry[:i], strings.TrimSuffix(entry[i:], "/")
+	}
+	if !strings.EqualFold(u.Host, host) {
+		return false
+	}
+	if pathPrefix == "" {
+		return true
+	}
+	p := path.Clean("/" + strings.Replace(u.Path, "\\", "/", -1))
+	return p == pathPrefix || strings.HasPrefix(p, pathPrefix+"/")
+}
+
+// validateRedirectAllowlist checks that the allowlist entries are hosts,
+// optionally followed by path prefixes, without schemes.
+func validateRedirectAllowlist(allowlist []string) error {
+	for _, entry := range allowlist {
+		u, err := url.Parse("//" + entry)
+		if err != nil || entry == "" || strings.Contains(entry, "://") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("redirect_allowlist entry %q is not a host with an optional path", entry)
+		}
+	}
+	return nil
+}
+
+// getURLHosts returns the hosts, including ports, of the provided URLs.
+func getURLHosts(urls []string) []string {
+	hosts := []string{}
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		hosts = append(hosts, u.Host)
+	}
+	return hosts
+}
+
+// newRedirectURLCookie returns the cookie carrying the originally requested
+// URL. Over TLS, the cookie accompanies the cross-site POST of the SAML
+// Response from the IdP.
+func newRedirectURLCookie(r *http.Request, originalURL string) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     redirectURLCookieName,
+		Value:    url.QueryEscape(originalURL),
+		Path:     "/",
+		MaxAge:   redirectURLCookieMaxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if r.TLS != nil {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	return cookie
+}
+
+// newExpiredRedirectURLCookie returns the cookie instructing a browser to
+// delete the cookie carrying the originally requested URL.
+func newExpiredRedirectURLCookie(r *http.Request) *http.Cookie {
+	cookie := newRedirectURLCookie(r, "")
+	cookie.MaxAge = -1
+	return cookie
+}
+
+// getOriginalURL returns the URL the user originally requested. The URL is
+// conveyed by the RelayState of the SAML Response, the redirect_url query
+// parameter, or the cookie set when the user was asked to log in, in this
+// order. The URLs failing isSafeRedirectURL are ignored.
+func (m AuthProvider) getOriginalURL(r *http.Request) string {
+	candidates := []string{}
+	if r.Method == "POST" {
+		relayState, _ := parseRelayState(r.PostFormValue("RelayState"))
+		candidates = append(candidates, relayState)
+	}
+	candidates = append(candidates, r.URL.Query().Get(redirectURLParameter))
+	if cookie, err := r.Cookie(redirectURLCookieName); err == nil {
+		if value, err := url.QueryUnescape(cookie.Value); err == nil {
+			candidates = append(candidates, value)
+		}
+	}
+	for _, candidate := range candidates {
+		if isSafeRedirectURL(candidate, m.redirectAllowlist) {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// defaultLandingURL is the link of the success page rendered when the user
+// has nowhere to be redirected to after the login.
+const defaultLandingURL = "/"
+
+// getLandingURL returns the URL the user lands on after the login, i.e.
+// the originally requested URL, the success URL path, or the default
+// landing URL, in this order. It returns an empty string when none of them
+// is available.
+func (m AuthProvider) getLandingURL(originalURL string) string {
+	for _, landingURL := range []string{originalURL, m.SuccessURLPath, m.DefaultLandingURL} {
+		if landingURL != "" {
+			return landingURL
+		}
+	}
+	return ""
+}
+
+// redirectStatusCodes are the HTTP status codes of the post-login
+// redirects.
+var redirectStatusCodes = map[int]bool{
+	http.StatusFound:             true,
+	http.StatusSeeOther:          true,
+	http.StatusTemporaryRedirect: true,
+}
+
+// redirectToOriginalURL redirects the authenticated user to the originally
+// requested URL, or another landing URL, with the status code, and deletes
+// the cookie carrying the originally requested URL. It returns false when
+// there is no URL.
+func redirectToOriginalURL(w http.ResponseWriter, r *http.Request, originalURL string, statusCode int) bool {
+	if originalURL == "" {
+		return false
+	}
+	http.SetCookie(w, newExpiredRedirectURLCookie(r))
+	http.Redirect(w, r, originalURL, statusCode)
+	return true
+}
+
+// validateRedirects validates the status code of the post-login redirects
+// and the redirect allowlist, and checks the configured redirect targets,
+// i.e. the post-logout, the success, and the default landing URLs, against
+// the allowlist. The hosts of the ACS URLs are allowed along with the
+// allowlist.
+func (m *AuthProvider) validateRedirects() error {
+	if m.RedirectStatusCode == 0 {
+		m.RedirectStatusCode = http.StatusSeeOther
+	}
+	if !redirectStatusCodes[m.RedirectStatusCode] {
+		return fmt.Errorf("redirect_status_code %d is not supported, supported: 302, 303, 307", m.RedirectStatusCode)
+	}
+	if err := validateRedirectAllowlist(m.RedirectAllowlist); err != nil {
+		return err
+	}
+	m.redirectAllowlist = append([]string{}, m.RedirectAllowlist...)
+	if m.isAzureEnabled() {
+		m.redirectAllowlist = append(m.redirectAllowlist, getURLHosts(m.Azure.AssertionConsumerServiceURLs)...)
+	}
+	if m.PostLogoutRedirectURL != "" && !isSafeRedirectURL(m.PostLogoutRedirectURL, m.redirectAllowlist) {
+		return fmt.Errorf("post_logout_redirect_url %s is neither a relative path nor matches redirect_allowlist or ACS URL hosts",
+			m.PostLogoutRedirectURL,
+		)
+	}
+	if m.SuccessURLPath != "" && !isSafeRedirectURL(m.SuccessURLPath, nil) {
+		return fmt.Errorf("success_url_path %s is not a relative path", m.SuccessURLPath)
+	}
+	if m.DefaultLandingURL != "" && !isSafeRedirectURL(m.DefaultLandingURL, m.redirectAllowlist) {
+		return fmt.Errorf("default_landing_url %s is neither a relative path nor matches redirect_allowlist or ACS URL hosts",
+			m.DefaultLandingURL,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package saml
+
+import (
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestOriginalURL(t *testing.T) {
+	m := AuthProvider{
+		CommonParameters: CommonParameters{
+			AuthURLPath:       "/saml",
+			LogoutURLPath:     "/saml/logout",
+			Jwt:               TokenParameters{TokenName: "JWT_TOKEN"},
+			redirectAllowlist: []string{"localhost:3443"},
+		},
+		UI:     &UserInterface{},
+		logger: zap.NewNop(),
+	}
+	if err := m.UI.validate(); err != nil {
+		t.Fatalf("failed validating UI: %s", err)
+	}
+	m.UI.Template = template.Must(template.New("AuthForm").Parse(`{{ .OriginalURL }}`))
+
+	// The protected URL is captured when the user is asked to log in.
+	r := httptest.NewRequest("GET", "https://localhost:3443/app/reports?id=1", nil)
+	w := httptest.NewRecorder()
+	m.Authenticate(w, r)
+	if body := w.Body.String(); body != "/app/reports?id=1" {
+		t.Fatalf("unexpected original URL in UI: %q", body)
+	}
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == redirectURLCookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatalf("original URL cookie was not set")
+	}
+
+	// The SAML Response arrives along with the cookie.
+	for _, test := range []struct {
+		name       string
+		relayState string
+		expected   string
+	}{
+		{name: "cookie", expected: "/app/reports?id=1"},
+		{name: "relay state", relayState: "https://localhost:3443/app/other", expected: "https://localhost:3443/app/other"},
+		{name: "unsafe relay state", relayState: "https://evil.com/", expected: "/app/reports?id=1"},
+		{name: "protocol-relative relay state", relayState: "//evil.com/", expected: "/app/reports?id=1"},
+	} {
+		form := url.Values{"SAMLResponse": {"PHNhbWxwOlJlc3BvbnNlLz4="}}
+		if test.relayState != "" {
+			form.Set("RelayState", test.relayState)
+		}
+		r := httptest.NewRequest("POST", "https://localhost:3443/saml", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(cookie)
+		originalURL := m.getOriginalURL(r)
+		if originalURL != test.expected {
+			t.Fatalf("%s: expected original URL %q, got %q", test.name, test.expected, originalURL)
+		}
+
+		// The authenticated user lands on the original URL.
+		w := httptest.NewRecorder()
+		if !redirectToOriginalURL(w, r, originalURL, http.StatusSeeOther) {
+			t.Fatalf("%s: user was not redirected", test.name)
+		}
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("%s: unexpected status code: %d", test.name, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != test.expected {
+			t.Fatalf("%s: unexpected redirect target: %s", test.name, location)
+		}
+		if c := w.Header().Get("Set-Cookie"); !strings.HasPrefix(c, redirectURLCookieName+"=;") {
+			t.Fatalf("%s: original URL cookie was not deleted: %s", test.name, c)
+		}
+	}
+
+	r = httptest.NewRequest("GET", "https://localhost:3443/saml?redirect_url=https%3A%2F%2Fevil.com%2F", nil)
+	if originalURL := m.getOriginalURL(r); originalURL != "" {
+		t.Fatalf("unsafe redirect_url accepted: %s", originalURL)
+	}
+	if redirectToOriginalURL(httptest.NewRecorder(), r, "", http.StatusSeeOther) {
+		t.Fatalf("user redirected without original URL")
+	}
+}
+
+func TestLandingURL(t *testing.T) {
+	for _, test := range []struct {
+		name              string
+		originalURL       string
+		successURLPath    string
+		defaultLandingURL string
+		expected          string
+	}{
+		{name: "relay state", originalURL: "/app/reports", successURLPath: "/welcome", defaultLandingURL: "/home", expected: "/app/reports"},
+		{name: "success url path", successURLPath: "/welcome", defaultLandingURL: "/home", expected: "/welcome"},
+		{name: "default landing url", defaultLandingURL: "/home", expected: "/home"},
+		{name: "no landing url"},
+	} {
+		m := AuthProvider{
+			CommonParameters: CommonParameters{
+				SuccessURLPath:    test.successURLPath,
+				DefaultLandingURL: test.defaultLandingURL,
+			},
+		}
+		if landingURL := m.getLandingURL(test.originalURL); landingURL != test.expected {
+			t.Fatalf("%s: expected landing URL %q, got %q", test.name, test.expected, landingURL)
+		}
+	}
+
+	// Without RelayState and success URL, the success page links to the
+	// default landing URL.
+	m := AuthProvider{UI: &UserInterface{}}
+	if err := m.UI.validate(); err != nil {
+		t.Fatalf("failed validating UI: %s", err)
+	}
+	r := httptest.NewRequest("POST", "https://localhost:3443/saml", nil)
+	w := httptest.NewRecorder()
+	if redirectToOriginalURL(w, r, m.getLandingURL(m.getOriginalURL(r)), http.StatusSeeOther) {
+		t.Fatalf("user redirected without landing URL")
+	}
+	args := m.UI.newUserInterfaceArgs()
+	args.Authenticated = true
+	args.LandingURL = defaultLandingURL
+	if err := m.UI.render(w, 200, args); err != nil {
+		t.Fatalf("failed rendering UI: %s", err)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `href="/">Continue</a>`) {
+		t.Fatalf("success page has no link to default landing URL: %s", body)
+	}
+}
+
+func TestRedirectStatusCode(t *testing.T) {
+	for _, test := range []struct {
+		statusCode int
+		shouldErr  bool
+		expected   int
+	}{
+		{expected: http.StatusSeeOther},
+		{statusCode: http.StatusFound, expected: http.StatusFound},
+		{statusCode: http.StatusSeeOther, expected: http.StatusSeeOther},
+		{statusCode: http.StatusTemporaryRedirect, expected: http.StatusTemporaryRedirect},
+		{statusCode: http.StatusMovedPermanently, shouldErr: true},
+		{statusCode: http.StatusOK, shouldErr: true},
+	} {
+		m := AuthProvider{
+			CommonParameters: CommonParameters{
+				RedirectStatusCode:    test.statusCode,
+				SuccessURLPath:        "/welcome",
+				PostLogoutRedirectURL: "/saml",
+			},
+		}
+		err := m.validateRedirects()
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("%d: expected failure, got success", test.statusCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: unexpected failure: %s", test.statusCode, err)
+			continue
+		}
+		r := httptest.NewRequest("POST", "https://localhost:3443/saml", nil)
+		w := httptest.NewRecorder()
+		if !redirectToOriginalURL(w, r, m.getLandingURL(m.getOriginalURL(r)), m.RedirectStatusCode) {
+			t.Fatalf("%d: user was not redirected", test.statusCode)
+		}
+		if w.Code != test.expected {
+			t.Errorf("%d: unexpected status code: %d, expected: %d", test.statusCode, w.Code, test.expected)
+		}
+		if location := w.Header().Get("Location"); location != "/welcome" {
+			t.Errorf("%d: unexpected redirect target: %s", test.statusCode, location)
+		}
+	}
+}
+
+func TestRedirectAllowlist(t *testing.T) {
+	allowlist := []string{"app.contoso.com", "portal.contoso.com/app/", "localhost:3443"}
+	for _, test := range []struct {
+		target string
+		safe   bool
+	}{
+		{target: "/dashboard", safe: true},
+		{target: "https://app.contoso.com/reports", safe: true},
+		{target: "https://APP.contoso.com", safe: true},
+		{target: "https://portal.contoso.com/app", safe: true},
+		{target: "https://portal.contoso.com/app/reports", safe: true},
+		{target: "https://portal.contoso.com/application", safe: false},
+		{target: "https://portal.contoso.com/", safe: false},
+		{target: "https://portal.contoso.com/app/../admin", safe: false},
+		{target: "https://portal.contoso.com/app/%2e%2e/admin", safe: false},
+		{target: "https://portal.contoso.com/app/..\\admin", safe: false},
+		{target: "https://portal.contoso.com/app/./reports/../settings", safe: true},
+		{target: "https://localhost:3443/saml", safe: true},
+		{target: "https://localhost/saml", safe: false},
+		{target: "https://evil.com/app.contoso.com", safe: false},
+		{target: "https://app.contoso.com.evil.com/", safe: false},
+		{target: "//app.contoso.com/", safe: false},
+	} {
+		if safe := isSafeRedirectURL(test.target, allowlist); safe != test.safe {
+			t.Errorf("redirect target %q: expected safe=%t, got %t", test.target, test.safe, safe)
+		}
+	}
+
+	for _, entry := range []string{"", "https://app.contoso.com", "/app", "app.contoso.com/?next=1"} {
+		if err := validateRedirectAllowlist([]string{entry}); err == nil {
+			t.Errorf("invalid redirect_allowlist entry %q passed validation", entry)
+		}
+	}
+
+	// Post-logout and post-login redirects
+	for _, test := range []struct {
+		name       string
+		configure  func(m *AuthProvider)
+		shouldFail bool
+	}{
+		{name: "allowed post-logout redirect", configure: func(m *AuthProvider) { m.PostLogoutRedirectURL = "https://portal.contoso.com/app/" }},
+		{name: "blocked post-logout redirect", configure: func(m *AuthProvider) { m.PostLogoutRedirectURL = "https://portal.contoso.com/" }, shouldFail: true},
+		{name: "ACS host post-logout redirect", configure: func(m *AuthProvider) { m.PostLogoutRedirectURL = "https://localhost:3443/saml" }},
+		{name: "allowed default landing url", configure: func(m *AuthProvider) { m.DefaultLandingURL = "https://app.contoso.com/" }},
+		{name: "blocked default landing url", configure: func(m *AuthProvider) { m.DefaultLandingURL = "https://evil.com/" }, shouldFail: true},
+		{name: "absolute success url path", configure: func(m *AuthProvider) { m.SuccessURLPath = "https://app.contoso.com/" }, shouldFail: true},
+		{name: "invalid allowlist", configure: func(m *AuthProvider) { m.RedirectAllowlist = []string{"https://app.contoso.com"} }, shouldFail: true},
+	} {
+		m := &AuthProvider{
+			CommonParameters: CommonParameters{
+				PostLogoutRedirectURL: "/saml",
+				RedirectAllowlist:     []string{"app.contoso.com", "portal.contoso.com/app"},
+			},
+			Azure: &AzureIdp{},
+		}
+		m.Azure.AssertionConsumerServiceURLs = []string{"https://localhost:3443/saml"}
+		test.configure(m)
+		err := m.validateRedirects()
+		if test.shouldFail && err == nil {
+			t.Errorf("%s: expected failure, got success", test.name)
+		}
+		if !test.shouldFail && err != nil {
+			t.Errorf("%s: expected success, got %s", test.name, err)
+		}
+	}
+
+	// RelayState redirects
+	m := AuthProvider{
+		CommonParameters: CommonParameters{
+			RedirectAllowlist: []string{"app.contoso.com"},
+		},
+	}
+	// Without the post-logout redirect, the logout confirmation page is
+	// rendered.
+	if err := m.validateRedirects(); err != nil {
+		t.Fatalf("empty post-logout redirect failed validation: %s", err)
+	}
+	m.PostLogoutRedirectURL = "/saml"
+	if err := m.validateRedirects(); err != nil {
+		t.Fatalf("failed validating redirects: %s", err)
+	}
+	for relayState, expected := range map[string]string{
+		"https://app.contoso.com/reports": "https://app.contoso.com/reports",
+		"https://evil.com/":               "",
+		"/dashboard":                      "/dashboard",
+	} {
+		form := url.Values{"RelayState": {relayState}}
+		r := httptest.NewRequest("POST", "https://localhost:3443/saml", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if originalURL := m.getOriginalURL(r); originalURL != expected {
+			t.Errorf("RelayState %q: expected original URL %q, got %q", relayState, expected, originalURL)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package saml
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// rememberParameter is the query parameter of the SP-initiated login
+	// requesting the longer-lived session, i.e. the "Remember me" checkbox.
+	rememberParameter = "remember"
+	// rememberRelayStatePrefix marks the RelayState of the logins
+	// requesting the longer-lived session. The rest of the RelayState is
+	// the originally requested URL.
+	rememberRelayStatePrefix = "remember:"
+	// maxTokenLifetimeRemember is the absolute maximum number of seconds
+	// a remembered token is valid for, i.e. 30 days.
+	maxTokenLifetimeRemember = 2592000
+)
+
+// newRelayState returns the RelayState of the authentication request
+// carrying the originally requested URL and the "Remember me" flag.
+func newRelayState(originalURL string, remember bool) string {
+	if remember {
+		return rememberRelayStatePrefix + originalURL
+	}
+	return originalURL
+}
+
+// parseRelayState returns the originally requested URL and the
+// "Remember me" flag the RelayState carries.
+func parseRelayState(relayState string) (string, bool) {
+	if strings.HasPrefix(relayState, rememberRelayStatePrefix) {
+		return strings.TrimPrefix(relayState, rememberRelayStatePrefix), true
+	}
+	return relayState, false
+}
+
+// validateRemember validates the lifetime of the remembered tokens.
+func (p TokenParameters) validateRemember() error {
+	if p.TokenLifetimeRemember < 0 {
+		return fmt.Errorf("jwt.token_lifetime_remember must not be negative")
+	}
+	if p.TokenLifetimeRemember > maxTokenLifetimeRemember {
+		return fmt.Errorf(
+			"jwt.token_lifetime_remember must not exceed %d seconds",
+			maxTokenLifetimeRemember,
+		)
+	}
+	return nil
+}
+
+// isRememberEnabled returns true when the users may opt into the
+// longer-lived session.
+func (p TokenParameters) isRememberEnabled() bool {
+	return p.TokenLifetimeRemember > 0
+}
+
+// isRememberRequested returns true when the SAML Response is delivered
+// with the RelayState requesting the longer-lived session.
+func (p TokenParameters) isRememberRequested(r *http.Request) bool {
+	if !p.isRememberEnabled() || r.Method != "POST" {
+		return false
+	}
+	_, remember := parseRelayState(r.PostFormValue("RelayState"))
+	return remember
+}
+
+// applyRemember extends the expiration time of the token to the lifetime
+// of the remembered tokens, capped by the absolute maximum.
+func (p TokenParameters) applyRemember(claims *UserClaims, remember bool) {
+	if !remember || !p.isRememberEnabled() {
+		return
+	}
+	lifetime := int64(p.TokenLifetimeRemember)
+	if lifetime > maxTokenLifetimeRemember {
+		lifetime = maxTokenLifetimeRemember
+	}
+	claims.ExpiresAt = claims.IssuedAt + lifetime
+}
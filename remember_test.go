@@ -0,0 +1,79 @@
+package saml
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRememberTokenLifetime(t *testing.T) {
+	now := time.Now().Unix()
+	for i, test := range []struct {
+		lifetime  int
+		remember  bool
+		expiresIn int64
+	}{
+		{lifetime: 0, remember: false, expiresIn: 900},
+		{lifetime: 0, remember: true, expiresIn: 900},
+		{lifetime: 604800, remember: false, expiresIn: 900},
+		{lifetime: 604800, remember: true, expiresIn: 604800},
+		{lifetime: 5184000, remember: true, expiresIn: maxTokenLifetimeRemember},
+	} {
+		p := TokenParameters{TokenLifetimeRemember: test.lifetime}
+		claims := &UserClaims{IssuedAt: now, ExpiresAt: now + 900}
+		p.applyRemember(claims, test.remember)
+		if got := claims.ExpiresAt - claims.IssuedAt; got != test.expiresIn {
+			t.Errorf("test %d: expected lifetime %d, got %d", i, test.expiresIn, got)
+		}
+	}
+}
+
+func TestRememberRelayState(t *testing.T) {
+	for i, test := range []struct {
+		lifetime   int
+		relayState string
+		remember   bool
+		url        string
+	}{
+		{lifetime: 604800, relayState: newRelayState("/app?x=1", false), remember: false, url: "/app?x=1"},
+		{lifetime: 604800, relayState: newRelayState("/app?x=1", true), remember: true, url: "/app?x=1"},
+		{lifetime: 604800, relayState: newRelayState("", true), remember: true, url: ""},
+		{lifetime: 0, relayState: newRelayState("/app", true), remember: false, url: "/app"},
+	} {
+		p := TokenParameters{TokenLifetimeRemember: test.lifetime}
+		form := url.Values{"RelayState": {test.relayState}}
+		r := httptest.NewRequest("POST", "/saml", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if remember := p.isRememberRequested(r); remember != test.remember {
+			t.Errorf("test %d: expected remember %t, got %t", i, test.remember, remember)
+		}
+		m := AuthProvider{}
+		if originalURL := m.getOriginalURL(r); originalURL != test.url {
+			t.Errorf("test %d: expected original URL %q, got %q", i, test.url, originalURL)
+		}
+	}
+}
+
+func TestValidateRemember(t *testing.T) {
+	for i, test := range []struct {
+		lifetime  int
+		shouldErr bool
+	}{
+		{lifetime: 0},
+		{lifetime: 604800},
+		{lifetime: maxTokenLifetimeRemember},
+		{lifetime: maxTokenLifetimeRemember + 1, shouldErr: true},
+		{lifetime: -1, shouldErr: true},
+	} {
+		p := TokenParameters{TokenLifetimeRemember: test.lifetime}
+		err := p.validateRemember()
+		if test.shouldErr && err == nil {
+			t.Errorf("test %d: expected error, got none", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("test %d: unexpected error: %s", i, err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package saml
+
+import (
+	"fmt"
+	samllib "github.com/crewjam/saml"
+	"sync"
+	"time"
+)
+
+// defaultConsumedAssertionLifetime is the time the plugin remembers a
+// consumed one-time-use assertion without NotOnOrAfter condition.
+const defaultConsumedAssertionLifetime = time.Hour
+
+// assertionCache keeps track of the consumed one-time-use assertions until
+// they expire, i.e. until they can no longer be replayed.
+type assertionCache struct {
+	mu         sync.Mutex
+	assertions map[string]time.Time
+}
+
+func newAssertionCache() *assertionCache {
+	return &assertionCache{
+		assertions: make(map[string]time.Time),
+	}
+}
+
+// consume records the assertion with the ID as consumed until the
+// expiration time. It returns false when the assertion was consumed before
+// and has not expired yet. The expired assertions are being discarded.
+func (c *assertionCache) consume(id string, expiresAt time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, v := range c.assertions {
+		if now.After(v) {
+			delete(c.assertions, k)
+		}
+	}
+	if _, exists := c.assertions[id]; exists {
+		return false
+	}
+	c.assertions[id] = expiresAt
+	return true
+}
+
+// validateOneTimeUse rejects the replay of the assertion with OneTimeUse
+// condition. Such an assertion is accepted once, regardless of the other
+// settings, e.g. of allowed IdP-initiated logins. With MaxReplayWindow
+// set, the assertion valid for longer than the window is rejected, so that
+// it cannot be replayed once it is no longer remembered.
+func (az *AzureIdp) validateOneTimeUse(assertion *samllib.Assertion, now time.Time) error {
+	if assertion.Conditions == nil || assertion.Conditions.OneTimeUse == nil {
+		return nil
+	}
+	if assertion.ID == "" {
+		return fmt.Errorf("SAML Response one-time-use assertion has no ID")
+	}
+	lifetime := defaultConsumedAssertionLifetime
+	if az.MaxReplayWindow > 0 {
+		lifetime = time.Duration(az.MaxReplayWindow) * time.Second
+	}
+	expiresAt := assertion.Conditions.NotOnOrAfter
+	if expiresAt.IsZero() {
+		expiresAt = now.Add(lifetime)
+	}
+	if az.MaxReplayWindow > 0 && expiresAt.After(now.Add(lifetime)) {
+		return fmt.Errorf("SAML Response one-time-use assertion %s is valid until %s, past max_replay_window of %d seconds",
+			assertion.ID, expiresAt.UTC().Format(time.RFC3339), az.MaxReplayWindow,
+		)
+	}
+	if !az.assertionCache.consume(assertion.ID, expiresAt) {
+		return fmt.Errorf("SAML Response one-time-use assertion %s was already used", assertion.ID)
+	}
+	return nil
+}
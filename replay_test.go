@@ -0,0 +1,148 @@
+package saml
+
+import (
+	samllib "github.com/crewjam/saml"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestOneTimeUse(t *testing.T) {
+	az := &AzureIdp{assertionCache: newAssertionCache()}
+
+	assertion := &samllib.Assertion{
+		ID: "_b7f0d3c4-5e6a-4c1b-9f2e-0a1b2c3d4e5f",
+		Conditions: &samllib.Conditions{
+			NotOnOrAfter: time.Now().Add(5 * time.Minute),
+			OneTimeUse:   &samllib.OneTimeUse{},
+		},
+	}
+	if err := az.validateOneTimeUse(assertion, time.Now()); err != nil {
+		t.Fatalf("one-time-use assertion rejected on first use: %s", err)
+	}
+	if err := az.validateOneTimeUse(assertion, time.Now()); err == nil {
+		t.Fatalf("one-time-use assertion accepted on replay")
+	}
+
+	// The assertions without the condition are not tracked.
+	assertion = &samllib.Assertion{
+		ID:         "_0c5d8e2a-7b1f-4a3e-8d6c-9e0f1a2b3c4d",
+		Conditions: &samllib.Conditions{NotOnOrAfter: time.Now().Add(5 * time.Minute)},
+	}
+	for i := 0; i < 2; i++ {
+		if err := az.validateOneTimeUse(assertion, time.Now()); err != nil {
+			t.Fatalf("assertion without OneTimeUse rejected: %s", err)
+		}
+	}
+
+	assertion = &samllib.Assertion{
+		Conditions: &samllib.Conditions{OneTimeUse: &samllib.OneTimeUse{}},
+	}
+	if err := az.validateOneTimeUse(assertion, time.Now()); err == nil {
+		t.Fatalf("one-time-use assertion without ID accepted")
+	}
+
+	// The expired assertions are discarded.
+	cache := newAssertionCache()
+	if !cache.consume("_expired", time.Now().Add(-time.Second)) {
+		t.Fatalf("assertion not consumed")
+	}
+	if !cache.consume("_other", time.Now().Add(time.Minute)) {
+		t.Fatalf("assertion not consumed")
+	}
+	if _, exists := cache.assertions["_expired"]; exists {
+		t.Fatalf("expired assertion was not discarded")
+	}
+}
+
+func TestMaxReplayWindow(t *testing.T) {
+	now := time.Now()
+	for _, test := range []struct {
+		name         string
+		notOnOrAfter time.Time
+		shouldFail   bool
+	}{
+		{name: "within window", notOnOrAfter: now.Add(5 * time.Minute)},
+		{name: "at window boundary", notOnOrAfter: now.Add(10 * time.Minute)},
+		{name: "past window boundary", notOnOrAfter: now.Add(10*time.Minute + time.Second), shouldFail: true},
+		{name: "far future", notOnOrAfter: now.Add(24 * time.Hour), shouldFail: true},
+	} {
+		az := &AzureIdp{
+			MaxReplayWindow: 600,
+			assertionCache:  newAssertionCache(),
+		}
+		assertion := &samllib.Assertion{
+			ID: "_3e4f5a6b-7c8d-4e9f-a0b1-c2d3e4f5a6b7",
+			Conditions: &samllib.Conditions{
+				NotOnOrAfter: test.notOnOrAfter,
+				OneTimeUse:   &samllib.OneTimeUse{},
+			},
+		}
+		err := az.validateOneTimeUse(assertion, now)
+		if test.shouldFail {
+			if err == nil {
+				t.Errorf("%s: expected failure, got success", test.name)
+			}
+			if len(az.assertionCache.assertions) != 0 {
+				t.Errorf("%s: rejected assertion was remembered", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected success, got %s", test.name, err)
+			continue
+		}
+		if expiresAt := az.assertionCache.assertions[assertion.ID]; !expiresAt.Equal(test.notOnOrAfter) {
+			t.Errorf("%s: unexpected expiration %s, expected %s", test.name, expiresAt, test.notOnOrAfter)
+		}
+	}
+
+	// The assertion without NotOnOrAfter is remembered for the window.
+	az := &AzureIdp{
+		MaxReplayWindow: 600,
+		assertionCache:  newAssertionCache(),
+	}
+	assertion := &samllib.Assertion{
+		ID:         "_9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d",
+		Conditions: &samllib.Conditions{OneTimeUse: &samllib.OneTimeUse{}},
+	}
+	if err := az.validateOneTimeUse(assertion, now); err != nil {
+		t.Fatalf("assertion without NotOnOrAfter rejected: %s", err)
+	}
+	if expiresAt := az.assertionCache.assertions[assertion.ID]; !expiresAt.Equal(now.Add(10 * time.Minute)) {
+		t.Fatalf("unexpected expiration %s", expiresAt)
+	}
+}
+
+func TestAssertionCacheScope(t *testing.T) {
+	newProvider := func(acsURL string) *AzureIdp {
+		az := &AzureIdp{
+			IdpMetadataLocation: "assets/idp/azure_ad_app_metadata.xml",
+			TenantID:            "1b9e886b-8ff2-4378-b6c8-6771259a5f51",
+			ApplicationID:       "623cae7c-e6b2-43c5-853c-2059c9b2cb58",
+			ApplicationName:     "My Gatekeeper",
+			EntityID:            "urn:caddy:mygatekeeper",
+			logger:              zap.NewNop(),
+		}
+		az.AssertionConsumerServiceURLs = []string{acsURL}
+		if err := az.Validate(); err != nil {
+			t.Fatalf("failed validating Azure AD settings: %s", err)
+		}
+		return az
+	}
+	az := newProvider("https://app.contoso.com/saml")
+	defer releasePooledState(az.poolKeys)
+	reloaded := newProvider("https://app.contoso.com/saml")
+	defer releasePooledState(reloaded.poolKeys)
+	other := newProvider("https://portal.contoso.com/saml")
+	defer releasePooledState(other.poolKeys)
+
+	if reloaded.assertionCache != az.assertionCache {
+		t.Fatalf("consumed assertions lost after reload")
+	}
+	// The sites with the same Entity ID do not share the consumed
+	// assertions.
+	if other.assertionCache == az.assertionCache {
+		t.Fatalf("consumed assertions shared with another site")
+	}
+}
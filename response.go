@@ -0,0 +1,254 @@
+package saml
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	samllib "github.com/crewjam/saml"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// The namespaces of the SAML Responses. The elements are matched by the
+// namespace URIs, regardless of the prefixes the IdPs bind them to.
+const (
+	samlAssertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+	xmlDsigNamespace       = "http://www.w3.org/2000/09/xmldsig#"
+)
+
+// samlResponse holds the attributes of a SAML Response the plugin inspects
+// in addition to the validation performed by a service provider.
+type samlResponse struct {
+	XMLName      xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Response"`
+	ID           string   `xml:"ID,attr"`
+	InResponseTo string   `xml:"InResponseTo,attr"`
+	Destination  string   `xml:"Destination,attr"`
+	// Issuer is the entity ID of the IdP issuing the response.
+	Issuer string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	// Status is the status of the response.
+	Status *samlStatus `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+	// Signature is the signature of the response.
+	Signature *xmlSignature `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
+	// Assertions are the unencrypted assertions of the response.
+	Assertions []samlResponseAssertion `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+	// EncryptedAssertions are the encrypted assertions of the response.
+	EncryptedAssertions []struct{} `xml:"urn:oasis:names:tc:SAML:2.0:assertion EncryptedAssertion"`
+}
+
+// samlResponseAssertion holds the attributes of an assertion of a SAML
+// Response the plugin inspects.
+type samlResponseAssertion struct {
+	ID        string        `xml:"ID,attr"`
+	Issuer    string        `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Signature *xmlSignature `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
+}
+
+// samlResponseEncodings are the base64 encodings of the SAMLResponse form
+// value, in the order they are tried. Some IdPs and intermediaries use the
+// URL-safe alphabet or omit the padding.
+var samlResponseEncodings = []*base64.Encoding{
+	base64.StdEncoding,
+	base64.URLEncoding,
+	base64.RawStdEncoding,
+	base64.RawURLEncoding,
+}
+
+// decodeSAMLResponse decodes the base64-encoded SAMLResponse form value.
+// The whitespace, e.g. the line breaks, is stripped before decoding. The
+// error of the standard encoding is returned when none of the encodings
+// succeeds.
+func decodeSAMLResponse(s string) ([]byte, error) {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+	var firstErr error
+	for _, encoding := range samlResponseEncodings {
+		b, err := encoding.DecodeString(s)
+		if err == nil {
+			return b, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// parseSAMLResponse parses the decoded SAML Response.
+func parseSAMLResponse(b []byte) (*samlResponse, error) {
+	resp := &samlResponse{}
+	if err := xml.Unmarshal(b, resp); err != nil {
+		return nil, fmt.Errorf("malformed SAML Response: %s", err)
+	}
+	return resp, nil
+}
+
+// validateDestination checks that the Destination of the SAML Response,
+// when present, is the ACS URL the response was delivered to. The error
+// is shown to the user, hence it does not echo the unsigned Destination.
+func (resp *samlResponse) validateDestination(acsURL *url.URL) error {
+	if resp.Destination == "" {
+		return nil
+	}
+	destinationURL, err := url.Parse(resp.Destination)
+	if err != nil || !isSameEndpoint(destinationURL, acsURL) {
+		return fmt.Errorf("SAML Response Destination does not match the ACS URL")
+	}
+	return nil
+}
+
+// validateIssuerConsistency checks that the Issuers of the unencrypted
+// assertions match the Issuer of the response, when present. A mismatch
+// is a sign of tampering, e.g. an assertion of another IdP spliced into
+// the response. The error does not echo the unsigned Issuers.
+func (resp *samlResponse) validateIssuerConsistency() error {
+	responseIssuer := strings.TrimSpace(resp.Issuer)
+	if responseIssuer == "" {
+		return nil
+	}
+	for _, assertion := range resp.Assertions {
+		if issuer := strings.TrimSpace(assertion.Issuer); issuer != responseIssuer {
+			return fmt.Errorf("SAML Response assertion Issuer does not match the response Issuer")
+		}
+	}
+	return nil
+}
+
+// getAssertionIssuers returns the Issuers of the unencrypted assertions.
+func (resp *samlResponse) getAssertionIssuers() []string {
+	var issuers []string
+	for _, assertion := range resp.Assertions {
+		issuers = append(issuers, strings.TrimSpace(assertion.Issuer))
+	}
+	return issuers
+}
+
+// validateIssuer checks that the Issuer of the response, when present,
+// and the Issuers of its unencrypted assertions are the expected IdP
+// entity ID. The check is skipped when no issuer is expected. The error
+// is shown to the user, hence it does not echo the unsigned Issuers.
+func (resp *samlResponse) validateIssuer(expectedIssuer string) error {
+	if expectedIssuer == "" {
+		return nil
+	}
+	if issuer := strings.TrimSpace(resp.Issuer); issuer != "" && issuer != expectedIssuer {
+		return fmt.Errorf("SAML Response Issuer is not the expected issuer")
+	}
+	for _, assertion := range resp.Assertions {
+		if issuer := strings.TrimSpace(assertion.Issuer); issuer != expectedIssuer {
+			return fmt.Errorf("SAML Response assertion Issuer is not the expected issuer")
+		}
+	}
+	return nil
+}
+
+// getSignatures returns the signatures of the response and its unencrypted
+// assertions.
+func (resp *samlResponse) getSignatures() []*xmlSignature {
+	signatures := []*xmlSignature{}
+	if resp.Signature != nil {
+		signatures = append(signatures, resp.Signature)
+	}
+	for _, assertion := range resp.Assertions {
+		if assertion.Signature != nil {
+			signatures = append(signatures, assertion.Signature)
+		}
+	}
+	return signatures
+}
+
+// getSignatureAlgorithms returns the distinct signature and digest
+// algorithms of the signatures of the response and its unencrypted
+// assertions.
+func (resp *samlResponse) getSignatureAlgorithms() ([]string, []string) {
+	seen := make(map[string]bool)
+	signatureAlgorithms := []string{}
+	digestAlgorithms := []string{}
+	for _, signature := range resp.getSignatures() {
+		algorithm := strings.TrimSpace(signature.SignatureMethod.Algorithm)
+		if !seen[algorithm] {
+			seen[algorithm] = true
+			signatureAlgorithms = append(signatureAlgorithms, algorithm)
+		}
+		for _, digestMethod := range signature.DigestMethods {
+			algorithm := strings.TrimSpace(digestMethod.Algorithm)
+			if !seen[algorithm] {
+				seen[algorithm] = true
+				digestAlgorithms = append(digestAlgorithms, algorithm)
+			}
+		}
+	}
+	return signatureAlgorithms, digestAlgorithms
+}
+
+// validateSignatureAlgorithms checks that the signatures of the response
+// and its unencrypted assertions use sufficiently strong algorithms.
+func (resp *samlResponse) validateSignatureAlgorithms(minimumHash string) error {
+	for _, signature := range resp.getSignatures() {
+		if err := signature.validateAlgorithms(minimumHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateSignaturePresence rejects the responses with unsigned plain
+// assertions upfront. With requireSignedAssertion, each plain assertion
+// must carry its own signature. Otherwise, the signature of the response
+// suffices. The signatures of the encrypted assertions are checked once
+// the assertions are decrypted.
+func (resp *samlResponse) validateSignaturePresence(requireSignedAssertion bool) error {
+	for _, assertion := range resp.Assertions {
+		if assertion.Signature != nil {
+			continue
+		}
+		if requireSignedAssertion {
+			return fmt.Errorf("SAML Response assertion %s is not signed, signed assertions are required", assertion.ID)
+		}
+		if resp.Signature == nil {
+			return fmt.Errorf("SAML Response assertion %s is not signed, and the response is not signed either", assertion.ID)
+		}
+	}
+	return nil
+}
+
+// defaultResponseParseTimeout is the default number of seconds the parsing
+// and the validation of a SAML Response may take.
+const defaultResponseParseTimeout = 10
+
+// responseParseTimeoutError is returned when the parsing of a SAML Response
+// does not complete in time.
+type responseParseTimeoutError struct {
+	err error
+}
+
+func (e *responseParseTimeoutError) Error() string {
+	return fmt.Sprintf("parsing of SAML Response was aborted: %s", e.err)
+}
+
+// parseAssertionWithContext runs the parse function until it completes or
+// the context is done, whichever comes first. When the context is done,
+// the parse function keeps running in the background, but its result
+// is discarded.
+func parseAssertionWithContext(ctx context.Context, parse func() (*samllib.Assertion, error)) (*samllib.Assertion, error) {
+	type parseResult struct {
+		assertion *samllib.Assertion
+		err       error
+	}
+	results := make(chan parseResult, 1)
+	go func() {
+		assertion, err := parse()
+		results <- parseResult{assertion, err}
+	}()
+	select {
+	case result := <-results:
+		return result.assertion, result.err
+	case <-ctx.Done():
+		return nil, &responseParseTimeoutError{ctx.Err()}
+	}
+}
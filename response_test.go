@@ -0,0 +1,482 @@
+package saml
+
+import (
+	"context"
+	"encoding/base64"
+	samllib "github.com/crewjam/saml"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateResponseDestination(t *testing.T) {
+	acsURL, _ := url.Parse("https://localhost:3443/saml")
+	for _, test := range []struct {
+		name        string
+		destination string
+		shouldFail  bool
+	}{
+		{name: "matching destination", destination: "https://localhost:3443/saml"},
+		{name: "another acs url", destination: "https://mygatekeeper/saml", shouldFail: true},
+		{name: "absent destination"},
+		{name: "mismatched host", destination: "https://evil.com/saml", shouldFail: true},
+		{name: "mismatched path", destination: "https://localhost:3443/other", shouldFail: true},
+		{name: "markup in destination", destination: "https://evil.com/&lt;script&gt;", shouldFail: true},
+	} {
+		raw := `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_1"`
+		if test.destination != "" {
+			raw += ` Destination="` + test.destination + `"`
+		}
+		raw += `></samlp:Response>`
+		resp, err := parseSAMLResponse([]byte(raw))
+		if err != nil {
+			t.Fatalf("%s: failed parsing response: %s", test.name, err)
+		}
+		err = resp.validateDestination(acsURL)
+		if test.shouldFail && err == nil {
+			t.Errorf("%s: expected failure, got success", test.name)
+		}
+		// The unsigned Destination is not echoed to the user.
+		if err != nil && resp.Destination != "" && strings.Contains(err.Error(), resp.Destination) {
+			t.Errorf("%s: error echoes the Destination: %s", test.name, err)
+		}
+		if !test.shouldFail && err != nil {
+			t.Errorf("%s: expected success, got %s", test.name, err)
+		}
+	}
+}
+
+func TestValidateSignatureAlgorithms(t *testing.T) {
+	for _, test := range []struct {
+		name               string
+		signatureAlgorithm string
+		digestAlgorithm    string
+		minimumAlgorithm   string
+		shouldFail         bool
+	}{
+		{
+			name:               "rsa-sha256 signature",
+			signatureAlgorithm: "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+			digestAlgorithm:    "http://www.w3.org/2001/04/xmlenc#sha256",
+			minimumAlgorithm:   "sha256",
+		},
+		{
+			name:               "rsa-sha1 signature",
+			signatureAlgorithm: "http://www.w3.org/2000/09/xmldsig#rsa-sha1",
+			digestAlgorithm:    "http://www.w3.org/2000/09/xmldsig#sha1",
+			minimumAlgorithm:   "sha256",
+			shouldFail:         true,
+		},
+		{
+			name:               "rsa-sha256 signature with sha1 digest",
+			signatureAlgorithm: "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+			digestAlgorithm:    "http://www.w3.org/2000/09/xmldsig#sha1",
+			minimumAlgorithm:   "sha256",
+			shouldFail:         true,
+		},
+		{
+			name:               "rsa-sha1 signature allowed",
+			signatureAlgorithm: "http://www.w3.org/2000/09/xmldsig#rsa-sha1",
+			digestAlgorithm:    "http://www.w3.org/2000/09/xmldsig#sha1",
+			minimumAlgorithm:   "sha1",
+		},
+	} {
+		raw := `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_1">` +
+			`<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="_2">` +
+			`<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:SignedInfo>` +
+			`<ds:SignatureMethod Algorithm="` + test.signatureAlgorithm + `"/>` +
+			`<ds:Reference URI="#_2"><ds:DigestMethod Algorithm="` + test.digestAlgorithm + `"/></ds:Reference>` +
+			`</ds:SignedInfo></ds:Signature>` +
+			`</Assertion></samlp:Response>`
+		resp, err := parseSAMLResponse([]byte(raw))
+		if err != nil {
+			t.Fatalf("%s: failed parsing response: %s", test.name, err)
+		}
+		if n := len(resp.getSignatures()); n != 1 {
+			t.Fatalf("%s: expected 1 signature, found %d", test.name, n)
+		}
+		err = resp.validateSignatureAlgorithms(test.minimumAlgorithm)
+		if test.shouldFail && err == nil {
+			t.Errorf("%s: expected failure, got success", test.name)
+		}
+		if !test.shouldFail && err != nil {
+			t.Errorf("%s: expected success, got %s", test.name, err)
+		}
+	}
+}
+
+func TestValidateSignaturePresence(t *testing.T) {
+	signature := `<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:SignedInfo>` +
+		`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/>` +
+		`</ds:SignedInfo></ds:Signature>`
+	for _, test := range []struct {
+		name                   string
+		responseSignature      string
+		assertionSignature     string
+		requireSignedAssertion bool
+		shouldFail             bool
+	}{
+		{
+			name:                   "unsigned assertion of unsigned response",
+			requireSignedAssertion: true,
+			shouldFail:             true,
+		},
+		{
+			name:       "unsigned assertion of unsigned response without required assertion signature",
+			shouldFail: true,
+		},
+		{
+			name:                   "unsigned assertion of signed response",
+			responseSignature:      signature,
+			requireSignedAssertion: true,
+			shouldFail:             true,
+		},
+		{
+			name:              "unsigned assertion of signed response without required assertion signature",
+			responseSignature: signature,
+		},
+		{
+			name:                   "signed assertion",
+			assertionSignature:     signature,
+			requireSignedAssertion: true,
+		},
+	} {
+		raw := `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_1">` +
+			test.responseSignature +
+			`<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="_2">` +
+			test.assertionSignature +
+			`<Subject><NameID>jsmith@contoso.com</NameID></Subject>` +
+			`</Assertion></samlp:Response>`
+		resp, err := parseSAMLResponse([]byte(raw))
+		if err != nil {
+			t.Fatalf("%s: failed parsing response: %s", test.name, err)
+		}
+		err = resp.validateSignaturePresence(test.requireSignedAssertion)
+		if test.shouldFail && err == nil {
+			t.Errorf("%s: expected failure, got success", test.name)
+		}
+		if !test.shouldFail && err != nil {
+			t.Errorf("%s: expected success, got %s", test.name, err)
+		}
+	}
+}
+
+func TestValidateIssuer(t *testing.T) {
+	expectedIssuer := "https://sts.windows.net/1b9e886b-8ff2-4378-b6c8-6771259a5f51/"
+	for _, test := range []struct {
+		name            string
+		responseIssuer  string
+		assertionIssuer string
+		expectedIssuer  string
+		shouldFail      bool
+	}{
+		{
+			name:            "matching issuers",
+			responseIssuer:  expectedIssuer,
+			assertionIssuer: expectedIssuer,
+			expectedIssuer:  expectedIssuer,
+		},
+		{
+			name:            "matching assertion issuer without response issuer",
+			assertionIssuer: expectedIssuer,
+			expectedIssuer:  expectedIssuer,
+		},
+		{
+			name:            "mismatched response issuer",
+			responseIssuer:  "https://idp.contoso.com/",
+			assertionIssuer: expectedIssuer,
+			expectedIssuer:  expectedIssuer,
+			shouldFail:      true,
+		},
+		{
+			name:            "mismatched assertion issuer",
+			responseIssuer:  expectedIssuer,
+			assertionIssuer: "https://idp.contoso.com/",
+			expectedIssuer:  expectedIssuer,
+			shouldFail:      true,
+		},
+		{
+			name:           "missing assertion issuer",
+			responseIssuer: expectedIssuer,
+			expectedIssuer: expectedIssuer,
+			shouldFail:     true,
+		},
+		{
+			name:            "markup in assertion issuer",
+			responseIssuer:  expectedIssuer,
+			assertionIssuer: "&lt;script&gt;",
+			expectedIssuer:  expectedIssuer,
+			shouldFail:      true,
+		},
+		{
+			name:            "no expected issuer",
+			responseIssuer:  "https://idp.contoso.com/",
+			assertionIssuer: "https://idp.contoso.com/",
+		},
+	} {
+		raw := `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_1">`
+		if test.responseIssuer != "" {
+			raw += `<Issuer xmlns="urn:oasis:names:tc:SAML:2.0:assertion">` + test.responseIssuer + `</Issuer>`
+		}
+		raw += `<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="_2">`
+		if test.assertionIssuer != "" {
+			raw += `<Issuer>` + test.assertionIssuer + `</Issuer>`
+		}
+		raw += `</Assertion></samlp:Response>`
+		resp, err := parseSAMLResponse([]byte(raw))
+		if err != nil {
+			t.Fatalf("%s: failed parsing response: %s", test.name, err)
+		}
+		err = resp.validateIssuer(test.expectedIssuer)
+		if test.shouldFail && err == nil {
+			t.Errorf("%s: expected failure, got success", test.name)
+		}
+		// The unsigned Issuers and the assertion ID are not echoed to the user.
+		if err != nil && (strings.Contains(err.Error(), "_2") || strings.Contains(err.Error(), "contoso") || strings.Contains(err.Error(), "<script>")) {
+			t.Errorf("%s: error echoes the Issuer: %s", test.name, err)
+		}
+		if !test.shouldFail && err != nil {
+			t.Errorf("%s: expected success, got %s", test.name, err)
+		}
+
+		assertion := &samllib.Assertion{Issuer: samllib.Issuer{Value: test.assertionIssuer}}
+		err = validateAssertionIssuer(assertion, test.expectedIssuer)
+		assertionShouldFail := test.expectedIssuer != "" && test.assertionIssuer != test.expectedIssuer
+		if assertionShouldFail && err == nil {
+			t.Errorf("%s: expected assertion issuer failure, got success", test.name)
+		}
+		if err != nil && (strings.Contains(err.Error(), "contoso") || strings.Contains(err.Error(), "<script>")) {
+			t.Errorf("%s: assertion issuer error echoes the Issuer: %s", test.name, err)
+		}
+		if !assertionShouldFail && err != nil {
+			t.Errorf("%s: expected assertion issuer success, got %s", test.name, err)
+		}
+	}
+}
+
+func TestValidateIssuerConsistency(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		responseIssuer  string
+		assertionIssuer string
+		shouldFail      bool
+	}{
+		{
+			name:            "consistent issuers",
+			responseIssuer:  "https://idp.contoso.com/",
+			assertionIssuer: "https://idp.contoso.com/",
+		},
+		{
+			name:            "consistent issuers with whitespace",
+			responseIssuer:  " https://idp.contoso.com/\n",
+			assertionIssuer: "https://idp.contoso.com/",
+		},
+		{
+			name:            "no response issuer",
+			assertionIssuer: "https://idp.contoso.com/",
+		},
+		{
+			name:            "inconsistent issuers",
+			responseIssuer:  "https://idp.contoso.com/",
+			assertionIssuer: "https://idp.fabrikam.com/",
+			shouldFail:      true,
+		},
+		{
+			name:           "missing assertion issuer",
+			responseIssuer: "https://idp.contoso.com/",
+			shouldFail:     true,
+		},
+		{
+			name:            "markup in assertion issuer",
+			responseIssuer:  "https://idp.contoso.com/",
+			assertionIssuer: "&lt;script&gt;",
+			shouldFail:      true,
+		},
+	} {
+		raw := `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_1">`
+		if test.responseIssuer != "" {
+			raw += `<Issuer xmlns="urn:oasis:names:tc:SAML:2.0:assertion">` + test.responseIssuer + `</Issuer>`
+		}
+		raw += `<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="_2">`
+		if test.assertionIssuer != "" {
+			raw += `<Issuer>` + test.assertionIssuer + `</Issuer>`
+		}
+		raw += `</Assertion></samlp:Response>`
+		resp, err := parseSAMLResponse([]byte(raw))
+		if err != nil {
+			t.Fatalf("%s: failed parsing response: %s", test.name, err)
+		}
+		err = resp.validateIssuerConsistency()
+		if test.shouldFail && err == nil {
+			t.Errorf("%s: expected failure, got success", test.name)
+		}
+		// The unsigned Issuers and the assertion ID are not echoed to the user.
+		if err != nil && (strings.Contains(err.Error(), "_2") || strings.Contains(err.Error(), "contoso") || strings.Contains(err.Error(), "<script>")) {
+			t.Errorf("%s: error echoes the Issuer: %s", test.name, err)
+		}
+		if !test.shouldFail && err != nil {
+			t.Errorf("%s: expected success, got %s", test.name, err)
+		}
+
+		// The decrypted assertion is checked the same way.
+		assertion := &samllib.Assertion{Issuer: samllib.Issuer{Value: test.assertionIssuer}}
+		err = validateAssertionIssuerConsistency(assertion, test.responseIssuer)
+		if test.shouldFail && err == nil {
+			t.Errorf("%s: expected assertion failure, got success", test.name)
+		}
+		if err != nil && (strings.Contains(err.Error(), "contoso") || strings.Contains(err.Error(), "<script>")) {
+			t.Errorf("%s: assertion error echoes the Issuer: %s", test.name, err)
+		}
+		if !test.shouldFail && err != nil {
+			t.Errorf("%s: expected assertion success, got %s", test.name, err)
+		}
+	}
+}
+
+// nonstandardPrefixResponse binds the SAML namespaces to nonstandard
+// prefixes, e.g. saml2p and saml2, and uses a default namespace for the
+// second assertion.
+const nonstandardPrefixResponse = `<saml2p:Response xmlns:saml2p="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml2="urn:oasis:names:tc:SAML:2.0:assertion" ID="_r1" Version="2.0" Destination="https://localhost:3443/saml" InResponseTo="_q1">` +
+	`<saml2:Issuer>https://idp.contoso.com/</saml2:Issuer>` +
+	`<dsig:Signature xmlns:dsig="http://www.w3.org/2000/09/xmldsig#"><dsig:SignedInfo>` +
+	`<dsig:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/>` +
+	`</dsig:SignedInfo></dsig:Signature>` +
+	`<saml2p:Status><saml2p:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></saml2p:Status>` +
+	`<saml2:Assertion ID="_a1" Version="2.0"><saml2:Issuer>https://idp.contoso.com/</saml2:Issuer>` +
+	`<sig:Signature xmlns:sig="http://www.w3.org/2000/09/xmldsig#"><sig:SignedInfo>` +
+	`<sig:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/>` +
+	`</sig:SignedInfo></sig:Signature>` +
+	`</saml2:Assertion>` +
+	`<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="_a2" Version="2.0"><Issuer>https://idp.contoso.com/</Issuer></Assertion>` +
+	`<saml:Assertion xmlns:saml="urn:example:not-saml" ID="_x1"/>` +
+	`</saml2p:Response>`
+
+func TestNamespacePrefixes(t *testing.T) {
+	resp, err := parseSAMLResponse([]byte(nonstandardPrefixResponse))
+	if err != nil {
+		t.Fatalf("failed parsing response: %s", err)
+	}
+	if resp.ID != "_r1" || resp.InResponseTo != "_q1" || resp.Destination != "https://localhost:3443/saml" {
+		t.Fatalf("unexpected response attributes: %+v", resp)
+	}
+	if resp.Issuer != "https://idp.contoso.com/" {
+		t.Fatalf("unexpected response issuer: %q", resp.Issuer)
+	}
+	if resp.Status.getStatusCode() != samlStatusSuccess {
+		t.Fatalf("unexpected status code: %s", resp.Status.getStatusCode())
+	}
+	if n := resp.getAssertionCount(); n != 2 {
+		t.Fatalf("expected 2 assertions, got %d", n)
+	}
+	if n := len(resp.getSignatures()); n != 2 {
+		t.Fatalf("expected 2 signatures, got %d", n)
+	}
+	if err := resp.validateSignatureAlgorithms("sha256"); err != nil {
+		t.Fatalf("unexpected signature algorithm error: %s", err)
+	}
+	if err := resp.validateIssuer("https://idp.contoso.com/"); err != nil {
+		t.Fatalf("unexpected issuer error: %s", err)
+	}
+
+	rawResponses, err := splitSAMLResponse([]byte(nonstandardPrefixResponse))
+	if err != nil {
+		t.Fatalf("failed splitting response: %s", err)
+	}
+	if len(rawResponses) != 2 {
+		t.Fatalf("expected 2 responses, got %d", len(rawResponses))
+	}
+	for i, assertionID := range []string{"_a1", "_a2"} {
+		splitResp, err := parseSAMLResponse(rawResponses[i])
+		if err != nil {
+			t.Fatalf("response %d: failed parsing: %s", i, err)
+		}
+		if len(splitResp.Assertions) != 1 || splitResp.Assertions[0].ID != assertionID {
+			t.Fatalf("response %d: expected assertion %s, got %v", i, assertionID, splitResp.Assertions)
+		}
+		if splitResp.Signature != nil {
+			t.Fatalf("response %d: response signature was not removed", i)
+		}
+		// The element of the foreign namespace is not an assertion.
+		if !strings.Contains(string(rawResponses[i]), `ID="_x1"`) {
+			t.Fatalf("response %d: element of foreign namespace was removed", i)
+		}
+	}
+}
+
+func TestDecodeSAMLResponse(t *testing.T) {
+	// The trailing bytes encode to "+" and "/" in the standard alphabet,
+	// and to "-" and "_" in the URL-safe one.
+	raw := []byte(nonstandardPrefixResponse + "\xfb\xff\xbf")
+	encoded := base64.StdEncoding.EncodeToString(raw)
+	wrapped := []string{}
+	for i := 0; i < len(encoded); i += 76 {
+		end := i + 76
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		wrapped = append(wrapped, encoded[i:end])
+	}
+	for _, test := range []struct {
+		name      string
+		value     string
+		shouldErr bool
+	}{
+		{name: "standard", value: encoded},
+		{name: "line breaks", value: strings.Join(wrapped, "\r\n")},
+		{name: "whitespace", value: " \t" + strings.Join(wrapped, "\n  ") + "\n"},
+		{name: "url-safe", value: base64.URLEncoding.EncodeToString(raw)},
+		{name: "url-safe without padding", value: base64.RawURLEncoding.EncodeToString(raw)},
+		{name: "url-safe with whitespace", value: strings.Replace(base64.URLEncoding.EncodeToString(raw), "A", "A\n", 3)},
+		{name: "malformed", value: "PHNhbWxwOlJlc3BvbnNlLz4*", shouldErr: true},
+	} {
+		b, err := decodeSAMLResponse(test.value)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("%s: expected failure, got success", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected failure: %s", test.name, err)
+			continue
+		}
+		if string(b) != string(raw) {
+			t.Errorf("%s: unexpected decoded response: %q", test.name, b)
+		}
+	}
+	if !strings.ContainsAny(encoded, "+/") || !strings.ContainsAny(base64.URLEncoding.EncodeToString(raw), "-_") {
+		t.Fatalf("the encodings do not differ")
+	}
+}
+
+func TestParseAssertionWithContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	release := make(chan struct{})
+	defer close(release)
+	start := time.Now()
+	_, err := parseAssertionWithContext(ctx, func() (*samllib.Assertion, error) {
+		<-release
+		return &samllib.Assertion{}, nil
+	})
+	if err == nil {
+		t.Fatalf("slow parsing did not time out")
+	}
+	if _, timedOut := err.(*responseParseTimeoutError); !timedOut {
+		t.Fatalf("unexpected error type: %T: %s", err, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("parsing was not aborted in time: %s", elapsed)
+	}
+
+	assertion, err := parseAssertionWithContext(context.Background(), func() (*samllib.Assertion, error) {
+		return &samllib.Assertion{ID: "id-1"}, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if assertion.ID != "id-1" {
+		t.Fatalf("unexpected assertion: %v", assertion)
+	}
+}
@@ -0,0 +1,81 @@
+package saml
+
+import (
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+)
+
+// samlResponseProvider is implemented by the IdPs the SAML Responses
+// posted to the authentication endpoint are routed to.
+type samlResponseProvider interface {
+	// getProviderName returns the name of the IdP in the provider query
+	// parameter, e.g. "azure".
+	getProviderName() string
+	// getPriority returns the precedence of the IdP when the SAML Response
+	// matches multiple IdPs. The higher takes precedence.
+	getPriority() int
+	// matchesSAMLResponse returns true when the request appears to carry
+	// a SAML Response of the IdP, e.g. per the Origin header.
+	matchesSAMLResponse(r *http.Request) bool
+}
+
+// selectSAMLResponseProvider returns the IdP the SAML Response of the
+// request is routed to, or nil when none matches. When multiple IdPs
+// match, the provider query parameter, e.g. of the ACS URL, selects one
+// of them. Otherwise, the one with the highest priority wins. The IdPs
+// with the same priority are ambiguous, and the one configured first
+// wins. The names of the ambiguous IdPs are returned for logging.
+func selectSAMLResponseProvider(r *http.Request, providers []samlResponseProvider) (samlResponseProvider, []string) {
+	candidates := []samlResponseProvider{}
+	for _, provider := range providers {
+		if provider.matchesSAMLResponse(r) {
+			candidates = append(candidates, provider)
+		}
+	}
+	if len(candidates) < 2 {
+		if len(candidates) == 0 {
+			return nil, nil
+		}
+		return candidates[0], nil
+	}
+	if name := r.URL.Query().Get("provider"); name != "" {
+		for _, provider := range candidates {
+			if provider.getProviderName() == name {
+				return provider, nil
+			}
+		}
+		return nil, nil
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].getPriority() > candidates[j].getPriority()
+	})
+	if candidates[0].getPriority() != candidates[1].getPriority() {
+		return candidates[0], nil
+	}
+	ambiguous := []string{}
+	for _, provider := range candidates {
+		if provider.getPriority() == candidates[0].getPriority() {
+			ambiguous = append(ambiguous, provider.getProviderName())
+		}
+	}
+	return candidates[0], ambiguous
+}
+
+// getSAMLResponseProvider returns the enabled IdP the SAML Response of the
+// request is routed to, if any. The ambiguous matches are logged.
+func (m AuthProvider) getSAMLResponseProvider(r *http.Request) samlResponseProvider {
+	providers := []samlResponseProvider{}
+	if m.isAzureEnabled() {
+		providers = append(providers, m.Azure)
+	}
+	provider, ambiguous := selectSAMLResponseProvider(r, providers)
+	if len(ambiguous) > 0 {
+		m.logger.Warn(
+			"SAML Response matches multiple providers, set the provider query parameter or priority",
+			zap.Strings("providers", ambiguous),
+			zap.String("selected_provider", provider.getProviderName()),
+		)
+	}
+	return provider
+}
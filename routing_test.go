@@ -0,0 +1,101 @@
+package saml
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testSAMLResponseProvider is an IdP matching the SAML Responses posted
+// from the origin.
+type testSAMLResponseProvider struct {
+	name     string
+	priority int
+	origin   string
+}
+
+func (p *testSAMLResponseProvider) getProviderName() string {
+	return p.name
+}
+
+func (p *testSAMLResponseProvider) getPriority() int {
+	return p.priority
+}
+
+func (p *testSAMLResponseProvider) matchesSAMLResponse(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Origin"), p.origin)
+}
+
+func TestSelectSAMLResponseProvider(t *testing.T) {
+	for _, test := range []struct {
+		name              string
+		providers         []*testSAMLResponseProvider
+		target            string
+		expected          string
+		expectedAmbiguous []string
+	}{
+		{
+			name: "single match",
+			providers: []*testSAMLResponseProvider{
+				{name: "contoso", origin: "login.contoso.com"},
+				{name: "fabrikam", origin: "login.fabrikam.com"},
+			},
+			target:   "/saml",
+			expected: "contoso",
+		},
+		{
+			name: "ambiguous match",
+			providers: []*testSAMLResponseProvider{
+				{name: "contoso", origin: "contoso.com"},
+				{name: "contoso-partners", origin: "login.contoso.com"},
+			},
+			target:            "/saml",
+			expected:          "contoso",
+			expectedAmbiguous: []string{"contoso", "contoso-partners"},
+		},
+		{
+			name: "provider parameter",
+			providers: []*testSAMLResponseProvider{
+				{name: "contoso", origin: "contoso.com"},
+				{name: "contoso-partners", origin: "login.contoso.com"},
+			},
+			target:   "/saml?provider=contoso-partners",
+			expected: "contoso-partners",
+		},
+		{
+			name: "priority",
+			providers: []*testSAMLResponseProvider{
+				{name: "contoso", origin: "contoso.com"},
+				{name: "contoso-partners", origin: "login.contoso.com", priority: 10},
+			},
+			target:   "/saml",
+			expected: "contoso-partners",
+		},
+		{
+			name: "no match",
+			providers: []*testSAMLResponseProvider{
+				{name: "fabrikam", origin: "login.fabrikam.com"},
+			},
+			target: "/saml",
+		},
+	} {
+		providers := []samlResponseProvider{}
+		for _, provider := range test.providers {
+			providers = append(providers, provider)
+		}
+		r := httptest.NewRequest("POST", test.target, nil)
+		r.Header.Set("Origin", "https://login.contoso.com")
+		provider, ambiguous := selectSAMLResponseProvider(r, providers)
+		name := ""
+		if provider != nil {
+			name = provider.getProviderName()
+		}
+		if name != test.expected {
+			t.Errorf("%s: unexpected provider %q, expected %q", test.name, name, test.expected)
+		}
+		if strings.Join(ambiguous, ",") != strings.Join(test.expectedAmbiguous, ",") {
+			t.Errorf("%s: unexpected ambiguous providers %v, expected %v", test.name, ambiguous, test.expectedAmbiguous)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package saml
+
+import (
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+// defaultMaxSessionLifetime is the default number of seconds since
+// authentication past which a session token is no longer renewed.
+const defaultMaxSessionLifetime = 43200
+
+// authenticateSession authenticates the request carrying a valid session
+// token. The token is renewed when it is about to expire. When the user is
+// denied access, the user interface with the reason is rendered, and the
+// request is not authenticated.
+func (m AuthProvider) authenticateSession(w http.ResponseWriter, r *http.Request, claims *UserClaims) (caddyauth.User, bool, error) {
+	user := claims.newUser()
+	if err := m.authorize(user); err != nil {
+		m.audit.recordAuthorizationDenied(r, user, err)
+		statusCode := m.getFailureStatusCode(err)
+		if statusCode == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		uiArgs := m.UI.newUserInterfaceArgs()
+		uiArgs.Message = err.Error()
+		m.renderUI(w, statusCode, uiArgs)
+		return caddyauth.User{}, false, nil
+	}
+	token, renewed, err := m.Jwt.renewToken(claims, time.Now())
+	if err != nil {
+		m.logger.Error(
+			"failed renewing session token",
+			zap.String("user", user.ID),
+			zap.String("error", err.Error()),
+		)
+	}
+	if renewed {
+		http.SetCookie(w, m.Jwt.newSessionCookie(r, token))
+		m.Jwt.setTokenHeader(w, token)
+	}
+	m.logClaimsHeaderError(m.setClaimsHeader(w, claims))
+	return *user, true, nil
+}
+
+// renewToken returns the token with a fresh expiration time when the token
+// expires within the refresh window. The token keeps its original lifetime,
+// but it is not renewed past the maximum session lifetime. The token is not
+// renewed when the renewal is disabled, the token is not yet within the
+// refresh window, or the session reached its maximum lifetime.
+func (p TokenParameters) renewToken(claims *UserClaims, now time.Time) (string, bool, error) {
+	if p.RefreshWindow == 0 {
+		return "", false, nil
+	}
+	if claims.IssuedAt == 0 || claims.AuthTime == 0 {
+		return "", false, nil
+	}
+	if claims.ExpiresAt-now.Unix() > int64(p.RefreshWindow) {
+		return "", false, nil
+	}
+	maxExpiresAt := claims.AuthTime + int64(p.MaxSessionLifetime)
+	if now.Unix() >= maxExpiresAt || claims.ExpiresAt >= maxExpiresAt {
+		return "", false, nil
+	}
+	renewedClaims := *claims
+	renewedClaims.IssuedAt = now.Unix()
+	renewedClaims.ExpiresAt = now.Unix() + (claims.ExpiresAt - claims.IssuedAt)
+	if renewedClaims.ExpiresAt > maxExpiresAt {
+		renewedClaims.ExpiresAt = maxExpiresAt
+	}
+	token, err := p.signToken(renewedClaims)
+	if err != nil {
+		return "", false, err
+	}
+	if err := p.extendSession(&renewedClaims); err != nil {
+		return "", false, err
+	}
+	return token, true, nil
+}
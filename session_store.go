@@ -0,0 +1,396 @@
+package saml
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionStoreMemory = "memory"
+	sessionStoreRedis  = "redis"
+)
+
+// Session is the server-side record of the session of an issued token.
+type Session struct {
+	// ID is the session ID the token carries in the sid claim.
+	ID string
+	// UserID is the ID of the user, i.e. the email address.
+	UserID string
+	// ExpiresAt is the time the session expires at, i.e. the expiration
+	// time of the token.
+	ExpiresAt time.Time
+}
+
+// SessionStore keeps track of the sessions of the issued tokens, so that
+// the sessions can be revoked before the tokens expire.
+type SessionStore interface {
+	// Add stores the session, or updates its expiration time when the
+	// session is already stored.
+	Add(session *Session) error
+	// Exists returns true when the session is stored and has not expired.
+	Exists(id string) (bool, error)
+	// Revoke removes the session.
+	Revoke(id string) error
+	// RevokeUser removes all sessions of the user and returns the number
+	// of the removed sessions.
+	RevokeUser(userID string) (int, error)
+}
+
+// SessionStoreParameters are the settings of the server-side session
+// tracking. The sessions are not tracked, i.e. the tokens are stateless,
+// unless the settings are present.
+type SessionStoreParameters struct {
+	// Type is the type of the store: "memory" (default) or "redis".
+	Type string `json:"type,omitempty"`
+	// RedisAddress is the host and the port of the Redis server.
+	RedisAddress string `json:"redis_address,omitempty"`
+	// RedisPassword is the password of the Redis server.
+	RedisPassword string `json:"redis_password,omitempty"`
+	// RedisDB is the number of the Redis database.
+	RedisDB int `json:"redis_db,omitempty"`
+	// RedisKeyPrefix is the prefix of the Redis keys of the sessions.
+	// Defaults to "caddy-auth-saml:session:".
+	RedisKeyPrefix string `json:"redis_key_prefix,omitempty"`
+	// RevokeURLPath is the path of the endpoint revoking sessions. The
+	// endpoint is disabled when the path is empty.
+	RevokeURLPath string `json:"revoke_url_path,omitempty"`
+	// AdminRoles are the roles allowed to revoke the sessions of other
+	// users. Any user may revoke their own session.
+	AdminRoles []string `json:"admin_roles,omitempty"`
+	// AdminURLPath is the path of the admin endpoint revoking all sessions
+	// of a user. The endpoint is disabled when the path is empty.
+	AdminURLPath string `json:"admin_url_path,omitempty"`
+	// AdminToken is the bearer token the requests to the admin endpoint
+	// must carry in the Authorization header.
+	AdminToken string `json:"admin_token,omitempty"`
+}
+
+// defaultRedisKeyPrefix is the default prefix of the Redis keys of the
+// sessions.
+const defaultRedisKeyPrefix = "caddy-auth-saml:session:"
+
+// validate checks the settings and sets the defaults.
+func (p *SessionStoreParameters) validate() error {
+	if p.AdminURLPath != "" && p.AdminToken == "" {
+		return fmt.Errorf("session_store.admin_token is required for session_store.admin_url_path")
+	}
+	switch p.Type {
+	case "", sessionStoreMemory:
+		p.Type = sessionStoreMemory
+	case sessionStoreRedis:
+		if p.RedisAddress == "" {
+			return fmt.Errorf("session_store.redis_address is required for redis session store")
+		}
+		if p.RedisDB < 0 {
+			return fmt.Errorf("session_store.redis_db must not be negative")
+		}
+		if p.RedisKeyPrefix == "" {
+			p.RedisKeyPrefix = defaultRedisKeyPrefix
+		}
+	default:
+		return fmt.Errorf("session_store.type %s is not supported", p.Type)
+	}
+	return nil
+}
+
+// newSessionStore validates the settings and returns the session store.
+func (p *SessionStoreParameters) newSessionStore() (SessionStore, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	if p.Type == sessionStoreRedis {
+		return newRedisSessionStore(p.RedisAddress, p.RedisPassword, p.RedisDB, p.RedisKeyPrefix), nil
+	}
+	return newMemorySessionStore(), nil
+}
+
+// getPoolKey returns the key of the session store of the plugin instance
+// in the state pool. The store is scoped to the instance, so that the
+// sites and the IdPs do not share the sessions.
+func (p *SessionStoreParameters) getPoolKey(instanceKey string) string {
+	if p.Type == sessionStoreRedis {
+		return fmt.Sprintf("session_store/%s/%s/%s/%d/%s", instanceKey, p.Type, p.RedisAddress, p.RedisDB, p.RedisKeyPrefix)
+	}
+	return fmt.Sprintf("session_store/%s/%s", instanceKey, p.Type)
+}
+
+// loadSessionStore returns the session store of the plugin instance with
+// the settings from the state pool, so that the sessions survive config
+// reloads. The store is created when the pool has none.
+func (p *SessionStoreParameters) loadSessionStore(instanceKey string) (SessionStore, string, error) {
+	if err := p.validate(); err != nil {
+		return nil, "", err
+	}
+	key := p.getPoolKey(instanceKey)
+	value, err := loadPooledState(key, func() (interface{}, error) {
+		return p.newSessionStore()
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return value.(SessionStore), key, nil
+}
+
+// memorySessionStore keeps the sessions in memory. The sessions do not
+// survive restarts and are not shared between instances.
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+	failures map[string]failureCount
+}
+
+// failureCount is the number of the login failures counted until the
+// time the count expires at.
+type failureCount struct {
+	count     int
+	expiresAt time.Time
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{
+		sessions: make(map[string]Session),
+		failures: make(map[string]failureCount),
+	}
+}
+
+// Add stores the session. The expired sessions are being discarded.
+func (s *memorySessionStore) Add(session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, stored := range s.sessions {
+		if now.After(stored.ExpiresAt) {
+			delete(s.sessions, id)
+		}
+	}
+	s.sessions[session.ID] = *session
+	return nil
+}
+
+// Exists returns true when the session is stored and has not expired.
+func (s *memorySessionStore) Exists(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, exists := s.sessions[id]
+	return exists && time.Now().Before(session.ExpiresAt), nil
+}
+
+// Revoke removes the session.
+func (s *memorySessionStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+// RevokeUser removes all sessions of the user. The user IDs are compared
+// case-insensitively.
+func (s *memorySessionStore) RevokeUser(userID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for id, session := range s.sessions {
+		if strings.EqualFold(session.UserID, userID) {
+			delete(s.sessions, id)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// incrementFailures counts a login failure of the key. The count expires
+// the window after the first failure. The expired counts are being
+// discarded.
+func (s *memorySessionStore) incrementFailures(key string, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, failures := range s.failures {
+		if now.After(failures.expiresAt) {
+			delete(s.failures, k)
+		}
+	}
+	failures, exists := s.failures[key]
+	if !exists {
+		failures.expiresAt = now.Add(window)
+	}
+	failures.count++
+	s.failures[key] = failures
+	return failures.count, nil
+}
+
+// getFailures returns the number of the login failures of the key.
+func (s *memorySessionStore) getFailures(key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failures, exists := s.failures[key]
+	if !exists || time.Now().After(failures.expiresAt) {
+		return 0, nil
+	}
+	return failures.count, nil
+}
+
+// resetFailures clears the login failures of the key.
+func (s *memorySessionStore) resetFailures(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.failures, key)
+	return nil
+}
+
+// newSessionID returns a random session ID.
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// startSession assigns a new session ID to the claims and stores the
+// session. It does nothing when the session store is disabled.
+func (p TokenParameters) startSession(claims *UserClaims) error {
+	if p.sessions == nil {
+		return nil
+	}
+	id, err := newSessionID()
+	if err != nil {
+		return fmt.Errorf("failed generating session ID: %s", err)
+	}
+	claims.SessionID = id
+	return p.sessions.Add(&Session{
+		ID:        claims.SessionID,
+		UserID:    claims.Email,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	})
+}
+
+// extendSession updates the expiration time of the session of the renewed
+// claims. It does nothing when the session store is disabled.
+func (p TokenParameters) extendSession(claims *UserClaims) error {
+	if p.sessions == nil || claims.SessionID == "" {
+		return nil
+	}
+	return p.sessions.Add(&Session{
+		ID:        claims.SessionID,
+		UserID:    claims.Email,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	})
+}
+
+// validateSession checks that the session of the claims has not been
+// revoked. When the session store is enabled, the tokens without session
+// ID are rejected.
+func (p TokenParameters) validateSession(claims *UserClaims) error {
+	if p.sessions == nil {
+		return nil
+	}
+	if claims.SessionID == "" {
+		return fmt.Errorf("token has no session ID")
+	}
+	exists, err := p.sessions.Exists(claims.SessionID)
+	if err != nil {
+		return fmt.Errorf("failed looking up session: %s", err)
+	}
+	if !exists {
+		return fmt.Errorf("session %s is revoked or expired", claims.SessionID)
+	}
+	return nil
+}
+
+// handleSessionRevocation revokes the session with the ID in the sid form
+// value of the POST request. A user may revoke their own session, while
+// revoking the sessions of other users requires one of the admin roles.
+func (m AuthProvider) handleSessionRevocation(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return fmt.Errorf("session revocation request method %s is not allowed", r.Method)
+	}
+	claims, _, err := m.Jwt.validateRequestToken(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return err
+	}
+	sessionID := r.FormValue("sid")
+	if sessionID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return fmt.Errorf("session revocation request has no sid")
+	}
+	if sessionID != claims.SessionID && !hasAnyRole(claims.Roles, m.SessionStore.AdminRoles) {
+		w.WriteHeader(http.StatusForbidden)
+		return fmt.Errorf("user %s is not allowed to revoke session %s", claims.Email, sessionID)
+	}
+	if err := m.Jwt.sessions.Revoke(sessionID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+	m.audit.recordSessionRevoked(r, claims.Email, sessionID)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleSessionAdmin revokes all sessions of the user in the user form
+// value of the POST request. The request must carry the admin token in the
+// Authorization header. The response is the number of the revoked sessions.
+func (m AuthProvider) handleSessionAdmin(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(`{"error":"method not allowed"}`))
+		return fmt.Errorf("session admin request method %s is not allowed", r.Method)
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(m.SessionStore.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"unauthorized"}`))
+		return fmt.Errorf("session admin request has no valid admin token")
+	}
+	userID := r.FormValue("user")
+	if userID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"user is required"}`))
+		return fmt.Errorf("session admin request has no user")
+	}
+	count, err := m.Jwt.sessions.RevokeUser(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"internal server error"}`))
+		return err
+	}
+	m.audit.recordUserSessionsRevoked(r, userID, count)
+	b, err := json.Marshal(map[string]interface{}{
+		"user":             userID,
+		"revoked_sessions": count,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+	w.Write(b)
+	return nil
+}
+
+// hasAnyRole returns true when the roles include one of the required ones.
+func hasAnyRole(roles, requiredRoles []string) bool {
+	for _, role := range roles {
+		for _, requiredRole := range requiredRoles {
+			if role == requiredRole {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,308 @@
+package saml
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisTimeout is the timeout of the connection to and of the commands
+// sent to the Redis server.
+const redisTimeout = 5 * time.Second
+
+// redisSessionStore keeps the sessions in Redis, so that the sessions are
+// shared between instances and survive restarts. The sessions are stored
+// as the keys expiring along with the sessions.
+type redisSessionStore struct {
+	address   string
+	password  string
+	db        int
+	keyPrefix string
+	mu        sync.Mutex
+	conn      net.Conn
+	reader    *bufio.Reader
+}
+
+func newRedisSessionStore(address, password string, db int, keyPrefix string) *redisSessionStore {
+	return &redisSessionStore{
+		address:   address,
+		password:  password,
+		db:        db,
+		keyPrefix: keyPrefix,
+	}
+}
+
+// Add stores the session with the time to live of the session. The ID of
+// the session is added to the set of the sessions of the user, which
+// lives as long as the longest session of the user.
+func (s *redisSessionStore) Add(session *Session) error {
+	ttl := int64(time.Until(session.ExpiresAt) / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+	if _, err := s.do("SET", s.keyPrefix+session.ID, session.UserID, "EX", strconv.FormatInt(ttl, 10)); err != nil {
+		return err
+	}
+	userKey := s.userKey(session.UserID)
+	if _, err := s.do("SADD", userKey, session.ID); err != nil {
+		return err
+	}
+	reply, err := s.do("TTL", userKey)
+	if err != nil {
+		return err
+	}
+	if userTTL, ok := reply.(int64); ok && userTTL >= ttl {
+		return nil
+	}
+	_, err = s.do("EXPIRE", userKey, strconv.FormatInt(ttl, 10))
+	return err
+}
+
+// Exists returns true when the session is stored. The expired sessions are
+// removed by Redis.
+func (s *redisSessionStore) Exists(id string) (bool, error) {
+	reply, err := s.do("EXISTS", s.keyPrefix+id)
+	if err != nil {
+		return false, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return false, fmt.Errorf("unexpected Redis EXISTS reply: %v", reply)
+	}
+	return n > 0, nil
+}
+
+// Revoke removes the session.
+func (s *redisSessionStore) Revoke(id string) error {
+	_, err := s.do("DEL", s.keyPrefix+id)
+	return err
+}
+
+// RevokeUser removes all sessions of the user along with the set of the
+// sessions of the user.
+func (s *redisSessionStore) RevokeUser(userID string) (int, error) {
+	userKey := s.userKey(userID)
+	reply, err := s.do("SMEMBERS", userKey)
+	if err != nil {
+		return 0, err
+	}
+	ids, ok := reply.([]interface{})
+	if !ok {
+		return 0, fmt.Errorf("unexpected Redis SMEMBERS reply: %v", reply)
+	}
+	count := 0
+	for _, item := range ids {
+		id, ok := item.(string)
+		if !ok {
+			continue
+		}
+		reply, err := s.do("DEL", s.keyPrefix+id)
+		if err != nil {
+			return count, err
+		}
+		if n, ok := reply.(int64); ok {
+			count += int(n)
+		}
+	}
+	if _, err := s.do("DEL", userKey); err != nil {
+		return count, err
+	}
+	return count, nil
+}
+
+// incrementFailures counts a login failure of the key. The count expires
+// the window after the first failure.
+func (s *redisSessionStore) incrementFailures(key string, window time.Duration) (int, error) {
+	failuresKey := s.failuresKey(key)
+	reply, err := s.do("INCR", failuresKey)
+	if err != nil {
+		return 0, err
+	}
+	count, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected Redis INCR reply: %v", reply)
+	}
+	if count == 1 {
+		seconds := int64(window / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+		if _, err := s.do("EXPIRE", failuresKey, strconv.FormatInt(seconds, 10)); err != nil {
+			return 0, err
+		}
+	}
+	return int(count), nil
+}
+
+// getFailures returns the number of the login failures of the key.
+func (s *redisSessionStore) getFailures(key string) (int, error) {
+	reply, err := s.do("GET", s.failuresKey(key))
+	if err != nil {
+		return 0, err
+	}
+	if reply == nil {
+		return 0, nil
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return 0, fmt.Errorf("unexpected Redis GET reply: %v", reply)
+	}
+	return strconv.Atoi(value)
+}
+
+// resetFailures clears the login failures of the key.
+func (s *redisSessionStore) resetFailures(key string) error {
+	_, err := s.do("DEL", s.failuresKey(key))
+	return err
+}
+
+// failuresKey returns the key of the login failures count.
+func (s *redisSessionStore) failuresKey(key string) string {
+	return s.keyPrefix + "failures:" + key
+}
+
+// userKey returns the key of the set of the sessions of the user. The user
+// IDs are compared case-insensitively.
+func (s *redisSessionStore) userKey(userID string) string {
+	return s.keyPrefix + "user:" + strings.ToLower(userID)
+}
+
+// do sends the command to the Redis server and returns the reply. The
+// connection is established on demand and closed on failure, so that
+// the next command reconnects.
+func (s *redisSessionStore) do(args ...string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := s.roundTrip(args...)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	return reply, nil
+}
+
+// connect establishes the connection to the Redis server, authenticates,
+// and selects the database.
+func (s *redisSessionStore) connect() error {
+	conn, err := net.DialTimeout("tcp", s.address, redisTimeout)
+	if err != nil {
+		return fmt.Errorf("failed connecting to Redis %s: %s", s.address, err)
+	}
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+	if s.password != "" {
+		if _, err := s.roundTrip("AUTH", s.password); err != nil {
+			s.close()
+			return fmt.Errorf("failed authenticating to Redis %s: %s", s.address, err)
+		}
+	}
+	if s.db != 0 {
+		if _, err := s.roundTrip("SELECT", strconv.Itoa(s.db)); err != nil {
+			s.close()
+			return fmt.Errorf("failed selecting Redis database %d: %s", s.db, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the connection to the Redis server.
+func (s *redisSessionStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.close()
+	return nil
+}
+
+func (s *redisSessionStore) close() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn = nil
+	s.reader = nil
+}
+
+// roundTrip writes the command in RESP and reads the reply.
+func (s *redisSessionStore) roundTrip(args ...string) (interface{}, error) {
+	if err := s.conn.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(s.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(s.reader)
+}
+
+// redisError is an error reply of the Redis server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "Redis error: " + string(e)
+}
+
+// readRedisReply reads a RESP reply. The simple strings and the bulk
+// strings are returned as strings, the integers as int64, and the arrays
+// as slices of replies. The null bulk string is returned as nil.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("malformed Redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("malformed Redis bulk string length: %s", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("malformed Redis array length: %s", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			item, err := readRedisReply(r)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unsupported Redis reply type %q", line[0])
+}
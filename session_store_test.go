@@ -0,0 +1,508 @@
+package saml
+
+import (
+	"bufio"
+	"fmt"
+	"go.uber.org/zap"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemorySessionStore(t *testing.T) {
+	store := newMemorySessionStore()
+	if err := store.Add(&Session{ID: "active", UserID: "jsmith@contoso.com", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("failed adding session: %s", err)
+	}
+	if err := store.Add(&Session{ID: "expired", UserID: "jsmith@contoso.com", ExpiresAt: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatalf("failed adding session: %s", err)
+	}
+	for id, expected := range map[string]bool{
+		"active":  true,
+		"expired": false,
+		"unknown": false,
+	} {
+		exists, err := store.Exists(id)
+		if err != nil {
+			t.Fatalf("failed looking up session %s: %s", id, err)
+		}
+		if exists != expected {
+			t.Errorf("session %s: expected exists=%t, got %t", id, expected, exists)
+		}
+	}
+	if err := store.Revoke("active"); err != nil {
+		t.Fatalf("failed revoking session: %s", err)
+	}
+	if exists, _ := store.Exists("active"); exists {
+		t.Fatalf("revoked session still exists")
+	}
+}
+
+func TestValidateSession(t *testing.T) {
+	p := TokenParameters{}
+	if err := p.validateSession(&UserClaims{}); err != nil {
+		t.Fatalf("stateless token failed validation: %s", err)
+	}
+
+	p.sessions = newMemorySessionStore()
+	claims := &UserClaims{
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Email:     "jsmith@contoso.com",
+	}
+	if err := p.startSession(claims); err != nil {
+		t.Fatalf("failed starting session: %s", err)
+	}
+	if claims.SessionID == "" {
+		t.Fatalf("session ID was not assigned")
+	}
+	if err := p.validateSession(claims); err != nil {
+		t.Fatalf("active session failed validation: %s", err)
+	}
+	if err := p.validateSession(&UserClaims{Email: "jsmith@contoso.com"}); err == nil {
+		t.Fatalf("token without session ID passed validation")
+	}
+	if err := p.sessions.Revoke(claims.SessionID); err != nil {
+		t.Fatalf("failed revoking session: %s", err)
+	}
+	if err := p.validateSession(claims); err == nil {
+		t.Fatalf("revoked session passed validation")
+	}
+}
+
+func TestSessionRevocationToken(t *testing.T) {
+	p := TokenParameters{
+		TokenSecret: "75f03764-147c-4d87-b2f0-4fda89e331c8",
+		sessions:    newMemorySessionStore(),
+	}
+	claims := UserClaims{
+		ExpiresAt: time.Now().Add(900 * time.Second).Unix(),
+		Email:     "jsmith@contoso.com",
+	}
+	if err := p.startSession(&claims); err != nil {
+		t.Fatalf("failed starting session: %s", err)
+	}
+	token, err := p.signToken(claims)
+	if err != nil {
+		t.Fatalf("failed signing token: %s", err)
+	}
+	validClaims, _, err := p.validateToken(token)
+	if err != nil {
+		t.Fatalf("token failed validation: %s", err)
+	}
+	if validClaims.SessionID != claims.SessionID {
+		t.Fatalf("expected session ID %s, got %s", claims.SessionID, validClaims.SessionID)
+	}
+	if err := p.sessions.Revoke(claims.SessionID); err != nil {
+		t.Fatalf("failed revoking session: %s", err)
+	}
+	if _, _, err := p.validateToken(token); err == nil {
+		t.Fatalf("token of revoked session passed validation")
+	}
+}
+
+func TestHandleSessionRevocation(t *testing.T) {
+	sessions := newMemorySessionStore()
+	m := AuthProvider{
+		CommonParameters: CommonParameters{
+			Jwt: TokenParameters{
+				TokenName:   "JWT_TOKEN",
+				TokenSecret: "75f03764-147c-4d87-b2f0-4fda89e331c8",
+				sessions:    sessions,
+			},
+			SessionStore: &SessionStoreParameters{
+				RevokeURLPath: "/saml/sessions/revoke",
+				AdminRoles:    []string{"AzureAD_Administrator"},
+			},
+		},
+	}
+	m.audit = newAuditLogger(zap.NewNop(), nil, auditFormatJSON)
+	newToken := func(email string, roles ...string) (string, string) {
+		claims := UserClaims{
+			ExpiresAt: time.Now().Add(900 * time.Second).Unix(),
+			Email:     email,
+			Roles:     roles,
+		}
+		if err := m.Jwt.startSession(&claims); err != nil {
+			t.Fatalf("failed starting session: %s", err)
+		}
+		token, err := m.Jwt.signToken(claims)
+		if err != nil {
+			t.Fatalf("failed signing token: %s", err)
+		}
+		return token, claims.SessionID
+	}
+	revoke := func(token, sessionID string) int {
+		form := url.Values{"sid": {sessionID}}
+		r := httptest.NewRequest("POST", "/saml/sessions/revoke", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		m.handleSessionRevocation(w, r)
+		return w.Code
+	}
+
+	userToken, userSessionID := newToken("jsmith@contoso.com", "AzureAD_Viewer")
+	_, otherSessionID := newToken("jdoe@contoso.com", "AzureAD_Viewer")
+	adminToken, _ := newToken("admin@contoso.com", "AzureAD_Administrator")
+
+	if code := revoke(userToken, otherSessionID); code != 403 {
+		t.Fatalf("expected status code 403 revoking session of other user, got %d", code)
+	}
+	if code := revoke(adminToken, otherSessionID); code != 204 {
+		t.Fatalf("expected status code 204 revoking session as admin, got %d", code)
+	}
+	if exists, _ := sessions.Exists(otherSessionID); exists {
+		t.Fatalf("session revoked by admin still exists")
+	}
+	if code := revoke(userToken, userSessionID); code != 204 {
+		t.Fatalf("expected status code 204 revoking own session, got %d", code)
+	}
+	if code := revoke(userToken, userSessionID); code != 401 {
+		t.Fatalf("expected status code 401 using revoked session, got %d", code)
+	}
+}
+
+// fakeRedisServer serves the subset of the Redis commands the session store
+// uses.
+type fakeRedisServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	keys     map[string]string
+	sets     map[string][]string
+	commands []string
+}
+
+func newFakeRedisServer(t *testing.T) *fakeRedisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed listening: %s", err)
+	}
+	s := &fakeRedisServer{
+		listener: listener,
+		keys:     make(map[string]string),
+		sets:     make(map[string][]string),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeRedisServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeRedisServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]interface{})
+		args := []string{}
+		for _, item := range items {
+			arg, _ := item.(string)
+			args = append(args, arg)
+		}
+		if len(args) == 0 {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, args[0])
+		var response string
+		switch args[0] {
+		case "AUTH":
+			if args[1] == "secret" {
+				response = "+OK\r\n"
+			} else {
+				response = "-WRONGPASS invalid password\r\n"
+			}
+		case "SELECT":
+			response = "+OK\r\n"
+		case "SET":
+			s.keys[args[1]] = args[2]
+			response = "+OK\r\n"
+		case "EXISTS":
+			_, exists := s.keys[args[1]]
+			if exists {
+				response = ":1\r\n"
+			} else {
+				response = ":0\r\n"
+			}
+		case "DEL":
+			_, exists := s.keys[args[1]]
+			_, setExists := s.sets[args[1]]
+			delete(s.keys, args[1])
+			delete(s.sets, args[1])
+			if exists || setExists {
+				response = ":1\r\n"
+			} else {
+				response = ":0\r\n"
+			}
+		case "SADD":
+			s.sets[args[1]] = append(s.sets[args[1]], args[2])
+			response = ":1\r\n"
+		case "SMEMBERS":
+			members := s.sets[args[1]]
+			response = fmt.Sprintf("*%d\r\n", len(members))
+			for _, member := range members {
+				response += fmt.Sprintf("$%d\r\n%s\r\n", len(member), member)
+			}
+		case "INCR":
+			n, _ := strconv.Atoi(s.keys[args[1]])
+			s.keys[args[1]] = strconv.Itoa(n + 1)
+			response = fmt.Sprintf(":%d\r\n", n+1)
+		case "GET":
+			if value, exists := s.keys[args[1]]; exists {
+				response = fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+			} else {
+				response = "$-1\r\n"
+			}
+		case "TTL":
+			response = ":-1\r\n"
+		case "EXPIRE":
+			response = ":1\r\n"
+		default:
+			response = "-ERR unknown command\r\n"
+		}
+		s.mu.Unlock()
+		conn.Write([]byte(response))
+	}
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	server := newFakeRedisServer(t)
+	defer server.listener.Close()
+
+	params := &SessionStoreParameters{
+		Type:          "redis",
+		RedisAddress:  server.listener.Addr().String(),
+		RedisPassword: "secret",
+		RedisDB:       2,
+	}
+	store, err := params.newSessionStore()
+	if err != nil {
+		t.Fatalf("failed creating session store: %s", err)
+	}
+	if err := store.Add(&Session{ID: "abc", UserID: "jsmith@contoso.com", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("failed adding session: %s", err)
+	}
+	server.mu.Lock()
+	userID, stored := server.keys["caddy-auth-saml:session:abc"]
+	commands := strings.Join(server.commands, ",")
+	server.mu.Unlock()
+	if !stored || userID != "jsmith@contoso.com" {
+		t.Fatalf("session was not stored with default key prefix")
+	}
+	if commands != "AUTH,SELECT,SET,SADD,TTL,EXPIRE" {
+		t.Fatalf("unexpected Redis commands: %s", commands)
+	}
+	if exists, err := store.Exists("abc"); err != nil || !exists {
+		t.Fatalf("stored session not found: %t, %v", exists, err)
+	}
+	if err := store.Revoke("abc"); err != nil {
+		t.Fatalf("failed revoking session: %s", err)
+	}
+	if exists, err := store.Exists("abc"); err != nil || exists {
+		t.Fatalf("revoked session still exists: %t, %v", exists, err)
+	}
+
+	for _, id := range []string{"def", "ghi"} {
+		if err := store.Add(&Session{ID: id, UserID: "jsmith@contoso.com", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatalf("failed adding session: %s", err)
+		}
+	}
+	if count, err := store.RevokeUser("JSmith@contoso.com"); err != nil || count != 2 {
+		t.Fatalf("expected 2 revoked sessions, got %d, %v", count, err)
+	}
+	if exists, err := store.Exists("def"); err != nil || exists {
+		t.Fatalf("session of revoked user still exists: %t, %v", exists, err)
+	}
+
+	params.RedisPassword = "wrong"
+	store, err = params.newSessionStore()
+	if err != nil {
+		t.Fatalf("failed creating session store: %s", err)
+	}
+	if _, err := store.Exists("abc"); err == nil {
+		t.Fatalf("expected authentication error, got none")
+	}
+}
+
+func TestNewSessionStoreValidation(t *testing.T) {
+	for _, params := range []*SessionStoreParameters{
+		{Type: "memcached"},
+		{Type: "redis"},
+		{Type: "redis", RedisAddress: "localhost:6379", RedisDB: -1},
+		{AdminURLPath: "/saml/admin/sessions"},
+	} {
+		if _, err := params.newSessionStore(); err == nil {
+			t.Errorf("invalid session store settings passed validation: %+v", params)
+		}
+	}
+	params := &SessionStoreParameters{}
+	if _, err := params.newSessionStore(); err != nil {
+		t.Fatalf("default session store settings failed validation: %s", err)
+	}
+	if params.Type != "memory" {
+		t.Fatalf("unexpected default session store type: %s", params.Type)
+	}
+}
+
+func TestHandleSessionAdmin(t *testing.T) {
+	sessions := newMemorySessionStore()
+	m := AuthProvider{
+		CommonParameters: CommonParameters{
+			Jwt: TokenParameters{sessions: sessions},
+			SessionStore: &SessionStoreParameters{
+				AdminURLPath: "/saml/admin/sessions",
+				AdminToken:   "b0c1bd5b-9f3e-4b4a-8d1e-1f0ad3bb2c4e",
+			},
+		},
+	}
+	m.audit = newAuditLogger(zap.NewNop(), nil, auditFormatJSON)
+	p := TokenParameters{sessions: sessions}
+	claims := &UserClaims{
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Email:     "jsmith@contoso.com",
+	}
+	if err := p.startSession(claims); err != nil {
+		t.Fatalf("failed starting session: %s", err)
+	}
+	otherClaims := &UserClaims{
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Email:     "jdoe@contoso.com",
+	}
+	if err := p.startSession(otherClaims); err != nil {
+		t.Fatalf("failed starting session: %s", err)
+	}
+
+	revoke := func(token, user string) *httptest.ResponseRecorder {
+		form := url.Values{"user": {user}}
+		r := httptest.NewRequest("POST", "/saml/admin/sessions", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		m.handleSessionAdmin(w, r)
+		return w
+	}
+
+	if w := revoke("invalid", "jsmith@contoso.com"); w.Code != 401 {
+		t.Fatalf("expected status code 401 with invalid admin token, got %d", w.Code)
+	}
+	if err := p.validateSession(claims); err != nil {
+		t.Fatalf("session revoked with invalid admin token: %s", err)
+	}
+	w := revoke(m.SessionStore.AdminToken, "jsmith@contoso.com")
+	if w.Code != 200 {
+		t.Fatalf("expected status code 200, got %d", w.Code)
+	}
+	if body := w.Body.String(); body != `{"revoked_sessions":1,"user":"jsmith@contoso.com"}` {
+		t.Fatalf("unexpected response: %s", body)
+	}
+	if err := p.validateSession(claims); err == nil {
+		t.Fatalf("revoked session passed validation")
+	}
+	if err := p.validateSession(otherClaims); err != nil {
+		t.Fatalf("session of other user was revoked: %s", err)
+	}
+}
+
+func TestSessionStoreReload(t *testing.T) {
+	params := SessionStoreParameters{}
+	oldProvider := &AuthProvider{
+		Name:             "old",
+		CommonParameters: CommonParameters{SessionStore: &params},
+	}
+	sessions, poolKey, err := oldProvider.SessionStore.loadSessionStore(oldProvider.getInstanceKey())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	oldProvider.poolKeys = append(oldProvider.poolKeys, poolKey)
+	session := &Session{ID: "abc", UserID: "jsmith@contoso.com", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := sessions.Add(session); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The new config is provisioned before the old one is cleaned up.
+	newParams := SessionStoreParameters{}
+	newProvider := &AuthProvider{
+		Name:             "new",
+		CommonParameters: CommonParameters{SessionStore: &newParams},
+	}
+	reloaded, poolKey, err := newProvider.SessionStore.loadSessionStore(newProvider.getInstanceKey())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	newProvider.poolKeys = append(newProvider.poolKeys, poolKey)
+	if err := oldProvider.Cleanup(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	exists, err := reloaded.Exists(session.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !exists {
+		t.Fatalf("session %s lost after reload", session.ID)
+	}
+
+	if err := newProvider.Cleanup(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// Once released by all instances, the sessions are gone.
+	fresh, poolKey, err := params.loadSessionStore(oldProvider.getInstanceKey())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer releasePooledState([]string{poolKey})
+	if exists, _ := fresh.Exists(session.ID); exists {
+		t.Fatalf("session store %s not released after cleanup", poolKey)
+	}
+}
+
+func TestSessionStoreInstanceScope(t *testing.T) {
+	params := SessionStoreParameters{}
+	newProvider := func(acsURL string) *AuthProvider {
+		return &AuthProvider{
+			CommonParameters: CommonParameters{AuthURLPath: "/saml", SessionStore: &params},
+			Azure: &AzureIdp{
+				TenantID:         "1b9e886b-8ff2-4378-b6c8-6771259a5f51",
+				CommonParameters: CommonParameters{AssertionConsumerServiceURLs: AcsURLList{acsURL}},
+			},
+		}
+	}
+	sessions, poolKey, err := params.loadSessionStore(newProvider("https://app.contoso.com/saml").getInstanceKey())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer releasePooledState([]string{poolKey})
+	session := &Session{ID: "abc", UserID: "jsmith@contoso.com", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := sessions.Add(session); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The instance of another site does not share the sessions.
+	other, otherPoolKey, err := params.loadSessionStore(newProvider("https://portal.contoso.com/saml").getInstanceKey())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer releasePooledState([]string{otherPoolKey})
+	if otherPoolKey == poolKey {
+		t.Fatalf("instances of different sites share the pool key %s", poolKey)
+	}
+	if exists, _ := other.Exists(session.ID); exists {
+		t.Fatalf("session %s shared with the instance of another site", session.ID)
+	}
+}
@@ -0,0 +1,170 @@
+package saml
+
+import (
+	"go.uber.org/zap"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenewToken(t *testing.T) {
+	now := time.Now()
+	p := TokenParameters{
+		TokenSecret:        "75f03764-147c-4d87-b2f0-4fda89e331c8",
+		RefreshWindow:      300,
+		MaxSessionLifetime: 3600,
+	}
+	testcases := []struct {
+		name              string
+		authTime          time.Time
+		issuedAt          time.Time
+		expiresAt         time.Time
+		refreshWindow     int
+		shouldRenew       bool
+		expectedExpiresAt time.Time
+	}{
+		{
+			name:              "within refresh window",
+			authTime:          now.Add(-800 * time.Second),
+			issuedAt:          now.Add(-800 * time.Second),
+			expiresAt:         now.Add(100 * time.Second),
+			refreshWindow:     300,
+			shouldRenew:       true,
+			expectedExpiresAt: now.Add(900 * time.Second),
+		},
+		{
+			name:          "outside refresh window",
+			authTime:      now.Add(-100 * time.Second),
+			issuedAt:      now.Add(-100 * time.Second),
+			expiresAt:     now.Add(800 * time.Second),
+			refreshWindow: 300,
+		},
+		{
+			name:              "capped at maximum session lifetime",
+			authTime:          now.Add(-3000 * time.Second),
+			issuedAt:          now.Add(-800 * time.Second),
+			expiresAt:         now.Add(100 * time.Second),
+			refreshWindow:     300,
+			shouldRenew:       true,
+			expectedExpiresAt: now.Add(600 * time.Second),
+		},
+		{
+			name:          "past maximum session lifetime",
+			authTime:      now.Add(-3600 * time.Second),
+			issuedAt:      now.Add(-800 * time.Second),
+			expiresAt:     now.Add(100 * time.Second),
+			refreshWindow: 300,
+		},
+		{
+			name:          "expiring at maximum session lifetime",
+			authTime:      now.Add(-3500 * time.Second),
+			issuedAt:      now.Add(-800 * time.Second),
+			expiresAt:     now.Add(100 * time.Second),
+			refreshWindow: 300,
+		},
+		{
+			name:          "renewal disabled",
+			authTime:      now.Add(-800 * time.Second),
+			issuedAt:      now.Add(-800 * time.Second),
+			expiresAt:     now.Add(100 * time.Second),
+			refreshWindow: 0,
+		},
+	}
+
+	for _, tc := range testcases {
+		p.RefreshWindow = tc.refreshWindow
+		claims := &UserClaims{
+			AuthTime:  tc.authTime.Unix(),
+			IssuedAt:  tc.issuedAt.Unix(),
+			ExpiresAt: tc.expiresAt.Unix(),
+			Name:      "Smith, John",
+			Email:     "jsmith@contoso.com",
+		}
+		token, renewed, err := p.renewToken(claims, now)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.name, err)
+		}
+		if renewed != tc.shouldRenew {
+			t.Fatalf("%s: expected renewal %t, got %t", tc.name, tc.shouldRenew, renewed)
+		}
+		if !renewed {
+			continue
+		}
+		renewedClaims, _, err := p.validateToken(token)
+		if err != nil {
+			t.Fatalf("%s: renewed token failed validation: %s", tc.name, err)
+		}
+		if renewedClaims.ExpiresAt != tc.expectedExpiresAt.Unix() {
+			t.Fatalf("%s: expected expiration %d, got %d", tc.name, tc.expectedExpiresAt.Unix(), renewedClaims.ExpiresAt)
+		}
+		if renewedClaims.AuthTime != claims.AuthTime {
+			t.Fatalf("%s: renewal changed authentication time", tc.name)
+		}
+		if renewedClaims.Email != claims.Email {
+			t.Fatalf("%s: renewal changed claims", tc.name)
+		}
+	}
+}
+
+func TestAuthenticateSession(t *testing.T) {
+	ui := &UserInterface{}
+	if err := ui.validate(); err != nil {
+		t.Fatalf("failed validating UI: %s", err)
+	}
+	for _, test := range []struct {
+		name          string
+		roles         []string
+		requiredRoles []string
+		statusCode    int
+		authenticated bool
+	}{
+		{name: "no required roles", roles: []string{"viewer"}, authenticated: true},
+		{name: "required role", roles: []string{"viewer"}, requiredRoles: []string{"viewer"}, authenticated: true},
+		{name: "missing required role", roles: []string{"viewer"}, requiredRoles: []string{"admin"}, statusCode: 403},
+		{name: "missing required role with 401", roles: []string{"viewer"}, requiredRoles: []string{"admin"}, statusCode: 401},
+	} {
+		m := AuthProvider{
+			CommonParameters: CommonParameters{
+				RequiredRoles:                  test.requiredRoles,
+				AuthorizationFailureStatusCode: test.statusCode,
+			},
+			UI:     ui,
+			logger: zap.NewNop(),
+			audit:  newAuditLogger(zap.NewNop(), nil, auditFormatJSON),
+		}
+		claims := &UserClaims{
+			ExpiresAt: time.Now().Add(900 * time.Second).Unix(),
+			Name:      "Smith, John",
+			Email:     "jsmith@contoso.com",
+			Roles:     test.roles,
+		}
+		r := httptest.NewRequest("GET", "/app", nil)
+		w := httptest.NewRecorder()
+		user, authenticated, err := m.authenticateSession(w, r, claims)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		if authenticated != test.authenticated {
+			t.Fatalf("%s: expected authenticated %t, got %t", test.name, test.authenticated, authenticated)
+		}
+		if test.authenticated {
+			if user.ID != "jsmith@contoso.com" {
+				t.Fatalf("%s: unexpected user: %v", test.name, user)
+			}
+			if w.Body.Len() > 0 {
+				t.Fatalf("%s: authenticated request got a response: %s", test.name, w.Body.String())
+			}
+			continue
+		}
+		if w.Code != test.statusCode {
+			t.Fatalf("%s: expected status code %d, got %d", test.name, test.statusCode, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "none of the required roles") {
+			t.Fatalf("%s: denial reason not rendered: %s", test.name, w.Body.String())
+		}
+		if challenge := w.Header().Get("WWW-Authenticate"); (test.statusCode == 401) != (challenge == "Bearer") {
+			t.Fatalf("%s: unexpected WWW-Authenticate: %q", test.name, challenge)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package saml
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// xmlSignature holds the algorithms of XML Signature.
+type xmlSignature struct {
+	SignatureMethod xmlAlgorithm   `xml:"http://www.w3.org/2000/09/xmldsig# SignedInfo>SignatureMethod"`
+	DigestMethods   []xmlAlgorithm `xml:"http://www.w3.org/2000/09/xmldsig# SignedInfo>Reference>DigestMethod"`
+}
+
+type xmlAlgorithm struct {
+	Algorithm string `xml:"Algorithm,attr"`
+}
+
+// hashAlgorithmStrength is the strength of the hash functions that could
+// be used in the signatures of SAML Responses.
+var hashAlgorithmStrength = map[string]int{
+	"sha1":   160,
+	"sha256": 256,
+	"sha384": 384,
+	"sha512": 512,
+}
+
+// signatureAlgorithmHashes maps the identifiers of signature and digest
+// algorithms to their hash functions.
+var signatureAlgorithmHashes = map[string]string{
+	"http://www.w3.org/2000/09/xmldsig#rsa-sha1":          "sha1",
+	"http://www.w3.org/2000/09/xmldsig#dsa-sha1":          "sha1",
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256":   "sha256",
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha384":   "sha384",
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512":   "sha512",
+	"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha1":   "sha1",
+	"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256": "sha256",
+	"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha384": "sha384",
+	"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha512": "sha512",
+	"http://www.w3.org/2000/09/xmldsig#sha1":              "sha1",
+	"http://www.w3.org/2001/04/xmlenc#sha256":             "sha256",
+	"http://www.w3.org/2001/04/xmldsig-more#sha384":       "sha384",
+	"http://www.w3.org/2001/04/xmlenc#sha512":             "sha512",
+}
+
+// getSupportedHashAlgorithms returns the names of supported hash functions.
+func getSupportedHashAlgorithms() []string {
+	names := []string{}
+	for name := range hashAlgorithmStrength {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getHashAlgorithms returns the sorted distinct hash functions, e.g.
+// sha256, of the signature and digest algorithms.
+func getHashAlgorithms(algorithms ...[]string) []string {
+	seen := make(map[string]bool)
+	hashes := []string{}
+	for _, list := range algorithms {
+		for _, algorithm := range list {
+			hash, exists := signatureAlgorithmHashes[strings.TrimSpace(algorithm)]
+			if !exists || seen[hash] {
+				continue
+			}
+			seen[hash] = true
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// getAlgorithms returns the signature and digest algorithms of the signature.
+func (sig *xmlSignature) getAlgorithms() []string {
+	algorithms := []string{sig.SignatureMethod.Algorithm}
+	for _, digestMethod := range sig.DigestMethods {
+		algorithms = append(algorithms, digestMethod.Algorithm)
+	}
+	return algorithms
+}
+
+// validateAlgorithms checks that the signature and digest algorithms of
+// the signature are at least as strong as the minimum hash function.
+func (sig *xmlSignature) validateAlgorithms(minimumHash string) error {
+	minimumStrength, exists := hashAlgorithmStrength[minimumHash]
+	if !exists {
+		return fmt.Errorf("unsupported minimum signature algorithm %s", minimumHash)
+	}
+	for _, algorithm := range sig.getAlgorithms() {
+		hash, exists := signatureAlgorithmHashes[strings.TrimSpace(algorithm)]
+		if !exists {
+			return fmt.Errorf("unsupported signature algorithm %q", algorithm)
+		}
+		if hashAlgorithmStrength[hash] < minimumStrength {
+			return fmt.Errorf("signature algorithm %s is weaker than %s", algorithm, minimumHash)
+		}
+	}
+	return nil
+}
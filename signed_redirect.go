@@ -0,0 +1,180 @@
+package saml
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// signedRedirectMethodGet appends the signed payload to the query
+	// string of the redirect URL.
+	signedRedirectMethodGet = "get"
+	// signedRedirectMethodPost posts the signed payload to the redirect
+	// URL via an auto-submitting form.
+	signedRedirectMethodPost = "post"
+)
+
+// SignedRedirectParameters are the settings of the post-login redirect to
+// a backend URL carrying the claims of the user signed with HMAC-SHA256,
+// so that the backend can verify the login notification with the shared
+// secret.
+type SignedRedirectParameters struct {
+	// URL is the URL the user is redirected to after the login. It must
+	// match the redirect allowlist or the hosts of the ACS URLs.
+	URL string `json:"url,omitempty"`
+	// Secret is the shared secret of the HMAC.
+	Secret string `json:"secret,omitempty"`
+	// Method is the way the signed payload is conveyed: "get" (default)
+	// in the query string, or "post" in the form-encoded request body.
+	Method string `json:"method,omitempty"`
+	// Claims are the names of the token claims, i.e. after claim_name_map,
+	// the payload carries. Defaults to all claims of the token.
+	Claims []string `json:"claims,omitempty"`
+}
+
+// signedRedirectPayload is the payload of the signed redirect.
+type signedRedirectPayload struct {
+	Claims map[string]interface{} `json:"claims"`
+	// LandingURL is the URL the user would have landed on otherwise,
+	// e.g. the originally requested URL.
+	LandingURL string `json:"landing_url,omitempty"`
+	// IssuedAt is the time of the login, so that the backend can reject
+	// the stale payloads.
+	IssuedAt int64 `json:"iat"`
+}
+
+// validate checks the settings against the redirect allowlist and sets
+// the defaults.
+func (p *SignedRedirectParameters) validate(allowlist []string) error {
+	if p.URL == "" {
+		return fmt.Errorf("signed_redirect.url is required")
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil || !u.IsAbs() || !isSafeRedirectURL(p.URL, allowlist) {
+		return fmt.Errorf("signed_redirect.url %s is not an absolute URL matching redirect_allowlist or ACS URL hosts", p.URL)
+	}
+	if p.Secret == "" {
+		return fmt.Errorf("signed_redirect.secret is required")
+	}
+	switch p.Method {
+	case "":
+		p.Method = signedRedirectMethodGet
+	case signedRedirectMethodGet, signedRedirectMethodPost:
+	default:
+		return fmt.Errorf("signed_redirect.method %s is not supported, supported: %s, %s",
+			p.Method, signedRedirectMethodGet, signedRedirectMethodPost,
+		)
+	}
+	return nil
+}
+
+// sign returns the base64url-encoded JSON payload with the selected claims
+// of the token and the base64url-encoded HMAC-SHA256 of the encoded
+// payload.
+func (p *SignedRedirectParameters) sign(tokenClaims map[string]interface{}, landingURL string, now time.Time) (string, string, error) {
+	included := make(map[string]bool)
+	for _, k := range p.Claims {
+		included[k] = true
+	}
+	payload := signedRedirectPayload{
+		Claims:     make(map[string]interface{}),
+		LandingURL: landingURL,
+		IssuedAt:   now.Unix(),
+	}
+	for k, v := range tokenClaims {
+		if len(included) > 0 && !included[k] {
+			continue
+		}
+		payload.Claims[k] = v
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", "", err
+	}
+	encodedPayload := base64.RawURLEncoding.EncodeToString(b)
+	return encodedPayload, signRedirectPayload(p.Secret, encodedPayload), nil
+}
+
+// signRedirectPayload returns the base64url-encoded HMAC-SHA256 of the
+// encoded payload.
+func signRedirectPayload(secret, encodedPayload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(encodedPayload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedRedirectForm is the page posting the signed payload to the
+// redirect URL. The button submits the form when scripts are disabled.
+var signedRedirectForm = template.Must(template.New("signed_redirect").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Redirecting</title></head>
+<body>
+<form method="post" action="{{.URL}}">
+<input type="hidden" name="payload" value="{{.Payload}}">
+<input type="hidden" name="signature" value="{{.Signature}}">
+<noscript><button type="submit">Continue</button></noscript>
+</form>
+<script>` + signedRedirectScript + `</script>
+</body>
+</html>
+`))
+
+// signedRedirectScript submits the form of the signed redirect. The
+// Content-Security-Policy of the page allows it by its hash.
+const signedRedirectScript = `document.forms[0].submit();`
+
+// getSignedRedirectContentSecurityPolicy returns the
+// Content-Security-Policy header of the page posting the signed payload to
+// the redirect URL.
+func getSignedRedirectContentSecurityPolicy(target *url.URL) string {
+	sum := sha256.Sum256([]byte(signedRedirectScript))
+	return fmt.Sprintf("default-src 'none'; script-src 'sha256-%s'; form-action %s://%s",
+		base64.StdEncoding.EncodeToString(sum[:]), target.Scheme, target.Host,
+	)
+}
+
+// redirectWithSignedPayload redirects the authenticated user to the
+// signed redirect URL with the signed claims of the token. The redirect
+// is always 303 See Other, so that the browser never repeats the POST
+// request with the SAML Response.
+func (m AuthProvider) redirectWithSignedPayload(w http.ResponseWriter, r *http.Request, claims *UserClaims, landingURL string) error {
+	u, err := url.Parse(m.SignedRedirect.URL)
+	if err != nil {
+		return err
+	}
+	payload, signature, err := m.SignedRedirect.sign(m.Jwt.getTokenClaims(*claims), landingURL, time.Now())
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, newExpiredRedirectURLCookie(r))
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if m.SignedRedirect.Method == signedRedirectMethodPost {
+		var buf bytes.Buffer
+		if err := signedRedirectForm.Execute(&buf, map[string]string{
+			"URL":       u.String(),
+			"Payload":   payload,
+			"Signature": signature,
+		}); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", getSignedRedirectContentSecurityPolicy(u))
+		w.WriteHeader(http.StatusOK)
+		w.Write(buf.Bytes())
+		return nil
+	}
+	query := u.Query()
+	query.Set("payload", payload)
+	query.Set("signature", signature)
+	u.RawQuery = query.Encode()
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+	return nil
+}
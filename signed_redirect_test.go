@@ -0,0 +1,105 @@
+package saml
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedRedirect(t *testing.T) {
+	secret := "4f1c2b7e-8a9d-4e3f-b6c5-d7e8f9a0b1c2"
+	allowlist := []string{"portal.contoso.com"}
+	p := &SignedRedirectParameters{
+		URL:    "https://portal.contoso.com/login/callback?tenant=contoso",
+		Secret: secret,
+		Claims: []string{"email", "roles"},
+	}
+	if err := p.validate(allowlist); err != nil {
+		t.Fatalf("failed validating signed redirect: %s", err)
+	}
+	m := AuthProvider{CommonParameters: CommonParameters{SignedRedirect: p}}
+	claims := &UserClaims{
+		ExpiresAt: time.Now().Add(time.Duration(900) * time.Second).Unix(),
+		Name:      "Smith, John",
+		Email:     "jsmith@contoso.com",
+		Roles:     []string{"AzureAD_Viewer"},
+	}
+	r := httptest.NewRequest("POST", "https://localhost:3443/saml", nil)
+	w := httptest.NewRecorder()
+	if err := m.redirectWithSignedPayload(w, r, claims, "/app"); err != nil {
+		t.Fatalf("failed redirecting: %s", err)
+	}
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("unexpected status code %d", w.Code)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("failed parsing Location: %s", err)
+	}
+	if location.Host != "portal.contoso.com" || location.Path != "/login/callback" || location.Query().Get("tenant") != "contoso" {
+		t.Fatalf("unexpected Location: %s", location)
+	}
+	payload := location.Query().Get("payload")
+	signature := location.Query().Get("signature")
+
+	// The backend verifies the signature with the shared secret.
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	expectedSignature := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(signature), []byte(expectedSignature)) {
+		t.Fatalf("unexpected signature %q, expected %q", signature, expectedSignature)
+	}
+	if signRedirectPayload("another secret", payload) == signature {
+		t.Fatalf("signature verified with another secret")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		t.Fatalf("failed decoding payload: %s", err)
+	}
+	decoded := signedRedirectPayload{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("failed decoding payload %s: %s", b, err)
+	}
+	if decoded.LandingURL != "/app" || decoded.IssuedAt == 0 {
+		t.Errorf("unexpected payload: %s", b)
+	}
+	if decoded.Claims["email"] != "jsmith@contoso.com" {
+		t.Errorf("unexpected email claim: %v", decoded.Claims["email"])
+	}
+	if _, exists := decoded.Claims["name"]; exists {
+		t.Errorf("unselected claim found in payload: %s", b)
+	}
+
+	// The payload is posted in the form-encoded request body.
+	p.Method = signedRedirectMethodPost
+	w = httptest.NewRecorder()
+	if err := m.redirectWithSignedPayload(w, r, claims, "/app"); err != nil {
+		t.Fatalf("failed posting: %s", err)
+	}
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, `name="signature"`) || !strings.Contains(body, `action="https://portal.contoso.com/login/callback?tenant=contoso"`) {
+		t.Fatalf("unexpected form: %d %s", w.Code, body)
+	}
+	if csp := w.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "form-action https://portal.contoso.com") {
+		t.Fatalf("unexpected Content-Security-Policy: %s", csp)
+	}
+
+	for _, p := range []*SignedRedirectParameters{
+		{URL: "https://evil.com/callback", Secret: secret},
+		{URL: "/callback", Secret: secret},
+		{URL: "https://portal.contoso.com/callback"},
+		{URL: "https://portal.contoso.com/callback", Secret: secret, Method: "put"},
+	} {
+		if err := p.validate(allowlist); err == nil {
+			t.Errorf("invalid signed redirect passed validation: %+v", p)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package saml
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	samllib "github.com/crewjam/saml"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+// loadKeyPair reads the PEM-encoded certificate and RSA private key of the
+// service provider and checks that they belong together.
+func loadKeyPair(certPath, keyPath string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	certBytes, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBytes, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, key, err := parseKeyPair(certBytes, keyBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s, %s: %s", certPath, keyPath, err)
+	}
+	return cert, key, nil
+}
+
+// loadPrivateKey reads the PEM-encoded RSA private key.
+func loadPrivateKey(keyPath string) (*rsa.PrivateKey, error) {
+	keyBytes, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKeyPEM(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", keyPath, err)
+	}
+	return key, nil
+}
+
+// parseKeyPair parses the PEM-encoded certificate and RSA private key and
+// checks that they belong together.
+func parseKeyPair(certBytes, keyBytes []byte) (*x509.Certificate, *rsa.PrivateKey, error) {
+	cert, err := parseCertificatePEM(certBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := parsePrivateKeyPEM(keyBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPublicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok || certPublicKey.N.Cmp(key.N) != 0 || certPublicKey.E != key.E {
+		return nil, nil, fmt.Errorf("private key does not match certificate")
+	}
+	return cert, key, nil
+}
+
+// parseCertificatePEM parses the first PEM-encoded certificate.
+func parseCertificatePEM(b []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM-encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// parsePrivateKeyPEM parses the first PEM-encoded RSA private key, either
+// in PKCS #1 or in PKCS #8 form.
+func parsePrivateKeyPEM(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM-encoded private key found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key is not an RSA key")
+		}
+		return rsaKey, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %s", block.Type)
+}
+
+// loadServiceProviderKeys loads the signing and the encryption key pairs
+// of the service provider, along with the additional decryption keys. The
+// inline signing key pair takes precedence over the files. The encryption
+// key pair defaults to the signing one.
+func (az *AzureIdp) loadServiceProviderKeys() error {
+	if az.SpCertPEM != "" || az.SpKeyPEM != "" {
+		if az.SpCertPEM == "" || az.SpKeyPEM == "" {
+			return newConfigError("azure.sp_cert_pem", "Azure AD sp_cert_pem and sp_key_pem must be set together")
+		}
+		cert, key, err := parseKeyPair([]byte(az.SpCertPEM), []byte(az.SpKeyPEM))
+		if err != nil {
+			return newConfigError("azure.sp_cert_pem", "Azure AD SP signing key pair is invalid: %s", err)
+		}
+		az.spSigningCert = cert
+		az.spSigningKey = key
+	}
+	if (az.SpCertLocation == "") != (az.SpKeyLocation == "") {
+		return newConfigError("azure.sp_cert_location", "Azure AD sp_cert_location and sp_key_location must be set together")
+	}
+	if (az.SpEncryptionCertLocation == "") != (az.SpEncryptionKeyLocation == "") {
+		return newConfigError("azure.sp_encryption_cert_location", "Azure AD sp_encryption_cert_location and sp_encryption_key_location must be set together")
+	}
+	if az.spSigningCert == nil && az.SpCertLocation != "" {
+		cert, key, err := loadKeyPair(az.SpCertLocation, az.SpKeyLocation)
+		if err != nil {
+			return newConfigError("azure.sp_cert_location", "Azure AD SP signing key pair is invalid: %s", err)
+		}
+		az.spSigningCert = cert
+		az.spSigningKey = key
+	}
+	az.spEncryptionCert = az.spSigningCert
+	az.spEncryptionKey = az.spSigningKey
+	if az.SpEncryptionCertLocation != "" {
+		cert, key, err := loadKeyPair(az.SpEncryptionCertLocation, az.SpEncryptionKeyLocation)
+		if err != nil {
+			return newConfigError("azure.sp_encryption_cert_location", "Azure AD SP encryption key pair is invalid: %s", err)
+		}
+		az.spEncryptionCert = cert
+		az.spEncryptionKey = key
+	}
+	az.spDecryptionKeys = nil
+	for i, keyPath := range az.SpDecryptionKeyLocations {
+		key, err := loadPrivateKey(keyPath)
+		if err != nil {
+			return newConfigError(fmt.Sprintf("azure.sp_decryption_key_locations[%d]", i), "Azure AD SP decryption key is invalid: %s", err)
+		}
+		az.spDecryptionKeys = append(az.spDecryptionKeys, key)
+	}
+	return nil
+}
+
+// newKeyDescriptor returns the metadata key descriptor with the usage,
+// i.e. signing or encryption, of the certificate.
+func newKeyDescriptor(use string, cert *x509.Certificate) samllib.KeyDescriptor {
+	keyDescriptor := samllib.KeyDescriptor{
+		Use: use,
+		KeyInfo: samllib.KeyInfo{
+			XMLName: xml.Name{
+				Space: "http://www.w3.org/2000/09/xmldsig#",
+				Local: "KeyInfo",
+			},
+			Certificate: base64.StdEncoding.EncodeToString(cert.Raw),
+		},
+	}
+	if use == "encryption" {
+		keyDescriptor.EncryptionMethods = []samllib.EncryptionMethod{
+			{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes128-cbc"},
+			{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes192-cbc"},
+			{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes256-cbc"},
+			{Algorithm: "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"},
+		}
+	}
+	return keyDescriptor
+}
+
+// getServiceProviderMetadata returns the metadata of the service provider.
+// The metadata advertises the signing and the encryption certificates in
+// separate key descriptors, and all ACS URLs indexed by their positions.
+func (az *AzureIdp) getServiceProviderMetadata(sp *samllib.ServiceProvider) *samllib.EntityDescriptor {
+	metadata := sp.Metadata()
+	acsEndpoints := []samllib.IndexedEndpoint{}
+	for i, acsURL := range az.AssertionConsumerServiceURLs {
+		isDefault := az.DefaultAcsIndex != nil && *az.DefaultAcsIndex == i
+		acsEndpoints = append(acsEndpoints, samllib.IndexedEndpoint{
+			Binding:   samllib.HTTPPostBinding,
+			Location:  acsURL,
+			Index:     i,
+			IsDefault: &isDefault,
+		})
+	}
+	keyDescriptors := []samllib.KeyDescriptor{}
+	if az.spSigningCert != nil {
+		keyDescriptors = append(keyDescriptors, newKeyDescriptor("signing", az.spSigningCert))
+	}
+	if az.spEncryptionCert != nil {
+		keyDescriptors = append(keyDescriptors, newKeyDescriptor("encryption", az.spEncryptionCert))
+	}
+	for i := range metadata.SPSSODescriptors {
+		metadata.SPSSODescriptors[i].KeyDescriptors = keyDescriptors
+		if len(acsEndpoints) > 0 {
+			metadata.SPSSODescriptors[i].AssertionConsumerServices = acsEndpoints
+		}
+	}
+	return metadata
+}
+
+// authorizeMetadataRequest enforces the access controls of the SP metadata
+// endpoint. It writes the error response to the denied request.
+func (m AuthProvider) authorizeMetadataRequest(w http.ResponseWriter, r *http.Request) error {
+	if len(m.metadataAllowNetworks) > 0 {
+		clientIP := getClientIP(r, m.clientIPProxies)
+		ip := net.ParseIP(clientIP)
+		if ip == nil || !isTrustedIP(ip, m.metadataAllowNetworks) {
+			w.WriteHeader(http.StatusForbidden)
+			return fmt.Errorf("SP metadata request from %s is not in metadata_allow_cidrs", clientIP)
+		}
+	}
+	if m.MetadataRequireAuth {
+		if _, _, err := m.Jwt.validateRequestToken(r); err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return fmt.Errorf("SP metadata request has no valid token: %s", err)
+		}
+	}
+	return nil
+}
+
+// handleMetadata writes the metadata of the service provider with the ACS
+// URL the request arrived at.
+func (m AuthProvider) handleMetadata(w http.ResponseWriter, r *http.Request) error {
+	sp := m.Azure.getServiceProvider(r)
+	b, err := xml.MarshalIndent(m.Azure.getServiceProviderMetadata(sp), "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+	return nil
+}
@@ -0,0 +1,311 @@
+package saml
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	samllib "github.com/crewjam/saml"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestKeyPair(t *testing.T, name string) ([]byte, []byte, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed creating certificate: %s", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	cert, _ := x509.ParseCertificate(certBytes)
+	return certPEM, keyPEM, cert
+}
+
+func writeTestKeyPair(t *testing.T, dir, name string) *x509.Certificate {
+	certPEM, keyPEM, cert := newTestKeyPair(t, name)
+	if err := ioutil.WriteFile(filepath.Join(dir, name+"_cert.pem"), certPEM, 0600); err != nil {
+		t.Fatalf("failed writing certificate: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+"_key.pem"), keyPEM, 0600); err != nil {
+		t.Fatalf("failed writing key: %s", err)
+	}
+	return cert
+}
+
+func TestServiceProviderMetadataKeyDescriptors(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "caddy-auth-saml")
+	if err != nil {
+		t.Fatalf("failed creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	signingCert := writeTestKeyPair(t, tmpDir, "signing")
+	encryptionCert := writeTestKeyPair(t, tmpDir, "encryption")
+
+	az := &AzureIdp{
+		SpCertLocation:           filepath.Join(tmpDir, "signing_cert.pem"),
+		SpKeyLocation:            filepath.Join(tmpDir, "signing_key.pem"),
+		SpEncryptionCertLocation: filepath.Join(tmpDir, "encryption_cert.pem"),
+		SpEncryptionKeyLocation:  filepath.Join(tmpDir, "encryption_key.pem"),
+	}
+	if err := az.loadServiceProviderKeys(); err != nil {
+		t.Fatalf("failed loading SP keys: %s", err)
+	}
+
+	sp := &samllib.ServiceProvider{
+		Key:         az.spEncryptionKey,
+		Certificate: az.spEncryptionCert,
+	}
+	metadata := az.getServiceProviderMetadata(sp)
+	if len(metadata.SPSSODescriptors) == 0 {
+		t.Fatalf("SP metadata has no SP SSO descriptors")
+	}
+	expected := map[string]string{
+		"signing":    base64.StdEncoding.EncodeToString(signingCert.Raw),
+		"encryption": base64.StdEncoding.EncodeToString(encryptionCert.Raw),
+	}
+	found := map[string]string{}
+	for _, keyDescriptor := range metadata.SPSSODescriptors[0].KeyDescriptors {
+		found[keyDescriptor.Use] = keyDescriptor.KeyInfo.Certificate
+	}
+	for use, cert := range expected {
+		if found[use] != cert {
+			t.Fatalf("SP metadata has no %s key descriptor with the %s certificate", use, use)
+		}
+	}
+	if len(found) != 2 {
+		t.Fatalf("unexpected key descriptors: %v", found)
+	}
+
+	// The private key must match the certificate.
+	az = &AzureIdp{
+		SpCertLocation: filepath.Join(tmpDir, "signing_cert.pem"),
+		SpKeyLocation:  filepath.Join(tmpDir, "encryption_key.pem"),
+	}
+	if err := az.loadServiceProviderKeys(); err == nil {
+		t.Fatalf("mismatched SP key pair passed validation")
+	}
+}
+
+func TestInlineServiceProviderKeyPair(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "caddy-auth-saml")
+	if err != nil {
+		t.Fatalf("failed creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	writeTestKeyPair(t, tmpDir, "signing")
+	certPEM, keyPEM, cert := newTestKeyPair(t, "inline")
+
+	// The inline key pair takes precedence over the files.
+	az := &AzureIdp{
+		SpCertLocation: filepath.Join(tmpDir, "signing_cert.pem"),
+		SpKeyLocation:  filepath.Join(tmpDir, "signing_key.pem"),
+		SpCertPEM:      string(certPEM),
+		SpKeyPEM:       string(keyPEM),
+	}
+	if err := az.loadServiceProviderKeys(); err != nil {
+		t.Fatalf("failed loading inline SP keys: %s", err)
+	}
+	if !az.spSigningCert.Equal(cert) || !az.spEncryptionCert.Equal(cert) {
+		t.Fatalf("inline SP certificate was not used")
+	}
+
+	for _, test := range []struct {
+		name    string
+		certPEM string
+		keyPEM  string
+	}{
+		{name: "certificate without key", certPEM: string(certPEM)},
+		{name: "malformed certificate", certPEM: "-----BEGIN CERTIFICATE-----\nMIIC\n-----END CERTIFICATE-----\n", keyPEM: string(keyPEM)},
+		{name: "not a PEM certificate", certPEM: "MIIC", keyPEM: string(keyPEM)},
+		{name: "key in place of certificate", certPEM: string(keyPEM), keyPEM: string(keyPEM)},
+	} {
+		az := &AzureIdp{SpCertPEM: test.certPEM, SpKeyPEM: test.keyPEM}
+		if err := az.loadServiceProviderKeys(); err == nil {
+			t.Errorf("%s: expected failure, got success", test.name)
+		}
+	}
+}
+
+func TestServiceProviderDecryptionKeys(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "caddy-auth-saml")
+	if err != nil {
+		t.Fatalf("failed creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	writeTestKeyPair(t, tmpDir, "encryption")
+	previousCert := writeTestKeyPair(t, tmpDir, "previous")
+
+	az := &AzureIdp{
+		SpEncryptionCertLocation: filepath.Join(tmpDir, "encryption_cert.pem"),
+		SpEncryptionKeyLocation:  filepath.Join(tmpDir, "encryption_key.pem"),
+		SpDecryptionKeyLocations: []string{filepath.Join(tmpDir, "previous_key.pem")},
+	}
+	if err := az.loadServiceProviderKeys(); err != nil {
+		t.Fatalf("failed loading SP keys: %s", err)
+	}
+	if len(az.spDecryptionKeys) != 1 {
+		t.Fatalf("unexpected number of decryption keys: %d", len(az.spDecryptionKeys))
+	}
+	if previousPublicKey := previousCert.PublicKey.(*rsa.PublicKey); previousPublicKey.N.Cmp(az.spDecryptionKeys[0].N) != 0 {
+		t.Fatalf("previous key was not loaded")
+	}
+
+	// The metadata advertises the current encryption certificate only.
+	metadata := az.getServiceProviderMetadata(&samllib.ServiceProvider{})
+	for _, keyDescriptor := range metadata.SPSSODescriptors[0].KeyDescriptors {
+		if keyDescriptor.KeyInfo.Certificate == base64.StdEncoding.EncodeToString(previousCert.Raw) {
+			t.Fatalf("previous certificate advertised in the metadata")
+		}
+	}
+
+	for _, keyPath := range []string{
+		filepath.Join(tmpDir, "missing_key.pem"),
+		filepath.Join(tmpDir, "previous_cert.pem"),
+	} {
+		az := &AzureIdp{SpDecryptionKeyLocations: []string{keyPath}}
+		err := az.loadServiceProviderKeys()
+		if err == nil {
+			t.Errorf("%s: expected failure, got success", keyPath)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), "azure.sp_decryption_key_locations[0]: ") {
+			t.Errorf("%s: error has no path: %s", keyPath, err)
+		}
+	}
+}
+
+func TestReadCertPEM(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "caddy-auth-saml")
+	if err != nil {
+		t.Fatalf("failed creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	writeTestKeyPair(t, tmpDir, "idp")
+	certPath := filepath.Join(tmpDir, "idp_cert.pem")
+
+	fileCert, err := readCertFile(certPath)
+	if err != nil {
+		t.Fatalf("failed reading %s: %s", certPath, err)
+	}
+	b, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		t.Fatalf("failed reading %s: %s", certPath, err)
+	}
+	inlineCert, err := readCertPEM(string(b))
+	if err != nil {
+		t.Fatalf("failed parsing inline certificate: %s", err)
+	}
+	if inlineCert != fileCert {
+		t.Fatalf("inline certificate %s does not match certificate file %s", inlineCert, fileCert)
+	}
+	if _, err := readCertPEM("MIIC"); err == nil {
+		t.Fatalf("malformed inline certificate passed validation")
+	}
+}
+
+func TestMetadataAccessControl(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.1"})
+	if err != nil {
+		t.Fatalf("failed parsing trusted proxies: %s", err)
+	}
+	allowNetworks, err := parseNetworks([]string{"192.168.0.0/16", "2001:db8::1"})
+	if err != nil {
+		t.Fatalf("failed parsing metadata_allow_cidrs: %s", err)
+	}
+	for _, test := range []struct {
+		name          string
+		allowNetworks []*net.IPNet
+		remoteAddr    string
+		forwardedFor  string
+		expectedCode  int
+	}{
+		{name: "public", remoteAddr: "203.0.113.7:41234", expectedCode: http.StatusOK},
+		{name: "allowed network", allowNetworks: allowNetworks, remoteAddr: "192.168.10.5:41234", expectedCode: http.StatusOK},
+		{name: "allowed address", allowNetworks: allowNetworks, remoteAddr: "[2001:db8::1]:41234", expectedCode: http.StatusOK},
+		{name: "denied address", allowNetworks: allowNetworks, remoteAddr: "203.0.113.7:41234", expectedCode: http.StatusForbidden},
+		{name: "allowed behind trusted proxy", allowNetworks: allowNetworks, remoteAddr: "10.0.0.1:41234", forwardedFor: "192.168.10.5", expectedCode: http.StatusOK},
+		{name: "denied behind trusted proxy", allowNetworks: allowNetworks, remoteAddr: "10.0.0.1:41234", forwardedFor: "203.0.113.7", expectedCode: http.StatusForbidden},
+		{name: "spoofed forwarded address", allowNetworks: allowNetworks, remoteAddr: "203.0.113.7:41234", forwardedFor: "192.168.10.5", expectedCode: http.StatusForbidden},
+	} {
+		m := AuthProvider{
+			CommonParameters: CommonParameters{
+				metadataAllowNetworks: test.allowNetworks,
+				clientIPProxies:       trustedProxies,
+			},
+		}
+		r := httptest.NewRequest("GET", "https://localhost:3443/saml/metadata", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		err := m.authorizeMetadataRequest(w, r)
+		if test.expectedCode == http.StatusOK {
+			if err != nil {
+				t.Errorf("%s: expected access, got %s", test.name, err)
+			}
+			continue
+		}
+		if err == nil || w.Code != test.expectedCode {
+			t.Errorf("%s: expected status code %d, got %d", test.name, test.expectedCode, w.Code)
+		}
+	}
+
+	for _, entries := range [][]string{{"192.168.0.0/33"}, {"localhost"}} {
+		if _, err := parseNetworks(entries); err == nil {
+			t.Errorf("metadata_allow_cidrs %v passed validation", entries)
+		}
+	}
+}
+
+func TestMetadataRequireAuth(t *testing.T) {
+	m := AuthProvider{
+		CommonParameters: CommonParameters{
+			MetadataRequireAuth: true,
+			Jwt:                 TokenParameters{TokenSecret: "75f03764-147c-4d87-b2f0-4fda89e331c8"},
+		},
+	}
+	r := httptest.NewRequest("GET", "https://localhost:3443/saml/metadata", nil)
+	w := httptest.NewRecorder()
+	if err := m.authorizeMetadataRequest(w, r); err == nil || w.Code != http.StatusUnauthorized {
+		t.Fatalf("request without token: expected status code %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Fatalf("request without token: WWW-Authenticate header not found")
+	}
+
+	claims := UserClaims{
+		ExpiresAt: time.Now().Add(time.Duration(900) * time.Second).Unix(),
+		Email:     "jsmith@contoso.com",
+	}
+	token, err := m.Jwt.signToken(claims)
+	if err != nil {
+		t.Fatalf("failed signing token: %s", err)
+	}
+	r = httptest.NewRequest("GET", "https://localhost:3443/saml/metadata", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if err := m.authorizeMetadataRequest(httptest.NewRecorder(), r); err != nil {
+		t.Fatalf("request with token: expected access, got %s", err)
+	}
+}
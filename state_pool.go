@@ -0,0 +1,55 @@
+package saml
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"io"
+)
+
+// statePool keeps the state of the plugin instances, i.e. the session
+// stores and the trackers of the authentication requests, across config
+// reloads. Caddy provisions the instances of the new config before it
+// cleans up the instances of the old one, so the instances with the same
+// settings take over the state instead of starting afresh.
+var statePool = caddy.NewUsagePool()
+
+// pooledState is the state in the state pool.
+type pooledState struct {
+	value interface{}
+}
+
+// Destruct releases the resources, e.g. the connections, of the state once
+// no plugin instance uses it.
+func (s pooledState) Destruct() error {
+	if closer, ok := s.value.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// loadPooledState returns the state with the key from the state pool. The
+// state is created when the pool has none. Each load must be followed by
+// releasePooledState when the instance is cleaned up.
+func loadPooledState(key string, create func() (interface{}, error)) (interface{}, error) {
+	value, _, err := statePool.LoadOrNew(key, func() (caddy.Destructor, error) {
+		state, err := create()
+		if err != nil {
+			return nil, err
+		}
+		return pooledState{value: state}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(pooledState).value, nil
+}
+
+// releasePooledState releases the states with the keys. A state is
+// destructed when no plugin instance uses it anymore.
+func releasePooledState(keys []string) error {
+	for _, key := range keys {
+		if _, err := statePool.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package saml
+
+// samlStatusSuccess is the status code of a successful SAML Response.
+const samlStatusSuccess = "urn:oasis:names:tc:SAML:2.0:status:Success"
+
+// samlStatus is the status of a SAML Response.
+type samlStatus struct {
+	StatusCode    *samlStatusCode `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
+	StatusMessage string          `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusMessage"`
+}
+
+// samlStatusCode is a status code, optionally with a sub-status code
+// providing more specific information about the failure.
+type samlStatusCode struct {
+	Value      string          `xml:"Value,attr"`
+	StatusCode *samlStatusCode `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
+}
+
+// samlStatusMessages are the user-facing messages of well-known status
+// and sub-status codes.
+var samlStatusMessages = map[string]string{
+	"urn:oasis:names:tc:SAML:2.0:status:Requester":              "Your identity provider rejected the authentication request",
+	"urn:oasis:names:tc:SAML:2.0:status:Responder":              "Authentication failed at your identity provider",
+	"urn:oasis:names:tc:SAML:2.0:status:VersionMismatch":        "Your identity provider does not support the SAML version",
+	"urn:oasis:names:tc:SAML:2.0:status:AuthnFailed":            "Authentication failed at your identity provider",
+	"urn:oasis:names:tc:SAML:2.0:status:NoAuthnContext":         "Your identity provider could not authenticate you with the required method",
+	"urn:oasis:names:tc:SAML:2.0:status:NoPassive":              "Your identity provider requires you to sign in",
+	"urn:oasis:names:tc:SAML:2.0:status:RequestDenied":          "Your identity provider denied the authentication request",
+	"urn:oasis:names:tc:SAML:2.0:status:RequestUnsupported":     "Your identity provider does not support the authentication request",
+	"urn:oasis:names:tc:SAML:2.0:status:UnknownPrincipal":       "Your identity provider does not recognize your account",
+	"urn:oasis:names:tc:SAML:2.0:status:InvalidNameIDPolicy":    "Your identity provider does not support the requested user identifier",
+	"urn:oasis:names:tc:SAML:2.0:status:UnsupportedBinding":     "Your identity provider does not support the authentication request binding",
+	"urn:oasis:names:tc:SAML:2.0:status:PartialLogout":          "Your identity provider could not complete the logout",
+	"urn:oasis:names:tc:SAML:2.0:status:ProxyCountExceeded":     "Your identity provider could not forward the authentication request",
+	"urn:oasis:names:tc:SAML:2.0:status:NoAvailableIDP":         "No identity provider is available to authenticate you",
+	"urn:oasis:names:tc:SAML:2.0:status:NoSupportedIDP":         "No identity provider is available to authenticate you",
+	"urn:oasis:names:tc:SAML:2.0:status:InvalidAttrNameOrValue": "Your identity provider could not provide the requested attributes",
+}
+
+// defaultSAMLStatusMessage is the user-facing message of unknown failure
+// status codes.
+const defaultSAMLStatusMessage = "Your identity provider returned an error"
+
+// samlStatusError is returned when a SAML Response has a failure status.
+// The error message is suitable for end users.
+type samlStatusError struct {
+	StatusCode    string
+	SubStatusCode string
+	StatusMessage string
+}
+
+func (e *samlStatusError) Error() string {
+	if msg, exists := samlStatusMessages[e.SubStatusCode]; exists {
+		return msg
+	}
+	if msg, exists := samlStatusMessages[e.StatusCode]; exists {
+		return msg
+	}
+	return defaultSAMLStatusMessage
+}
+
+// getStatusCode returns the top-level status code.
+func (s *samlStatus) getStatusCode() string {
+	if s == nil || s.StatusCode == nil {
+		return ""
+	}
+	return s.StatusCode.Value
+}
+
+// getSubStatusCode returns the second-level status code, if any.
+func (s *samlStatus) getSubStatusCode() string {
+	if s == nil || s.StatusCode == nil || s.StatusCode.StatusCode == nil {
+		return ""
+	}
+	return s.StatusCode.StatusCode.Value
+}
+
+// validate returns samlStatusError when the status is not success. The
+// absence of status is left to the service provider validating the
+// response.
+func (s *samlStatus) validate() error {
+	statusCode := s.getStatusCode()
+	if statusCode == "" || statusCode == samlStatusSuccess {
+		return nil
+	}
+	err := &samlStatusError{
+		StatusCode:    statusCode,
+		SubStatusCode: s.getSubStatusCode(),
+	}
+	if s != nil {
+		err.StatusMessage = s.StatusMessage
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+package saml
+
+import (
+	"testing"
+)
+
+func TestSAMLResponseStatus(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		status          string
+		shouldFail      bool
+		expectedMessage string
+	}{
+		{
+			name:   "success",
+			status: `<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>`,
+		},
+		{
+			name: "absent status",
+		},
+		{
+			name: "responder with authentication failure",
+			status: `<samlp:Status>` +
+				`<samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Responder">` +
+				`<samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:AuthnFailed"/>` +
+				`</samlp:StatusCode>` +
+				`<samlp:StatusMessage>AADSTS50105: The signed in user is not assigned to a role</samlp:StatusMessage>` +
+				`</samlp:Status>`,
+			shouldFail:      true,
+			expectedMessage: "Authentication failed at your identity provider",
+		},
+		{
+			name: "requester with unknown principal",
+			status: `<samlp:Status>` +
+				`<samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Requester">` +
+				`<samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:UnknownPrincipal"/>` +
+				`</samlp:StatusCode>` +
+				`</samlp:Status>`,
+			shouldFail:      true,
+			expectedMessage: "Your identity provider does not recognize your account",
+		},
+		{
+			name: "requester with unknown sub-status",
+			status: `<samlp:Status>` +
+				`<samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Requester">` +
+				`<samlp:StatusCode Value="urn:example:status:Custom"/>` +
+				`</samlp:StatusCode>` +
+				`</samlp:Status>`,
+			shouldFail:      true,
+			expectedMessage: "Your identity provider rejected the authentication request",
+		},
+		{
+			name:            "unknown status",
+			status:          `<samlp:Status><samlp:StatusCode Value="urn:example:status:Custom"/></samlp:Status>`,
+			shouldFail:      true,
+			expectedMessage: defaultSAMLStatusMessage,
+		},
+	} {
+		raw := `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_1">` + test.status + `</samlp:Response>`
+		resp, err := parseSAMLResponse([]byte(raw))
+		if err != nil {
+			t.Fatalf("%s: failed parsing response: %s", test.name, err)
+		}
+		err = resp.Status.validate()
+		if !test.shouldFail {
+			if err != nil {
+				t.Errorf("%s: expected success, got %s", test.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected failure, got success", test.name)
+			continue
+		}
+		if err.Error() != test.expectedMessage {
+			t.Errorf("%s: expected message %q, got %q", test.name, test.expectedMessage, err.Error())
+		}
+		statusErr, ok := err.(*samlStatusError)
+		if !ok {
+			t.Fatalf("%s: unexpected error type %T", test.name, err)
+		}
+		if statusErr.StatusCode == "" {
+			t.Errorf("%s: status code not captured", test.name)
+		}
+	}
+}
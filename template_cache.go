@@ -0,0 +1,33 @@
+package saml
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"text/template"
+)
+
+// getTemplateCacheKey returns the key of the parsed template in the state
+// pool.
+func getTemplateCacheKey(name, body string) string {
+	h := sha256.Sum256([]byte(body))
+	return "template/" + name + ":" + hex.EncodeToString(h[:])
+}
+
+// parseCachedTemplate returns the parsed template with the name and the
+// body, parsing it only when the state pool has none. The templates are
+// keyed by the name and the content hash, so that the provider instances,
+// e.g. the ones using the default template, share a single parsed
+// template, and a changed template is parsed anew. The parsed templates
+// are safe for concurrent use. It returns the key of the template in the
+// pool, which must be released when the instance is cleaned up, so that
+// the templates no instance uses are dropped.
+func parseCachedTemplate(name, body string) (*template.Template, string, error) {
+	key := getTemplateCacheKey(name, body)
+	value, err := loadPooledState(key, func() (interface{}, error) {
+		return template.New(name).Parse(body)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return value.(*template.Template), key, nil
+}
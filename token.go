@@ -0,0 +1,321 @@
+package saml
+
+import (
+	"fmt"
+	jwt "github.com/dgrijalva/jwt-go"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// reservedClaimNames are the claims the claim name map cannot rename,
+// because token verifiers rely on them to establish token validity.
+var reservedClaimNames = map[string]bool{
+	"exp": true,
+	"iat": true,
+	"nbf": true,
+}
+
+// knownClaimNames are the names of the claims in UserClaims.
+var knownClaimNames = map[string]bool{
+	"aud":           true,
+	"exp":           true,
+	"jti":           true,
+	"iat":           true,
+	"iss":           true,
+	"nbf":           true,
+	"sub":           true,
+	"name":          true,
+	"email":         true,
+	"roles":         true,
+	"origin":        true,
+	"auth_time":     true,
+	"auth_instant":  true,
+	"auth_method":   true,
+	"session_index": true,
+	"sid":           true,
+	"custom":        true,
+}
+
+// validateClaimNameMap validates the mapping of the claim names.
+func (p TokenParameters) validateClaimNameMap() error {
+	names := make(map[string]string)
+	for k, v := range p.ClaimNameMap {
+		if !knownClaimNames[k] {
+			return fmt.Errorf("claim_name_map: unsupported claim %s", k)
+		}
+		if reservedClaimNames[k] {
+			return fmt.Errorf("claim_name_map: claim %s cannot be renamed", k)
+		}
+		if v == "" {
+			return fmt.Errorf("claim_name_map: claim %s has empty name", k)
+		}
+		names[k] = v
+	}
+	claimNames := make(map[string]string)
+	for k := range knownClaimNames {
+		name := k
+		if v, exists := names[k]; exists {
+			name = v
+		}
+		if prev, exists := claimNames[name]; exists {
+			return fmt.Errorf("claim_name_map: claims %s and %s have the same name %s", prev, k, name)
+		}
+		claimNames[name] = k
+	}
+	return nil
+}
+
+// requiredClaimNames are the claims the tokens cannot be issued without,
+// because the plugin identifies the users and their sessions by them.
+var requiredClaimNames = map[string]bool{
+	"email": true,
+	"sid":   true,
+}
+
+// validateExcludeClaims validates the claims excluded from the tokens.
+func (p TokenParameters) validateExcludeClaims() error {
+	for _, k := range p.ExcludeClaims {
+		if !knownClaimNames[k] {
+			return fmt.Errorf("exclude_claims: unsupported claim %s", k)
+		}
+		if reservedClaimNames[k] || requiredClaimNames[k] {
+			return fmt.Errorf("exclude_claims: claim %s cannot be excluded", k)
+		}
+	}
+	return nil
+}
+
+// reservedHeaderFields are the registered JWT header fields, whose
+// semantics the verifiers rely on.
+var reservedHeaderFields = map[string]bool{
+	"alg":      true,
+	"crit":     true,
+	"cty":      true,
+	"jku":      true,
+	"jwk":      true,
+	"kid":      true,
+	"typ":      true,
+	"x5c":      true,
+	"x5t":      true,
+	"x5t#S256": true,
+	"x5u":      true,
+}
+
+// validateHeaderFields validates the custom fields of the token header.
+func (p TokenParameters) validateHeaderFields() error {
+	for k := range p.HeaderFields {
+		if k == "" {
+			return fmt.Errorf("header_fields: field name must not be empty")
+		}
+		if reservedHeaderFields[k] {
+			return fmt.Errorf("header_fields: field %s is reserved", k)
+		}
+	}
+	return nil
+}
+
+// isClaimExcluded returns true when the claim is excluded from the tokens.
+func (p TokenParameters) isClaimExcluded(k string) bool {
+	for _, name := range p.ExcludeClaims {
+		if name == k {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	defaultTokenHeaderName       = "Authorization"
+	existingTokenHeaderOverwrite = "overwrite"
+	existingTokenHeaderPreserve  = "preserve"
+)
+
+// validateTokenHeader validates the settings of the token header.
+func (p *TokenParameters) validateTokenHeader() error {
+	if p.TokenHeaderName == "" {
+		p.TokenHeaderName = defaultTokenHeaderName
+	}
+	if strings.ContainsAny(p.TokenHeaderName, " :\t\r\n") {
+		return fmt.Errorf("jwt.token_header_name %q is not a valid header name", p.TokenHeaderName)
+	}
+	p.TokenHeaderName = textproto.CanonicalMIMEHeaderKey(p.TokenHeaderName)
+	switch p.TokenHeaderName {
+	case "Cookie", "Set-Cookie":
+		return fmt.Errorf("jwt.token_header_name %s is reserved", p.TokenHeaderName)
+	}
+	switch p.ExistingTokenHeader {
+	case "":
+		p.ExistingTokenHeader = existingTokenHeaderOverwrite
+	case existingTokenHeaderOverwrite, existingTokenHeaderPreserve:
+	default:
+		return fmt.Errorf("jwt.existing_token_header %s is not supported", p.ExistingTokenHeader)
+	}
+	return nil
+}
+
+// getTokenHeaderName returns the name of the response header carrying
+// the token.
+func (p TokenParameters) getTokenHeaderName() string {
+	if p.TokenHeaderName == "" {
+		return defaultTokenHeaderName
+	}
+	return p.TokenHeaderName
+}
+
+// setTokenHeader adds the token to the response. The header already
+// present in the response is kept when ExistingTokenHeader is "preserve".
+func (p TokenParameters) setTokenHeader(w http.ResponseWriter, token string) {
+	name := p.getTokenHeaderName()
+	if p.ExistingTokenHeader == existingTokenHeaderPreserve && w.Header().Get(name) != "" {
+		return
+	}
+	w.Header().Set(name, "Bearer "+token)
+}
+
+// getTokenClaims returns the claims the token carries. The excluded claims
+// are omitted, and the claims are renamed per claim name map.
+func (p TokenParameters) getTokenClaims(claims UserClaims) jwt.MapClaims {
+	tokenClaims := jwt.MapClaims{}
+	for k, v := range claims.AsMap() {
+		if p.isClaimExcluded(k) {
+			continue
+		}
+		if name, exists := p.ClaimNameMap[k]; exists {
+			k = name
+		}
+		tokenClaims[k] = v
+	}
+	return tokenClaims
+}
+
+// signToken issues a JWT token with the claims.
+func (p TokenParameters) signToken(claims UserClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, p.getTokenClaims(claims))
+	for k, v := range p.HeaderFields {
+		token.Header[k] = v
+	}
+	return token.SignedString([]byte(p.TokenSecret))
+}
+
+// getRequestToken returns the JWT token passed via the Authorization
+// header or via the cookie with the token.
+func (p TokenParameters) getRequestToken(r *http.Request) string {
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		if strings.HasPrefix(authHeader, "Bearer ") {
+			return strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+		}
+	}
+	if cookie, err := r.Cookie(p.TokenName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// parseToken verifies the signature of the JWT token and returns the
+// claims the token carries. The token is verified with the token secret
+// first and then with the previous token secrets.
+func (p TokenParameters) parseToken(s string) (jwt.MapClaims, error) {
+	// The time-based claims are validated by validateClaimsTime, because
+	// the parser does not support leeway.
+	parser := &jwt.Parser{
+		ValidMethods:         []string{jwt.SigningMethodHS512.Alg()},
+		SkipClaimsValidation: true,
+	}
+	var token *jwt.Token
+	var err error
+	// The tokens signed with any of the previous secrets remain valid
+	// during secret rotation.
+	for _, secret := range append([]string{p.TokenSecret}, p.PreviousTokenSecrets...) {
+		tokenSecret := []byte(secret)
+		token, err = parser.Parse(s, func(token *jwt.Token) (interface{}, error) {
+			return tokenSecret, nil
+		})
+		if err == nil {
+			break
+		}
+		if validationErr, ok := err.(*jwt.ValidationError); ok {
+			if validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
+				continue
+			}
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+	tokenClaims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fmt.Errorf("unsupported token claims")
+	}
+	return tokenClaims, nil
+}
+
+// validateToken verifies the JWT token and returns user claims along
+// with the claims the token carries. The claims renamed per claim name
+// map are converted back to UserClaims.
+func (p TokenParameters) validateToken(s string) (*UserClaims, jwt.MapClaims, error) {
+	tokenClaims, err := p.parseToken(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	reverseClaimNameMap := make(map[string]string)
+	for k, name := range p.ClaimNameMap {
+		reverseClaimNameMap[name] = k
+	}
+	m := make(map[string]interface{})
+	for name, v := range tokenClaims {
+		if k, exists := reverseClaimNameMap[name]; exists {
+			m[k] = v
+			continue
+		}
+		if _, renamed := p.ClaimNameMap[name]; renamed {
+			continue
+		}
+		m[name] = v
+	}
+	claims, err := newUserClaimsFromMap(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := p.validateClaimsTime(claims, time.Now()); err != nil {
+		return nil, nil, err
+	}
+	if err := p.validateSession(claims); err != nil {
+		return nil, nil, err
+	}
+	return claims, tokenClaims, nil
+}
+
+// validateClaimsTime checks the expiration, not before, and issued at
+// times of the token. The token expired within the token expiry leeway
+// is still valid, so that a slight clock skew does not force re-login.
+func (p TokenParameters) validateClaimsTime(claims *UserClaims, now time.Time) error {
+	if claims.ExpiresAt == 0 {
+		return fmt.Errorf("token has no expiration time")
+	}
+	leeway := int64(p.TokenExpiryLeeway)
+	if claims.ExpiresAt+leeway < now.Unix() {
+		return fmt.Errorf("The access token expired")
+	}
+	if claims.NotBefore > 0 && claims.NotBefore-leeway > now.Unix() {
+		return fmt.Errorf("The access token is not valid yet")
+	}
+	if claims.IssuedAt > 0 && claims.IssuedAt-leeway > now.Unix() {
+		return fmt.Errorf("The access token is issued in the future")
+	}
+	return nil
+}
+
+// validateRequestToken verifies the JWT token passed with the request.
+func (p TokenParameters) validateRequestToken(r *http.Request) (*UserClaims, jwt.MapClaims, error) {
+	s := p.getRequestToken(r)
+	if s == "" {
+		return nil, nil, fmt.Errorf("token not found")
+	}
+	return p.validateToken(s)
+}
@@ -0,0 +1,66 @@
+package saml
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tokenResponse is the JSON response body carrying the token issued to a
+// programmatic client.
+type tokenResponse struct {
+	Token     string `json:"token"`
+	TokenType string `json:"token_type"`
+	ExpiresAt int64  `json:"expires_at"`
+	ExpiresIn int64  `json:"expires_in"`
+}
+
+// acceptsJSON returns true when the request asks for a JSON response via
+// the Accept header.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTokenResponse writes the token along with its expiration time in
+// the JSON response body.
+func (m AuthProvider) writeTokenResponse(w http.ResponseWriter, r *http.Request, token string) error {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	claims, _, err := m.Jwt.validateToken(token)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"internal server error"}`))
+		return err
+	}
+	b, err := json.Marshal(tokenResponse{
+		Token:     token,
+		TokenType: "Bearer",
+		ExpiresAt: claims.ExpiresAt,
+		ExpiresIn: claims.ExpiresAt - time.Now().Unix(),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"internal server error"}`))
+		return err
+	}
+	w.Write(b)
+	return nil
+}
+
+// writeTokenErrorResponse writes the reason of the failed authentication of
+// a programmatic client in the JSON response body.
+func (m AuthProvider) writeTokenErrorResponse(w http.ResponseWriter, statusCode int, message string) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	b, _ := json.Marshal(map[string]string{"error": message})
+	w.WriteHeader(statusCode)
+	w.Write(b)
+}
@@ -0,0 +1,122 @@
+package saml
+
+import (
+	"encoding/json"
+	"go.uber.org/zap"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTokenResponse(t *testing.T) {
+	m := AuthProvider{
+		CommonParameters: CommonParameters{
+			Jwt: TokenParameters{
+				TokenName:   "JWT_TOKEN",
+				TokenSecret: "75f03764-147c-4d87-b2f0-4fda89e331c8",
+			},
+		},
+	}
+	expiresAt := time.Now().Add(900 * time.Second).Unix()
+	token, err := m.Jwt.signToken(UserClaims{
+		ExpiresAt: expiresAt,
+		Name:      "Smith, John",
+		Email:     "jsmith@contoso.com",
+	})
+	if err != nil {
+		t.Fatalf("failed signing token: %s", err)
+	}
+
+	r := httptest.NewRequest("POST", "https://localhost:3443/saml", nil)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	if err := m.writeTokenResponse(w, r, token); err != nil {
+		t.Fatalf("failed writing token response: %s", err)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("unexpected content type: %s", contentType)
+	}
+	resp := tokenResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed parsing token response %s: %s", w.Body.String(), err)
+	}
+	if resp.Token != token {
+		t.Fatalf("token response has no token: %s", w.Body.String())
+	}
+	if resp.TokenType != "Bearer" || resp.ExpiresAt != expiresAt || resp.ExpiresIn <= 0 || resp.ExpiresIn > 900 {
+		t.Fatalf("unexpected token response: %+v", resp)
+	}
+}
+
+func TestWriteTokenErrorResponse(t *testing.T) {
+	m := AuthProvider{}
+	w := httptest.NewRecorder()
+	m.writeTokenErrorResponse(w, 401, "The Azure AD authorization POST request has no SAMLResponse")
+	if w.Code != 401 {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+	if body := w.Body.String(); body != `{"error":"The Azure AD authorization POST request has no SAMLResponse"}` {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
+func TestAuthenticateTokenErrorResponse(t *testing.T) {
+	for _, statusCode := range []int{401, 400} {
+		m := AuthProvider{
+			CommonParameters: CommonParameters{
+				AuthURLPath:                     "/saml",
+				AuthenticationFailureStatusCode: statusCode,
+				Jwt:                             TokenParameters{TokenName: "JWT_TOKEN"},
+			},
+			Azure:  &AzureIdp{},
+			UI:     &UserInterface{},
+			logger: zap.NewNop(),
+		}
+		if err := m.UI.validate(); err != nil {
+			t.Fatalf("failed validating UI: %s", err)
+		}
+		form := url.Values{"SAMLResponse": {"PHNhbWxwOlJlc3BvbnNlLz4="}}
+		r := httptest.NewRequest("POST", "https://localhost:3443/saml", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		if _, authenticated, _ := m.Authenticate(w, r); authenticated {
+			t.Fatalf("status %d: unexpected authentication", statusCode)
+		}
+		// The headers set after writing the status never reach the client,
+		// hence the recorder must hold the same headers as the result.
+		resp := w.Result()
+		if resp.StatusCode != statusCode {
+			t.Fatalf("status %d: unexpected status code: %d", statusCode, resp.StatusCode)
+		}
+		expected := ""
+		if statusCode == 401 {
+			expected = "Bearer"
+		}
+		for _, challenge := range []string{resp.Header.Get("WWW-Authenticate"), w.Header().Get("WWW-Authenticate")} {
+			if challenge != expected {
+				t.Fatalf("status %d: unexpected WWW-Authenticate: %q", statusCode, challenge)
+			}
+		}
+		if contentType := resp.Header.Get("Content-Type"); contentType != "application/json" {
+			t.Fatalf("status %d: unexpected content type: %s", statusCode, contentType)
+		}
+	}
+}
+
+func TestAcceptsJSON(t *testing.T) {
+	for accept, expected := range map[string]bool{
+		"application/json":                    true,
+		"text/html, application/json;q=0.9":   true,
+		"text/html,application/xhtml+xml,*/*": false,
+		"":                                    false,
+	} {
+		r := httptest.NewRequest("POST", "https://localhost:3443/saml", nil)
+		r.Header.Set("Accept", accept)
+		if acceptsJSON(r) != expected {
+			t.Errorf("Accept %q: expected %t", accept, expected)
+		}
+	}
+}
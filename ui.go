@@ -2,8 +2,14 @@ package saml
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
 	"net/http"
+	"net/url"
 	"text/template"
+	"time"
 )
 
 // UserInterface represents a set of configuration settings
@@ -18,24 +24,186 @@ type UserInterface struct {
 	Links              []userInterfaceLink `json:"-"`
 	AuthEndpoint       string              `json:"-"`
 	LocalAuthEnabled   bool                `json:"local_auth_enabled"`
+	// StaticAssetsLocation is the directory with the assets, e.g. logo and
+	// stylesheet, served by the plugin under <auth_url_path>/assets/.
+	StaticAssetsLocation string `json:"static_assets_location,omitempty"`
+	// LogoFile is the name of the logo file in StaticAssetsLocation. When
+	// set, it takes precedence over LogoURL.
+	LogoFile string `json:"logo_file,omitempty"`
+	// StylesheetFile is the name of the optional stylesheet file in
+	// StaticAssetsLocation.
+	StylesheetFile string `json:"stylesheet_file,omitempty"`
+	// FaviconFile is the name of the favicon file, e.g. favicon.ico, in
+	// StaticAssetsLocation.
+	FaviconFile string `json:"favicon_file,omitempty"`
+	// ManifestFile is the name of the web app manifest file, e.g.
+	// site.webmanifest, in StaticAssetsLocation.
+	ManifestFile string `json:"manifest_file,omitempty"`
+	// ContentSecurityPolicy is the Content-Security-Policy header of the
+	// UI responses. The default policy allows the resources the default
+	// template loads. Custom templates may require a different policy.
+	ContentSecurityPolicy string `json:"content_security_policy,omitempty"`
+	// ReferrerPolicy is the Referrer-Policy header of the UI responses.
+	// Defaults to no-referrer.
+	ReferrerPolicy string `json:"referrer_policy,omitempty"`
+	// ExtraLinks are the links, e.g. to help desk or status page,
+	// rendered after the login buttons of the IdPs.
+	ExtraLinks []userInterfaceLink `json:"extra_links,omitempty"`
+	// LoginPageStatus is the HTTP status code of the login page rendered
+	// for the unauthenticated requests. Defaults to 200.
+	LoginPageStatus int `json:"login_page_status,omitempty"`
+	// TemplateDevReload re-reads and re-parses the template at
+	// TemplateLocation on each render, so that the changes to the
+	// template show without a server reload. It is meant for the UI
+	// development only.
+	TemplateDevReload bool `json:"template_dev_reload,omitempty"`
+	// SpInitiatedLinks points the login buttons of the IdPs to the
+	// authentication endpoint, i.e. {auth_url_path}?provider={name}, which
+	// redirects the browser to the IdP with an authentication request,
+	// instead of the IdP portals.
+	SpInitiatedLinks bool `json:"sp_initiated_links,omitempty"`
+	// LogoutTemplateLocation is the path to the template of the logout
+	// confirmation page rendered when no post-logout redirect URL is
+	// configured. Defaults to a built-in minimal page.
+	LogoutTemplateLocation string             `json:"logout_template_location,omitempty"`
+	LogoutTemplate         *template.Template `json:"-"`
+	// poolKeys are the keys of the cached templates in the state pool.
+	poolKeys []string
 }
 
 type userInterfaceArgs struct {
 	Title            string
 	LogoURL          string
 	LogoDescription  string
+	StylesheetURL    string
+	FaviconURL       string
+	ManifestURL      string
 	AuthEndpoint     string
 	Message          string
 	MessageType      string
 	Links            []userInterfaceLink
 	LocalAuthEnabled bool
 	Authenticated    bool
+	// OriginalURL is the URL the user originally requested. The user
+	// lands on it after the login.
+	OriginalURL string
+	// LandingURL is the link of the success page rendered when the user
+	// has nowhere to be redirected to after the login.
+	LandingURL string
+	// RememberEnabled shows the "Remember me" checkbox of the login
+	// with the IdP.
+	RememberEnabled bool
 }
 
 type userInterfaceLink struct {
-	Link  string
-	Title string
-	Style string
+	Link  string `json:"link,omitempty"`
+	Title string `json:"title,omitempty"`
+	// Icon is the CSS classes of the icon, e.g. "fab fa-windows".
+	Icon string `json:"icon,omitempty"`
+	// Style is the CSS classes of the button, e.g. "btn-primary".
+	Style string `json:"style,omitempty"`
+}
+
+// defaultContentSecurityPolicy allows the resources the default UI
+// template loads from CDNs, and denies framing of the UI. The scripts are
+// allowed by their exact URLs, rather than by the CDN hosts, because the
+// CDNs host libraries usable to bypass the policy. The template pins
+// their content with Subresource Integrity.
+const defaultContentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' " +
+	"https://code.jquery.com/jquery-3.3.1.slim.min.js " +
+	"https://cdnjs.cloudflare.com/ajax/libs/popper.js/1.14.7/umd/popper.min.js " +
+	"https://cdnjs.cloudflare.com/ajax/libs/font-awesome/5.13.0/js/all.min.js " +
+	"https://cdnjs.cloudflare.com/ajax/libs/highlight.js/9.18.1/highlight.min.js " +
+	"https://stackpath.bootstrapcdn.com/bootstrap/4.3.1/js/bootstrap.min.js; " +
+	"style-src 'self' 'unsafe-inline' https://stackpath.bootstrapcdn.com https://cdnjs.cloudflare.com https://fonts.googleapis.com; " +
+	"font-src 'self' data: https://fonts.gstatic.com; " +
+	"img-src 'self' data: https:; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"form-action 'self'; " +
+	"frame-ancestors 'none'"
+
+// defaultReferrerPolicy is the default Referrer-Policy of the UI.
+const defaultReferrerPolicy = "no-referrer"
+
+// defaultExtraLinkStyle is the default style of the extra links.
+const defaultExtraLinkStyle = "btn-secondary"
+
+// LoginButton is the appearance of the login button an IdP contributes
+// to the user interface.
+type LoginButton struct {
+	Title string `json:"title,omitempty"`
+	Icon  string `json:"icon,omitempty"`
+	Style string `json:"style,omitempty"`
+}
+
+// ProviderBranding is the title and the logo of the pages rendered during
+// the authentication flow of an IdP, e.g. when the flow fails. The
+// settings not configured fall back to the ones of the user interface.
+type ProviderBranding struct {
+	Title           string `json:"title,omitempty"`
+	LogoURL         string `json:"logo_url,omitempty"`
+	LogoDescription string `json:"logo_description,omitempty"`
+}
+
+// apply overrides the title and the logo of the user interface with the
+// configured settings of the branding.
+func (b *ProviderBranding) apply(args *userInterfaceArgs) {
+	if b == nil {
+		return
+	}
+	if b.Title != "" {
+		args.Title = b.Title
+	}
+	if b.LogoURL != "" {
+		args.LogoURL = b.LogoURL
+		args.LogoDescription = b.LogoDescription
+	}
+}
+
+// userInterfaceLinkProvider is implemented by the IdPs contributing
+// a login button to the user interface.
+type userInterfaceLinkProvider interface {
+	getUserInterfaceLink() userInterfaceLink
+	// getProviderName returns the name of the IdP in the provider query
+	// parameter of the SP-initiated logins, e.g. "azure".
+	getProviderName() string
+}
+
+// addProviderLink adds the login button of the IdP. With SpInitiatedLinks,
+// the button points to the authentication endpoint initiating the login
+// with the IdP instead of the IdP itself.
+func (ui *UserInterface) addProviderLink(provider userInterfaceLinkProvider) {
+	link := provider.getUserInterfaceLink()
+	if ui.SpInitiatedLinks {
+		link.Link = ui.AuthEndpoint + "?provider=" + url.QueryEscape(provider.getProviderName())
+	}
+	ui.Links = append(ui.Links, link)
+}
+
+// newUserInterfaceLink returns the link with the appearance of the button,
+// falling back to the defaults for the settings not configured.
+func newUserInterfaceLink(link string, button *LoginButton, defaults LoginButton) userInterfaceLink {
+	l := userInterfaceLink{
+		Link:  link,
+		Title: defaults.Title,
+		Icon:  defaults.Icon,
+		Style: defaults.Style,
+	}
+	if button == nil {
+		return l
+	}
+	if button.Title != "" {
+		l.Title = button.Title
+	}
+	if button.Icon != "" {
+		l.Icon = button.Icon
+	}
+	if button.Style != "" {
+		l.Style = button.Style
+	}
+	return l
 }
 
 func (ui *UserInterface) newUserInterfaceArgs() userInterfaceArgs {
@@ -43,10 +211,22 @@ func (ui *UserInterface) newUserInterfaceArgs() userInterfaceArgs {
 		Title:            ui.Title,
 		LogoURL:          ui.LogoURL,
 		LogoDescription:  ui.LogoDescription,
-		Links:            ui.Links,
+		Links:            append(append([]userInterfaceLink{}, ui.Links...), ui.ExtraLinks...),
 		AuthEndpoint:     ui.AuthEndpoint,
 		LocalAuthEnabled: ui.LocalAuthEnabled,
 	}
+	if ui.LogoFile != "" {
+		args.LogoURL = ui.staticAssetURL(ui.LogoFile)
+	}
+	if ui.StylesheetFile != "" {
+		args.StylesheetURL = ui.staticAssetURL(ui.StylesheetFile)
+	}
+	if ui.FaviconFile != "" {
+		args.FaviconURL = ui.staticAssetURL(ui.FaviconFile)
+	}
+	if ui.ManifestFile != "" {
+		args.ManifestURL = ui.staticAssetURL(ui.ManifestFile)
+	}
 	return args
 }
 
@@ -54,43 +234,217 @@ func (ui *UserInterface) validate() error {
 	if err := ui.loadTemplates(); err != nil {
 		return err
 	}
+	if err := ui.validateStaticAssets(); err != nil {
+		return err
+	}
 	if ui.Title == "" {
 		ui.Title = "Sign In"
 	}
+	if ui.ContentSecurityPolicy == "" {
+		ui.ContentSecurityPolicy = defaultContentSecurityPolicy
+	}
+	if ui.ReferrerPolicy == "" {
+		ui.ReferrerPolicy = defaultReferrerPolicy
+	}
+	if ui.LoginPageStatus == 0 {
+		ui.LoginPageStatus = http.StatusOK
+	}
+	if ui.LoginPageStatus != http.StatusOK {
+		if err := validateStatusCode("login_page_status", ui.LoginPageStatus); err != nil {
+			return err
+		}
+	}
+	for i := range ui.ExtraLinks {
+		link := &ui.ExtraLinks[i]
+		if link.Link == "" {
+			return fmt.Errorf("extra link %d has no link", i+1)
+		}
+		if link.Title == "" {
+			return fmt.Errorf("extra link %s has no title", link.Link)
+		}
+		if link.Style == "" {
+			link.Style = defaultExtraLinkStyle
+		}
+	}
 	return nil
 }
 
 func (ui *UserInterface) loadTemplates() error {
+	if err := releasePooledState(ui.poolKeys); err != nil {
+		return err
+	}
+	ui.poolKeys = nil
+	t, err := ui.parseTemplate()
+	if err != nil {
+		return err
+	}
+	ui.Template = t
+	logoutTemplate, err := ui.parseLogoutTemplate()
+	if err != nil {
+		return err
+	}
+	ui.LogoutTemplate = logoutTemplate
+	return nil
+}
+
+// parseTemplate reads and parses the template at TemplateLocation, or the
+// default template.
+func (ui *UserInterface) parseTemplate() (*template.Template, error) {
 	var templateBody string
-	t := template.New("AuthForm")
 	if ui.TemplateLocation != "" {
 		templateBodyBytes, err := readFile(ui.TemplateLocation)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		templateBody = string(templateBodyBytes)
 	} else {
 		templateBody = defaultUserInterface
 	}
-	t, err := t.Parse(templateBody)
+	return ui.parseTemplateBody("AuthForm", templateBody)
+}
+
+// parseTemplateBody parses the template. The parsed templates are cached,
+// except with TemplateDevReload, so that the cache does not grow with each
+// change of the template under development.
+func (ui *UserInterface) parseTemplateBody(name, body string) (*template.Template, error) {
+	if ui.TemplateDevReload {
+		return template.New(name).Parse(body)
+	}
+	t, key, err := parseCachedTemplate(name, body)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	ui.Template = t
-	return nil
+	ui.poolKeys = append(ui.poolKeys, key)
+	return t, nil
 }
 
-func (ui *UserInterface) render(w http.ResponseWriter, args userInterfaceArgs) error {
-	b := bytes.NewBuffer(nil)
-	err := ui.Template.Execute(b, args)
-	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte(`Internal Server Error`))
-		return err
+// parseLogoutTemplate reads and parses the template at
+// LogoutTemplateLocation, or the default logout confirmation page.
+func (ui *UserInterface) parseLogoutTemplate() (*template.Template, error) {
+	templateBody := defaultLogoutUserInterface
+	if ui.LogoutTemplateLocation != "" {
+		templateBodyBytes, err := readFile(ui.LogoutTemplateLocation)
+		if err != nil {
+			return nil, err
+		}
+		templateBody = string(templateBodyBytes)
+	}
+	return ui.parseTemplateBody("LogoutForm", templateBody)
+}
+
+// setSecurityHeaders sets the headers protecting the UI, e.g. from
+// clickjacking and content injection.
+func (ui *UserInterface) setSecurityHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Security-Policy", ui.ContentSecurityPolicy)
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Referrer-Policy", ui.ReferrerPolicy)
+}
+
+func (ui *UserInterface) render(w http.ResponseWriter, statusCode int, args userInterfaceArgs) error {
+	t := ui.Template
+	if ui.TemplateDevReload && ui.TemplateLocation != "" {
+		reloaded, err := ui.parseTemplate()
+		if err != nil {
+			return renderFallbackErrorPage(w, err)
+		}
+		t = reloaded
+	}
+	return ui.execute(w, statusCode, t, args)
+}
+
+// renderLogout renders the logout confirmation page.
+func (ui *UserInterface) renderLogout(w http.ResponseWriter, args userInterfaceArgs) error {
+	t := ui.LogoutTemplate
+	if ui.TemplateDevReload && ui.LogoutTemplateLocation != "" {
+		reloaded, err := ui.parseLogoutTemplate()
+		if err != nil {
+			return renderFallbackErrorPage(w, err)
+		}
+		t = reloaded
 	}
+	return ui.execute(w, http.StatusOK, t, args)
+}
 
+// execute renders the template with the security headers.
+func (ui *UserInterface) execute(w http.ResponseWriter, statusCode int, t *template.Template, args userInterfaceArgs) error {
+	ui.setSecurityHeaders(w)
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	w.Header().Set("Content-Type", "text/html")
+	b := bytes.NewBuffer(nil)
+	err := t.Execute(b, args)
+	if err != nil {
+		return renderFallbackErrorPage(w, err)
+	}
+	w.WriteHeader(statusCode)
 	w.Write(b.Bytes())
 	return nil
 }
+
+// renderError is returned when the UI template fails to render. The
+// correlation ID is displayed to the user and logged along with the error.
+type renderError struct {
+	CorrelationID string
+	Err           error
+}
+
+func (e *renderError) Error() string {
+	return fmt.Sprintf("failed rendering UI template, correlation id %s: %s", e.CorrelationID, e.Err)
+}
+
+// fallbackErrorPage is the page displayed when the UI template fails to
+// render. It does not depend on the template.
+const fallbackErrorPage = `<!doctype html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8">
+    <title>Internal Server Error</title>
+  </head>
+  <body>
+    <h1>Internal Server Error</h1>
+    <p>The sign in page is temporarily unavailable. Please contact the administrator with the following correlation ID.</p>
+    <p><code>%s</code></p>
+  </body>
+</html>
+`
+
+// defaultLogoutUserInterface is the default logout confirmation page.
+const defaultLogoutUserInterface = `<!doctype html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>{{ .Title }}</title>
+    {{ if .FaviconURL }}<link rel="icon" href="{{ .FaviconURL }}">{{ end }}
+    {{ if .StylesheetURL }}<link rel="stylesheet" href="{{ .StylesheetURL }}">{{ end }}
+  </head>
+  <body>
+    {{ if .LogoURL }}<img src="{{ .LogoURL }}" alt="{{ .LogoDescription }}">{{ end }}
+    <h1>{{ .Title }}</h1>
+    <p>{{ .Message | html }}</p>
+    <p><a href="{{ .AuthEndpoint }}">Sign In</a></p>
+  </body>
+</html>
+`
+
+// renderFallbackErrorPage writes the fallback error page with a new
+// correlation ID.
+func renderFallbackErrorPage(w http.ResponseWriter, err error) error {
+	correlationID := newCorrelationID()
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, fallbackErrorPage, html.EscapeString(correlationID))
+	return &renderError{
+		CorrelationID: correlationID,
+		Err:           err,
+	}
+}
+
+// newCorrelationID returns a random ID correlating an error displayed to
+// a user with the logs.
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,176 @@
+package saml
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// uiAssetsPathPrefix is the path, relative to the authentication endpoint,
+// the static assets of the user interface are being served from.
+const uiAssetsPathPrefix = "/assets/"
+
+// uiAssetsCacheControl is the value of Cache-Control header sent with
+// static assets.
+const uiAssetsCacheControl = "public, max-age=3600"
+
+// uiAssetContentTypes are the content types of the static assets with the
+// extensions missing from the system MIME types.
+var uiAssetContentTypes = map[string]string{
+	".ico":         "image/x-icon",
+	".webmanifest": "application/manifest+json",
+}
+
+func (ui *UserInterface) validateStaticAssets() error {
+	if ui.StaticAssetsLocation == "" {
+		if ui.LogoFile != "" || ui.StylesheetFile != "" || ui.FaviconFile != "" || ui.ManifestFile != "" {
+			return fmt.Errorf("static_assets_location must be set when using logo_file, stylesheet_file, favicon_file, or manifest_file")
+		}
+		return nil
+	}
+
+	assetsDir, err := filepath.Abs(ui.StaticAssetsLocation)
+	if err != nil {
+		return err
+	}
+	assetsDir, err = filepath.EvalSymlinks(assetsDir)
+	if err != nil {
+		return err
+	}
+	fileInfo, err := os.Stat(assetsDir)
+	if err != nil {
+		return err
+	}
+	if !fileInfo.IsDir() {
+		return fmt.Errorf("static assets location %s is not a directory", ui.StaticAssetsLocation)
+	}
+	ui.StaticAssetsLocation = assetsDir
+
+	for _, assetName := range []string{ui.LogoFile, ui.StylesheetFile, ui.FaviconFile, ui.ManifestFile} {
+		if assetName == "" {
+			continue
+		}
+		if _, err := ui.openStaticAsset(assetName); err != nil {
+			return fmt.Errorf("static asset %s: %s", assetName, err)
+		}
+	}
+	return nil
+}
+
+// staticAssetURL returns the URL path the UI template uses to reference
+// a static asset.
+func (ui *UserInterface) staticAssetURL(assetName string) string {
+	return strings.TrimSuffix(ui.AuthEndpoint, "/") + uiAssetsPathPrefix + path.Clean("/" + assetName)[1:]
+}
+
+// isStaticAssetRequest returns true when the request is for a static asset.
+func (ui *UserInterface) isStaticAssetRequest(r *http.Request) bool {
+	if ui.StaticAssetsLocation == "" {
+		return false
+	}
+	return strings.HasPrefix(r.URL.Path, strings.TrimSuffix(ui.AuthEndpoint, "/")+uiAssetsPathPrefix)
+}
+
+// openStaticAsset opens the file with the static asset. The name of the asset
+// is relative to the static assets location. The files outside of the location
+// are not served.
+func (ui *UserInterface) openStaticAsset(assetName string) (*os.File, error) {
+	cleanName := path.Clean("/" + assetName)
+	if cleanName == "/" {
+		return nil, fmt.Errorf("empty asset name")
+	}
+	filePath := filepath.Join(ui.StaticAssetsLocation, filepath.FromSlash(cleanName))
+	filePath, err := filepath.EvalSymlinks(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(filePath, ui.StaticAssetsLocation+string(filepath.Separator)) {
+		return nil, fmt.Errorf("asset is outside of static assets location")
+	}
+	fileHandle, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := fileHandle.Stat()
+	if err != nil {
+		fileHandle.Close()
+		return nil, err
+	}
+	if !fileInfo.Mode().IsRegular() {
+		fileHandle.Close()
+		return nil, fmt.Errorf("asset is not a regular file")
+	}
+	return fileHandle, nil
+}
+
+// serveStaticAsset writes the requested static asset to the response.
+func (ui *UserInterface) serveStaticAsset(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return nil
+	}
+	assetName := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(ui.AuthEndpoint, "/")+uiAssetsPathPrefix)
+	fileHandle, err := ui.openStaticAsset(assetName)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`Not Found`))
+		return fmt.Errorf("failed serving static asset %s: %s", r.URL.Path, err)
+	}
+	defer fileHandle.Close()
+	fileInfo, err := fileHandle.Stat()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`Internal Server Error`))
+		return err
+	}
+
+	// The gzip-compressed assets are served decompressed.
+	var content io.ReadSeeker = fileHandle
+	contentName := fileInfo.Name()
+	if isGzipFile(contentName) {
+		gzipReader, err := gzip.NewReader(fileHandle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`Internal Server Error`))
+			return fmt.Errorf("failed decompressing static asset %s: %s", r.URL.Path, err)
+		}
+		defer gzipReader.Close()
+		data, err := ioutil.ReadAll(gzipReader)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`Internal Server Error`))
+			return fmt.Errorf("failed decompressing static asset %s: %s", r.URL.Path, err)
+		}
+		content = bytes.NewReader(data)
+		contentName = strings.TrimSuffix(contentName, ".gz")
+	}
+
+	if contentType := getStaticAssetContentType(contentName); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Cache-Control", uiAssetsCacheControl)
+	// The conditional requests are answered with 304 Not Modified.
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, fileInfo.ModTime().UnixNano(), fileInfo.Size()))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, contentName, fileInfo.ModTime(), content)
+	return nil
+}
+
+// getStaticAssetContentType returns the content type of the static asset
+// by the extension of its name.
+func getStaticAssetContentType(assetName string) string {
+	ext := strings.ToLower(filepath.Ext(assetName))
+	if contentType, exists := uiAssetContentTypes[ext]; exists {
+		return contentType
+	}
+	return mime.TypeByExtension(ext)
+}
@@ -9,8 +9,15 @@ var defaultUserInterface = `<!doctype html>
     <meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no">
     <meta name="description" content="">
     <meta name="author" content="">
+    {{ if .FaviconURL }}
+    <link rel="icon" href="{{ .FaviconURL }}">
+    {{ else }}
     <link rel="shortcut icon" href="/favicon.ico" type="image/x-icon">
     <link rel="icon" href="/favicon.ico" type="image/x-icon">
+    {{ end }}
+    {{ if .ManifestURL }}
+    <link rel="manifest" href="{{ .ManifestURL }}">
+    {{ end }}
 
     <!-- Bootstrap CSS -->
     <link rel="stylesheet" href="https://stackpath.bootstrapcdn.com/bootstrap/4.3.1/css/bootstrap.min.css" integrity="sha384-ggOyR0iXCbMQv3Xipma34MD+dH/1fQ784/j6cY/iJTQUOhcWr7x9JvoRxT2MZw1T" crossorigin="anonymous">
@@ -29,6 +36,9 @@ var defaultUserInterface = `<!doctype html>
       hr { overflow: visible; padding: 0.5em; border: none; border-top: 1.5px solid #5a6268; color: #5a6268; text-align: center; }
       hr:after { content: "or"; display: inline-block; position: relative; top: -1.3em; font-size: 1.35em; padding: 0 0.25em; background: white; }
     </style>
+    {{ if .StylesheetURL }}
+    <link rel="stylesheet" href="{{ .StylesheetURL }}">
+    {{ end }}
 
   </head>
   <body>
@@ -44,7 +54,7 @@ var defaultUserInterface = `<!doctype html>
           </div>
           {{ if .Message }}
           <div class="alert alert-warning alert-dismissible fade show p-2" role="alert">
-            <p>{{ .Message }}</p>
+            <p>{{ .Message | html }}</p>
             <button type="button" class="close" data-dismiss="alert" aria-label="Close">
               <span aria-hidden="true">&times;</span>
             </button>
@@ -53,11 +63,22 @@ var defaultUserInterface = `<!doctype html>
 
           {{range .Links}}
           <div class="pb-2 p-1">
-            <a class="btn btn-primary btn-lg btn-block" href="{{ .Link }}">
-              <span class="fab {{ .Style }}"></span> {{ .Title }}
+            <a class="btn {{ .Style }} btn-lg btn-block" href="{{ .Link }}">
+              <span class="{{ .Icon }}"></span> {{ .Title }}
             </a>
           </div>
           {{ end }}
+          {{ if .RememberEnabled }}
+          <form action="{{ .AuthEndpoint }}" method="GET" role="form" class="card p-2 mb-2">
+            <input type="hidden" name="provider" value="azure">
+            <input type="hidden" name="redirect_url" value="{{ .OriginalURL | html }}">
+            <div class="form-check mb-2">
+              <input class="form-check-input" type="checkbox" name="remember" value="1" id="remember">
+              <label class="form-check-label" for="remember">Remember me</label>
+            </div>
+            <button type="submit" class="btn btn-secondary btn-block">Sign In</button>
+          </form>
+          {{ end }}
           {{ if .LocalAuthEnabled }}
           <hr />
           <form action="{{ .AuthEndpoint }}" method="POST" role="form" class="card p-2">
@@ -72,7 +93,15 @@ var defaultUserInterface = `<!doctype html>
         </div>
       </div>
       {{ else }}
-      Authenticated User
+      <div class="row justify-content-center py-5">
+        <div class="col-md-4 order-md-2 mb-4 card p-2">
+          <div class="py-2 text-center">
+            <h2>Signed In</h2>
+            <p>You have signed in successfully.</p>
+            <a class="btn btn-primary btn-lg btn-block" href="{{ .LandingURL }}">Continue</a>
+          </div>
+        </div>
+      </div>
       {{ end }}
     </div>
 
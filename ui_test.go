@@ -0,0 +1,675 @@
+package saml
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestRenderLoginButtons(t *testing.T) {
+	azure := &AzureIdp{
+		LoginURL: "https://account.activedirectory.windowsazure.com/applications/signin/MyGatekeeper",
+	}
+	custom := &AzureIdp{
+		LoginURL: "https://idp.contoso.com/sso",
+		LoginButton: &LoginButton{
+			Title: "Contoso Account",
+			Icon:  "fas fa-building",
+		},
+	}
+
+	ui := &UserInterface{}
+	if err := ui.validate(); err != nil {
+		t.Fatalf("failed validating UI: %s", err)
+	}
+	for _, linkProvider := range []userInterfaceLinkProvider{azure, custom} {
+		ui.Links = append(ui.Links, linkProvider.getUserInterfaceLink())
+	}
+
+	w := httptest.NewRecorder()
+	if err := ui.render(w, 200, ui.newUserInterfaceArgs()); err != nil {
+		t.Fatalf("failed rendering UI: %s", err)
+	}
+	body := w.Body.String()
+	for _, expected := range []string{
+		`<a class="btn btn-primary btn-lg btn-block" href="https://account.activedirectory.windowsazure.com/applications/signin/MyGatekeeper">`,
+		`<span class="fab fa-windows"></span> Office 365`,
+		`<a class="btn btn-primary btn-lg btn-block" href="https://idp.contoso.com/sso">`,
+		`<span class="fas fa-building"></span> Contoso Account`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("rendered UI has no %s", expected)
+		}
+	}
+}
+
+func TestSpInitiatedLinks(t *testing.T) {
+	for _, test := range []struct {
+		spInitiatedLinks bool
+		expected         string
+	}{
+		{expected: `href="https://account.activedirectory.windowsazure.com/applications/signin/MyGatekeeper"`},
+		{spInitiatedLinks: true, expected: `href="/saml?provider=azure"`},
+	} {
+		ui := &UserInterface{
+			AuthEndpoint:     "/saml",
+			SpInitiatedLinks: test.spInitiatedLinks,
+		}
+		if err := ui.validate(); err != nil {
+			t.Fatalf("failed validating UI: %s", err)
+		}
+		ui.addProviderLink(&AzureIdp{
+			LoginURL: "https://account.activedirectory.windowsazure.com/applications/signin/MyGatekeeper",
+		})
+		w := httptest.NewRecorder()
+		if err := ui.render(w, 200, ui.newUserInterfaceArgs()); err != nil {
+			t.Fatalf("failed rendering UI: %s", err)
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, test.expected) {
+			t.Errorf("sp_initiated_links=%t: rendered UI has no %s", test.spInitiatedLinks, test.expected)
+		}
+		if !strings.Contains(body, `<span class="fab fa-windows"></span> Office 365`) {
+			t.Errorf("sp_initiated_links=%t: rendered UI has no login button appearance", test.spInitiatedLinks)
+		}
+	}
+}
+
+func writeGzipFile(t *testing.T, filePath string, content string) {
+	fileHandle, err := os.Create(filePath)
+	if err != nil {
+		t.Fatalf("failed creating %s: %s", filePath, err)
+	}
+	defer fileHandle.Close()
+	gzipWriter := gzip.NewWriter(fileHandle)
+	if _, err := gzipWriter.Write([]byte(content)); err != nil {
+		t.Fatalf("failed writing %s: %s", filePath, err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatalf("failed writing %s: %s", filePath, err)
+	}
+}
+
+func TestGzipTemplateAndAssets(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "caddy-auth-saml")
+	if err != nil {
+		t.Fatalf("failed creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	templatePath := filepath.Join(tmpDir, "ui.template.gz")
+	writeGzipFile(t, templatePath, `<html><title>{{ .Title }}</title><link href="{{ .StylesheetURL }}"></html>`)
+	writeGzipFile(t, filepath.Join(tmpDir, "custom.css.gz"), `body { color: #5a6268; }`)
+
+	ui := &UserInterface{
+		TemplateLocation:     templatePath,
+		StaticAssetsLocation: tmpDir,
+		StylesheetFile:       "custom.css.gz",
+		AuthEndpoint:         "/saml",
+	}
+	if err := ui.validate(); err != nil {
+		t.Fatalf("failed validating UI: %s", err)
+	}
+	w := httptest.NewRecorder()
+	if err := ui.render(w, 200, ui.newUserInterfaceArgs()); err != nil {
+		t.Fatalf("failed rendering UI: %s", err)
+	}
+	if body := w.Body.String(); body != `<html><title>Sign In</title><link href="/saml/assets/custom.css.gz"></html>` {
+		t.Fatalf("unexpected rendered UI: %s", body)
+	}
+
+	r := httptest.NewRequest("GET", "/saml/assets/custom.css.gz", nil)
+	w = httptest.NewRecorder()
+	if err := ui.serveStaticAsset(w, r); err != nil {
+		t.Fatalf("failed serving static asset: %s", err)
+	}
+	if body := w.Body.String(); body != `body { color: #5a6268; }` {
+		t.Fatalf("unexpected static asset: %s", body)
+	}
+	if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/css") {
+		t.Fatalf("unexpected static asset content type: %s", contentType)
+	}
+}
+
+func TestFaviconAndManifest(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "caddy-auth-saml")
+	if err != nil {
+		t.Fatalf("failed creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	favicon := []byte{0x00, 0x00, 0x01, 0x00, 0x01, 0x00}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "favicon.ico"), favicon, 0600); err != nil {
+		t.Fatalf("failed writing favicon: %s", err)
+	}
+	manifest := `{"name": "Contoso Sign In", "icons": [{"src": "favicon.ico"}]}`
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "site.webmanifest"), []byte(manifest), 0600); err != nil {
+		t.Fatalf("failed writing manifest: %s", err)
+	}
+
+	var ui *UserInterface
+	// The sample template links the favicon and the manifest the same way
+	// as the default one.
+	for _, templateLocation := range []string{"assets/ui/ui.template", ""} {
+		ui = &UserInterface{
+			TemplateLocation:     templateLocation,
+			StaticAssetsLocation: tmpDir,
+			FaviconFile:          "favicon.ico",
+			ManifestFile:         "site.webmanifest",
+			AuthEndpoint:         "/saml",
+		}
+		if err := ui.validate(); err != nil {
+			t.Fatalf("%q: failed validating UI: %s", templateLocation, err)
+		}
+		w := httptest.NewRecorder()
+		if err := ui.render(w, 200, ui.newUserInterfaceArgs()); err != nil {
+			t.Fatalf("%q: failed rendering UI: %s", templateLocation, err)
+		}
+		for _, link := range []string{
+			`<link rel="icon" href="/saml/assets/favicon.ico">`,
+			`<link rel="manifest" href="/saml/assets/site.webmanifest">`,
+		} {
+			if !strings.Contains(w.Body.String(), link) {
+				t.Fatalf("%q: link %s not found in rendered UI", templateLocation, link)
+			}
+		}
+	}
+
+	for _, test := range []struct {
+		path        string
+		contentType string
+		body        string
+	}{
+		{path: "/saml/assets/favicon.ico", contentType: "image/x-icon", body: string(favicon)},
+		{path: "/saml/assets/site.webmanifest", contentType: "application/manifest+json", body: manifest},
+	} {
+		r := httptest.NewRequest("GET", test.path, nil)
+		w := httptest.NewRecorder()
+		if err := ui.serveStaticAsset(w, r); err != nil {
+			t.Fatalf("%s: failed serving static asset: %s", test.path, err)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != test.contentType {
+			t.Fatalf("%s: unexpected content type: %s", test.path, contentType)
+		}
+		if body := w.Body.String(); body != test.body {
+			t.Fatalf("%s: unexpected body: %q", test.path, body)
+		}
+		etag := w.Header().Get("ETag")
+		if etag == "" {
+			t.Fatalf("%s: ETag not set", test.path)
+		}
+
+		// Conditional request
+		r = httptest.NewRequest("GET", test.path, nil)
+		r.Header.Set("If-None-Match", etag)
+		w = httptest.NewRecorder()
+		if err := ui.serveStaticAsset(w, r); err != nil {
+			t.Fatalf("%s: failed serving static asset: %s", test.path, err)
+		}
+		if w.Code != 304 {
+			t.Fatalf("%s: expected status code 304, got %d", test.path, w.Code)
+		}
+	}
+
+	ui = &UserInterface{FaviconFile: "favicon.ico"}
+	if err := ui.validate(); err == nil {
+		t.Fatalf("favicon_file without static_assets_location passed validation")
+	}
+}
+
+func TestServeStaticAssetTraversal(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "caddy-auth-saml")
+	if err != nil {
+		t.Fatalf("failed creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	assetsDir := filepath.Join(tmpDir, "assets")
+	if err := os.Mkdir(assetsDir, 0700); err != nil {
+		t.Fatalf("failed creating assets directory: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(assetsDir, "custom.css"), []byte(`body { color: #5a6268; }`), 0600); err != nil {
+		t.Fatalf("failed writing stylesheet: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "secret.txt"), []byte(`secret`), 0600); err != nil {
+		t.Fatalf("failed writing secret: %s", err)
+	}
+	if err := os.Symlink(filepath.Join(tmpDir, "secret.txt"), filepath.Join(assetsDir, "link.txt")); err != nil {
+		t.Fatalf("failed creating symlink: %s", err)
+	}
+
+	ui := &UserInterface{
+		StaticAssetsLocation: assetsDir,
+		AuthEndpoint:         "/saml",
+	}
+	if err := ui.validate(); err != nil {
+		t.Fatalf("failed validating UI: %s", err)
+	}
+
+	for _, test := range []struct {
+		path       string
+		statusCode int
+	}{
+		{path: "/saml/assets/custom.css", statusCode: 200},
+		{path: "/saml/assets/../secret.txt", statusCode: 404},
+		{path: "/saml/assets/css/../../secret.txt", statusCode: 404},
+		{path: "/saml/assets/..%2fsecret.txt", statusCode: 404},
+		{path: "/saml/assets/%2e%2e/secret.txt", statusCode: 404},
+		{path: "/saml/assets/%2e%2e%2fsecret.txt", statusCode: 404},
+		{path: "/saml/assets/..%5csecret.txt", statusCode: 404},
+		{path: "/saml/assets/link.txt", statusCode: 404},
+		{path: "/saml/assets/", statusCode: 404},
+	} {
+		r := httptest.NewRequest("GET", test.path, nil)
+		w := httptest.NewRecorder()
+		err := ui.serveStaticAsset(w, r)
+		if test.statusCode == 200 && err != nil {
+			t.Fatalf("%s: failed serving static asset: %s", test.path, err)
+		}
+		if test.statusCode != 200 && err == nil {
+			t.Fatalf("%s: expected error", test.path)
+		}
+		if w.Code != test.statusCode {
+			t.Fatalf("%s: expected status code %d, got %d", test.path, test.statusCode, w.Code)
+		}
+		if strings.Contains(w.Body.String(), "secret") {
+			t.Fatalf("%s: served file outside of static assets location", test.path)
+		}
+	}
+}
+
+func TestRenderExtraLinks(t *testing.T) {
+	ui := &UserInterface{}
+	if err := json.Unmarshal([]byte(`{
+		"extra_links": [
+			{"link": "https://support.contoso.com", "title": "Help Desk", "icon": "fas fa-life-ring"},
+			{"link": "https://status.contoso.com", "title": "Status", "style": "btn-light"}
+		]
+	}`), ui); err != nil {
+		t.Fatalf("failed parsing UI configuration: %s", err)
+	}
+	if err := ui.validate(); err != nil {
+		t.Fatalf("failed validating UI: %s", err)
+	}
+	azure := &AzureIdp{LoginURL: "https://account.activedirectory.windowsazure.com/applications/signin/MyGatekeeper"}
+	ui.Links = append(ui.Links, azure.getUserInterfaceLink())
+
+	w := httptest.NewRecorder()
+	if err := ui.render(w, 200, ui.newUserInterfaceArgs()); err != nil {
+		t.Fatalf("failed rendering UI: %s", err)
+	}
+	body := w.Body.String()
+	for _, expected := range []string{
+		`<span class="fab fa-windows"></span> Office 365`,
+		`<a class="btn btn-secondary btn-lg btn-block" href="https://support.contoso.com">`,
+		`<span class="fas fa-life-ring"></span> Help Desk`,
+		`<a class="btn btn-light btn-lg btn-block" href="https://status.contoso.com">`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("rendered UI has no %s", expected)
+		}
+	}
+	if strings.Index(body, "Office 365") > strings.Index(body, "Help Desk") {
+		t.Fatalf("extra links rendered before login buttons")
+	}
+
+	for _, config := range []string{
+		`{"extra_links": [{"title": "Help Desk"}]}`,
+		`{"extra_links": [{"link": "https://support.contoso.com"}]}`,
+	} {
+		ui := &UserInterface{}
+		if err := json.Unmarshal([]byte(config), ui); err != nil {
+			t.Fatalf("failed parsing UI configuration: %s", err)
+		}
+		if err := ui.validate(); err == nil {
+			t.Fatalf("invalid extra link passed validation: %s", config)
+		}
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	ui := &UserInterface{}
+	if err := ui.validate(); err != nil {
+		t.Fatalf("failed validating UI: %s", err)
+	}
+	w := httptest.NewRecorder()
+	if err := ui.render(w, 200, ui.newUserInterfaceArgs()); err != nil {
+		t.Fatalf("failed rendering UI: %s", err)
+	}
+	for header, expected := range map[string]string{
+		"Content-Security-Policy": defaultContentSecurityPolicy,
+		"X-Frame-Options":         "DENY",
+		"X-Content-Type-Options":  "nosniff",
+		"Referrer-Policy":         "no-referrer",
+	} {
+		if value := w.Header().Get(header); value != expected {
+			t.Fatalf("expected %s header %q, got %q", header, expected, value)
+		}
+	}
+	if !strings.Contains(defaultContentSecurityPolicy, "frame-ancestors 'none'") {
+		t.Fatalf("default policy allows framing")
+	}
+	// The default policy allows the exact scripts of the default
+	// template, each pinned with Subresource Integrity, rather than
+	// entire CDN hosts.
+	scriptSources := map[string]bool{}
+	for _, directive := range strings.Split(defaultContentSecurityPolicy, ";") {
+		if fields := strings.Fields(directive); len(fields) > 0 && fields[0] == "script-src" {
+			for _, source := range fields[1:] {
+				scriptSources[source] = true
+			}
+		}
+	}
+	for source := range scriptSources {
+		if u, err := url.Parse(source); err == nil && u.Host != "" && (u.Path == "" || u.Path == "/") {
+			t.Fatalf("default policy allows scripts of the entire host %s", source)
+		}
+	}
+	for _, match := range regexp.MustCompile(`<script src="([^"]+)"( integrity="[^"]+")?`).FindAllStringSubmatch(defaultUserInterface, -1) {
+		if !scriptSources[match[1]] {
+			t.Fatalf("default policy does not allow script %s of the default template", match[1])
+		}
+		if match[2] == "" {
+			t.Fatalf("script %s of the default template has no integrity", match[1])
+		}
+	}
+
+	ui = &UserInterface{
+		ContentSecurityPolicy: "default-src 'self'",
+		ReferrerPolicy:        "same-origin",
+	}
+	if err := ui.validate(); err != nil {
+		t.Fatalf("failed validating UI: %s", err)
+	}
+	w = httptest.NewRecorder()
+	if err := ui.render(w, 401, ui.newUserInterfaceArgs()); err != nil {
+		t.Fatalf("failed rendering UI: %s", err)
+	}
+	if value := w.Header().Get("Content-Security-Policy"); value != "default-src 'self'" {
+		t.Fatalf("unexpected custom Content-Security-Policy: %s", value)
+	}
+	if value := w.Header().Get("Referrer-Policy"); value != "same-origin" {
+		t.Fatalf("unexpected custom Referrer-Policy: %s", value)
+	}
+}
+
+func TestRenderFallbackErrorPage(t *testing.T) {
+	ui := &UserInterface{}
+	if err := ui.validate(); err != nil {
+		t.Fatalf("failed validating UI: %s", err)
+	}
+	ui.Template = template.Must(template.New("AuthForm").Parse(`<html>{{ .Title.Missing }}</html>`))
+
+	w := httptest.NewRecorder()
+	err := ui.render(w, 200, ui.newUserInterfaceArgs())
+	if err == nil {
+		t.Fatalf("expected template execution error, got none")
+	}
+	renderErr, ok := err.(*renderError)
+	if !ok {
+		t.Fatalf("unexpected error type %T: %s", err, err)
+	}
+	if renderErr.CorrelationID == "" {
+		t.Fatalf("correlation id is empty")
+	}
+	if w.Code != 500 {
+		t.Fatalf("expected status code 500, got %d", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, renderErr.CorrelationID) {
+		t.Fatalf("fallback error page has no correlation id: %s", body)
+	}
+	if !strings.Contains(body, "Internal Server Error") {
+		t.Fatalf("unexpected fallback error page: %s", body)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "text/html" {
+		t.Fatalf("unexpected content type: %s", contentType)
+	}
+	if w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Fatalf("fallback error page has no security headers")
+	}
+}
+
+func TestRenderEscapedMessage(t *testing.T) {
+	for _, templateLocation := range []string{"", "assets/ui/ui.template"} {
+		ui := &UserInterface{TemplateLocation: templateLocation}
+		if err := ui.validate(); err != nil {
+			t.Fatalf("%q: failed validating UI: %s", templateLocation, err)
+		}
+		args := ui.newUserInterfaceArgs()
+		args.Message = `request <script>alert(1)</script> failed`
+		w := httptest.NewRecorder()
+		if err := ui.render(w, 200, args); err != nil {
+			t.Fatalf("%q: failed rendering UI: %s", templateLocation, err)
+		}
+		if strings.Contains(w.Body.String(), "<script>alert(1)</script>") {
+			t.Fatalf("%q: message rendered unescaped", templateLocation)
+		}
+		if !strings.Contains(w.Body.String(), "request &lt;script&gt;alert(1)&lt;/script&gt; failed") {
+			t.Fatalf("%q: escaped message not found in rendered UI", templateLocation)
+		}
+	}
+
+	ui := &UserInterface{}
+	if err := ui.validate(); err != nil {
+		t.Fatalf("failed validating UI: %s", err)
+	}
+	args := ui.newUserInterfaceArgs()
+	args.Message = `<script>alert(1)</script>`
+	w := httptest.NewRecorder()
+	if err := ui.renderLogout(w, args); err != nil {
+		t.Fatalf("failed rendering logout page: %s", err)
+	}
+	if strings.Contains(w.Body.String(), "<script>alert(1)</script>") {
+		t.Fatalf("message rendered unescaped on logout page")
+	}
+}
+
+func TestLoginPageStatus(t *testing.T) {
+	ui := &UserInterface{}
+	if err := ui.validate(); err != nil {
+		t.Fatalf("failed validating UI: %s", err)
+	}
+	if ui.LoginPageStatus != 200 {
+		t.Fatalf("unexpected default login page status: %d", ui.LoginPageStatus)
+	}
+
+	ui = &UserInterface{LoginPageStatus: 401}
+	if err := ui.validate(); err != nil {
+		t.Fatalf("failed validating UI: %s", err)
+	}
+	w := httptest.NewRecorder()
+	if err := ui.render(w, ui.LoginPageStatus, ui.newUserInterfaceArgs()); err != nil {
+		t.Fatalf("failed rendering UI: %s", err)
+	}
+	if w.Code != 401 {
+		t.Fatalf("expected login page status 401, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "Sign In") {
+		t.Fatalf("login page body was not rendered")
+	}
+
+	ui = &UserInterface{LoginPageStatus: 302}
+	if err := ui.validate(); err == nil {
+		t.Fatalf("redirect status passed login_page_status validation")
+	}
+}
+
+func TestRenderProviderBranding(t *testing.T) {
+	ui := &UserInterface{
+		Title:           "Contoso Portal",
+		LogoURL:         "https://contoso.com/logo.png",
+		LogoDescription: "Contoso",
+	}
+	if err := ui.validate(); err != nil {
+		t.Fatalf("failed validating UI: %s", err)
+	}
+	for _, test := range []struct {
+		name     string
+		branding *ProviderBranding
+		expected []string
+	}{
+		{
+			name: "no branding",
+			expected: []string{
+				`<title>Contoso Portal</title>`,
+				`src="https://contoso.com/logo.png" alt="Contoso"`,
+			},
+		},
+		{
+			name:     "title only",
+			branding: &ProviderBranding{Title: "Fabrikam Sign In"},
+			expected: []string{
+				`<title>Fabrikam Sign In</title>`,
+				`src="https://contoso.com/logo.png" alt="Contoso"`,
+			},
+		},
+		{
+			name: "title and logo",
+			branding: &ProviderBranding{
+				Title:           "Fabrikam Sign In",
+				LogoURL:         "https://fabrikam.com/logo.png",
+				LogoDescription: "Fabrikam",
+			},
+			expected: []string{
+				`<title>Fabrikam Sign In</title>`,
+				`src="https://fabrikam.com/logo.png" alt="Fabrikam"`,
+			},
+		},
+	} {
+		args := ui.newUserInterfaceArgs()
+		test.branding.apply(&args)
+		w := httptest.NewRecorder()
+		if err := ui.render(w, 200, args); err != nil {
+			t.Fatalf("%s: failed rendering UI: %s", test.name, err)
+		}
+		body := w.Body.String()
+		for _, expected := range test.expected {
+			if !strings.Contains(body, expected) {
+				t.Fatalf("%s: rendered UI has no %s", test.name, expected)
+			}
+		}
+	}
+}
+
+func TestTemplateDevReload(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "caddy-auth-saml")
+	if err != nil {
+		t.Fatalf("failed creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	templateLocation := filepath.Join(tmpDir, "ui.template")
+
+	for _, devReload := range []bool{false, true} {
+		if err := ioutil.WriteFile(templateLocation, []byte(`<html>v1 {{ .Title }}</html>`), 0600); err != nil {
+			t.Fatalf("failed writing template: %s", err)
+		}
+		ui := &UserInterface{
+			TemplateLocation:  templateLocation,
+			TemplateDevReload: devReload,
+		}
+		if err := ui.validate(); err != nil {
+			t.Fatalf("failed validating UI: %s", err)
+		}
+		if err := ioutil.WriteFile(templateLocation, []byte(`<html>v2 {{ .Title }}</html>`), 0600); err != nil {
+			t.Fatalf("failed writing template: %s", err)
+		}
+		w := httptest.NewRecorder()
+		if err := ui.render(w, 200, ui.newUserInterfaceArgs()); err != nil {
+			t.Fatalf("failed rendering UI: %s", err)
+		}
+		expected := "<html>v1 Sign In</html>"
+		if devReload {
+			expected = "<html>v2 Sign In</html>"
+		}
+		if body := w.Body.String(); body != expected {
+			t.Fatalf("template_dev_reload %t: expected %q, got %q", devReload, expected, body)
+		}
+	}
+}
+
+func TestTemplateCache(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "caddy-auth-saml")
+	if err != nil {
+		t.Fatalf("failed creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	templateLocation := filepath.Join(tmpDir, "ui.template")
+	if err := ioutil.WriteFile(templateLocation, []byte(`<html>cached v1 {{ .Title }}</html>`), 0600); err != nil {
+		t.Fatalf("failed writing template: %s", err)
+	}
+
+	// The provider instances using the same templates share them.
+	instances := []*UserInterface{{}, {}, {TemplateLocation: templateLocation}, {TemplateLocation: templateLocation}}
+	for _, ui := range instances {
+		if err := ui.validate(); err != nil {
+			t.Fatalf("failed validating UI: %s", err)
+		}
+	}
+	if instances[0].Template != instances[1].Template || instances[0].LogoutTemplate != instances[1].LogoutTemplate {
+		t.Fatalf("default templates were parsed repeatedly")
+	}
+	if instances[2].Template != instances[3].Template {
+		t.Fatalf("identical custom templates were parsed repeatedly")
+	}
+	if instances[0].Template == instances[2].Template {
+		t.Fatalf("different templates share a parsed template")
+	}
+
+	// The changed template is parsed anew, e.g. on config reload.
+	if err := ioutil.WriteFile(templateLocation, []byte(`<html>cached v2 {{ .Title }}</html>`), 0600); err != nil {
+		t.Fatalf("failed writing template: %s", err)
+	}
+	reloaded := &UserInterface{TemplateLocation: templateLocation}
+	if err := reloaded.validate(); err != nil {
+		t.Fatalf("failed validating UI: %s", err)
+	}
+	if reloaded.Template == instances[2].Template {
+		t.Fatalf("changed template was served from the cache")
+	}
+	w := httptest.NewRecorder()
+	if err := reloaded.render(w, 200, reloaded.newUserInterfaceArgs()); err != nil {
+		t.Fatalf("failed rendering UI: %s", err)
+	}
+	if body := w.Body.String(); body != "<html>cached v2 Sign In</html>" {
+		t.Fatalf("unexpected rendered UI: %q", body)
+	}
+
+	// The templates under development are not cached.
+	devInstances := []*UserInterface{{TemplateDevReload: true}, {TemplateDevReload: true}}
+	for _, ui := range devInstances {
+		if err := ui.validate(); err != nil {
+			t.Fatalf("failed validating UI: %s", err)
+		}
+	}
+	if devInstances[0].Template == devInstances[1].Template {
+		t.Fatalf("template under development was cached")
+	}
+
+	// The templates are dropped once no instance uses them.
+	for _, ui := range append(instances, reloaded) {
+		m := &AuthProvider{UI: ui}
+		if err := m.Cleanup(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := ioutil.WriteFile(templateLocation, []byte(`<html>cached v1 {{ .Title }}</html>`), 0600); err != nil {
+		t.Fatalf("failed writing template: %s", err)
+	}
+	fresh := &UserInterface{TemplateLocation: templateLocation}
+	if err := fresh.validate(); err != nil {
+		t.Fatalf("failed validating UI: %s", err)
+	}
+	defer releasePooledState(fresh.poolKeys)
+	if fresh.Template == instances[2].Template {
+		t.Fatalf("template of the cleaned up instances was served from the cache")
+	}
+}
@@ -2,6 +2,9 @@ package saml
 
 import (
 	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"strings"
 	"time"
 )
 
@@ -18,6 +21,25 @@ type UserClaims struct {
 	Email     string   `json:"email,omitempty"`
 	Roles     []string `json:"roles,omitempty"`
 	Origin    string   `json:"origin,omitempty"`
+	// AuthTime is the time the user authenticated with an IdP. Unlike
+	// IssuedAt, it does not change when the token is renewed.
+	AuthTime int64 `json:"auth_time,omitempty"`
+	// AuthInstant is the time the user authenticated at the IdP, i.e.
+	// the AuthnInstant of the assertion's authentication statement.
+	AuthInstant int64 `json:"auth_instant,omitempty"`
+	// AuthMethod is the method the user authenticated with at the IdP,
+	// i.e. the AuthnContextClassRef of the authentication statement.
+	AuthMethod string `json:"auth_method,omitempty"`
+	// SessionIndex is the session of the user at the IdP, i.e. the
+	// SessionIndex of the authentication statement, referenced by the
+	// LogoutRequest of the Single Logout.
+	SessionIndex string `json:"session_index,omitempty"`
+	// SessionID is the ID of the server-side session of the token. It is
+	// set only when the session store is enabled.
+	SessionID string `json:"sid,omitempty"`
+	// Custom holds the claims not defined by the above fields, e.g. the
+	// attributes passed through from SAML assertions.
+	Custom map[string]interface{} `json:"custom,omitempty"`
 }
 
 // Valid validates user claims.
@@ -56,7 +78,7 @@ func (u UserClaims) AsMap() map[string]interface{} {
 		m["name"] = u.Name
 	}
 	if u.Email != "" {
-		m["mail"] = u.Name
+		m["email"] = u.Email
 	}
 	if len(u.Roles) > 0 {
 		m["roles"] = u.Roles
@@ -64,5 +86,108 @@ func (u UserClaims) AsMap() map[string]interface{} {
 	if u.Origin != "" {
 		m["origin"] = u.Origin
 	}
+	if u.AuthTime > 0 {
+		m["auth_time"] = u.AuthTime
+	}
+	if u.AuthInstant > 0 {
+		m["auth_instant"] = u.AuthInstant
+	}
+	if u.AuthMethod != "" {
+		m["auth_method"] = u.AuthMethod
+	}
+	if u.SessionIndex != "" {
+		m["session_index"] = u.SessionIndex
+	}
+	if u.SessionID != "" {
+		m["sid"] = u.SessionID
+	}
+	if len(u.Custom) > 0 {
+		m["custom"] = u.Custom
+	}
 	return m
 }
+
+// newUserClaimsFromMap converts the claims of a parsed token to UserClaims.
+func newUserClaimsFromMap(m map[string]interface{}) (*UserClaims, error) {
+	u := &UserClaims{}
+	for k, v := range m {
+		switch k {
+		case "aud", "jti", "iss", "sub", "name", "email", "origin", "auth_method", "session_index", "sid":
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("claim %s is not a string", k)
+			}
+			switch k {
+			case "aud":
+				u.Audience = s
+			case "jti":
+				u.ID = s
+			case "iss":
+				u.Issuer = s
+			case "sub":
+				u.Subject = s
+			case "name":
+				u.Name = s
+			case "email":
+				u.Email = s
+			case "origin":
+				u.Origin = s
+			case "auth_method":
+				u.AuthMethod = s
+			case "session_index":
+				u.SessionIndex = s
+			case "sid":
+				u.SessionID = s
+			}
+		case "exp", "iat", "nbf", "auth_time", "auth_instant":
+			f, ok := v.(float64)
+			if !ok {
+				return nil, fmt.Errorf("claim %s is not a number", k)
+			}
+			switch k {
+			case "exp":
+				u.ExpiresAt = int64(f)
+			case "iat":
+				u.IssuedAt = int64(f)
+			case "nbf":
+				u.NotBefore = int64(f)
+			case "auth_time":
+				u.AuthTime = int64(f)
+			case "auth_instant":
+				u.AuthInstant = int64(f)
+			}
+		case "roles":
+			roles, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("claim %s is not a list", k)
+			}
+			for _, role := range roles {
+				s, ok := role.(string)
+				if !ok {
+					return nil, fmt.Errorf("claim %s contains non-string values", k)
+				}
+				u.Roles = append(u.Roles, s)
+			}
+		case "custom":
+			custom, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("claim %s is not a map", k)
+			}
+			u.Custom = custom
+		}
+	}
+	return u, nil
+}
+
+// newUser returns the user identity with the claims.
+func (u UserClaims) newUser() *caddyauth.User {
+	return &caddyauth.User{
+		ID: u.Email,
+		Metadata: map[string]string{
+			"name":        u.Name,
+			"email":       u.Email,
+			"roles":       strings.Join(u.Roles, " "),
+			"auth_method": u.AuthMethod,
+		},
+	}
+}
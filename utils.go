@@ -3,6 +3,10 @@ package saml
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
 	"os"
 	"strings"
 )
@@ -40,6 +44,18 @@ func readCertFile(filePath string) (string, error) {
 	return buffer.String(), nil
 }
 
+// readCertPEM returns the base64-encoded DER of the PEM-encoded certificate,
+// i.e. the same content readCertFile returns for a certificate file.
+func readCertPEM(s string) (string, error) {
+	cert, err := parseCertificatePEM([]byte(s))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(cert.Raw), nil
+}
+
+// readFile reads the file, trimming the lines. The files with .gz
+// extension are decompressed transparently.
 func readFile(filePath string) (string, error) {
 	var buffer bytes.Buffer
 	fileHandle, err := os.Open(filePath)
@@ -48,7 +64,17 @@ func readFile(filePath string) (string, error) {
 	}
 	defer fileHandle.Close()
 
-	scanner := bufio.NewScanner(fileHandle)
+	var fileReader io.Reader = fileHandle
+	if isGzipFile(filePath) {
+		gzipReader, err := gzip.NewReader(fileHandle)
+		if err != nil {
+			return "", fmt.Errorf("failed decompressing %s: %s", filePath, err)
+		}
+		defer gzipReader.Close()
+		fileReader = gzipReader
+	}
+
+	scanner := bufio.NewScanner(fileReader)
 	for scanner.Scan() {
 		line := scanner.Text()
 		buffer.WriteString(strings.TrimSpace(line))
@@ -60,3 +86,9 @@ func readFile(filePath string) (string, error) {
 
 	return buffer.String(), nil
 }
+
+// isGzipFile returns true when the file is gzip-compressed, i.e. it has
+// .gz extension.
+func isGzipFile(filePath string) bool {
+	return strings.HasSuffix(filePath, ".gz")
+}
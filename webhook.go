@@ -0,0 +1,275 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultWebhookTimeout is the default number of seconds a delivery
+	// attempt of an event may take.
+	defaultWebhookTimeout = 5
+	// defaultWebhookMaxRetries is the default number of the retries of a
+	// failed delivery.
+	defaultWebhookMaxRetries = 2
+	// defaultWebhookQueueSize is the default number of the events waiting
+	// for delivery past which the new events are dropped.
+	defaultWebhookQueueSize = 100
+	// webhookRetryDelay is the delay before the first retry. The delay
+	// doubles with each retry.
+	webhookRetryDelay = time.Second
+)
+
+// WebhookParameters are the settings of the webhook receiving the login
+// events, e.g. for anomaly detection. The events are delivered
+// asynchronously and never delay the logins.
+type WebhookParameters struct {
+	// URL is the URL the events are posted to as JSON.
+	URL string `json:"url,omitempty"`
+	// Timeout is the number of seconds a delivery attempt may take.
+	// Defaults to 5.
+	Timeout int `json:"timeout,omitempty"`
+	// MaxRetries is the number of the retries of a failed delivery, i.e.
+	// of a connection error or a 5xx response. Defaults to 2.
+	MaxRetries int `json:"max_retries,omitempty"`
+	// QueueSize is the number of the events waiting for delivery past
+	// which the new events are dropped. Defaults to 100.
+	QueueSize int            `json:"queue_size,omitempty"`
+	sender    *webhookSender `json:"-"`
+}
+
+// validate checks the settings and sets the defaults.
+func (p *WebhookParameters) validate() error {
+	u, err := url.Parse(p.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook.url %q is not a valid http or https URL", p.URL)
+	}
+	if p.Timeout < 0 {
+		return fmt.Errorf("webhook.timeout must not be negative")
+	}
+	if p.Timeout == 0 {
+		p.Timeout = defaultWebhookTimeout
+	}
+	if p.MaxRetries < 0 {
+		return fmt.Errorf("webhook.max_retries must not be negative")
+	}
+	if p.MaxRetries == 0 {
+		p.MaxRetries = defaultWebhookMaxRetries
+	}
+	if p.QueueSize < 0 {
+		return fmt.Errorf("webhook.queue_size must not be negative")
+	}
+	if p.QueueSize == 0 {
+		p.QueueSize = defaultWebhookQueueSize
+	}
+	return nil
+}
+
+// getPoolKey returns the key of the sender with the settings in the state
+// pool.
+func (p *WebhookParameters) getPoolKey() string {
+	return fmt.Sprintf("webhook/%s/%d/%d/%d", p.URL, p.Timeout, p.MaxRetries, p.QueueSize)
+}
+
+// loadWebhookSender returns the sender with the settings from the state
+// pool, so that the queued events survive config reloads. The sender is
+// started when the pool has none.
+func (p *WebhookParameters) loadWebhookSender(logger *zap.Logger) (string, error) {
+	if err := p.validate(); err != nil {
+		return "", err
+	}
+	key := p.getPoolKey()
+	value, err := loadPooledState(key, func() (interface{}, error) {
+		sender := newWebhookSender(p.URL, time.Duration(p.Timeout)*time.Second, p.MaxRetries, p.QueueSize, logger)
+		sender.start()
+		return sender, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	p.sender = value.(*webhookSender)
+	return key, nil
+}
+
+// webhookEvent is the login event posted to the webhook. It carries
+// neither the tokens nor the SAML Responses, nor the error messages.
+type webhookEvent struct {
+	Event      string `json:"event"`
+	Time       string `json:"time"`
+	ClientIP   string `json:"client_ip"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	User       string `json:"user,omitempty"`
+	AuthMethod string `json:"auth_method,omitempty"`
+	// Reason is the reason of the failure: authentication_failed,
+	// locked_out, or the unmet requirement of the authorization, e.g.
+	// required_roles.
+	Reason string `json:"reason,omitempty"`
+}
+
+// webhookSender delivers the events to the webhook from a bounded queue.
+type webhookSender struct {
+	url        string
+	client     *http.Client
+	maxRetries int
+	retryDelay time.Duration
+	queue      chan *webhookEvent
+	quit       chan struct{}
+	wg         sync.WaitGroup
+	logger     *zap.Logger
+}
+
+func newWebhookSender(url string, timeout time.Duration, maxRetries, queueSize int, logger *zap.Logger) *webhookSender {
+	return &webhookSender{
+		url:        url,
+		client:     &http.Client{Timeout: timeout},
+		maxRetries: maxRetries,
+		retryDelay: webhookRetryDelay,
+		queue:      make(chan *webhookEvent, queueSize),
+		quit:       make(chan struct{}),
+		logger:     logger,
+	}
+}
+
+// start runs the delivery of the queued events in the background.
+func (s *webhookSender) start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			select {
+			case event := <-s.queue:
+				if err := s.deliver(event); err != nil {
+					s.logger.Warn(
+						"failed delivering webhook event",
+						zap.String("event", event.Event),
+						zap.String("error", err.Error()),
+					)
+				}
+			case <-s.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the delivery. The events still queued are discarded.
+func (s *webhookSender) Close() error {
+	close(s.quit)
+	s.wg.Wait()
+	return nil
+}
+
+// send queues the event for delivery without blocking. It returns false
+// when the queue is full and the event is dropped.
+func (s *webhookSender) send(event *webhookEvent) bool {
+	select {
+	case s.queue <- event:
+		return true
+	default:
+		s.logger.Warn(
+			"dropped webhook event, queue is full",
+			zap.String("event", event.Event),
+		)
+		return false
+	}
+}
+
+// deliver posts the event to the webhook. The connection errors and the
+// 5xx responses are retried with exponential backoff.
+func (s *webhookSender) deliver(event *webhookEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	delay := s.retryDelay
+	for attempt := 0; ; attempt++ {
+		err = s.post(b)
+		if err == nil {
+			return nil
+		}
+		if _, retryable := err.(*webhookRetryableError); !retryable || attempt >= s.maxRetries {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-s.quit:
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// webhookRetryableError is the failure of a delivery attempt worth
+// retrying.
+type webhookRetryableError struct {
+	err error
+}
+
+func (e *webhookRetryableError) Error() string {
+	return e.err.Error()
+}
+
+// post makes a delivery attempt.
+func (s *webhookSender) post(b []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return &webhookRetryableError{err}
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return &webhookRetryableError{fmt.Errorf("webhook responded with status code %d", resp.StatusCode)}
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// newLoginWebhookEvent returns the event of the login result.
+func newLoginWebhookEvent(r *http.Request, trustedProxies []*net.IPNet, userID, authMethod string, loginErr error) *webhookEvent {
+	event := &webhookEvent{
+		Event:      "login succeeded",
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		ClientIP:   getClientIP(r, trustedProxies),
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		User:       userID,
+		AuthMethod: authMethod,
+	}
+	if loginErr == nil {
+		return event
+	}
+	event.Event = "login failed"
+	switch err := loginErr.(type) {
+	case *lockoutError:
+		event.Reason = "locked_out"
+	case *authorizationError:
+		event.Reason = err.reason
+	default:
+		event.Reason = "authentication_failed"
+	}
+	return event
+}
+
+// sendLoginWebhookEvent queues the event of the login result for the
+// webhook, if any.
+func (m AuthProvider) sendLoginWebhookEvent(r *http.Request, user *caddyauth.User, loginErr error) {
+	if m.Webhook == nil || m.Webhook.sender == nil {
+		return
+	}
+	userID, authMethod := "", ""
+	if user != nil {
+		userID = user.ID
+		authMethod = user.Metadata["auth_method"]
+	}
+	m.Webhook.sender.send(newLoginWebhookEvent(r, m.clientIPProxies, userID, authMethod, loginErr))
+}
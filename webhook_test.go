@@ -0,0 +1,108 @@
+package saml
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	received := make(chan []byte, 1)
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- b
+	}))
+	defer server.Close()
+
+	sender := newWebhookSender(server.URL, time.Second, 2, 10, zap.NewNop())
+	sender.retryDelay = time.Millisecond
+	sender.start()
+	defer sender.Close()
+
+	r := httptest.NewRequest("POST", "/saml", strings.NewReader("SAMLResponse=PHNhbWxwOlJlc3BvbnNlLz4="))
+	r.RemoteAddr = "192.0.2.10:52314"
+	loginErr := &authorizationError{reason: "required_roles", msg: "user has none of the required roles"}
+	if !sender.send(newLoginWebhookEvent(r, nil, "jsmith@contoso.com", "", loginErr)) {
+		t.Fatalf("event dropped")
+	}
+
+	var b []byte
+	select {
+	case b = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("event not delivered")
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 delivery attempts, got %d", attempts)
+	}
+	event := map[string]interface{}{}
+	if err := json.Unmarshal(b, &event); err != nil {
+		t.Fatalf("failed decoding event %s: %s", b, err)
+	}
+	for k, v := range map[string]interface{}{
+		"event":     "login failed",
+		"client_ip": "192.0.2.10",
+		"method":    "POST",
+		"path":      "/saml",
+		"user":      "jsmith@contoso.com",
+		"reason":    "required_roles",
+	} {
+		if event[k] != v {
+			t.Errorf("unexpected %s: %v, expected: %v", k, event[k], v)
+		}
+	}
+	for _, s := range []string{"SAMLResponse", "PHNhbWxwOlJlc3BvbnNlLz4", "none of the required roles"} {
+		if strings.Contains(string(b), s) {
+			t.Errorf("event %s contains %q", b, s)
+		}
+	}
+}
+
+func TestWebhookQueueOverflow(t *testing.T) {
+	// The sender is not started, so the queue is not drained.
+	sender := newWebhookSender("http://localhost/webhook", time.Second, 0, 2, zap.NewNop())
+	r := httptest.NewRequest("POST", "/saml", nil)
+	for i := 0; i < 2; i++ {
+		if !sender.send(newLoginWebhookEvent(r, nil, fmt.Sprintf("user%d@contoso.com", i), "", nil)) {
+			t.Fatalf("event %d dropped", i)
+		}
+	}
+	if sender.send(newLoginWebhookEvent(r, nil, "user2@contoso.com", "", nil)) {
+		t.Fatalf("event queued past queue size")
+	}
+	if n := len(sender.queue); n != 2 {
+		t.Fatalf("expected 2 queued events, got %d", n)
+	}
+}
+
+func TestWebhookParameters(t *testing.T) {
+	p := &WebhookParameters{URL: "https://siem.contoso.com/events"}
+	if err := p.validate(); err != nil {
+		t.Fatalf("unexpected validation error: %s", err)
+	}
+	if p.Timeout != defaultWebhookTimeout || p.MaxRetries != defaultWebhookMaxRetries || p.QueueSize != defaultWebhookQueueSize {
+		t.Errorf("unexpected defaults: %+v", p)
+	}
+	for _, p := range []*WebhookParameters{
+		{},
+		{URL: "ftp://siem.contoso.com/events"},
+		{URL: "https://siem.contoso.com/events", Timeout: -1},
+		{URL: "https://siem.contoso.com/events", QueueSize: -1},
+	} {
+		if err := p.validate(); err == nil {
+			t.Errorf("invalid webhook settings passed validation: %+v", p)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package saml
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handleWhoami writes the claims of the JWT token passed with the request.
+// The token is passed either via the Authorization header or via the
+// cookie with the token.
+func (m AuthProvider) handleWhoami(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	_, tokenClaims, err := m.Jwt.validateRequestToken(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"unauthorized"}`))
+		return err
+	}
+	b, err := json.Marshal(tokenClaims)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"internal server error"}`))
+		return err
+	}
+	w.Write(b)
+	return nil
+}
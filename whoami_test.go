@@ -0,0 +1,88 @@
+package saml
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandleWhoami(t *testing.T) {
+	m := AuthProvider{
+		CommonParameters: CommonParameters{
+			Jwt: TokenParameters{
+				TokenName:   "JWT_TOKEN",
+				TokenSecret: "75f03764-147c-4d87-b2f0-4fda89e331c8",
+			},
+		},
+	}
+	claims := UserClaims{
+		ExpiresAt: time.Now().Add(900 * time.Second).Unix(),
+		Name:      "Smith, John",
+		Email:     "jsmith@contoso.com",
+	}
+	validToken, err := m.Jwt.signToken(claims)
+	if err != nil {
+		t.Fatalf("failed signing token: %s", err)
+	}
+	claims.ExpiresAt = time.Now().Add(-60 * time.Second).Unix()
+	expiredToken, err := m.Jwt.signToken(claims)
+	if err != nil {
+		t.Fatalf("failed signing token: %s", err)
+	}
+	claims.ExpiresAt = time.Now().Add(900 * time.Second).Unix()
+	foreignToken, err := TokenParameters{TokenSecret: "0e4a2b66-1b5b-4c3f-9d2b-1f64e2b1b4d1"}.signToken(claims)
+	if err != nil {
+		t.Fatalf("failed signing token: %s", err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		header     string
+		cookie     string
+		statusCode int
+	}{
+		{name: "valid token in header", header: "Bearer " + validToken, statusCode: http.StatusOK},
+		{name: "valid token in cookie", cookie: validToken, statusCode: http.StatusOK},
+		{name: "missing token", statusCode: http.StatusUnauthorized},
+		{name: "expired token", header: "Bearer " + expiredToken, statusCode: http.StatusUnauthorized},
+		{name: "token with invalid signature", header: "Bearer " + foreignToken, statusCode: http.StatusUnauthorized},
+		{name: "malformed token", cookie: "eyJhbGciOi.invalid", statusCode: http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest("GET", "/saml/whoami", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		if test.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "JWT_TOKEN", Value: test.cookie})
+		}
+		w := httptest.NewRecorder()
+		err := m.handleWhoami(w, r)
+		if w.Code != test.statusCode {
+			t.Fatalf("%s: expected status code %d, got %d", test.name, test.statusCode, w.Code)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Fatalf("%s: unexpected content type: %s", test.name, contentType)
+		}
+		if test.statusCode != http.StatusOK {
+			if err == nil {
+				t.Fatalf("%s: expected error", test.name)
+			}
+			if challenge := w.Header().Get("WWW-Authenticate"); challenge != "Bearer" {
+				t.Fatalf("%s: unexpected WWW-Authenticate: %q", test.name, challenge)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		tokenClaims := map[string]interface{}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &tokenClaims); err != nil {
+			t.Fatalf("%s: failed decoding claims %s: %s", test.name, w.Body.String(), err)
+		}
+		if tokenClaims["email"] != "jsmith@contoso.com" {
+			t.Fatalf("%s: unexpected claims: %v", test.name, tokenClaims)
+		}
+	}
+}